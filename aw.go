@@ -1 +1,72 @@
+// Package aw provides helpers that wire together the lower-level airwave
+// packages. Most applications should use the peer package directly; the helpers
+// here are intended for examples and tests.
 package aw
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/id"
+
+	"go.uber.org/zap"
+)
+
+// NewMemTransport returns a pair of Clients that are connected to each other
+// entirely in-memory, without using any sockets. The first Client is bound to
+// the second peer, and the second Client is bound to the first peer. Messages
+// sent from one Client will be received by the other. The connection is closed,
+// and both Clients are unbound, when the context is done.
+//
+//	ctx, cancel := context.WithCancel(context.Background())
+//	defer cancel()
+//	alice, bob := aw.NewMemTransport(ctx, channel.DefaultOptions(), aliceID, bobID)
+//	bob.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+//		// Handle the message from alice.
+//		return nil
+//	})
+//	alice.Send(ctx, bobID, wire.Msg{Type: wire.MsgTypeSend, Data: []byte("hello")})
+//
+func NewMemTransport(ctx context.Context, opts channel.Options, a, b id.Signatory) (*channel.Client, *channel.Client) {
+	clientA := channel.NewClient(opts, a)
+	clientB := channel.NewClient(opts, b)
+	clientA.Bind(b)
+	clientB.Bind(a)
+
+	connA, connB := net.Pipe()
+	attach := func(client *channel.Client, remote id.Signatory, conn net.Conn) {
+		defer client.Unbind(remote)
+		defer conn.Close()
+
+		enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+		dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+		if err := client.Attach(ctx, remote, conn, enc, dec); err != nil {
+			if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+				opts.Logger.Error("attach", zap.String("remote", remote.String()), zap.Error(err))
+			}
+		}
+	}
+	go attach(clientA, b, connA)
+	go attach(clientB, a, connB)
+
+	return clientA, clientB
+}
+
+// NewHandshake returns the default Handshake for a Transport. It is an ECIES
+// handshake, for the current version of the handshake protocol, wrapped using
+// handshake.Versioned, so that peers can move to later versions of the
+// handshake protocol without breaking compatibility. Remote peers must also use
+// a versioned Handshake.
+//
+//	h := aw.NewHandshake(privKey)
+//	t := transport.New(transport.DefaultOptions(), privKey.Signatory(), client, h, table)
+//
+func NewHandshake(privKey *id.PrivKey) handshake.Handshake {
+	return handshake.Versioned(map[uint8]handshake.Handshake{
+		handshake.Version: handshake.ECIES(privKey),
+	})
+}
@@ -1 +1,67 @@
 package aw_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/renproject/aw"
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+
+	"go.uber.org/zap"
+)
+
+func ExampleNewMemTransport() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	aliceID := id.NewPrivKey().Signatory()
+	bobID := id.NewPrivKey().Signatory()
+	alice, bob := aw.NewMemTransport(ctx, channel.DefaultOptions().WithLogger(zap.NewNop()), aliceID, bobID)
+
+	received := make(chan wire.Packet, 1)
+	bob.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+		if from.Equal(&aliceID) {
+			received <- packet
+		}
+		return nil
+	})
+
+	if err := alice.Send(ctx, bobID, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hello, bob!")}); err != nil {
+		panic(err)
+	}
+	packet := <-received
+	fmt.Println(string(packet.Msg.Data))
+	// Output: hello, bob!
+}
+
+func ExampleNewHandshake() {
+	alicePrivKey, bobPrivKey := id.NewPrivKey(), id.NewPrivKey()
+	aliceConn, bobConn := net.Pipe()
+	defer aliceConn.Close()
+	defer bobConn.Close()
+
+	// Both peers use the versioned handshake, so they agree on the version of
+	// the handshake protocol before authenticating each other.
+	remotes := make(chan id.Signatory, 1)
+	go func() {
+		_, _, remote, err := aw.NewHandshake(bobPrivKey)(bobConn, codec.PlainEncoder, codec.PlainDecoder)
+		if err != nil {
+			panic(err)
+		}
+		remotes <- remote
+	}()
+	_, _, remote, err := aw.NewHandshake(alicePrivKey)(aliceConn, codec.PlainEncoder, codec.PlainDecoder)
+	if err != nil {
+		panic(err)
+	}
+	bobID, aliceID := bobPrivKey.Signatory(), alicePrivKey.Signatory()
+	fmt.Println(remote.Equal(&bobID))
+	fmt.Println((<-remotes).Equal(&aliceID))
+	// Output:
+	// true
+	// true
+}
@@ -11,6 +11,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/renproject/aw/clock"
 	"github.com/renproject/aw/codec"
 	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
@@ -27,6 +28,10 @@ type Attacher interface {
 // Default options.
 var ()
 
+// ErrOutboundClosed is returned by a Channel when its outbound messaging
+// channel has been closed. This is treated as a fatal shutdown of the Channel.
+var ErrOutboundClosed = errors.New("outbound closed")
+
 // reader represents the read-half of a network connection. It also contains a
 // quit channel that is closed when the reader is no longer being used by the
 // Channel.
@@ -95,6 +100,11 @@ type writer struct {
 // Channel reads messages from the network connection and writes them to the
 // inbound messaging channel. Channels are safe for concurrent use.
 type Channel struct {
+	// lastRead is the time, in nanoseconds since the Unix epoch, at which a
+	// message was last read from a network connection. It is accessed
+	// atomically, so it must be the first field for alignment.
+	lastRead int64
+
 	opts   Options
 	remote id.Signatory
 
@@ -105,6 +115,22 @@ type Channel struct {
 	writers chan writer
 
 	rateLimiter *rate.Limiter
+
+	// urgent is an optional outbound messaging channel for messages with a
+	// high priority. Messages that are waiting on it are written before the
+	// ones that are waiting on the outbound messaging channel. It is used by
+	// the Client, and is never closed.
+	urgent <-chan wire.Msg
+
+	// onDequeue is called whenever a message is taken from the outbound
+	// messaging channel. It is used by the Client to track queue depths.
+	onDequeue func(wire.Msg)
+
+	// keepAliveAcks is signalled by the read loop when a keep-alive message is
+	// received, so that the write loop can respond to it.
+	keepAliveAcks chan struct{}
+
+	stats *stats
 }
 
 // New returns an abstract Channel connection to a remote peer. It will have no
@@ -130,6 +156,10 @@ func New(opts Options, remote id.Signatory, inbound chan<- wire.Packet, outbound
 		writers: make(chan writer, 1),
 
 		rateLimiter: rate.NewLimiter(opts.RateLimit, opts.MaxMessageSize),
+
+		keepAliveAcks: make(chan struct{}, 1),
+
+		stats: newStats(),
 	}
 }
 
@@ -143,9 +173,26 @@ func New(opts Options, remote id.Signatory, inbound chan<- wire.Packet, outbound
 // network connection) will always eventually be written to the inbound
 // messaging channel. Similarly, messages that are on the outbound queue will
 // always eventually be written to at least one attached network connection.
+//
+// If the outbound messaging channel is closed, the Channel stops running and
+// ErrOutboundClosed is returned.
 func (ch *Channel) Run(ctx context.Context) error {
-	go ch.writeLoop(ctx)
-	return ch.readLoop(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writeErr := make(chan error, 1)
+	go func() {
+		// If the write loop stops, then the read loop must also be stopped.
+		defer cancel()
+		writeErr <- ch.writeLoop(ctx)
+	}()
+
+	readErr := ch.readLoop(ctx)
+	cancel()
+	if err := <-writeErr; err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return readErr
 }
 
 // Attach a network connection to the Channel. This will replace the existing
@@ -212,6 +259,21 @@ func (ch *Channel) Attach(ctx context.Context, remote id.Signatory, conn net.Con
 	return nil
 }
 
+// Stats returns the number of messages, and bytes, that have been sent and
+// received by the Channel since it was created, or since the last call to
+// ResetStats.
+func (ch *Channel) Stats() Stats {
+	return ch.stats.snapshot()
+}
+
+// ResetStats resets the stats of the Channel to zero, and returns the stats
+// from immediately before the reset. No messages are counted twice, or missed,
+// by consecutive calls, so this can be used to report stats for every
+// interval.
+func (ch *Channel) ResetStats() Stats {
+	return ch.stats.reset()
+}
+
 // Remote peer identity expected by the Channel.
 func (ch Channel) Remote() id.Signatory {
 	return ch.remote
@@ -268,10 +330,24 @@ func (ch *Channel) readLoop(ctx context.Context) error {
 			// Unmarshal the message from binary. If this is successfully, then
 			// we mark the message as available (and will attempt to write it to
 			// the inbound message channel).
-			if _, _, err := m.Unmarshal(buf[:n], len(buf)); err != nil {
+			if err := ch.opts.MsgCodec.UnmarshalMsg(buf[:n], &m); err != nil {
 				ch.opts.Logger.Error("unmarshal", zap.Error(err))
 				continue
 			}
+			atomic.StoreInt64(&ch.lastRead, ch.opts.Clock.Now().UnixNano())
+
+			// Keep-alive messages are handled by the Channel itself.
+			switch m.Type {
+			case wire.MsgTypeKeepAlive:
+				select {
+				case ch.keepAliveAcks <- struct{}{}:
+				default:
+					// An acknowledgement is already waiting to be sent.
+				}
+				continue
+			case wire.MsgTypeKeepAliveAck:
+				continue
+			}
 
 			// An aggressive filtering strategy would involve pre-filtering
 			// synchronisation messages before reading the synchronisation data.
@@ -293,6 +369,8 @@ func (ch *Channel) readLoop(ctx context.Context) error {
 				m.SyncData = make([]byte, n)
 				copy(m.SyncData, bufSyncData[:n])
 			}
+			ch.opts.Metrics.ObserveReceived(m.Type, n+len(m.SyncData))
+			ch.stats.observeReceived(n + len(m.SyncData))
 
 			select {
 			case <-ctx.Done():
@@ -321,7 +399,7 @@ func (ch *Channel) readLoop(ctx context.Context) error {
 	}
 }
 
-func (ch *Channel) writeLoop(ctx context.Context) {
+func (ch *Channel) writeLoop(ctx context.Context) error {
 	buf := make([]byte, ch.opts.MaxMessageSize)
 
 	var w writer
@@ -330,15 +408,42 @@ func (ch *Channel) writeLoop(ctx context.Context) {
 	var m wire.Msg
 	var mOk bool
 	var mQueue <-chan wire.Msg
+	var urgentQueue <-chan wire.Msg
+
+	// When keep-alive messages are enabled, idle network connections are
+	// checked once per interval. The time at which the pending keep-alive
+	// message was sent is zero when there is no pending keep-alive message.
+	var keepAlive <-chan time.Time
+	var keepAliveSentAt time.Time
+	if ch.opts.KeepAliveInterval > 0 {
+		keepAlive = ch.opts.Clock.After(ch.opts.KeepAliveInterval)
+	}
 
 	for {
+		if !mOk {
+			// Messages with a high priority are taken before any messages
+			// that are waiting on the outbound messaging channel.
+			select {
+			case m, mOk = <-ch.urgent:
+				if mOk && ch.onDequeue != nil {
+					ch.onDequeue(m)
+				}
+			default:
+			}
+		}
+
+		urgentQueue = nil
 		switch {
 		case wOk && mOk:
 			q := make(chan wire.Msg, 1)
 			q <- m
 			mQueue = q
-		case wOk:
+		case !mOk:
+			// Read ahead by one message, even if there is no writer. The
+			// message will be held until a writer is attached, and this allows
+			// us to notice that the outbound messaging channel has been closed.
 			mQueue = ch.outbound
+			urgentQueue = ch.urgent
 		default:
 			mQueue = nil
 		}
@@ -348,14 +453,83 @@ func (ch *Channel) writeLoop(ctx context.Context) {
 			if w.q != nil {
 				close(w.q)
 			}
-			return
+			return ctx.Err()
 		case v, vOk := <-ch.writers:
 			if w.q != nil {
 				close(w.q)
 			}
 			w, wOk = v, vOk
+			// Give the new network connection a full interval before sending
+			// keep-alive messages.
+			atomic.StoreInt64(&ch.lastRead, ch.opts.Clock.Now().UnixNano())
+			keepAliveSentAt = time.Time{}
+		case <-keepAlive:
+			keepAlive = ch.opts.Clock.After(ch.opts.KeepAliveInterval)
+			if !wOk {
+				continue
+			}
+			lastRead := atomic.LoadInt64(&ch.lastRead)
+			if !keepAliveSentAt.IsZero() {
+				if lastRead < keepAliveSentAt.UnixNano() {
+					// Nothing has been received since the keep-alive message
+					// was sent, so the network connection is dead.
+					ch.opts.Logger.Debug("keep-alive: timeout", zap.String("remote", ch.remote.String()), zap.String("addr", w.Conn.RemoteAddr().String()))
+					w.Conn.Close()
+					close(w.q)
+					w, wOk = writer{}, false
+					keepAliveSentAt = time.Time{}
+					continue
+				}
+				keepAliveSentAt = time.Time{}
+			}
+			if clock.Since(ch.opts.Clock, time.Unix(0, lastRead)) < ch.opts.KeepAliveInterval {
+				// The network connection is not idle.
+				continue
+			}
+			// The time is recorded before writing, because the response can be
+			// received before writing returns.
+			keepAliveSentAt = ch.opts.Clock.Now()
+			if err := ch.writeControl(w, buf, wire.MsgTypeKeepAlive); err != nil {
+				ch.opts.Logger.Debug("keep-alive", zap.String("remote", ch.remote.String()), zap.Error(err))
+				close(w.q)
+				w, wOk = writer{}, false
+				keepAliveSentAt = time.Time{}
+				continue
+			}
+		case <-ch.keepAliveAcks:
+			if !wOk {
+				continue
+			}
+			if err := ch.writeControl(w, buf, wire.MsgTypeKeepAliveAck); err != nil {
+				ch.opts.Logger.Debug("keep-alive: ack", zap.String("remote", ch.remote.String()), zap.Error(err))
+				close(w.q)
+				w, wOk = writer{}, false
+				continue
+			}
+		case m, mOk = <-urgentQueue:
+			// The message is written, or held until a writer is attached, in
+			// the same way as messages from the outbound messaging channel.
+			if mOk && ch.onDequeue != nil {
+				ch.onDequeue(m)
+			}
 		case m, mOk = <-mQueue:
-			tail, _, err := m.Marshal(buf[:], len(buf))
+			if !mOk {
+				// The one-shot queue is never closed, so this can only happen
+				// when the outbound messaging channel has been closed. There
+				// will never be any more messages to write.
+				if w.q != nil {
+					close(w.q)
+				}
+				return ErrOutboundClosed
+			}
+			if ch.onDequeue != nil && mQueue == ch.outbound {
+				ch.onDequeue(m)
+			}
+			if !wOk {
+				// Hold the message until a writer is attached.
+				continue
+			}
+			n, err := ch.opts.MsgCodec.MarshalMsg(m, buf[:])
 			if err != nil {
 				ch.opts.Logger.Error("marshal", zap.Error(err))
 				// Clear the latest message so that we can move on to other
@@ -365,7 +539,7 @@ func (ch *Channel) writeLoop(ctx context.Context) {
 				mOk = false
 				continue
 			}
-			if _, err := w.Encoder(w.Writer, buf[:len(buf)-len(tail)]); err != nil {
+			if _, err := w.Encoder(w.Writer, buf[:n]); err != nil {
 				ch.opts.Logger.Error("encode", zap.Error(err))
 				// If an error happened when trying to write to the writer,
 				// then clean the writer. This will force the Channel to
@@ -388,7 +562,9 @@ func (ch *Channel) writeLoop(ctx context.Context) {
 				w, wOk = writer{}, false
 				continue
 			}
+			sent := n
 			if m.Type == wire.MsgTypeSync {
+				sent += len(m.SyncData)
 				if _, err := w.Encoder(w.Writer, m.SyncData); err != nil {
 					ch.opts.Logger.Error("encode", zap.NamedError("sync data", err))
 					close(w.q)
@@ -405,6 +581,8 @@ func (ch *Channel) writeLoop(ctx context.Context) {
 					continue
 				}
 			}
+			ch.opts.Metrics.ObserveSent(m.Type, sent)
+			ch.stats.observeSent(sent)
 
 			// Clear the latest message so that we can move on to other
 			// messages.
@@ -413,3 +591,20 @@ func (ch *Channel) writeLoop(ctx context.Context) {
 		}
 	}
 }
+
+// writeControl writes a message, which has no data, of the given type to the
+// writer. It is used for messages that are handled by the Channel itself.
+func (ch *Channel) writeControl(w writer, buf []byte, ty uint16) error {
+	m := wire.Msg{Version: wire.MsgVersion1, Type: ty, Priority: wire.MsgPriorityHigh}
+	n, err := ch.opts.MsgCodec.MarshalMsg(m, buf[:])
+	if err != nil {
+		return fmt.Errorf("marshal: %v", err)
+	}
+	if _, err := w.Encoder(w.Writer, buf[:n]); err != nil {
+		return fmt.Errorf("encode: %v", err)
+	}
+	if err := w.Writer.Flush(); err != nil {
+		return fmt.Errorf("flush: %v", err)
+	}
+	return nil
+}
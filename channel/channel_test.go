@@ -5,11 +5,16 @@ import (
 	"encoding/binary"
 	"log"
 	"math/rand"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/clock"
+	"github.com/renproject/aw/codec"
 	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
+	"github.com/renproject/surge"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -91,6 +96,23 @@ var _ = Describe("Channels", func() {
 		return quit
 	}
 
+	Context("when the outbound messaging channel is closed", func() {
+		It("should stop running and return an error", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			inbound, outbound := make(chan wire.Packet), make(chan wire.Msg)
+			ch := channel.New(channel.DefaultOptions(), id.NewPrivKey().Signatory(), inbound, outbound)
+			errs := make(chan error, 1)
+			go func() {
+				errs <- ch.Run(ctx)
+			}()
+
+			close(outbound)
+			Eventually(errs, time.Second).Should(Receive(Equal(channel.ErrOutboundClosed)))
+		})
+	})
+
 	Context("when a connection is attached before sending messages", func() {
 		It("should send and receive all message in order", func() {
 			ctx, cancel := context.WithCancel(context.Background())
@@ -201,4 +223,301 @@ var _ = Describe("Channels", func() {
 			})
 		})
 	})
+	Context("when keep-alive messages are enabled", func() {
+		// runRemote reads messages from the remote end of a network
+		// connection, and writes the types of the messages to the returned
+		// messaging channel. If ack is true, it responds to keep-alive
+		// messages.
+		runRemote := func(conn net.Conn, ack bool) <-chan uint16 {
+			types := make(chan uint16, 100)
+			go func() {
+				enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+				dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+				buf := make([]byte, 1024)
+				for {
+					n, err := dec(conn, buf)
+					if err != nil {
+						close(types)
+						return
+					}
+					m := wire.Msg{}
+					if _, _, err := m.Unmarshal(buf[:n], len(buf)); err != nil {
+						continue
+					}
+					types <- m.Type
+					if ack && m.Type == wire.MsgTypeKeepAlive {
+						data, err := surge.ToBinary(wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeKeepAliveAck})
+						if err != nil {
+							panic(err)
+						}
+						if _, err := enc(conn, data); err != nil {
+							close(types)
+							return
+						}
+					}
+				}
+			}()
+			return types
+		}
+
+		attach := func(ctx context.Context, opts channel.Options, conn net.Conn) (*channel.Channel, <-chan error) {
+			remote := id.NewPrivKey().Signatory()
+			inbound, outbound := make(chan wire.Packet), make(chan wire.Msg)
+			ch := channel.New(opts, remote, inbound, outbound)
+			go ch.Run(ctx)
+
+			attached := make(chan error, 1)
+			go func() {
+				enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+				dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+				attached <- ch.Attach(ctx, remote, conn, enc, dec)
+			}()
+			return ch, attached
+		}
+
+		It("should ping idle connections and keep them alive while they respond", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			localConn, remoteConn := net.Pipe()
+			defer localConn.Close()
+			defer remoteConn.Close()
+
+			_, attached := attach(ctx, channel.DefaultOptions().WithKeepAliveInterval(50*time.Millisecond), localConn)
+			types := runRemote(remoteConn, true)
+
+			for i := 0; i < 3; i++ {
+				Eventually(types).Should(Receive(Equal(wire.MsgTypeKeepAlive)))
+			}
+			Consistently(attached, 300*time.Millisecond).ShouldNot(Receive())
+		})
+
+		It("should close connections that do not respond", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			localConn, remoteConn := net.Pipe()
+			defer localConn.Close()
+			defer remoteConn.Close()
+
+			_, attached := attach(ctx, channel.DefaultOptions().WithKeepAliveInterval(50*time.Millisecond), localConn)
+			types := runRemote(remoteConn, false)
+
+			Eventually(types).Should(Receive(Equal(wire.MsgTypeKeepAlive)))
+			Eventually(attached).Should(Receive(BeNil()))
+			Eventually(types).Should(BeClosed())
+		})
+
+		It("should use the clock to decide when to ping and close connections", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			localConn, remoteConn := net.Pipe()
+			defer localConn.Close()
+			defer remoteConn.Close()
+
+			interval := time.Minute
+			c := clock.NewVirtual(time.Unix(0, 0))
+			_, attached := attach(ctx, channel.DefaultOptions().WithKeepAliveInterval(interval).WithClock(c), localConn)
+			types := runRemote(remoteConn, false)
+
+			// Nothing happens until the clock is advanced, no matter how much
+			// real time passes. The clock is advanced in small steps, so that
+			// the keep-alive message is seen before the connection times out.
+			Consistently(types, 200*time.Millisecond).ShouldNot(Receive())
+			Eventually(func() bool {
+				c.Advance(interval / 10)
+				select {
+				case ty := <-types:
+					return ty == wire.MsgTypeKeepAlive
+				default:
+					return false
+				}
+			}).Should(BeTrue())
+			Consistently(attached, 200*time.Millisecond).ShouldNot(Receive())
+			Eventually(func() bool {
+				c.Advance(interval)
+				select {
+				case err := <-attached:
+					return err == nil
+				default:
+					return false
+				}
+			}).Should(BeTrue())
+		})
+	})
+
+	Context("when using a protobuf message codec", func() {
+		It("should send protobuf messages over the connection", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			localConn, remoteConn := net.Pipe()
+			defer localConn.Close()
+			defer remoteConn.Close()
+
+			remote := id.NewPrivKey().Signatory()
+			inbound, outbound := make(chan wire.Packet, 1), make(chan wire.Msg)
+			ch := channel.New(channel.DefaultOptions().WithMsgCodec(wire.ProtobufCodec{}), remote, inbound, outbound)
+			go ch.Run(ctx)
+			go func() {
+				enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+				dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+				ch.Attach(ctx, remote, localConn, enc, dec)
+			}()
+
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			buf := make([]byte, 1024)
+
+			// Messages written by the channel can be read by other
+			// implementations of the protobuf codec, and the sync data follows
+			// immediately after the message.
+			outbound <- wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSync, Data: []byte("id"), SyncData: []byte("content")}
+			n, err := dec(remoteConn, buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(buf[:n]).To(Equal([]byte{0x08, 0x01, 0x10, 0x03, 0x22, 0x02, 'i', 'd'}))
+			n, err = dec(remoteConn, buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("content"))
+
+			// Messages written by other implementations can be read by the
+			// channel.
+			_, err = enc(remoteConn, []byte{0x08, 0x01, 0x10, 0x04, 0x22, 0x02, 'h', 'i'})
+			Expect(err).ToNot(HaveOccurred())
+			var packet wire.Packet
+			Eventually(inbound).Should(Receive(&packet))
+			Expect(packet.Msg.Version).To(Equal(wire.MsgVersion1))
+			Expect(packet.Msg.Type).To(Equal(wire.MsgTypeSend))
+			Expect(packet.Msg.Data).To(Equal([]byte("hi")))
+		})
+	})
+
+	Context("when observing metrics", func() {
+		It("should observe the type and size of every message sent and received", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			localConn, remoteConn := net.Pipe()
+			defer localConn.Close()
+			defer remoteConn.Close()
+
+			local, remote := id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory()
+			sentMetrics, receivedMetrics := newCountingMetrics(), newCountingMetrics()
+			outbound := make(chan wire.Msg)
+			inbound, remoteOutbound := make(chan wire.Packet, 2), make(chan wire.Msg)
+			sender := channel.New(channel.DefaultOptions().WithMetrics(sentMetrics), remote, nil, outbound)
+			receiver := channel.New(channel.DefaultOptions().WithMetrics(receivedMetrics), local, inbound, remoteOutbound)
+			go sender.Run(ctx)
+			go receiver.Run(ctx)
+			go func() {
+				enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+				dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+				sender.Attach(ctx, remote, localConn, enc, dec)
+			}()
+			go func() {
+				enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+				dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+				receiver.Attach(ctx, local, remoteConn, enc, dec)
+			}()
+
+			outbound <- wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hello")}
+			outbound <- wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSync, Data: []byte("id"), SyncData: []byte("content")}
+			Eventually(inbound).Should(Receive())
+			Eventually(inbound).Should(Receive())
+
+			Eventually(func() map[uint16]int { return sentMetrics.snapshot() }).Should(HaveLen(2))
+			sent := sentMetrics.snapshot()
+			received := receivedMetrics.snapshot()
+			Expect(received).To(Equal(sent))
+			Expect(sent[wire.MsgTypeSend]).To(BeNumerically(">", len("hello")))
+			Expect(sent[wire.MsgTypeSync]).To(BeNumerically(">", len("id")+len("content")))
+		})
+	})
+
+	Context("when resetting stats", func() {
+		It("should return the stats before the reset, and count from zero", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			localConn, remoteConn := net.Pipe()
+			defer localConn.Close()
+			defer remoteConn.Close()
+
+			local, remote := id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory()
+			outbound := make(chan wire.Msg)
+			inbound, remoteOutbound := make(chan wire.Packet, 3), make(chan wire.Msg)
+			sender := channel.New(channel.DefaultOptions(), remote, nil, outbound)
+			receiver := channel.New(channel.DefaultOptions(), local, inbound, remoteOutbound)
+			go sender.Run(ctx)
+			go receiver.Run(ctx)
+			go func() {
+				enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+				dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+				sender.Attach(ctx, remote, localConn, enc, dec)
+			}()
+			go func() {
+				enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+				dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+				receiver.Attach(ctx, local, remoteConn, enc, dec)
+			}()
+
+			send := func(data string) {
+				outbound <- wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte(data)}
+				Eventually(inbound).Should(Receive())
+			}
+			send("hello")
+			send("world")
+
+			Eventually(func() uint64 { return sender.Stats().MessagesSent }).Should(Equal(uint64(2)))
+			sent := sender.ResetStats()
+			received := receiver.ResetStats()
+			Expect(sent.MessagesSent).To(Equal(uint64(2)))
+			Expect(sent.BytesSent).To(BeNumerically(">", len("hello")+len("world")))
+			Expect(sent.MessagesReceived).To(BeZero())
+			Expect(received.MessagesReceived).To(Equal(uint64(2)))
+			Expect(received.BytesReceived).To(Equal(sent.BytesSent))
+			Expect(sender.Stats()).To(Equal(channel.Stats{}))
+			Expect(receiver.Stats()).To(Equal(channel.Stats{}))
+
+			send("again")
+			Eventually(func() uint64 { return sender.Stats().MessagesSent }).Should(Equal(uint64(1)))
+			Expect(receiver.Stats().MessagesReceived).To(Equal(uint64(1)))
+		})
+	})
 })
+
+// countingMetrics counts the number of bytes sent, and received, by message
+// type.
+type countingMetrics struct {
+	mu    *sync.Mutex
+	bytes map[uint16]int
+}
+
+func newCountingMetrics() countingMetrics {
+	return countingMetrics{mu: new(sync.Mutex), bytes: map[uint16]int{}}
+}
+
+func (metrics countingMetrics) ObserveSent(msgType uint16, bytes int) {
+	metrics.observe(msgType, bytes)
+}
+
+func (metrics countingMetrics) ObserveReceived(msgType uint16, bytes int) {
+	metrics.observe(msgType, bytes)
+}
+
+func (metrics countingMetrics) observe(msgType uint16, bytes int) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.bytes[msgType] += bytes
+}
+
+func (metrics countingMetrics) snapshot() map[uint16]int {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	snapshot := make(map[uint16]int, len(metrics.bytes))
+	for ty, bytes := range metrics.bytes {
+		snapshot[ty] = bytes
+	}
+	return snapshot
+}
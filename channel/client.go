@@ -33,6 +33,10 @@ type sharedChannel struct {
 	// outbound channel is sent messages that are destined for the remote peer
 	// to which the channel is bound.
 	outbound chan<- wire.Msg
+	// urgent channel is sent messages with a high priority that are destined
+	// for the remote peer to which the channel is bound. They are written
+	// before messages on the outbound channel.
+	urgent chan<- wire.Msg
 }
 
 type Msg struct {
@@ -47,6 +51,11 @@ type Client struct {
 	sharedChannelsMu *sync.RWMutex
 	sharedChannels   map[id.Signatory]*sharedChannel
 
+	// queueDepths tracks the number of outbound messages, by message type,
+	// that have been sent to a Channel but have not yet been taken by it.
+	queueDepthsMu *sync.Mutex
+	queueDepths   map[uint16]int
+
 	inbound            chan Msg
 	receivers          chan receiver
 	receiversRunningMu *sync.Mutex
@@ -61,6 +70,9 @@ func NewClient(opts Options, self id.Signatory) *Client {
 		sharedChannelsMu: new(sync.RWMutex),
 		sharedChannels:   map[id.Signatory]*sharedChannel{},
 
+		queueDepthsMu: new(sync.Mutex),
+		queueDepths:   map[uint16]int{},
+
 		inbound:            make(chan Msg),
 		receivers:          make(chan receiver),
 		receiversRunningMu: new(sync.Mutex),
@@ -80,22 +92,42 @@ func (client *Client) Bind(remote id.Signatory) {
 
 	inbound := make(chan wire.Packet, client.opts.InboundBufferSize)
 	outbound := make(chan wire.Msg, client.opts.OutboundBufferSize)
+	urgent := make(chan wire.Msg, client.opts.OutboundBufferSize)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	ch := New(client.opts, remote, inbound, outbound)
+	ch.urgent = urgent
+	ch.onDequeue = func(msg wire.Msg) {
+		client.addQueueDepth(msg.Type, -1)
+	}
 	go func() {
 		if err := ch.Run(ctx); err != nil {
 			if !errors.Is(err, context.Canceled) {
 				client.opts.Logger.Error("run", zap.Error(err))
 			}
 		}
+		// Messages that are still queued will never be taken by the Channel,
+		// so they no longer count towards the queue depths.
+		for {
+			select {
+			case msg := <-outbound:
+				client.addQueueDepth(msg.Type, -1)
+			case msg := <-urgent:
+				client.addQueueDepth(msg.Type, -1)
+			default:
+				return
+			}
+		}
 	}()
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case packet := <-inbound:
+			case packet, ok := <-inbound:
+				if !ok {
+					return
+				}
 				select {
 				case <-ctx.Done():
 					return
@@ -111,6 +143,7 @@ func (client *Client) Bind(remote id.Signatory) {
 		cancel:   cancel,
 		inbound:  inbound,
 		outbound: outbound,
+		urgent:   urgent,
 	}
 }
 
@@ -158,6 +191,10 @@ func (client *Client) Attach(ctx context.Context, remote id.Signatory, conn net.
 	return nil
 }
 
+// Send a message to the Channel associated with a remote peer. Messages with a
+// high priority are queued separately, and are written ahead of messages with a
+// normal priority that are still waiting to be written. The order of messages
+// with the same priority is preserved.
 func (client *Client) Send(ctx context.Context, remote id.Signatory, msg wire.Msg) error {
 	client.sharedChannelsMu.RLock()
 	shared, ok := client.sharedChannels[remote]
@@ -167,14 +204,76 @@ func (client *Client) Send(ctx context.Context, remote id.Signatory, msg wire.Ms
 	}
 	client.sharedChannelsMu.RUnlock()
 
+	outbound := shared.outbound
+	if msg.Priority == wire.MsgPriorityHigh {
+		outbound = shared.urgent
+	}
+
+	// The queue depth is increased before sending, so that it cannot be
+	// decreased by the Channel before it has been increased.
+	client.addQueueDepth(msg.Type, 1)
 	select {
 	case <-ctx.Done():
+		client.addQueueDepth(msg.Type, -1)
 		return fmt.Errorf("sending message %w", ctx.Err())
-	case shared.outbound <- msg:
+	case outbound <- msg:
 		return nil
 	}
 }
 
+// QueueDepths returns the number of outbound messages, by message type, that
+// are waiting to be taken by a Channel. This includes messages that are blocked
+// in Send because the outbound queue is full. Message types with nothing queued
+// are omitted.
+func (client *Client) QueueDepths() map[uint16]int {
+	client.queueDepthsMu.Lock()
+	defer client.queueDepthsMu.Unlock()
+
+	depths := make(map[uint16]int, len(client.queueDepths))
+	for ty, depth := range client.queueDepths {
+		depths[ty] = depth
+	}
+	return depths
+}
+
+// Stats returns the stats of the Channel that is bound to a remote peer. See
+// Channel.Stats. It returns false if no Channel is bound to the remote peer.
+func (client *Client) Stats(remote id.Signatory) (Stats, bool) {
+	client.sharedChannelsMu.RLock()
+	defer client.sharedChannelsMu.RUnlock()
+
+	shared, ok := client.sharedChannels[remote]
+	if !ok {
+		return Stats{}, false
+	}
+	return shared.ch.Stats(), true
+}
+
+// ResetStats resets the stats of the Channel that is bound to a remote peer,
+// and returns the stats from immediately before the reset. See
+// Channel.ResetStats. It returns false if no Channel is bound to the remote
+// peer.
+func (client *Client) ResetStats(remote id.Signatory) (Stats, bool) {
+	client.sharedChannelsMu.RLock()
+	defer client.sharedChannelsMu.RUnlock()
+
+	shared, ok := client.sharedChannels[remote]
+	if !ok {
+		return Stats{}, false
+	}
+	return shared.ch.ResetStats(), true
+}
+
+func (client *Client) addQueueDepth(ty uint16, delta int) {
+	client.queueDepthsMu.Lock()
+	defer client.queueDepthsMu.Unlock()
+
+	client.queueDepths[ty] += delta
+	if client.queueDepths[ty] == 0 {
+		delete(client.queueDepths, ty)
+	}
+}
+
 func (client *Client) Receive(ctx context.Context, f func(id.Signatory, wire.Packet) error) {
 	client.receiversRunningMu.Lock()
 	if client.receiversRunning {
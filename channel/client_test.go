@@ -165,6 +165,80 @@ var _ = Describe("Client", func() {
 		})
 	})
 
+	Context("when sending messages without an attached connection", func() {
+		It("should report the queue depth of each message type", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			remote := id.NewPrivKey().Signatory()
+			local := channel.NewClient(
+				channel.DefaultOptions().WithOutboundBufferSize(10),
+				id.NewPrivKey().Signatory())
+			local.Bind(remote)
+
+			for i := 0; i < 5; i++ {
+				Expect(local.Send(ctx, remote, wire.Msg{Type: wire.MsgTypePush})).To(Succeed())
+			}
+			for i := 0; i < 3; i++ {
+				Expect(local.Send(ctx, remote, wire.Msg{Type: wire.MsgTypeSend})).To(Succeed())
+			}
+
+			// The Channel takes the first message, and holds it until a
+			// connection is attached.
+			Eventually(local.QueueDepths).Should(Equal(map[uint16]int{
+				wire.MsgTypePush: 4,
+				wire.MsgTypeSend: 3,
+			}))
+
+			// Unbinding drops all queued messages.
+			local.Unbind(remote)
+			Eventually(local.QueueDepths).Should(BeEmpty())
+		})
+	})
+
+	Context("when sending messages with a high priority", func() {
+		It("should write them ahead of queued messages with a normal priority", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			local := channel.NewClient(channel.DefaultOptions().WithOutboundBufferSize(10), localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+			defer local.Unbind(remotePrivKey.Signatory())
+			remote := channel.NewClient(channel.DefaultOptions(), remotePrivKey.Signatory())
+			remote.Bind(localPrivKey.Signatory())
+			defer remote.Unbind(localPrivKey.Signatory())
+
+			// Queue messages before a connection is attached. The Channel
+			// takes the first message, and holds it until a connection is
+			// attached.
+			for i := byte(0); i < 5; i++ {
+				Expect(local.Send(ctx, remotePrivKey.Signatory(), wire.Msg{Data: []byte{i}})).To(Succeed())
+			}
+			Eventually(local.QueueDepths).Should(Equal(map[uint16]int{0: 4}))
+			for i := byte(5); i < 7; i++ {
+				Expect(local.Send(ctx, remotePrivKey.Signatory(), wire.Msg{Data: []byte{i}, Priority: wire.MsgPriorityHigh})).To(Succeed())
+			}
+
+			received := make(chan byte, 7)
+			remote.Receive(ctx, func(signatory id.Signatory, packet wire.Packet) error {
+				received <- packet.Msg.Data[0]
+				return nil
+			})
+			port := listen(ctx, remote, remotePrivKey.Signatory(), localPrivKey.Signatory())
+			dial(ctx, local, localPrivKey.Signatory(), remotePrivKey.Signatory(), port, time.Minute)
+
+			order := make([]byte, 0, 7)
+			for len(order) < 7 {
+				var data byte
+				Eventually(received, 5*time.Second).Should(Receive(&data))
+				order = append(order, data)
+			}
+			Expect(order).To(Equal([]byte{0, 5, 6, 1, 2, 3, 4}))
+		})
+	})
+
 	Context("when sending before binding", func() {
 		It("should return an error", func() {
 			ctx, cancel := context.WithCancel(context.Background())
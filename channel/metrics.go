@@ -0,0 +1,24 @@
+package channel
+
+// Metrics observes the messages that pass through Channels. Implementations
+// can be used to export message throughput to a monitoring system (for
+// example, Prometheus). Methods are called concurrently by all Channels, so
+// implementations must be safe for concurrent use, and must not block.
+type Metrics interface {
+	// ObserveSent is called after a message has been written to a network
+	// connection. The number of bytes includes the marshaled message, and any
+	// synchronisation data, but not the overhead added by encoders.
+	ObserveSent(msgType uint16, bytes int)
+	// ObserveReceived is called after a message has been read from a network
+	// connection, before it is delivered to receivers.
+	ObserveReceived(msgType uint16, bytes int)
+}
+
+// NopMetrics is a Metrics implementation that does nothing. It is the default.
+type NopMetrics struct{}
+
+// ObserveSent does nothing.
+func (NopMetrics) ObserveSent(uint16, int) {}
+
+// ObserveReceived does nothing.
+func (NopMetrics) ObserveReceived(uint16, int) {}
@@ -3,6 +3,8 @@ package channel
 import (
 	"time"
 
+	"github.com/renproject/aw/clock"
+	"github.com/renproject/aw/wire"
 	"go.uber.org/zap"
 	"golang.org/x/time/rate"
 )
@@ -13,6 +15,8 @@ var (
 	DefaultRateLimit          = rate.Limit(1024 * 1024) // 1MB per second
 	DefaultInboundBufferSize  = 0
 	DefaultOutboundBufferSize = 0
+	DefaultKeepAliveInterval  = time.Duration(0)
+	DefaultMsgCodec           = wire.MsgCodec(wire.SurgeCodec{})
 )
 
 // Options for parameterizing the behaviour of a Channel.
@@ -23,6 +27,10 @@ type Options struct {
 	RateLimit          rate.Limit
 	InboundBufferSize  int
 	OutboundBufferSize int
+	KeepAliveInterval  time.Duration
+	MsgCodec           wire.MsgCodec
+	Metrics            Metrics
+	Clock              clock.Clock
 }
 
 // DefaultOptions returns Options with sane defaults.
@@ -38,6 +46,10 @@ func DefaultOptions() Options {
 		RateLimit:          DefaultRateLimit,
 		InboundBufferSize:  DefaultInboundBufferSize,
 		OutboundBufferSize: DefaultOutboundBufferSize,
+		KeepAliveInterval:  DefaultKeepAliveInterval,
+		MsgCodec:           DefaultMsgCodec,
+		Metrics:            NopMetrics{},
+		Clock:              clock.Real{},
 	}
 }
 
@@ -89,3 +101,39 @@ func (opts Options) WithOutboundBufferSize(size int) Options {
 	opts.OutboundBufferSize = size
 	return opts
 }
+
+// WithKeepAliveInterval sets how long a network connection can go without
+// receiving a message before the Channel sends a keep-alive message over it.
+// If nothing is received within another interval, then the network connection
+// is assumed to be dead, and is closed. This keeps NAT mappings alive, and
+// detects dead network connections quickly. An interval of zero, or less,
+// disables keep-alive messages. Channels always respond to keep-alive
+// messages, regardless of this option.
+func (opts Options) WithKeepAliveInterval(interval time.Duration) Options {
+	opts.KeepAliveInterval = interval
+	return opts
+}
+
+// WithMsgCodec sets the codec used to convert messages to, and from, their
+// on-the-wire representation. Both ends of a connection must use the same
+// codec. This allows interoperability with other implementations that use a
+// different format (for example, protobuf).
+func (opts Options) WithMsgCodec(codec wire.MsgCodec) Options {
+	opts.MsgCodec = codec
+	return opts
+}
+
+// WithMetrics sets the Metrics that observe the messages sent and received by
+// the Channel. Keep-alive messages are handled by the Channel itself, and are
+// not observed.
+func (opts Options) WithMetrics(metrics Metrics) Options {
+	opts.Metrics = metrics
+	return opts
+}
+
+// WithClock sets the Clock used to decide when keep-alive messages are sent,
+// and when network connections that do not respond to them are closed.
+func (opts Options) WithClock(c clock.Clock) Options {
+	opts.Clock = c
+	return opts
+}
@@ -0,0 +1,56 @@
+package channel
+
+import "sync"
+
+// Stats counts the messages, and bytes, that have been sent and received by a
+// Channel. Bytes are counted in the same way as they are by Metrics.
+type Stats struct {
+	MessagesSent     uint64
+	BytesSent        uint64
+	MessagesReceived uint64
+	BytesReceived    uint64
+}
+
+// stats are the Stats of a Channel. They are guarded by a mutex, rather than
+// updated atomically, so that they can be snapshotted and reset at the same
+// time without losing counts.
+type stats struct {
+	mu    *sync.Mutex
+	stats Stats
+}
+
+func newStats() *stats {
+	return &stats{mu: new(sync.Mutex)}
+}
+
+func (s *stats) observeSent(bytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.MessagesSent++
+	s.stats.BytesSent += uint64(bytes)
+}
+
+func (s *stats) observeReceived(bytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.MessagesReceived++
+	s.stats.BytesReceived += uint64(bytes)
+}
+
+func (s *stats) snapshot() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats
+}
+
+func (s *stats) reset() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := s.stats
+	s.stats = Stats{}
+	return snapshot
+}
@@ -0,0 +1,102 @@
+// Package clock abstracts access to the current time, so that time-dependent
+// behaviour (round-trip times, expiry, backoff, and so on) can be simulated
+// deterministically using virtual time.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock tells the current time, and notifies when durations have elapsed.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After returns a channel on which the current time is sent once the
+	// duration has elapsed.
+	After(time.Duration) <-chan time.Time
+}
+
+// Real is a Clock that uses the system time.
+type Real struct{}
+
+// Now returns the current system time.
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// After is the same as time.After.
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Since returns the time elapsed since t, according to the Clock.
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Until returns the duration until t, according to the Clock.
+func Until(c Clock, t time.Time) time.Duration {
+	return t.Sub(c.Now())
+}
+
+// Virtual is a Clock that only moves when it is advanced. It is safe for
+// concurrent use.
+type Virtual struct {
+	mu      *sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewVirtual returns a Virtual clock that starts at the given time.
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{
+		mu:  new(sync.Mutex),
+		now: start,
+	}
+}
+
+// Now returns the current virtual time.
+func (c *Virtual) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel on which the virtual time is sent once the clock has
+// been advanced by at least the duration.
+func (c *Virtual) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, waiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance the clock by a duration, notifying all waiters whose durations have
+// elapsed.
+func (c *Virtual) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
@@ -0,0 +1,45 @@
+package clock_test
+
+import (
+	"time"
+
+	"github.com/renproject/aw/clock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Virtual clock", func() {
+	start := time.Unix(1000, 0)
+
+	Context("when advancing the clock", func() {
+		It("should move the current time by exactly the duration", func() {
+			c := clock.NewVirtual(start)
+			Expect(c.Now()).To(Equal(start))
+
+			c.Advance(time.Hour)
+			Expect(c.Now()).To(Equal(start.Add(time.Hour)))
+			Expect(clock.Since(c, start)).To(Equal(time.Hour))
+			Expect(clock.Until(c, start.Add(90*time.Minute))).To(Equal(30 * time.Minute))
+		})
+	})
+
+	Context("when waiting for a duration", func() {
+		It("should only notify once the clock has been advanced far enough", func() {
+			c := clock.NewVirtual(start)
+			short := c.After(time.Second)
+			long := c.After(time.Minute)
+			Expect(c.After(0)).To(Receive(Equal(start)))
+
+			c.Advance(500 * time.Millisecond)
+			Expect(short).ToNot(Receive())
+
+			c.Advance(500 * time.Millisecond)
+			Expect(short).To(Receive(Equal(start.Add(time.Second))))
+			Expect(long).ToNot(Receive())
+
+			c.Advance(time.Hour)
+			Expect(long).To(Receive())
+		})
+	})
+})
@@ -1,9 +1,18 @@
 package codec
 
 import (
+	"errors"
 	"io"
 )
 
+// ErrMessageTooLarge is returned by Decoders when the data being decoded is
+// larger than the buffer that it is being decoded into. Decoders that know the
+// size of the data before reading it (for example, because of a length prefix)
+// return it before reading the data, so a remote peer cannot force large reads
+// or allocations by announcing a large size. Errors that wrap it can be checked
+// using errors.Is.
+var ErrMessageTooLarge = errors.New("message too large")
+
 // An Encoder is a function that encodes a byte slice into an I/O writer. It
 // returns the number of bytes written, and errors that happen.
 type Encoder func(w io.Writer, buf []byte) (int, error)
@@ -0,0 +1,141 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A Framer wraps the Encoder and Decoder used by a network connection so that
+// the remote peer can recover the boundaries between messages. Peers must use
+// the same Framer, otherwise they will fail to decode messages from each other.
+type Framer func(enc Encoder, dec Decoder) (Encoder, Decoder)
+
+// LengthPrefixFramer frames messages with a fixed size uint32 length prefix.
+// This is the default framing used by the Transport.
+func LengthPrefixFramer(enc Encoder, dec Decoder) (Encoder, Decoder) {
+	return LengthPrefixEncoder(PlainEncoder, enc), LengthPrefixDecoder(PlainDecoder, dec)
+}
+
+// VarintLengthPrefixFramer frames messages with a variable size uvarint length
+// prefix.
+func VarintLengthPrefixFramer(enc Encoder, dec Decoder) (Encoder, Decoder) {
+	return VarintLengthPrefixEncoder(PlainEncoder, enc), VarintLengthPrefixDecoder(PlainDecoder, dec)
+}
+
+// DelimiterFramer returns a Framer that terminates messages with a delimiter
+// byte. For example, DelimiterFramer('\n') can be used to talk to peers that
+// use newline delimited text protocols. See DelimiterEncoder for restrictions
+// on the data that can be framed.
+func DelimiterFramer(delim byte) Framer {
+	return func(enc Encoder, dec Decoder) (Encoder, Decoder) {
+		return DelimiterEncoder(delim, enc), DelimiterDecoder(delim, dec)
+	}
+}
+
+// VarintLengthPrefixEncoder returns an Encoder that prefixes all data with a
+// uvarint length. The returned Encoder wraps two other Encoders, one that is
+// used to encode the length prefix, and one that is used to encode the actual
+// data.
+func VarintLengthPrefixEncoder(prefixEnc Encoder, bodyEnc Encoder) Encoder {
+	return func(w io.Writer, buf []byte) (int, error) {
+		prefixBytes := [binary.MaxVarintLen64]byte{}
+		prefixLen := binary.PutUvarint(prefixBytes[:], uint64(len(buf)))
+		if _, err := prefixEnc(w, prefixBytes[:prefixLen]); err != nil {
+			return 0, fmt.Errorf("encoding data length: %w", err)
+		}
+		n, err := bodyEnc(w, buf)
+		if err != nil {
+			return n, fmt.Errorf("encoding data: %w", err)
+		}
+		return n, nil
+	}
+}
+
+// VarintLengthPrefixDecoder returns a Decoder that assumes all data is prefixed
+// with a uvarint length. The returned Decoder wraps two other Decoders, one
+// that is used to decode the length prefix (one byte at a time), and one that
+// is used to decode the actual data. Like LengthPrefixDecoder, data that is
+// longer than the buffer is rejected before it is read.
+func VarintLengthPrefixDecoder(prefixDec Decoder, bodyDec Decoder) Decoder {
+	return func(r io.Reader, buf []byte) (int, error) {
+		prefixBytes := [binary.MaxVarintLen64]byte{}
+		prefixLen := 0
+		for {
+			if prefixLen >= len(prefixBytes) {
+				return 0, fmt.Errorf("decoding data length: varint overflow")
+			}
+			if _, err := prefixDec(r, prefixBytes[prefixLen:prefixLen+1]); err != nil {
+				return 0, fmt.Errorf("decoding data length: %w", err)
+			}
+			prefixLen++
+			if prefixBytes[prefixLen-1] < 0x80 {
+				break
+			}
+		}
+		prefix, n := binary.Uvarint(prefixBytes[:prefixLen])
+		if n <= 0 {
+			return 0, fmt.Errorf("decoding data length: varint overflow")
+		}
+		if uint64(len(buf)) < prefix {
+			return 0, fmt.Errorf("decoding data length: %w: expected at most %v, got %v", ErrMessageTooLarge, len(buf), prefix)
+		}
+		m, err := bodyDec(r, buf[:prefix])
+		if err != nil {
+			return m, fmt.Errorf("decoding data: %w", err)
+		}
+		return m, nil
+	}
+}
+
+// DelimiterEncoder returns an Encoder that terminates all data with a delimiter
+// byte. The returned Encoder wraps another Encoder that is used to encode the
+// actual data. The encoded data must not contain the delimiter, so this is
+// only suitable for textual data (or data that is encoded as text).
+func DelimiterEncoder(delim byte, bodyEnc Encoder) Encoder {
+	return func(w io.Writer, buf []byte) (int, error) {
+		body := new(bytes.Buffer)
+		n, err := bodyEnc(body, buf)
+		if err != nil {
+			return n, fmt.Errorf("encoding data: %w", err)
+		}
+		if bytes.IndexByte(body.Bytes(), delim) >= 0 {
+			return 0, fmt.Errorf("encoding data: data contains delimiter %q", delim)
+		}
+		body.WriteByte(delim)
+		if _, err := w.Write(body.Bytes()); err != nil {
+			return 0, fmt.Errorf("encoding data: %w", err)
+		}
+		return n, nil
+	}
+}
+
+// DelimiterDecoder returns a Decoder that assumes all data is terminated by a
+// delimiter byte. The returned Decoder wraps another Decoder that is used to
+// decode the actual data, and it is given a buffer that is exactly the length
+// of the delimited data. An error is returned if the delimiter is not found
+// before the buffer is full.
+func DelimiterDecoder(delim byte, bodyDec Decoder) Decoder {
+	return func(r io.Reader, buf []byte) (int, error) {
+		body := make([]byte, 0, len(buf))
+		b := [1]byte{}
+		for {
+			if _, err := io.ReadFull(r, b[:]); err != nil {
+				return 0, fmt.Errorf("decoding delimiter: %w", err)
+			}
+			if b[0] == delim {
+				break
+			}
+			if len(body) >= len(buf) {
+				return 0, fmt.Errorf("decoding delimiter: %w: expected at most %v bytes", ErrMessageTooLarge, len(buf))
+			}
+			body = append(body, b[0])
+		}
+		n, err := bodyDec(bytes.NewReader(body), buf[:len(body)])
+		if err != nil {
+			return n, fmt.Errorf("decoding data: %w", err)
+		}
+		return n, nil
+	}
+}
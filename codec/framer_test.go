@@ -0,0 +1,98 @@
+package codec_test
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/renproject/aw/codec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Framers", func() {
+	framers := map[string]codec.Framer{
+		"length prefix":        codec.LengthPrefixFramer,
+		"varint length prefix": codec.VarintLengthPrefixFramer,
+		"newline delimiter":    codec.DelimiterFramer('\n'),
+	}
+
+	for name, framer := range framers {
+		name, framer := name, framer
+
+		Context("when encoding and decoding messages using the "+name+" framer", func() {
+			It("should recover every message from the stream", func() {
+				var readerWriter bytes.Buffer
+				enc, dec := framer(codec.PlainEncoder, codec.PlainDecoder)
+
+				msgs := []string{"Hi there!", "", "How are you?", string(bytes.Repeat([]byte{'x'}, 300))}
+				for _, msg := range msgs {
+					n, err := enc(&readerWriter, []byte(msg))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(n).To(Equal(len(msg)))
+				}
+
+				var buf [4086]byte
+				for _, msg := range msgs {
+					n, err := dec(&readerWriter, buf[:])
+					Expect(err).ToNot(HaveOccurred())
+					Expect(string(buf[:n])).To(Equal(msg))
+				}
+				Expect(readerWriter.Len()).To(Equal(0))
+			})
+		})
+	}
+
+	Context("when decoding a message that is too large for the buffer", func() {
+		It("should return an error", func() {
+			for _, framer := range framers {
+				var readerWriter bytes.Buffer
+				enc, dec := framer(codec.PlainEncoder, codec.PlainDecoder)
+
+				_, err := enc(&readerWriter, []byte("Hi there!"))
+				Expect(err).ToNot(HaveOccurred())
+
+				var buf [4]byte
+				_, err = dec(&readerWriter, buf[:])
+				Expect(errors.Is(err, codec.ErrMessageTooLarge)).To(BeTrue())
+			}
+		})
+	})
+
+	Context("when encoding a message that contains the delimiter", func() {
+		It("should return an error without writing anything", func() {
+			var readerWriter bytes.Buffer
+			enc, _ := codec.DelimiterFramer('\n')(codec.PlainEncoder, codec.PlainDecoder)
+
+			_, err := enc(&readerWriter, []byte("Hi\nthere!"))
+			Expect(err).To(HaveOccurred())
+			Expect(readerWriter.Len()).To(Equal(0))
+		})
+	})
+
+	Context("when the encoder and decoder use mismatched framers", func() {
+		It("should return an error instead of returning corrupted messages", func() {
+			mismatched := []struct {
+				enc codec.Framer
+				dec codec.Framer
+			}{
+				{codec.DelimiterFramer('\n'), codec.LengthPrefixFramer},
+				{codec.LengthPrefixFramer, codec.DelimiterFramer('\n')},
+				{codec.VarintLengthPrefixFramer, codec.DelimiterFramer('\n')},
+				{codec.VarintLengthPrefixFramer, codec.LengthPrefixFramer},
+			}
+			for _, framers := range mismatched {
+				var readerWriter bytes.Buffer
+				enc, _ := framers.enc(codec.PlainEncoder, codec.PlainDecoder)
+				_, dec := framers.dec(codec.PlainEncoder, codec.PlainDecoder)
+
+				_, err := enc(&readerWriter, []byte("Hi there!"))
+				Expect(err).ToNot(HaveOccurred())
+
+				var buf [64]byte
+				_, err = dec(&readerWriter, buf[:])
+				Expect(err).To(HaveOccurred())
+			}
+		})
+	})
+})
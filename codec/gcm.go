@@ -4,11 +4,17 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"math"
+	"time"
 
+	"github.com/renproject/aw/clock"
 	"github.com/renproject/id"
 )
 
@@ -19,7 +25,7 @@ type gcmNonce struct {
 	countDown bool
 }
 
-func (nonce gcmNonce) next() {
+func (nonce *gcmNonce) next() {
 	if nonce.countDown {
 		nonce.pred()
 	} else {
@@ -28,7 +34,7 @@ func (nonce gcmNonce) next() {
 
 }
 
-func (nonce gcmNonce) succ() {
+func (nonce *gcmNonce) succ() {
 	nonce.bottom++
 	// If bottom overflows, increment top by 1
 	if nonce.bottom == 0 {
@@ -36,7 +42,7 @@ func (nonce gcmNonce) succ() {
 	}
 }
 
-func (nonce gcmNonce) pred() {
+func (nonce *gcmNonce) pred() {
 	nonce.bottom--
 	// If bottom underflows, decrement top by 1
 	if nonce.bottom == math.MaxUint64 {
@@ -44,30 +50,94 @@ func (nonce gcmNonce) pred() {
 	}
 }
 
+// A GCMRekeyPolicy defines when a GCMSession derives a new key for the data
+// that it writes. The key is derived after MaxBytes bytes have been written
+// using the current key, or after Interval has passed since the current key
+// was derived, whichever happens first. A value of zero, or less, disables the
+// respective threshold. Both peers of a connection must use a policy that
+// enables rekeying, or neither can, because rekeying changes the framing of
+// sealed data.
+type GCMRekeyPolicy struct {
+	MaxBytes int
+	Interval time.Duration
+	// Clock is used to measure the Interval. If it is nil, the system time is
+	// used.
+	Clock clock.Clock
+}
+
+func (policy GCMRekeyPolicy) enabled() bool {
+	return policy.MaxBytes > 0 || policy.Interval > 0
+}
+
+const (
+	gcmFrameData  = byte(0)
+	gcmFrameRekey = byte(1)
+
+	gcmRekeySaltSize = 32
+	gcmRekeyInfo     = "aw gcm rekey"
+)
+
 // A GCMSession stores the state of a GCM authenticated/encrypted session. This
 // includes the read/write nonces, memory buffers, and the GCM cipher itself.
 type GCMSession struct {
-	gcm        cipher.AEAD
-	readNonce  gcmNonce
-	writeNonce gcmNonce
+	readGCM     cipher.AEAD
+	writeGCM    cipher.AEAD
+	readNonce   gcmNonce
+	writeNonce  gcmNonce
+	fingerprint string
+
+	// The initial nonces are restored whenever the key is ratcheted, so that
+	// every key starts with the same nonces on both peers.
+	initialReadNonce  gcmNonce
+	initialWriteNonce gcmNonce
+
+	// The keys, and the write state, are only used when rekeying is enabled.
+	// Each direction is rekeyed independently: the writer picks the frame at
+	// which the key changes, and the reader changes its key at that frame.
+	rekey        GCMRekeyPolicy
+	clock        clock.Clock
+	readKey      [32]byte
+	writeKey     [32]byte
+	written      int
+	writeKeyedAt time.Time
 }
 
 // NewGCMSession accepts a symmetric secret key and returns a new GCMSession
 // that is configured using the symmetric secret key.
 func NewGCMSession(key [32]byte, self, remote id.Signatory) (*GCMSession, error) {
-	block, err := aes.NewCipher(key[:])
+	return NewGCMSessionWithRekeyPolicy(key, self, remote, GCMRekeyPolicy{})
+}
+
+// NewGCMSessionWithRekeyPolicy is the same as NewGCMSession, but the returned
+// GCMSession ratchets its keys according to the rekey policy. When the write
+// key is ratcheted, a fresh random salt is sent in-band, together with the
+// next sealed data, and the new key is derived using HKDF from the current
+// key and the salt. The remote peer derives the same key from the salt before
+// opening the data, so both peers always agree on which data is sealed using
+// which key.
+func NewGCMSessionWithRekeyPolicy(key [32]byte, self, remote id.Signatory, policy GCMRekeyPolicy) (*GCMSession, error) {
+	gcm, err := newGCM(key)
 	if err != nil {
-		return &GCMSession{}, fmt.Errorf("creating aes cipher: %v", err)
+		return &GCMSession{}, err
 	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return &GCMSession{}, fmt.Errorf("creating gcm cipher: %v", err)
+
+	c := policy.Clock
+	if c == nil {
+		c = clock.Real{}
 	}
 
 	gcmSession := &GCMSession{
-		gcm:        gcm,
-		readNonce:  gcmNonce{},
-		writeNonce: gcmNonce{},
+		readGCM:     gcm,
+		writeGCM:    gcm,
+		readNonce:   gcmNonce{},
+		writeNonce:  gcmNonce{},
+		fingerprint: fingerprint(key, self, remote),
+
+		rekey:        policy,
+		clock:        c,
+		readKey:      key,
+		writeKey:     key,
+		writeKeyedAt: c.Now(),
 	}
 
 	if bytes.Compare(self[:], remote[:]) < 0 {
@@ -79,17 +149,79 @@ func NewGCMSession(key [32]byte, self, remote id.Signatory) (*GCMSession, error)
 		gcmSession.readNonce.bottom = math.MaxUint64
 		gcmSession.readNonce.countDown = true
 	}
+	gcmSession.initialReadNonce = gcmSession.readNonce
+	gcmSession.initialWriteNonce = gcmSession.writeNonce
 	return gcmSession, nil
 }
 
+func newGCM(key [32]byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("creating aes cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating gcm cipher: %v", err)
+	}
+	return gcm, nil
+}
+
+// ratchet derives the next key from the current key and a salt, using
+// HKDF-SHA256 with a single block of output.
+func ratchet(key [32]byte, salt []byte) [32]byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(key[:])
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(gcmRekeyInfo))
+	expand.Write([]byte{1})
+
+	next := [32]byte{}
+	copy(next[:], expand.Sum(nil))
+	return next
+}
+
+// shouldRekey returns true if the next data written should be sealed using a
+// new key.
+func (session *GCMSession) shouldRekey() bool {
+	if session.rekey.MaxBytes > 0 && session.written >= session.rekey.MaxBytes {
+		return true
+	}
+	return session.rekey.Interval > 0 && clock.Since(session.clock, session.writeKeyedAt) >= session.rekey.Interval
+}
+
+// Fingerprint returns a stable, human-readable identifier for the session. It
+// is derived from the symmetric secret key, and the signatories of both peers,
+// so both peers of a connection compute the same fingerprint, but the key
+// cannot be recovered from it. Comparing fingerprints is useful for debugging
+// handshake issues, and for detecting man-in-the-middle attacks.
+func (session *GCMSession) Fingerprint() string {
+	return session.fingerprint
+}
+
+// fingerprint hashes the key together with the signatories, which are ordered
+// so that the result does not depend on which peer is the local peer.
+func fingerprint(key [32]byte, self, remote id.Signatory) string {
+	if bytes.Compare(self[:], remote[:]) > 0 {
+		self, remote = remote, self
+	}
+	h := sha256.New()
+	h.Write(key[:])
+	h.Write(self[:])
+	h.Write(remote[:])
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
 // GCMEncoder accepts a GCMSession and an encoder that wraps data encryption
 func GCMEncoder(session *GCMSession, enc Encoder) Encoder {
 	return func(w io.Writer, buf []byte) (int, error) {
+		if session.rekey.enabled() {
+			return encodeRekeyed(session, enc, w, buf)
+		}
 		nonceBuf := [12]byte{}
 		binary.BigEndian.PutUint32(nonceBuf[:4], session.writeNonce.top)
 		binary.BigEndian.PutUint64(nonceBuf[4:], session.writeNonce.bottom)
 		session.writeNonce.next()
-		encoded := session.gcm.Seal(nil, nonceBuf[:], buf, nil)
+		encoded := session.writeGCM.Seal(nil, nonceBuf[:], buf, nil)
 		_, err := enc(w, encoded)
 		if err != nil {
 			return 0, fmt.Errorf("encoding sealed data: %v", err)
@@ -101,6 +233,9 @@ func GCMEncoder(session *GCMSession, enc Encoder) Encoder {
 // GCMDEcoder accepts a GCMSession and a decoder that wraps data decryption
 func GCMDecoder(session *GCMSession, dec Decoder) Decoder {
 	return func(r io.Reader, buf []byte) (int, error) {
+		if session.rekey.enabled() {
+			return decodeRekeyed(session, dec, r, buf)
+		}
 		extendedSize := len(buf) + 16
 		if cap(buf) < extendedSize {
 			return 0, fmt.Errorf("decoding data: buffer too small, expected buffer capacity %v, got buffer capacity %v", extendedSize, cap(buf))
@@ -114,7 +249,7 @@ func GCMDecoder(session *GCMSession, dec Decoder) Decoder {
 		binary.BigEndian.PutUint32(nonceBuf[:4], session.readNonce.top)
 		binary.BigEndian.PutUint64(nonceBuf[4:], session.readNonce.bottom)
 		session.readNonce.next()
-		decrypted, err := session.gcm.Open(nil, nonceBuf[:], buf[:n], nil)
+		decrypted, err := session.readGCM.Open(nil, nonceBuf[:], buf[:n], nil)
 
 		if err != nil {
 			return 0, fmt.Errorf("opening sealed data: %v", err)
@@ -124,3 +259,90 @@ func GCMDecoder(session *GCMSession, dec Decoder) Decoder {
 		return len(decrypted), nil
 	}
 }
+
+// encodeRekeyed seals data for a GCMSession that has rekeying enabled. The
+// sealed data is preceded by a frame type, and, if the key is being ratcheted,
+// the salt used to derive the new key. Both are authenticated as additional
+// data, and the sealed data uses the new key, starting from the initial nonce.
+func encodeRekeyed(session *GCMSession, enc Encoder, w io.Writer, buf []byte) (int, error) {
+	header := []byte{gcmFrameData}
+	if session.shouldRekey() {
+		header = make([]byte, 1+gcmRekeySaltSize)
+		header[0] = gcmFrameRekey
+		if _, err := rand.Read(header[1:]); err != nil {
+			return 0, fmt.Errorf("generating rekey salt: %v", err)
+		}
+		key := ratchet(session.writeKey, header[1:])
+		gcm, err := newGCM(key)
+		if err != nil {
+			return 0, fmt.Errorf("rekeying: %v", err)
+		}
+		session.writeGCM = gcm
+		session.writeKey = key
+		session.writeNonce = session.initialWriteNonce
+		session.written = 0
+		session.writeKeyedAt = session.clock.Now()
+	}
+	session.written += len(buf)
+
+	nonceBuf := [12]byte{}
+	binary.BigEndian.PutUint32(nonceBuf[:4], session.writeNonce.top)
+	binary.BigEndian.PutUint64(nonceBuf[4:], session.writeNonce.bottom)
+	session.writeNonce.next()
+	encoded := session.writeGCM.Seal(header, nonceBuf[:], buf, header)
+	if _, err := enc(w, encoded); err != nil {
+		return 0, fmt.Errorf("encoding sealed data: %v", err)
+	}
+	return len(buf), nil
+}
+
+// decodeRekeyed opens data for a GCMSession that has rekeying enabled. If the
+// frame carries a salt, the read key is ratcheted, and the read nonce is reset,
+// before opening the data. The new key is only kept if the data can be opened
+// with it.
+func decodeRekeyed(session *GCMSession, dec Decoder, r io.Reader, buf []byte) (int, error) {
+	extendedSize := len(buf) + 16
+	if cap(buf) < extendedSize {
+		return 0, fmt.Errorf("decoding data: buffer too small, expected buffer capacity %v, got buffer capacity %v", extendedSize, cap(buf))
+	}
+
+	header := make([]byte, 1, 1+gcmRekeySaltSize)
+	if _, err := dec(r, header); err != nil {
+		return 0, fmt.Errorf("decoding frame type: %v", err)
+	}
+	gcm, key, nonce := session.readGCM, session.readKey, session.readNonce
+	switch header[0] {
+	case gcmFrameData:
+	case gcmFrameRekey:
+		header = header[:1+gcmRekeySaltSize]
+		if _, err := dec(r, header[1:]); err != nil {
+			return 0, fmt.Errorf("decoding rekey salt: %v", err)
+		}
+		key = ratchet(session.readKey, header[1:])
+		var err error
+		if gcm, err = newGCM(key); err != nil {
+			return 0, fmt.Errorf("rekeying: %v", err)
+		}
+		nonce = session.initialReadNonce
+	default:
+		return 0, fmt.Errorf("decoding frame type: unknown frame type %v", header[0])
+	}
+
+	buf = buf[:extendedSize]
+	n, err := dec(r, buf)
+	if err != nil {
+		return n, fmt.Errorf("decoding data: %v", err)
+	}
+	nonceBuf := [12]byte{}
+	binary.BigEndian.PutUint32(nonceBuf[:4], nonce.top)
+	binary.BigEndian.PutUint64(nonceBuf[4:], nonce.bottom)
+	nonce.next()
+	decrypted, err := gcm.Open(nil, nonceBuf[:], buf[:n], header)
+	if err != nil {
+		return 0, fmt.Errorf("opening sealed data: %v", err)
+	}
+	session.readGCM, session.readKey, session.readNonce = gcm, key, nonce
+	copy(buf, decrypted)
+
+	return len(decrypted), nil
+}
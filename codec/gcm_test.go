@@ -2,13 +2,32 @@ package codec_test
 
 import (
 	"bytes"
-	. "github.com/onsi/ginkgo"
-	. "github.com/onsi/gomega"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/renproject/aw/clock"
 	"github.com/renproject/aw/codec"
 	"github.com/renproject/id"
-	"math/rand"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
 )
 
+// rekeyedSessions returns two GCM sessions, one for each peer of a connection,
+// that ratchet their keys according to the rekey policy.
+func rekeyedSessions(policy codec.GCMRekeyPolicy) (*codec.GCMSession, *codec.GCMSession) {
+	var key [32]byte
+	rand.Read(key[:])
+	sig1 := id.NewPrivKey().Signatory()
+	sig2 := id.NewPrivKey().Signatory()
+	session1, err := codec.NewGCMSessionWithRekeyPolicy(key, sig1, sig2, policy)
+	Expect(err).ToNot(HaveOccurred())
+	session2, err := codec.NewGCMSessionWithRekeyPolicy(key, sig2, sig1, policy)
+	Expect(err).ToNot(HaveOccurred())
+	return session1, session2
+}
+
 var _ = Describe("GCM Codec", func() {
 	Context("when encoding and decoding a message using a GCM encoder and decoder", func() {
 		It("should successfully transmit message in both directions", func() {
@@ -50,4 +69,114 @@ var _ = Describe("GCM Codec", func() {
 
 		})
 	})
+
+	Context("when encoding the same message twice", func() {
+		It("should use a different nonce for each message", func() {
+			var key [32]byte
+			rand.Read(key[:])
+			sig1 := id.NewPrivKey().Signatory()
+			sig2 := id.NewPrivKey().Signatory()
+			session1, err := codec.NewGCMSession(key, sig1, sig2)
+			Expect(err).ToNot(HaveOccurred())
+			session2, err := codec.NewGCMSession(key, sig2, sig1)
+			Expect(err).ToNot(HaveOccurred())
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.GCMEncoder(session1, codec.PlainEncoder))
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.GCMDecoder(session2, codec.PlainDecoder))
+
+			first, second := new(bytes.Buffer), new(bytes.Buffer)
+			_, err = enc(first, []byte("same"))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = enc(second, []byte("same"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(first.Bytes()).ToNot(Equal(second.Bytes()))
+
+			buf := [4096]byte{}
+			for _, frame := range []*bytes.Buffer{first, second} {
+				n, err := dec(frame, buf[:])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(buf[:n])).To(Equal("same"))
+			}
+		})
+	})
+
+	Context("when rekeying after a number of bytes", func() {
+		It("should ratchet the key at the same frame on both peers", func() {
+			session1, session2 := rekeyedSessions(codec.GCMRekeyPolicy{MaxBytes: 32})
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.GCMEncoder(session1, codec.PlainEncoder))
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.GCMDecoder(session2, codec.PlainDecoder))
+
+			for i := 0; i < 10; i++ {
+				data := fmt.Sprintf("message number %v", i)
+				Expect(data).To(HaveLen(16))
+				frame := new(bytes.Buffer)
+				n, err := enc(frame, []byte(data))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).To(Equal(16))
+
+				// The frame type follows the length prefix. After the first
+				// two messages, every second message ratchets the key.
+				if i >= 2 && i%2 == 0 {
+					Expect(frame.Bytes()[4]).To(Equal(byte(1)))
+				} else {
+					Expect(frame.Bytes()[4]).To(Equal(byte(0)))
+				}
+
+				buf := [4096]byte{}
+				n, err = dec(frame, buf[:])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(buf[:n])).To(Equal(data))
+			}
+		})
+	})
+
+	Context("when rekeying after an interval", func() {
+		It("should ratchet the key once the interval has passed", func() {
+			c := clock.NewVirtual(time.Unix(0, 0))
+			session1, session2 := rekeyedSessions(codec.GCMRekeyPolicy{Interval: time.Minute, Clock: c})
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.GCMEncoder(session1, codec.PlainEncoder))
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.GCMDecoder(session2, codec.PlainDecoder))
+
+			frame := new(bytes.Buffer)
+			_, err := enc(frame, []byte("before"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(frame.Bytes()[4]).To(Equal(byte(0)))
+			buf := [4096]byte{}
+			n, err := dec(frame, buf[:])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("before"))
+
+			c.Advance(time.Minute)
+			frame.Reset()
+			_, err = enc(frame, []byte("after"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(frame.Bytes()[4]).To(Equal(byte(1)))
+			n, err = dec(frame, buf[:])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("after"))
+		})
+	})
+
+	Context("when the rekey salt is tampered with", func() {
+		It("should fail to open the data", func() {
+			session1, session2 := rekeyedSessions(codec.GCMRekeyPolicy{MaxBytes: 1})
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.GCMEncoder(session1, codec.PlainEncoder))
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.GCMDecoder(session2, codec.PlainDecoder))
+
+			frame := new(bytes.Buffer)
+			_, err := enc(frame, []byte("first"))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = enc(frame, []byte("second"))
+			Expect(err).ToNot(HaveOccurred())
+			buf := [4096]byte{}
+			_, err = dec(frame, buf[:])
+			Expect(err).ToNot(HaveOccurred())
+
+			// Flip a bit of the salt in the second frame.
+			tampered := frame.Bytes()
+			Expect(tampered[4]).To(Equal(byte(1)))
+			tampered[5] ^= 1
+			_, err = dec(bytes.NewReader(tampered), buf[:])
+			Expect(err).To(HaveOccurred())
+		})
+	})
 })
@@ -0,0 +1,91 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// DefaultGzipThreshold is the default size, in bytes, below which data is not
+// compressed. Compressing small data usually makes it larger.
+const DefaultGzipThreshold = 256
+
+const (
+	gzipFlagRaw        = byte(0)
+	gzipFlagCompressed = byte(1)
+)
+
+// GzipEncoder returns an Encoder that compresses data before passing it to
+// another Encoder. Data that is smaller than the threshold, or that does not
+// get smaller when compressed, is passed through uncompressed. Either way, the
+// data is prefixed with a flag byte, so it must be decoded by a GzipDecoder.
+// The wrapped Encoder must preserve message boundaries (for example, by using
+// a length prefix).
+func GzipEncoder(threshold int, enc Encoder) Encoder {
+	return func(w io.Writer, buf []byte) (int, error) {
+		encoded := append([]byte{gzipFlagRaw}, buf...)
+		if len(buf) >= threshold {
+			compressed := bytes.Buffer{}
+			compressed.WriteByte(gzipFlagCompressed)
+			gz := gzip.NewWriter(&compressed)
+			if _, err := gz.Write(buf); err != nil {
+				return 0, fmt.Errorf("compressing data: %v", err)
+			}
+			if err := gz.Close(); err != nil {
+				return 0, fmt.Errorf("compressing data: %v", err)
+			}
+			if compressed.Len() < len(encoded) {
+				encoded = compressed.Bytes()
+			}
+		}
+		if _, err := enc(w, encoded); err != nil {
+			return 0, fmt.Errorf("encoding compressed data: %v", err)
+		}
+		return len(buf), nil
+	}
+}
+
+// GzipDecoder returns a Decoder that decompresses data, encoded by a
+// GzipEncoder, after reading it from another Decoder. Data that decompresses
+// to more bytes than the buffer can hold is rejected.
+func GzipDecoder(dec Decoder) Decoder {
+	return func(r io.Reader, buf []byte) (int, error) {
+		// Encoded data is never more than one byte larger than the original
+		// data. Any extra capacity of the buffer is preserved, because the
+		// wrapped Decoder might need it (for example, to decrypt).
+		encoded := make([]byte, len(buf)+1, cap(buf)+1)
+		n, err := dec(r, encoded)
+		if err != nil {
+			return 0, fmt.Errorf("decoding compressed data: %v", err)
+		}
+		if n < 1 {
+			return 0, fmt.Errorf("decoding compressed data: expected flag")
+		}
+
+		switch encoded[0] {
+		case gzipFlagRaw:
+			return copy(buf, encoded[1:n]), nil
+		case gzipFlagCompressed:
+			gz, err := gzip.NewReader(bytes.NewReader(encoded[1:n]))
+			if err != nil {
+				return 0, fmt.Errorf("decompressing data: %v", err)
+			}
+			defer gz.Close()
+
+			// Read one byte more than the buffer can hold, so that data that
+			// is too large can be detected without decompressing all of it.
+			decompressed := bytes.Buffer{}
+			m, err := io.Copy(&decompressed, io.LimitReader(gz, int64(len(buf))+1))
+			if err != nil {
+				return 0, fmt.Errorf("decompressing data: %v", err)
+			}
+			if m > int64(len(buf)) {
+				return 0, fmt.Errorf("decompressing data: %w: expected at most %v bytes", ErrMessageTooLarge, len(buf))
+			}
+			return copy(buf, decompressed.Bytes()), nil
+		default:
+			return 0, fmt.Errorf("decoding compressed data: unknown flag %v", encoded[0])
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package codec_test
+
+import (
+	"bytes"
+	"math/rand"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/id"
+)
+
+var _ = Describe("Gzip Codec", func() {
+	enc := codec.GzipEncoder(codec.DefaultGzipThreshold, codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder))
+	dec := codec.GzipDecoder(codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder))
+
+	Context("when encoding and decoding a large, repetitive message", func() {
+		It("should compress the message and successfully transmit it", func() {
+			var readerWriter bytes.Buffer
+			data := bytes.Repeat([]byte("Hi there!"), 1000)
+
+			n, err := enc(&readerWriter, data)
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(len(data)))
+			Expect(readerWriter.Len()).To(BeNumerically("<", len(data)/10))
+
+			var buf [16384]byte
+			n, err = dec(&readerWriter, buf[:])
+			Expect(err).To(BeNil())
+			Expect(buf[:n]).To(Equal(data))
+		})
+	})
+
+	Context("when encoding and decoding a message below the threshold", func() {
+		It("should not compress the message", func() {
+			var readerWriter bytes.Buffer
+			data := []byte("Hi there!")
+
+			n, err := enc(&readerWriter, data)
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(len(data)))
+			// A length prefix, a flag, and the raw data.
+			Expect(readerWriter.Len()).To(Equal(4 + 1 + len(data)))
+
+			var buf [4086]byte
+			n, err = dec(&readerWriter, buf[:])
+			Expect(err).To(BeNil())
+			Expect(buf[:n]).To(Equal(data))
+		})
+	})
+
+	Context("when encoding and decoding a message that does not compress", func() {
+		It("should not compress the message", func() {
+			var readerWriter bytes.Buffer
+			data := make([]byte, 1024)
+			rand.Read(data)
+
+			_, err := enc(&readerWriter, data)
+			Expect(err).To(BeNil())
+			Expect(readerWriter.Len()).To(Equal(4 + 1 + len(data)))
+
+			var buf [4086]byte
+			n, err := dec(&readerWriter, buf[:])
+			Expect(err).To(BeNil())
+			Expect(buf[:n]).To(Equal(data))
+		})
+	})
+
+	Context("when decoding a message that decompresses to more than the buffer", func() {
+		It("should return an error", func() {
+			var readerWriter bytes.Buffer
+			data := bytes.Repeat([]byte{0}, 100000)
+
+			_, err := enc(&readerWriter, data)
+			Expect(err).To(BeNil())
+
+			var buf [4086]byte
+			_, err = dec(&readerWriter, buf[:])
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Context("when stacking with a GCM encoder and decoder", func() {
+		It("should successfully transmit the message", func() {
+			var readerWriter bytes.Buffer
+			data := bytes.Repeat([]byte("Hi there!"), 100)
+			var key [32]byte
+			rand.Read(key[:])
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			gcmSession1, err := codec.NewGCMSession(key, id.NewSignatory(privKey1.PubKey()), id.NewSignatory(privKey2.PubKey()))
+			Expect(err).To(BeNil())
+			gcmSession2, err := codec.NewGCMSession(key, id.NewSignatory(privKey2.PubKey()), id.NewSignatory(privKey1.PubKey()))
+			Expect(err).To(BeNil())
+
+			enc := codec.GzipEncoder(codec.DefaultGzipThreshold, codec.LengthPrefixEncoder(codec.PlainEncoder, codec.GCMEncoder(gcmSession1, codec.PlainEncoder)))
+			_, err = enc(&readerWriter, data)
+			Expect(err).To(BeNil())
+
+			var buf [4086]byte
+			dec := codec.GzipDecoder(codec.LengthPrefixDecoder(codec.PlainDecoder, codec.GCMDecoder(gcmSession2, codec.PlainDecoder)))
+			n, err := dec(&readerWriter, buf[:])
+			Expect(err).To(BeNil())
+			Expect(buf[:n]).To(Equal(data))
+		})
+	})
+})
@@ -28,7 +28,9 @@ func LengthPrefixEncoder(prefixEnc Encoder, bodyEnc Encoder) Encoder {
 // LengthPrefixDecoder returns an Decoder that assumes all data is prefixed with
 // a uint32 length. The returned Decoder wraps two other Decoders, one that is
 // used to decode the length prefix, and one that is used to decode the actual
-// data.
+// data. If the length prefix is larger than the buffer, an error wrapping
+// ErrMessageTooLarge is returned before the data is read, so the length of the
+// buffer is the maximum message size.
 func LengthPrefixDecoder(prefixDec Decoder, bodyDec Decoder) Decoder {
 	return func(r io.Reader, buf []byte) (int, error) {
 		prefixBytes := [4]byte{}
@@ -37,7 +39,7 @@ func LengthPrefixDecoder(prefixDec Decoder, bodyDec Decoder) Decoder {
 		}
 		prefix := binary.BigEndian.Uint32(prefixBytes[:])
 		if uint32(len(buf)) < prefix {
-			return 0, fmt.Errorf("decoding data length: expected %v, got %v", len(buf), prefix)
+			return 0, fmt.Errorf("decoding data length: %w: expected at most %v, got %v", ErrMessageTooLarge, len(buf), prefix)
 		}
 		n, err := bodyDec(r, buf[:prefix])
 		if err != nil {
@@ -2,6 +2,10 @@ package codec_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/renproject/aw/codec"
@@ -47,4 +51,27 @@ var _ = Describe("Length Prefix Codec", func() {
 			Expect(string(buf[:n])).To(Equal("Hi there!"))
 		})
 	})
+
+	Context("when decoding a message with a length prefix that is larger than the buffer", func() {
+		It("should return an error without decoding the data", func() {
+			var readerWriter bytes.Buffer
+			var prefix [4]byte
+			binary.BigEndian.PutUint32(prefix[:], 1<<31)
+			readerWriter.Write(prefix[:])
+			readerWriter.Write([]byte("Hi there!"))
+
+			decoded := false
+			bodyDec := func(r io.Reader, buf []byte) (int, error) {
+				decoded = true
+				return codec.PlainDecoder(r, buf)
+			}
+
+			var buf [4086]byte
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, bodyDec)
+			_, err := dec(&readerWriter, buf[:])
+			Expect(errors.Is(err, codec.ErrMessageTooLarge)).To(BeTrue())
+			Expect(decoded).To(BeFalse())
+			Expect(readerWriter.String()).To(Equal("Hi there!"))
+		})
+	})
 })
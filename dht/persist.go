@@ -0,0 +1,117 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/surge"
+)
+
+// SaveTable writes the address of every peer in the table to the writer, so
+// that they can be restored using LoadTable. Only addresses are saved. Subnets,
+// expiries, pins, and liveness are not.
+func SaveTable(w io.Writer, table Table) error {
+	sigAndAddrs := make([]wire.SignatoryAndAddress, 0, table.NumPeers())
+	if err := table.IteratePeerAddresses(context.Background(), func(sigAndAddr wire.SignatoryAndAddress) bool {
+		sigAndAddrs = append(sigAndAddrs, sigAndAddr)
+		return true
+	}); err != nil {
+		return fmt.Errorf("iterating peers: %v", err)
+	}
+	data, err := surge.ToBinary(sigAndAddrs)
+	if err != nil {
+		return fmt.Errorf("marshaling peers: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("writing peers: %v", err)
+	}
+	return nil
+}
+
+// LoadTable reads addresses that were written by SaveTable from the reader,
+// and adds them to the table. The local peer is skipped, so that peers saved by
+// a different local peer (for example, a file that was copied between peers)
+// never add the local peer to its own table. It returns the number of peers
+// that were added.
+//
+// Addresses are added without verifying their signatures, so the reader must
+// be trusted. Loaded peers are treated like any other peer: if they cannot be
+// reached, they will eventually expire.
+func LoadTable(r io.Reader, table Table) (int, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("reading peers: %v", err)
+	}
+	sigAndAddrs := []wire.SignatoryAndAddress{}
+	if err := surge.FromBinary(&sigAndAddrs, data); err != nil {
+		return 0, fmt.Errorf("unmarshaling peers: %v", err)
+	}
+	self := table.Self()
+	n := 0
+	for _, sigAndAddr := range sigAndAddrs {
+		if sigAndAddr.Signatory.Equal(&self) {
+			continue
+		}
+		table.AddPeer(sigAndAddr.Signatory, sigAndAddr.Address)
+		n++
+	}
+	return n, nil
+}
+
+// SaveTableFile saves the table to a file using SaveTable. The file is
+// replaced atomically, so a crash while saving does not corrupt the
+// previously saved peers.
+func SaveTableFile(path string, table Table) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	if err := SaveTable(f, table); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("syncing %v: %v", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing %v: %v", f.Name(), err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("renaming %v: %v", f.Name(), err)
+	}
+	return nil
+}
+
+// LoadTableFile loads peers from a file that was written by SaveTableFile. A
+// missing file is not an error, so that the first run of a peer does not need
+// to be handled separately.
+//
+// Loading the table before running the peer means that peer discovery will
+// ping the peers known from the previous run, as well as the bootstrap peers,
+// instead of depending entirely on the bootstrap peers being reachable:
+//
+//	n, err := dht.LoadTableFile(path, table)
+//	...
+//	go p.Run(ctx)
+//	...
+//	err = dht.SaveTableFile(path, table)
+func LoadTableFile(path string, table Table) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("opening %v: %v", path, err)
+	}
+	defer f.Close()
+	return LoadTable(f, table)
+}
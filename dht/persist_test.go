@@ -0,0 +1,104 @@
+package dht_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Persistence", func() {
+	fill := func(table dht.Table, n int) []id.Signatory {
+		sigs := make([]id.Signatory, n)
+		for i := range sigs {
+			sigs[i] = id.NewPrivKey().Signatory()
+			table.AddPeer(sigs[i], wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", uint64(i)))
+		}
+		return sigs
+	}
+
+	Context("when saving and loading a table", func() {
+		It("should restore the addresses of all peers", func() {
+			table, _ := initDHT()
+			sigs := fill(table, 10)
+
+			var buf bytes.Buffer
+			Expect(dht.SaveTable(&buf, table)).To(Succeed())
+
+			restored, _ := initDHT()
+			n, err := dht.LoadTable(&buf, restored)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(len(sigs)))
+			Expect(restored.NumPeers()).To(Equal(len(sigs)))
+			for _, sig := range sigs {
+				addr, ok := table.PeerAddress(sig)
+				Expect(ok).To(BeTrue())
+				restoredAddr, ok := restored.PeerAddress(sig)
+				Expect(ok).To(BeTrue())
+				Expect(restoredAddr).To(Equal(addr))
+			}
+		})
+	})
+
+	Context("when loading a table that contains the local peer", func() {
+		It("should skip the local peer", func() {
+			table, _ := initDHT()
+			sigs := fill(table, 10)
+
+			var buf bytes.Buffer
+			Expect(dht.SaveTable(&buf, table)).To(Succeed())
+
+			restored := dht.NewInMemTable(sigs[0])
+			n, err := dht.LoadTable(&buf, restored)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(len(sigs) - 1))
+			Expect(restored.NumPeers()).To(Equal(len(sigs) - 1))
+			_, ok := restored.PeerAddress(sigs[0])
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("when loading malformed data", func() {
+		It("should return an error", func() {
+			table, _ := initDHT()
+			_, err := dht.LoadTable(bytes.NewReader([]byte{0xff, 0xff, 0xff}), table)
+			Expect(err).To(HaveOccurred())
+			Expect(table.NumPeers()).To(Equal(0))
+		})
+	})
+
+	Context("when saving and loading a table file", func() {
+		It("should restore the peers, and treat a missing file as empty", func() {
+			dir, err := ioutil.TempDir("", "aw-dht")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "peers")
+
+			table, _ := initDHT()
+			n, err := dht.LoadTableFile(path, table)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(0))
+
+			sigs := fill(table, 10)
+			Expect(dht.SaveTableFile(path, table)).To(Succeed())
+			// Saving again replaces the file.
+			Expect(dht.SaveTableFile(path, table)).To(Succeed())
+
+			restored, _ := initDHT()
+			n, err = dht.LoadTableFile(path, restored)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(len(sigs)))
+
+			entries, err := ioutil.ReadDir(dir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+		})
+	})
+})
@@ -1,11 +1,14 @@
 package dht
 
 import (
+	"bytes"
+	"context"
 	"math/rand"
 	"sort"
 	"sync"
 	"time"
 
+	"github.com/renproject/aw/clock"
 	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
 )
@@ -36,6 +39,15 @@ type Table interface {
 	// Peers returns the n closest peers to the local peer, using XORing as the
 	// measure of distance between two peers.
 	Peers(int) []id.Signatory
+	// NearestPeers returns the n closest peers to the target, using XORing as
+	// the measure of distance between two peers. The target does not need to
+	// be in the table.
+	NearestPeers(id.Signatory, int) []id.Signatory
+	// IteratePeerAddresses calls the function with the address of each peer,
+	// in order of XOR distance from the local peer, without materialising the
+	// whole table. Iteration stops when the function returns false, or when
+	// the context is done, in which case the context error is returned.
+	IteratePeerAddresses(context.Context, func(wire.SignatoryAndAddress) bool) error
 	// RandomPeers returns n random peer IDs, using either partial permutation
 	// or Floyd's sampling algorithm.
 	RandomPeers(int) []id.Signatory
@@ -43,6 +55,17 @@ type Table interface {
 	// addresses in the table.
 	NumPeers() int
 
+	// MarkSeen records that a peer was seen alive at the given time. It is
+	// ignored if the peer is not in the table, or if a later time has already
+	// been recorded.
+	MarkSeen(id.Signatory, time.Time)
+	// LastSeen returns the latest time at which a peer was seen alive.
+	LastSeen(id.Signatory) (time.Time, bool)
+	// RemoveExpired deletes all peers that have neither been added (with a new
+	// address nonce), nor seen alive, within the given duration. Pinned peers are never removed. It
+	// returns the peers that were removed.
+	RemoveExpired(time.Duration) []id.Signatory
+
 	// HandleExpired returns whether a signatory has expired. It checks whether
 	// an Expiry exists for the signatory, and if it does, has it expired?
 	// If found expired, it deletes the peer from the table
@@ -52,6 +75,15 @@ type Table interface {
 	// DeleteExpiry from the table
 	DeleteExpiry(id.Signatory)
 
+	// PinPeer marks a peer as pinned. Pinned peers are exempt from expiry, and
+	// will not be evicted from the table regardless of their liveness. They can
+	// still be removed explicitly using DeletePeer.
+	PinPeer(id.Signatory)
+	// UnpinPeer removes the pin from a peer, making it subject to expiry again.
+	UnpinPeer(id.Signatory)
+	// IsPinned returns whether or not a peer is pinned.
+	IsPinned(id.Signatory) bool
+
 	// AddSubnet to the table. This returns a subnet hash that can be used to
 	// read/delete the subnet. It is the merkle root hash of the peers in the
 	// subnet.
@@ -61,6 +93,9 @@ type Table interface {
 	DeleteSubnet(id.Hash)
 	// Subnet returns the peers from the table.
 	Subnet(id.Hash) []id.Signatory
+	// PeerSubnets returns the hashes of all subnets that contain the peer,
+	// ordered by hash.
+	PeerSubnets(id.Signatory) []id.Hash
 }
 
 // InMemTable implements the Table using in-memory storage.
@@ -72,17 +107,31 @@ type InMemTable struct {
 
 	addrsBySignatoryMu *sync.Mutex
 	addrsBySignatory   map[id.Signatory]wire.Address
+	addedBySignatory   map[id.Signatory]time.Time
+
+	lastSeenBySignatoryMu *sync.RWMutex
+	lastSeenBySignatory   map[id.Signatory]time.Time
 
 	expiryBySignatoryMu *sync.Mutex
 	expiryBySignatory   map[id.Signatory]Expiry
 
+	pinnedMu *sync.RWMutex
+	pinned   map[id.Signatory]struct{}
+
 	subnetsByHashMu *sync.Mutex
 	subnetsByHash   map[id.Hash][]id.Signatory
 
 	randObj *rand.Rand
+	clock   clock.Clock
 }
 
 func NewInMemTable(self id.Signatory) *InMemTable {
+	return NewInMemTableWithClock(self, clock.Real{})
+}
+
+// NewInMemTableWithClock returns an InMemTable that uses the given Clock to
+// timestamp peers, and to decide when they have expired.
+func NewInMemTableWithClock(self id.Signatory, c clock.Clock) *InMemTable {
 	return &InMemTable{
 		self: self,
 
@@ -91,14 +140,22 @@ func NewInMemTable(self id.Signatory) *InMemTable {
 
 		addrsBySignatoryMu: new(sync.Mutex),
 		addrsBySignatory:   map[id.Signatory]wire.Address{},
+		addedBySignatory:   map[id.Signatory]time.Time{},
+
+		lastSeenBySignatoryMu: new(sync.RWMutex),
+		lastSeenBySignatory:   map[id.Signatory]time.Time{},
 
 		expiryBySignatoryMu: new(sync.Mutex),
 		expiryBySignatory:   map[id.Signatory]Expiry{},
 
+		pinnedMu: new(sync.RWMutex),
+		pinned:   map[id.Signatory]struct{}{},
+
 		subnetsByHashMu: new(sync.Mutex),
 		subnetsByHash:   map[id.Hash][]id.Signatory{},
 
 		randObj: rand.New(rand.NewSource(time.Now().UnixNano())),
+		clock:   c,
 	}
 }
 
@@ -117,10 +174,16 @@ func (table *InMemTable) AddPeer(peerID id.Signatory, peerAddr wire.Address) {
 		return
 	}
 
-	_, ok := table.addrsBySignatory[peerID]
+	existing, ok := table.addrsBySignatory[peerID]
 
 	// Insert into the map to allow for address lookup using the signatory.
+	// Re-adding an address that is not newer does not count as the peer being
+	// added, otherwise peers that keep advertising a dead peer would stop it
+	// from ever expiring.
 	table.addrsBySignatory[peerID] = peerAddr
+	if !ok || peerAddr.Nonce > existing.Nonce {
+		table.addedBySignatory[peerID] = table.clock.Now()
+	}
 
 	// Insert into the sorted signatories list based on its XOR distance from our
 	// own address.
@@ -143,6 +206,11 @@ func (table *InMemTable) DeletePeer(peerID id.Signatory) {
 
 	// Delete from the map.
 	delete(table.addrsBySignatory, peerID)
+	delete(table.addedBySignatory, peerID)
+
+	table.lastSeenBySignatoryMu.Lock()
+	delete(table.lastSeenBySignatory, peerID)
+	table.lastSeenBySignatoryMu.Unlock()
 
 	// Delete from the sorted list.
 	numAddrs := len(table.sorted)
@@ -164,6 +232,25 @@ func (table *InMemTable) PeerAddress(peerID id.Signatory) (wire.Address, bool) {
 	return addr, ok
 }
 
+func (table *InMemTable) NearestPeers(target id.Signatory, n int) []id.Signatory {
+	if target.Equal(&table.self) {
+		return table.Peers(n)
+	}
+	if n <= 0 {
+		return []id.Signatory{}
+	}
+
+	table.sortedMu.RLock()
+	sigs := make([]id.Signatory, len(table.sorted))
+	copy(sigs, table.sorted)
+	table.sortedMu.RUnlock()
+
+	sort.Slice(sigs, func(i, j int) bool {
+		return isCloser(target, sigs[i], sigs[j])
+	})
+	return sigs[:min(n, len(sigs))]
+}
+
 // Peers returns the n closest peer IDs.
 func (table *InMemTable) Peers(n int) []id.Signatory {
 	table.sortedMu.RLock()
@@ -181,6 +268,37 @@ func (table *InMemTable) Peers(n int) []id.Signatory {
 	return sigs
 }
 
+// IteratePeerAddresses calls f with the address of each peer, in order of
+// their XOR distance. The table is not locked while f is running, so f is free
+// to modify the table. Peers that are added or deleted during iteration may, or
+// may not, be visited.
+func (table *InMemTable) IteratePeerAddresses(ctx context.Context, f func(wire.SignatoryAndAddress) bool) error {
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		table.sortedMu.RLock()
+		if i >= len(table.sorted) {
+			table.sortedMu.RUnlock()
+			return nil
+		}
+		sig := table.sorted[i]
+		table.sortedMu.RUnlock()
+
+		addr, ok := table.PeerAddress(sig)
+		if !ok {
+			// The peer was deleted after we read it from the sorted list.
+			continue
+		}
+		if !f(wire.SignatoryAndAddress{Signatory: sig, Address: addr}) {
+			return nil
+		}
+	}
+}
+
 // RandomPeers returns n random peer IDs
 func (table *InMemTable) RandomPeers(n int) []id.Signatory {
 	table.sortedMu.RLock()
@@ -235,14 +353,70 @@ func (table *InMemTable) NumPeers() int {
 	return len(table.addrsBySignatory)
 }
 
+func (table *InMemTable) MarkSeen(peerID id.Signatory, seen time.Time) {
+	table.addrsBySignatoryMu.Lock()
+	defer table.addrsBySignatoryMu.Unlock()
+	if _, ok := table.addrsBySignatory[peerID]; !ok {
+		return
+	}
+
+	table.lastSeenBySignatoryMu.Lock()
+	defer table.lastSeenBySignatoryMu.Unlock()
+	if lastSeen, ok := table.lastSeenBySignatory[peerID]; ok && !seen.After(lastSeen) {
+		return
+	}
+	table.lastSeenBySignatory[peerID] = seen
+}
+
+func (table *InMemTable) LastSeen(peerID id.Signatory) (time.Time, bool) {
+	table.lastSeenBySignatoryMu.RLock()
+	defer table.lastSeenBySignatoryMu.RUnlock()
+	lastSeen, ok := table.lastSeenBySignatory[peerID]
+	return lastSeen, ok
+}
+
+func (table *InMemTable) RemoveExpired(olderThan time.Duration) []id.Signatory {
+	cutoff := table.clock.Now().Add(-olderThan)
+
+	table.addrsBySignatoryMu.Lock()
+	table.lastSeenBySignatoryMu.RLock()
+	expired := []id.Signatory{}
+	for peerID, added := range table.addedBySignatory {
+		refreshed := added
+		if lastSeen, ok := table.lastSeenBySignatory[peerID]; ok && lastSeen.After(refreshed) {
+			refreshed = lastSeen
+		}
+		if refreshed.Before(cutoff) {
+			expired = append(expired, peerID)
+		}
+	}
+	table.lastSeenBySignatoryMu.RUnlock()
+	table.addrsBySignatoryMu.Unlock()
+
+	removed := []id.Signatory{}
+	for _, peerID := range expired {
+		if table.IsPinned(peerID) {
+			continue
+		}
+		table.DeletePeer(peerID)
+		table.DeleteExpiry(peerID)
+		removed = append(removed, peerID)
+	}
+	return removed
+}
+
 func (table *InMemTable) HandleExpired(peerID id.Signatory) bool {
+	if table.IsPinned(peerID) {
+		return false
+	}
+
 	table.expiryBySignatoryMu.Lock()
 	defer table.expiryBySignatoryMu.Unlock()
 	expiry, ok := table.expiryBySignatory[peerID]
 	if !ok {
 		return false
 	}
-	expired := (time.Now().Sub(expiry.timestamp)) > expiry.minimumExpiryAge
+	expired := clock.Since(table.clock, expiry.timestamp) > expiry.minimumExpiryAge
 	if expired {
 		table.DeletePeer(peerID)
 		delete(table.expiryBySignatory, peerID)
@@ -251,6 +425,10 @@ func (table *InMemTable) HandleExpired(peerID id.Signatory) bool {
 }
 
 func (table *InMemTable) AddExpiry(peerID id.Signatory, duration time.Duration) {
+	if table.IsPinned(peerID) {
+		return
+	}
+
 	table.expiryBySignatoryMu.Lock()
 	defer table.expiryBySignatoryMu.Unlock()
 	_, ok := table.PeerAddress(peerID)
@@ -263,7 +441,7 @@ func (table *InMemTable) AddExpiry(peerID id.Signatory, duration time.Duration)
 	}
 	table.expiryBySignatory[peerID] = Expiry{
 		minimumExpiryAge: duration,
-		timestamp:        time.Now(),
+		timestamp:        table.clock.Now(),
 	}
 }
 
@@ -273,6 +451,29 @@ func (table *InMemTable) DeleteExpiry(peerID id.Signatory) {
 	delete(table.expiryBySignatory, peerID)
 }
 
+func (table *InMemTable) PinPeer(peerID id.Signatory) {
+	table.pinnedMu.Lock()
+	table.pinned[peerID] = struct{}{}
+	table.pinnedMu.Unlock()
+
+	// Any expiry that was started before the peer was pinned is no longer
+	// relevant.
+	table.DeleteExpiry(peerID)
+}
+
+func (table *InMemTable) UnpinPeer(peerID id.Signatory) {
+	table.pinnedMu.Lock()
+	defer table.pinnedMu.Unlock()
+	delete(table.pinned, peerID)
+}
+
+func (table *InMemTable) IsPinned(peerID id.Signatory) bool {
+	table.pinnedMu.RLock()
+	defer table.pinnedMu.RUnlock()
+	_, ok := table.pinned[peerID]
+	return ok
+}
+
 func (table *InMemTable) AddSubnet(signatories []id.Signatory) id.Hash {
 	copied := make([]id.Signatory, len(signatories))
 	copy(copied, signatories)
@@ -316,10 +517,36 @@ func (table *InMemTable) Subnet(hash id.Hash) []id.Signatory {
 	return copied
 }
 
+func (table *InMemTable) PeerSubnets(peerID id.Signatory) []id.Hash {
+	table.subnetsByHashMu.Lock()
+	defer table.subnetsByHashMu.Unlock()
+
+	hashes := []id.Hash{}
+	for hash, subnet := range table.subnetsByHash {
+		for _, sig := range subnet {
+			if sig.Equal(&peerID) {
+				hashes = append(hashes, hash)
+				break
+			}
+		}
+	}
+	// Sort the hashes, so that the order does not depend on map iteration.
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+	return hashes
+}
+
 func (table *InMemTable) isCloser(fst, snd id.Signatory) bool {
+	return isCloser(table.self, fst, snd)
+}
+
+// isCloser returns true if the first peer is closer to the target than the
+// second peer, using XORing as the measure of distance.
+func isCloser(target, fst, snd id.Signatory) bool {
 	for b := 0; b < 32; b++ {
-		d1 := table.self[b] ^ fst[b]
-		d2 := table.self[b] ^ snd[b]
+		d1 := target[b] ^ fst[b]
+		d2 := target[b] ^ snd[b]
 		if d1 < d2 {
 			return true
 		}
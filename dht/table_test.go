@@ -1,6 +1,8 @@
 package dht_test
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
@@ -8,6 +10,7 @@ import (
 	"testing/quick"
 	"time"
 
+	"github.com/renproject/aw/clock"
 	"github.com/renproject/aw/dht"
 	"github.com/renproject/aw/dht/dhtutil"
 	"github.com/renproject/aw/wire"
@@ -135,6 +138,103 @@ var _ = Describe("DHT", func() {
 			})
 		})
 
+		Context("when iterating over peer addresses", func() {
+			It("should only visit the prefix before stopping", func() {
+				table, _ := initDHT()
+				numAddrs := rand.Intn(90) + 10 // [10, 100)
+
+				for i := 0; i < numAddrs; i++ {
+					sig := id.NewPrivKey().Signatory()
+					addr := wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", uint64(time.Now().UnixNano()))
+					table.AddPeer(sig, addr)
+				}
+
+				numVisited := rand.Intn(numAddrs)
+				visited := make([]id.Signatory, 0, numVisited)
+				err := table.IteratePeerAddresses(context.Background(), func(sigAndAddr wire.SignatoryAndAddress) bool {
+					if len(visited) >= numVisited {
+						return false
+					}
+					visited = append(visited, sigAndAddr.Signatory)
+					return true
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(visited).To(Equal(table.Peers(numVisited)))
+			})
+
+			It("should visit every peer if the function never stops", func() {
+				table, _ := initDHT()
+				numAddrs := rand.Intn(100)
+
+				for i := 0; i < numAddrs; i++ {
+					sig := id.NewPrivKey().Signatory()
+					addr := wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", uint64(time.Now().UnixNano()))
+					table.AddPeer(sig, addr)
+				}
+
+				numVisited := 0
+				err := table.IteratePeerAddresses(context.Background(), func(sigAndAddr wire.SignatoryAndAddress) bool {
+					addr, ok := table.PeerAddress(sigAndAddr.Signatory)
+					Expect(ok).To(BeTrue())
+					Expect(addr).To(Equal(sigAndAddr.Address))
+					numVisited++
+					return true
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(numVisited).To(Equal(numAddrs))
+			})
+
+			It("should return an error when the context is done", func() {
+				table, _ := initDHT()
+				for i := 0; i < 10; i++ {
+					sig := id.NewPrivKey().Signatory()
+					addr := wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", uint64(time.Now().UnixNano()))
+					table.AddPeer(sig, addr)
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				numVisited := 0
+				err := table.IteratePeerAddresses(ctx, func(wire.SignatoryAndAddress) bool {
+					numVisited++
+					if numVisited == 3 {
+						cancel()
+					}
+					return true
+				})
+				Expect(err).To(Equal(context.Canceled))
+				Expect(numVisited).To(Equal(3))
+			})
+
+			It("should visit peers in the same order, whatever order they were added in", func() {
+				self := id.NewPrivKey().Signatory()
+				sigs := make([]id.Signatory, 50)
+				for i := range sigs {
+					sigs[i] = id.NewPrivKey().Signatory()
+				}
+
+				visit := func(order []int) []id.Signatory {
+					table := dht.NewInMemTable(self)
+					for _, i := range order {
+						addr := wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", uint64(time.Now().UnixNano()))
+						table.AddPeer(sigs[i], addr)
+					}
+					visited := make([]id.Signatory, 0, len(sigs))
+					err := table.IteratePeerAddresses(context.Background(), func(sigAndAddr wire.SignatoryAndAddress) bool {
+						visited = append(visited, sigAndAddr.Signatory)
+						return true
+					})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(visited).To(Equal(table.Peers(len(sigs))))
+					return visited
+				}
+
+				visited := visit(rand.Perm(len(sigs)))
+				Expect(visited).To(HaveLen(len(sigs)))
+				Expect(dhtutil.IsSorted(self, visited)).To(BeTrue())
+				Expect(visit(rand.Perm(len(sigs)))).To(Equal(visited))
+			})
+		})
+
 		Context("when querying random peers", func() {
 			It("should return the correct amount", func() {
 				table, _ := initDHT()
@@ -333,6 +433,178 @@ var _ = Describe("DHT", func() {
 	})
 
 	Describe("Subnets", func() {
+		Context("when marking peers as seen", func() {
+			It("should only keep the latest time for peers in the table", func() {
+				table, _ := initDHT()
+
+				sig := id.NewPrivKey().Signatory()
+				now := time.Now()
+				table.MarkSeen(sig, now)
+				_, ok := table.LastSeen(sig)
+				Expect(ok).To(BeFalse())
+
+				table.AddPeer(sig, wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", uint64(now.UnixNano())))
+				table.MarkSeen(sig, now)
+				table.MarkSeen(sig, now.Add(-time.Second))
+				lastSeen, ok := table.LastSeen(sig)
+				Expect(ok).To(BeTrue())
+				Expect(lastSeen).To(Equal(now))
+
+				table.DeletePeer(sig)
+				_, ok = table.LastSeen(sig)
+				Expect(ok).To(BeFalse())
+			})
+		})
+
+		Context("when querying the nearest peers to a target", func() {
+			It("should return the closest peers by XOR distance", func() {
+				table, _ := initDHT()
+				for i := 0; i < 100; i++ {
+					table.AddPeer(id.NewPrivKey().Signatory(), wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("172.16.254.1:%v", 3000+i), uint64(time.Now().UnixNano())))
+				}
+				target := id.NewPrivKey().Signatory()
+				distance := func(sig id.Signatory) []byte {
+					d := make([]byte, len(sig))
+					for i := range sig {
+						d[i] = sig[i] ^ target[i]
+					}
+					return d
+				}
+
+				nearest := table.NearestPeers(target, 10)
+				Expect(nearest).To(HaveLen(10))
+				all := table.NearestPeers(target, 1000)
+				Expect(all).To(HaveLen(100))
+				Expect(all[:10]).To(Equal(nearest))
+				for i := 1; i < len(all); i++ {
+					Expect(bytes.Compare(distance(all[i-1]), distance(all[i]))).To(Equal(-1))
+				}
+
+				Expect(table.NearestPeers(target, 0)).To(BeEmpty())
+				Expect(table.NearestPeers(table.Self(), 10)).To(Equal(table.Peers(10)))
+			})
+		})
+
+		Context("when removing expired peers", func() {
+			It("should only remove peers that have not been refreshed", func() {
+				table, _ := initDHT()
+
+				stale := id.NewPrivKey().Signatory()
+				seen := id.NewPrivKey().Signatory()
+				readded := id.NewPrivKey().Signatory()
+				pinned := id.NewPrivKey().Signatory()
+				for i, sig := range []id.Signatory{stale, seen, readded, pinned} {
+					table.AddPeer(sig, wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("172.16.254.1:%v", 3000+i), uint64(time.Now().UnixNano())))
+				}
+				table.PinPeer(pinned)
+				time.Sleep(20 * time.Millisecond)
+
+				table.MarkSeen(seen, time.Now())
+				table.AddPeer(readded, wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3002", uint64(time.Now().UnixNano())))
+
+				Expect(table.RemoveExpired(10 * time.Millisecond)).To(Equal([]id.Signatory{stale}))
+				_, ok := table.PeerAddress(stale)
+				Expect(ok).To(BeFalse())
+				for _, sig := range []id.Signatory{seen, readded, pinned} {
+					_, ok := table.PeerAddress(sig)
+					Expect(ok).To(BeTrue())
+				}
+				Expect(table.NumPeers()).To(Equal(3))
+				Expect(table.Peers(10)).To(HaveLen(3))
+			})
+		})
+
+		Context("when removing expired peers using a virtual clock", func() {
+			It("should expire peers as virtual time passes", func() {
+				c := clock.NewVirtual(time.Unix(0, 0))
+				table := dht.NewInMemTableWithClock(id.NewPrivKey().Signatory(), c)
+
+				stale := id.NewPrivKey().Signatory()
+				seen := id.NewPrivKey().Signatory()
+				table.AddPeer(stale, wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", 0))
+				table.AddPeer(seen, wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3001", 0))
+
+				c.Advance(time.Hour)
+				Expect(table.RemoveExpired(time.Hour)).To(BeEmpty())
+				table.MarkSeen(seen, c.Now())
+
+				c.Advance(time.Minute)
+				Expect(table.RemoveExpired(time.Hour)).To(Equal([]id.Signatory{stale}))
+				_, ok := table.PeerAddress(stale)
+				Expect(ok).To(BeFalse())
+				_, ok = table.PeerAddress(seen)
+				Expect(ok).To(BeTrue())
+
+				table.AddExpiry(seen, time.Minute)
+				Expect(table.HandleExpired(seen)).To(BeFalse())
+				c.Advance(2 * time.Minute)
+				Expect(table.HandleExpired(seen)).To(BeTrue())
+			})
+		})
+
+		Context("when a stale address is advertised again", func() {
+			It("should not extend the expiry of the peer", func() {
+				c := clock.NewVirtual(time.Unix(0, 0))
+				table := dht.NewInMemTableWithClock(id.NewPrivKey().Signatory(), c)
+
+				stale := id.NewPrivKey().Signatory()
+				updated := id.NewPrivKey().Signatory()
+				table.AddPeer(stale, wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", 1))
+				table.AddPeer(updated, wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3001", 1))
+
+				c.Advance(time.Hour)
+				table.AddPeer(stale, wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", 1))
+				table.AddPeer(updated, wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3001", 2))
+
+				c.Advance(time.Minute)
+				Expect(table.RemoveExpired(time.Hour)).To(Equal([]id.Signatory{stale}))
+				_, ok := table.PeerAddress(updated)
+				Expect(ok).To(BeTrue())
+			})
+		})
+
+		Context("when expiring a pinned peer", func() {
+			It("should not remove the peer from the table", func() {
+				table, _ := initDHT()
+
+				pinned := id.NewPrivKey().Signatory()
+				unpinned := id.NewPrivKey().Signatory()
+				table.AddPeer(pinned, wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", uint64(time.Now().UnixNano())))
+				table.AddPeer(unpinned, wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3001", uint64(time.Now().UnixNano())))
+				table.PinPeer(pinned)
+				Expect(table.IsPinned(pinned)).To(BeTrue())
+				Expect(table.IsPinned(unpinned)).To(BeFalse())
+
+				table.AddExpiry(pinned, time.Millisecond)
+				table.AddExpiry(unpinned, time.Millisecond)
+				time.Sleep(10 * time.Millisecond)
+
+				Expect(table.HandleExpired(pinned)).To(BeFalse())
+				Expect(table.HandleExpired(unpinned)).To(BeTrue())
+				_, ok := table.PeerAddress(pinned)
+				Expect(ok).To(BeTrue())
+				_, ok = table.PeerAddress(unpinned)
+				Expect(ok).To(BeFalse())
+			})
+
+			It("should remove the peer once it has been unpinned", func() {
+				table, _ := initDHT()
+
+				sig := id.NewPrivKey().Signatory()
+				table.AddPeer(sig, wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", uint64(time.Now().UnixNano())))
+				table.PinPeer(sig)
+				table.UnpinPeer(sig)
+				Expect(table.IsPinned(sig)).To(BeFalse())
+
+				table.AddExpiry(sig, time.Millisecond)
+				time.Sleep(10 * time.Millisecond)
+
+				Expect(table.HandleExpired(sig)).To(BeTrue())
+				_, ok := table.PeerAddress(sig)
+				Expect(ok).To(BeFalse())
+			})
+		})
+
 		Context("when adding a subnet", func() {
 			It("should be able to query it", func() {
 				table, identity := initDHT()
@@ -375,6 +647,26 @@ var _ = Describe("DHT", func() {
 			})
 		})
 
+		Context("when querying the subnets of a peer", func() {
+			It("should return every subnet that contains the peer", func() {
+				table, _ := initDHT()
+
+				member := id.NewPrivKey().Signatory()
+				other := id.NewPrivKey().Signatory()
+				fst := table.AddSubnet([]id.Signatory{member, other})
+				snd := table.AddSubnet([]id.Signatory{id.NewPrivKey().Signatory(), member})
+				table.AddSubnet([]id.Signatory{other})
+
+				subnets := table.PeerSubnets(member)
+				Expect(subnets).To(ConsistOf(fst, snd))
+				Expect(bytes.Compare(subnets[0][:], subnets[1][:])).To(Equal(-1))
+
+				table.DeleteSubnet(fst)
+				Expect(table.PeerSubnets(member)).To(Equal([]id.Hash{snd}))
+				Expect(table.PeerSubnets(id.NewPrivKey().Signatory())).To(BeEmpty())
+			})
+		})
+
 		Context("when querying a subnet that does not exist", func() {
 			It("should return an empty list", func() {
 				table, _ := initDHT()
@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"time"
 
+	"github.com/renproject/aw"
 	"github.com/renproject/aw/dht"
 
 	"github.com/renproject/aw/channel"
@@ -43,7 +44,7 @@ func main() {
 	transports := make([]*transport.Transport, n)
 	for i := range peers {
 		self := opts[i].PrivKey.Signatory()
-		h := handshake.Filter(func(id.Signatory) error { return nil }, handshake.ECIES(opts[i].PrivKey))
+		h := handshake.Filter(func(id.Signatory) error { return nil }, aw.NewHandshake(opts[i].PrivKey))
 		contentResolver := dht.NewDoubleCacheContentResolver(dht.DefaultDoubleCacheContentResolverOptions(), nil)
 		clients[i] = channel.NewClient(
 			channel.DefaultOptions().
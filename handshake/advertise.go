@@ -0,0 +1,91 @@
+package handshake
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"github.com/renproject/surge"
+)
+
+// MaxAdvertisedAddressSize is the maximum number of bytes that will be read
+// when decoding the advertised address of a remote peer.
+const MaxAdvertisedAddressSize = 1024
+
+// Advertise accepts the network address of the local peer, a Handshake
+// function, and a callback, and returns a wrapping Handshake function. The
+// wrapping Handshake runs the wrapped Handshake, and then both peers exchange
+// their advertised network addresses over the (now authenticated) connection.
+// The callback is called with the remote peer ID and the address that it
+// advertised, so that the accepting peer can learn how to reach the dialing
+// peer. If the remote peer does not advertise an address (its address value is
+// empty), then the callback is not called. If the advertised address is signed
+// by anyone other than the remote peer, then an error is returned.
+//
+// Both peers must use Advertise, otherwise the handshake will fail.
+func Advertise(self wire.Address, h Handshake, f func(id.Signatory, wire.Address)) Handshake {
+	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		enc, dec, remote, err := h(conn, enc, dec)
+		if err != nil {
+			return enc, dec, remote, err
+		}
+
+		selfData, err := surge.ToBinary(self)
+		if err != nil {
+			return enc, dec, remote, fmt.Errorf("marshaling local address: %v", err)
+		}
+
+		// Write the local address in the background, so that both peers can
+		// write at the same time without blocking each other.
+		errCh := make(chan error, 1)
+		go func() {
+			defer close(errCh)
+			sizeBuf := [4]byte{}
+			binary.BigEndian.PutUint32(sizeBuf[:], uint32(len(selfData)))
+			if _, err := enc(conn, sizeBuf[:]); err != nil {
+				errCh <- fmt.Errorf("encoding local address size: %v", err)
+				return
+			}
+			if _, err := enc(conn, selfData); err != nil {
+				errCh <- fmt.Errorf("encoding local address: %v", err)
+				return
+			}
+		}()
+
+		// The decoders used during handshakes can require the buffer to have
+		// additional capacity (for example, for authentication tags).
+		buf := make([]byte, MaxAdvertisedAddressSize+64)
+		if _, err := dec(conn, buf[:4]); err != nil {
+			return enc, dec, remote, fmt.Errorf("decoding remote address size: %v", err)
+		}
+		size := binary.BigEndian.Uint32(buf[:4])
+		if size > MaxAdvertisedAddressSize {
+			return enc, dec, remote, fmt.Errorf("decoding remote address size: expected at most %v, got %v", MaxAdvertisedAddressSize, size)
+		}
+		n, err := dec(conn, buf[:size])
+		if err != nil {
+			return enc, dec, remote, fmt.Errorf("decoding remote address: %v", err)
+		}
+		if err := <-errCh; err != nil {
+			return enc, dec, remote, err
+		}
+
+		addr := wire.Address{}
+		if err := surge.FromBinary(&addr, buf[:n]); err != nil {
+			return enc, dec, remote, fmt.Errorf("unmarshaling remote address: %v", err)
+		}
+		if addr.Value == "" {
+			return enc, dec, remote, nil
+		}
+		if !addr.Signature.Equal(&id.Signature{}) {
+			if err := addr.Verify(remote); err != nil {
+				return enc, dec, remote, fmt.Errorf("verifying remote address: %v", err)
+			}
+		}
+		f(remote, addr)
+		return enc, dec, remote, nil
+	}
+}
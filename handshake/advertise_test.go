@@ -0,0 +1,99 @@
+package handshake_test
+
+import (
+	"net"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Advertise", func() {
+	type result struct {
+		remote     id.Signatory
+		addr       wire.Address
+		advertised bool
+		err        error
+	}
+
+	run := func(privKey *id.PrivKey, self wire.Address, conn net.Conn) <-chan result {
+		resultCh := make(chan result, 1)
+		go func() {
+			res := result{}
+			h := handshake.Advertise(self, handshake.ECIES(privKey), func(remote id.Signatory, addr wire.Address) {
+				res.addr = addr
+				res.advertised = true
+			})
+			_, _, res.remote, res.err = h(conn, codec.PlainEncoder, codec.PlainDecoder)
+			resultCh <- res
+		}()
+		return resultCh
+	}
+
+	Context("when both peers advertise an address", func() {
+		It("should give the accepting peer the address of the dialing peer", func() {
+			clientPrivKey := id.NewPrivKey()
+			serverPrivKey := id.NewPrivKey()
+			clientAddr := wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3333", 1)
+			Expect(clientAddr.Sign(clientPrivKey)).To(Succeed())
+			serverAddr := wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3334", 2)
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			clientResultCh := run(clientPrivKey, clientAddr, clientConn)
+			serverResultCh := run(serverPrivKey, serverAddr, serverConn)
+			clientResult, serverResult := <-clientResultCh, <-serverResultCh
+			Expect(clientResult.err).ToNot(HaveOccurred())
+			Expect(serverResult.err).ToNot(HaveOccurred())
+
+			Expect(serverResult.advertised).To(BeTrue())
+			Expect(serverResult.remote).To(Equal(clientPrivKey.Signatory()))
+			Expect(serverResult.addr.Equal(&clientAddr)).To(BeTrue())
+
+			Expect(clientResult.advertised).To(BeTrue())
+			Expect(clientResult.addr.Equal(&serverAddr)).To(BeTrue())
+		})
+	})
+
+	Context("when a peer does not advertise an address", func() {
+		It("should not call the callback", func() {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			clientResultCh := run(id.NewPrivKey(), wire.Address{}, clientConn)
+			serverResultCh := run(id.NewPrivKey(), wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3334", 1), serverConn)
+			clientResult, serverResult := <-clientResultCh, <-serverResultCh
+			Expect(clientResult.err).ToNot(HaveOccurred())
+			Expect(serverResult.err).ToNot(HaveOccurred())
+
+			Expect(serverResult.advertised).To(BeFalse())
+			Expect(clientResult.advertised).To(BeTrue())
+		})
+	})
+
+	Context("when a peer advertises an address signed by someone else", func() {
+		It("should return an error", func() {
+			clientAddr := wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3333", 1)
+			Expect(clientAddr.Sign(id.NewPrivKey())).To(Succeed())
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			clientResultCh := run(id.NewPrivKey(), clientAddr, clientConn)
+			serverResultCh := run(id.NewPrivKey(), wire.Address{}, serverConn)
+			<-clientResultCh
+			serverResult := <-serverResultCh
+
+			Expect(serverResult.err).To(HaveOccurred())
+			Expect(serverResult.advertised).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,70 @@
+package handshake
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/id"
+)
+
+// WithContext accepts a context and a Handshake function, and returns a
+// wrapping Handshake function that stops the wrapped Handshake when the
+// context is done. The deadline of the context is used as the deadline of the
+// connection, and the connection is given a deadline in the past when the
+// context is canceled, so that blocked reads and writes return. If the context
+// is done before the wrapped Handshake completes, an error wrapping the error
+// of the context is returned. Otherwise, the deadline of the connection is
+// cleared, so that it does not affect the established session.
+//
+// This prevents a remote peer that stalls during the handshake from blocking
+// the local peer forever.
+func WithContext(ctx context.Context, h Handshake) Handshake {
+	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("handshake: %w", err)
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			if err := conn.SetDeadline(deadline); err != nil {
+				return nil, nil, id.Signatory{}, fmt.Errorf("setting deadline: %v", err)
+			}
+		}
+
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				conn.SetDeadline(time.Unix(1, 0))
+			case <-done:
+			}
+		}()
+		enc, dec, remote, err := h(conn, enc, dec)
+		close(done)
+		<-stopped
+
+		// The context being done takes precedence over other errors, because
+		// those are most likely caused by the deadline of the connection.
+		// Even if the wrapped Handshake succeeded, the deadline of the
+		// connection might have been changed, so the connection cannot be
+		// used.
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("handshake: %w", ctxErr)
+		}
+		if err != nil {
+			// The deadline of the connection can pass slightly before the
+			// context notices that its deadline has passed.
+			if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+				return nil, nil, id.Signatory{}, fmt.Errorf("handshake: %w", context.DeadlineExceeded)
+			}
+			return enc, dec, remote, err
+		}
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("clearing deadline: %v", err)
+		}
+		return enc, dec, remote, nil
+	}
+}
@@ -0,0 +1,99 @@
+package handshake_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WithContext", func() {
+	type result struct {
+		enc    codec.Encoder
+		dec    codec.Decoder
+		remote id.Signatory
+		err    error
+	}
+
+	run := func(ctx context.Context, privKey *id.PrivKey, conn net.Conn) <-chan result {
+		resultCh := make(chan result, 1)
+		go func() {
+			res := result{}
+			res.enc, res.dec, res.remote, res.err = handshake.WithContext(ctx, handshake.ECIES(privKey))(conn, codec.PlainEncoder, codec.PlainDecoder)
+			resultCh <- res
+		}()
+		return resultCh
+	}
+
+	Context("when the remote peer stalls until the deadline", func() {
+		It("should return a deadline exceeded error", func() {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			// The client reads everything, but never writes anything.
+			go io.Copy(io.Discard, clientConn)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			var res result
+			Eventually(run(ctx, id.NewPrivKey(), serverConn), time.Second).Should(Receive(&res))
+			Expect(errors.Is(res.err, context.DeadlineExceeded)).To(BeTrue())
+		})
+	})
+
+	Context("when the context is canceled", func() {
+		It("should return a canceled error", func() {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			go io.Copy(io.Discard, clientConn)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			resultCh := run(ctx, id.NewPrivKey(), serverConn)
+			Consistently(resultCh, 100*time.Millisecond).ShouldNot(Receive())
+			cancel()
+			var res result
+			Eventually(resultCh, time.Second).Should(Receive(&res))
+			Expect(errors.Is(res.err, context.Canceled)).To(BeTrue())
+		})
+	})
+
+	Context("when the handshake completes before the deadline", func() {
+		It("should clear the deadline of the connection", func() {
+			clientPrivKey := id.NewPrivKey()
+			serverPrivKey := id.NewPrivKey()
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			clientResultCh := run(ctx, clientPrivKey, clientConn)
+			serverResultCh := run(ctx, serverPrivKey, serverConn)
+			clientResult, serverResult := <-clientResultCh, <-serverResultCh
+			Expect(clientResult.err).ToNot(HaveOccurred())
+			Expect(serverResult.err).ToNot(HaveOccurred())
+			Expect(clientResult.remote).To(Equal(serverPrivKey.Signatory()))
+			Expect(serverResult.remote).To(Equal(clientPrivKey.Signatory()))
+
+			// The session can still be used after the deadline has passed.
+			<-ctx.Done()
+			enc, dec := codec.LengthPrefixFramer(clientResult.enc, serverResult.dec)
+			go enc(clientConn, []byte("hello"))
+			buf := make([]byte, 1024)
+			n, err := dec(serverConn, buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("hello"))
+		})
+	})
+})
@@ -3,7 +3,7 @@ package handshake
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/rand"
+	cryptorand "crypto/rand"
 	"fmt"
 	"io"
 	"math/big"
@@ -18,7 +18,112 @@ import (
 const sizeOfSecretKey = 32
 const sizeOfEncryptedSecretKey = 145 // 113-byte encryption header + 32-byte secret key
 
+// ECIESOptions configure an ECIES handshake.
+type ECIESOptions struct {
+	// Rand is the source of randomness used to generate secret keys, and to
+	// encrypt them. It must be cryptographically secure, except in tests that
+	// need deterministic handshakes, and it must not be shared between
+	// concurrent handshakes.
+	Rand io.Reader
+	// StepTags prefixes every message written during the handshake with a tag
+	// that identifies its step.
+	StepTags bool
+	// SessionObserver is called whenever a session is established.
+	SessionObserver func(remote id.Signatory, session *codec.GCMSession)
+	// RekeyPolicy defines when the established GCM session ratchets its keys.
+	RekeyPolicy codec.GCMRekeyPolicy
+}
+
+func DefaultECIESOptions() ECIESOptions {
+	return ECIESOptions{
+		Rand: cryptorand.Reader,
+	}
+}
+
+// WithRand sets the reader from which randomness is read, instead of from a
+// cryptographically secure source. This is only useful for producing
+// deterministic handshakes in tests.
+func (opts ECIESOptions) WithRand(rand io.Reader) ECIESOptions {
+	opts.Rand = rand
+	return opts
+}
+
+// WithStepTags prefixes every message written during the handshake with a tag
+// that identifies its step. If a message for an unexpected step is read, then
+// an error wrapping ErrHandshakeOutOfOrder is returned, instead of failing to
+// decrypt the message. The tags change the bytes that are written, so a
+// handshake with step tags is not compatible with one without them; use
+// Versioned to migrate between them.
+func (opts ECIESOptions) WithStepTags(tagged bool) ECIESOptions {
+	opts.StepTags = tagged
+	return opts
+}
+
+// WithSessionObserver sets an observer that is called with the identity of the
+// remote peer and the GCM session whenever a session is established. This
+// allows the fingerprint of the session to be logged, so that operators can
+// check that both peers of a connection agree on it.
+func (opts ECIESOptions) WithSessionObserver(observer func(remote id.Signatory, session *codec.GCMSession)) ECIESOptions {
+	opts.SessionObserver = observer
+	return opts
+}
+
+// WithRekeyPolicy sets the policy used by the established GCM session to
+// ratchet its keys, so that long-lived connections do not seal an unbounded
+// amount of data using one key. Both peers must use a rekey policy that
+// enables rekeying, because rekeying changes the framing of sealed data. The
+// thresholds of the peers do not need to match, because each peer decides
+// when to rekey the data that it writes.
+func (opts ECIESOptions) WithRekeyPolicy(policy codec.GCMRekeyPolicy) ECIESOptions {
+	opts.RekeyPolicy = policy
+	return opts
+}
+
+// ECIES returns a Handshake that establishes a GCM session by exchanging
+// secret keys that are encrypted using the public keys of both peers.
 func ECIES(privKey *id.PrivKey) Handshake {
+	return ECIESWithOptions(privKey, DefaultECIESOptions())
+}
+
+// ECIESWithOptions is the same as ECIES, but is configured using the options.
+func ECIESWithOptions(privKey *id.PrivKey, opts ECIESOptions) Handshake {
+	return eciesHandshake(privKey, opts)
+}
+
+// The steps of the ECIES handshake, used to tag messages when step tags are
+// enabled.
+const (
+	eciesStepPubKey       = uint8(1)
+	eciesStepLocalSecret  = uint8(2)
+	eciesStepRemoteSecret = uint8(3)
+)
+
+func eciesHandshake(privKey *id.PrivKey, opts ECIESOptions) Handshake {
+	rand := opts.Rand
+	// writeStep writes a message for the given step, prefixed by the step tag
+	// if step tags are enabled.
+	writeStep := func(conn net.Conn, step uint8, buf []byte) error {
+		if opts.StepTags {
+			buf = append([]byte{step}, buf...)
+		}
+		return writeFull(conn, buf)
+	}
+	// readStep reads a message for the given step, and checks that it is
+	// prefixed by the step tag if step tags are enabled.
+	readStep := func(conn net.Conn, step uint8, buf []byte) error {
+		if opts.StepTags {
+			tag := [1]byte{}
+			if _, err := io.ReadFull(conn, tag[:]); err != nil {
+				return err
+			}
+			if tag[0] != step {
+				return fmt.Errorf("%w: expected step %v, got %v", ErrHandshakeOutOfOrder, step, tag[0])
+			}
+		}
+		_, err := io.ReadFull(conn, buf)
+		return err
+	}
+
 	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
 		// Channel for passing errors from the writing goroutine to the reading
 		// goroutine (which has the ability to return the error).
@@ -40,7 +145,7 @@ func ECIES(privKey *id.PrivKey) Handshake {
 		// Generate a local secret key. We do it here, because it is needed by
 		// the writing and reading goroutine.
 		localSecretKey := [sizeOfSecretKey]byte{}
-		if _, err := rand.Read(localSecretKey[:]); err != nil {
+		if _, err := io.ReadFull(rand, localSecretKey[:]); err != nil {
 			return nil, nil, id.Signatory{}, fmt.Errorf("generate local secret key: %v", err)
 		}
 
@@ -49,16 +154,22 @@ func ECIES(privKey *id.PrivKey) Handshake {
 		go func() {
 			defer close(errCh)
 
+			// If writing fails, the remote peer will never respond, so the
+			// connection is closed to stop the reading goroutine from
+			// blocking forever.
+			writeFailed := true
+			defer func() {
+				if writeFailed {
+					conn.Close()
+				}
+			}()
+
 			// Write local pubkey so that the remote peer knows how to encrypt
 			// its secret key and send it back to the local peer.
 			xBuf := paddedTo32(localPubKey.X)
 			yBuf := paddedTo32(localPubKey.Y)
-			if _, err := conn.Write(xBuf[:]); err != nil {
-				errCh <- fmt.Errorf("write local pubkey x: %v", err)
-				return
-			}
-			if _, err := conn.Write(yBuf[:]); err != nil {
-				errCh <- fmt.Errorf("write local pubkey y: %v", err)
+			if err := writeStep(conn, eciesStepPubKey, append(xBuf[:], yBuf[:]...)); err != nil {
+				errCh <- fmt.Errorf("write local pubkey: %w", err)
 				return
 			}
 
@@ -66,16 +177,17 @@ func ECIES(privKey *id.PrivKey) Handshake {
 			// it to the remote peer.
 			remotePubKey, ok := <-remotePubKeyCh
 			if !ok {
+				writeFailed = false
 				return
 			}
 			importedRemotePubKey := ecies.ImportECDSAPublic((*ecdsa.PublicKey)(&remotePubKey))
-			encryptedLocalSecretKey, err := ecies.Encrypt(rand.Reader, importedRemotePubKey, localSecretKey[:], nil, nil)
+			encryptedLocalSecretKey, err := ecies.Encrypt(rand, importedRemotePubKey, localSecretKey[:], nil, nil)
 			if err != nil {
 				errCh <- fmt.Errorf("encrypt local secret key: %v", err)
 				return
 			}
-			if _, err := conn.Write(encryptedLocalSecretKey); err != nil {
-				errCh <- fmt.Errorf("write local secret key: %v", err)
+			if err := writeStep(conn, eciesStepLocalSecret, encryptedLocalSecretKey); err != nil {
+				errCh <- fmt.Errorf("write local secret key: %w", err)
 				return
 			}
 
@@ -85,23 +197,25 @@ func ECIES(privKey *id.PrivKey) Handshake {
 			// pubkey.
 			remoteSecretKey, ok := <-remoteSecretKeyCh
 			if !ok {
+				writeFailed = false
 				return
 			}
-			encryptedRemoteSecretKey, err := ecies.Encrypt(rand.Reader, importedRemotePubKey, remoteSecretKey, nil, nil)
+			encryptedRemoteSecretKey, err := ecies.Encrypt(rand, importedRemotePubKey, remoteSecretKey, nil, nil)
 			if err != nil {
 				errCh <- fmt.Errorf("encrypt remote secret key: %v", err)
 				return
 			}
-			if _, err := conn.Write(encryptedRemoteSecretKey); err != nil {
-				errCh <- fmt.Errorf("write remote secret key: %v", err)
+			if err := writeStep(conn, eciesStepRemoteSecret, encryptedRemoteSecretKey); err != nil {
+				errCh <- fmt.Errorf("write remote secret key: %w", err)
 				return
 			}
+			writeFailed = false
 		}()
 
 		// Read the remote pubkey.
 		remotePubKeyBuf := [64]byte{}
-		if _, err := io.ReadFull(conn, remotePubKeyBuf[:]); err != nil {
-			return nil, nil, id.Signatory{}, fmt.Errorf("read remote pubkey: %v", err)
+		if err := readStep(conn, eciesStepPubKey, remotePubKeyBuf[:]); err != nil {
+			return nil, nil, id.Signatory{}, writeErrOr(errCh, fmt.Errorf("read remote pubkey: %w", err))
 		}
 		remotePubKey := id.PubKey{
 			Curve: crypto.S256(),
@@ -112,8 +226,8 @@ func ECIES(privKey *id.PrivKey) Handshake {
 
 		// Read the encrypted remote secret key, and then decrypt it.
 		encryptedRemoteSecretKey := [sizeOfEncryptedSecretKey]byte{}
-		if _, err := io.ReadFull(conn, encryptedRemoteSecretKey[:]); err != nil {
-			return nil, nil, id.Signatory{}, fmt.Errorf("read remote secret key: %v", err)
+		if err := readStep(conn, eciesStepLocalSecret, encryptedRemoteSecretKey[:]); err != nil {
+			return nil, nil, id.Signatory{}, writeErrOr(errCh, fmt.Errorf("read remote secret key: %w", err))
 		}
 		remoteSecretKey, err := ecies.ImportECDSA((*ecdsa.PrivateKey)(privKey)).Decrypt(encryptedRemoteSecretKey[:], nil, nil)
 		if err != nil {
@@ -125,8 +239,8 @@ func ECIES(privKey *id.PrivKey) Handshake {
 		// proves to the local peer that the remote peer has access to its
 		// previously asserted pubkey.
 		encryptedLocalSecretKeyCheck := [sizeOfEncryptedSecretKey]byte{}
-		if _, err := io.ReadFull(conn, encryptedLocalSecretKeyCheck[:]); err != nil {
-			return nil, nil, id.Signatory{}, fmt.Errorf("read local secret key: %v", err)
+		if err := readStep(conn, eciesStepRemoteSecret, encryptedLocalSecretKeyCheck[:]); err != nil {
+			return nil, nil, id.Signatory{}, writeErrOr(errCh, fmt.Errorf("read local secret key: %w", err))
 		}
 		localSecretKeyCheck, err := ecies.ImportECDSA((*ecdsa.PrivateKey)(privKey)).Decrypt(encryptedLocalSecretKeyCheck[:], nil, nil)
 		if err != nil {
@@ -151,14 +265,48 @@ func ECIES(privKey *id.PrivKey) Handshake {
 
 		self := id.NewSignatory(localPubKey)
 		remote := id.NewSignatory(&remotePubKey)
-		gcmSession, err := codec.NewGCMSession(sessionKey, self, remote)
+		gcmSession, err := codec.NewGCMSessionWithRekeyPolicy(sessionKey, self, remote, opts.RekeyPolicy)
 		if err != nil {
 			return nil, nil, id.Signatory{}, fmt.Errorf("establish gcm session: %v", err)
 		}
+		if opts.SessionObserver != nil {
+			opts.SessionObserver(remote, gcmSession)
+		}
 		return codec.GCMEncoder(gcmSession, enc), codec.GCMDecoder(gcmSession, dec), remote, nil
 	}
 }
 
+// writeFull writes the entire buffer, even if the writer only writes part of the
+// buffer at a time. An error is returned if the writer stops making progress.
+func writeFull(w io.Writer, buf []byte) error {
+	written := 0
+	for written < len(buf) {
+		n, err := w.Write(buf[written:])
+		written += n
+		if err != nil {
+			return fmt.Errorf("wrote %v of %v bytes: %w", written, len(buf), err)
+		}
+		if n == 0 {
+			return fmt.Errorf("wrote %v of %v bytes: %w", written, len(buf), io.ErrShortWrite)
+		}
+	}
+	return nil
+}
+
+// writeErrOr returns the error from the writing goroutine if there is one,
+// because a failed write is usually the reason that reading failed. Otherwise,
+// it returns the given error.
+func writeErrOr(errCh <-chan error, err error) error {
+	select {
+	case writeErr, ok := <-errCh:
+		if ok && writeErr != nil {
+			return writeErr
+		}
+	default:
+	}
+	return err
+}
+
 // paddedTo32 encodes a big integer as a big-endian into a 32-byte array. It
 // will panic if the big integer is more than 32 bytes.
 // Modified from:
@@ -1 +1,205 @@
 package handshake_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// shortWriteConn is a connection that writes at most max bytes per call to
+// Write, without returning an error.
+type shortWriteConn struct {
+	net.Conn
+	max int
+}
+
+func (conn shortWriteConn) Write(buf []byte) (int, error) {
+	if len(buf) > conn.max {
+		buf = buf[:conn.max]
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	return conn.Conn.Write(buf)
+}
+
+var _ = Describe("ECIES", func() {
+	type result struct {
+		remote id.Signatory
+		err    error
+	}
+
+	run := func(privKey *id.PrivKey, conn net.Conn) <-chan result {
+		resultCh := make(chan result, 1)
+		go func() {
+			_, _, remote, err := handshake.ECIES(privKey)(conn, codec.PlainEncoder, codec.PlainDecoder)
+			resultCh <- result{remote: remote, err: err}
+		}()
+		return resultCh
+	}
+
+	Context("when the connection only writes part of the data at a time", func() {
+		It("should write everything and succeed", func() {
+			clientPrivKey := id.NewPrivKey()
+			serverPrivKey := id.NewPrivKey()
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			clientResultCh := run(clientPrivKey, shortWriteConn{Conn: clientConn, max: 1})
+			serverResultCh := run(serverPrivKey, serverConn)
+			clientResult, serverResult := <-clientResultCh, <-serverResultCh
+			Expect(clientResult.err).ToNot(HaveOccurred())
+			Expect(serverResult.err).ToNot(HaveOccurred())
+			Expect(clientResult.remote).To(Equal(serverPrivKey.Signatory()))
+			Expect(serverResult.remote).To(Equal(clientPrivKey.Signatory()))
+		})
+	})
+
+	Context("when the connection stops writing data", func() {
+		It("should return a short write error", func() {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			clientResultCh := run(id.NewPrivKey(), shortWriteConn{Conn: clientConn, max: 0})
+			serverResultCh := run(id.NewPrivKey(), serverConn)
+			clientResult, serverResult := <-clientResultCh, <-serverResultCh
+			Expect(errors.Is(clientResult.err, io.ErrShortWrite)).To(BeTrue())
+			Expect(serverResult.err).To(HaveOccurred())
+		})
+	})
+
+	Context("when observing the established sessions", func() {
+		It("should compute matching fingerprints on both peers", func() {
+			clientPrivKey := id.NewPrivKey()
+			serverPrivKey := id.NewPrivKey()
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			observe := func(privKey *id.PrivKey, conn net.Conn) <-chan string {
+				fingerprintCh := make(chan string, 1)
+				go func() {
+					defer GinkgoRecover()
+					h := handshake.ECIESWithOptions(privKey, handshake.DefaultECIESOptions().WithSessionObserver(func(remote id.Signatory, session *codec.GCMSession) {
+						fingerprintCh <- session.Fingerprint()
+					}))
+					_, _, _, err := h(conn, codec.PlainEncoder, codec.PlainDecoder)
+					Expect(err).ToNot(HaveOccurred())
+				}()
+				return fingerprintCh
+			}
+			clientFingerprintCh := observe(clientPrivKey, clientConn)
+			serverFingerprintCh := observe(serverPrivKey, serverConn)
+
+			var clientFingerprint, serverFingerprint string
+			Eventually(clientFingerprintCh).Should(Receive(&clientFingerprint))
+			Eventually(serverFingerprintCh).Should(Receive(&serverFingerprint))
+			Expect(clientFingerprint).To(HaveLen(32))
+			Expect(clientFingerprint).To(Equal(serverFingerprint))
+		})
+	})
+
+	Context("when using step tags", func() {
+		It("should succeed when both peers send the steps in order", func() {
+			clientPrivKey := id.NewPrivKey()
+			serverPrivKey := id.NewPrivKey()
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			runTagged := func(privKey *id.PrivKey, conn net.Conn) <-chan result {
+				resultCh := make(chan result, 1)
+				go func() {
+					_, _, remote, err := handshake.ECIESWithOptions(privKey, handshake.DefaultECIESOptions().WithStepTags(true))(conn, codec.PlainEncoder, codec.PlainDecoder)
+					resultCh <- result{remote: remote, err: err}
+				}()
+				return resultCh
+			}
+			clientResultCh := runTagged(clientPrivKey, clientConn)
+			serverResultCh := runTagged(serverPrivKey, serverConn)
+			clientResult, serverResult := <-clientResultCh, <-serverResultCh
+			Expect(clientResult.err).ToNot(HaveOccurred())
+			Expect(serverResult.err).ToNot(HaveOccurred())
+			Expect(clientResult.remote).To(Equal(serverPrivKey.Signatory()))
+			Expect(serverResult.remote).To(Equal(clientPrivKey.Signatory()))
+		})
+
+		It("should return an error when the remote peer sends a step out of order", func() {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			// The client ignores everything written by the server, and skips
+			// straight to the last step.
+			go io.Copy(io.Discard, clientConn)
+			go func() {
+				step := make([]byte, 1+145)
+				step[0] = 3
+				clientConn.Write(step)
+			}()
+
+			_, _, _, err := handshake.ECIESWithOptions(id.NewPrivKey(), handshake.DefaultECIESOptions().WithStepTags(true))(serverConn, codec.PlainEncoder, codec.PlainDecoder)
+			Expect(errors.Is(err, handshake.ErrHandshakeOutOfOrder)).To(BeTrue())
+		})
+	})
+
+	Context("when rekeying sessions", func() {
+		It("should exchange data across many key rotations", func() {
+			clientPrivKey := id.NewPrivKey()
+			serverPrivKey := id.NewPrivKey()
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			type session struct {
+				enc codec.Encoder
+				dec codec.Decoder
+			}
+			// The peers use different thresholds, because each peer decides
+			// when to rekey the data that it writes.
+			establish := func(privKey *id.PrivKey, conn net.Conn, maxBytes int) <-chan session {
+				sessionCh := make(chan session, 1)
+				go func() {
+					defer GinkgoRecover()
+					h := handshake.ECIESWithOptions(privKey, handshake.DefaultECIESOptions().WithRekeyPolicy(codec.GCMRekeyPolicy{MaxBytes: maxBytes}))
+					enc, dec, _, err := h(conn, codec.PlainEncoder, codec.PlainDecoder)
+					Expect(err).ToNot(HaveOccurred())
+					enc, dec = codec.LengthPrefixFramer(enc, dec)
+					sessionCh <- session{enc: enc, dec: dec}
+				}()
+				return sessionCh
+			}
+			clientCh := establish(clientPrivKey, clientConn, 64)
+			serverCh := establish(serverPrivKey, serverConn, 100)
+			client, server := <-clientCh, <-serverCh
+
+			exchange := func(from, to session, fromConn, toConn net.Conn) {
+				go func() {
+					defer GinkgoRecover()
+					for i := 0; i < 50; i++ {
+						_, err := from.enc(fromConn, []byte(fmt.Sprintf("message %v", i)))
+						Expect(err).ToNot(HaveOccurred())
+					}
+				}()
+				buf := make([]byte, 1024)
+				for i := 0; i < 50; i++ {
+					n, err := to.dec(toConn, buf)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(string(buf[:n])).To(Equal(fmt.Sprintf("message %v", i)))
+				}
+			}
+			exchange(client, server, clientConn, serverConn)
+			exchange(server, client, serverConn, clientConn)
+		})
+	})
+})
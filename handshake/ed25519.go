@@ -0,0 +1,179 @@
+package handshake
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/id"
+)
+
+// ed25519SignatureDomain is prepended to the ephemeral public key before it is
+// signed, so that handshake signatures cannot be confused with signatures made
+// by the same key for other purposes.
+const ed25519SignatureDomain = "aw/handshake/ed25519"
+
+// sizeOfSignedEphemeralKey is the size of the Ed25519 public key, followed by
+// the ephemeral public key, followed by the signature of the ephemeral public
+// key.
+const sizeOfSignedEphemeralKey = ed25519.PublicKeySize + 64 + ed25519.SignatureSize
+
+// Ed25519Signatory returns the signatory of an Ed25519 public key. Like
+// id.NewSignatory, it is the SHA256 hash of the public key, so signatories of
+// Ed25519 and ECDSA peers can be used together in the same table.
+func Ed25519Signatory(pubKey ed25519.PublicKey) id.Signatory {
+	return id.Signatory(sha256.Sum256(pubKey))
+}
+
+// Ed25519 returns a Handshake for peers that are identified by Ed25519 keys. It
+// follows the same steps as ECIES, but because Ed25519 keys cannot be used for
+// encryption, each peer generates an ephemeral secp256k1 key, and signs it
+// using its Ed25519 key:
+//
+//  1. Write the Ed25519 public key, and the signed ephemeral public key.
+//  2. Read, and verify, the signed ephemeral public key of the remote peer.
+//  3. Exchange secret keys, encrypted using the ephemeral public keys.
+//  4. XOR the secret keys to build the key of the GCM session.
+//
+// Use Filter to accept, or reject, remote peers by their signatory.
+func Ed25519(privKey ed25519.PrivateKey) Handshake {
+	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		localPubKey := privKey.Public().(ed25519.PublicKey)
+		ephemeralPrivKey := id.NewPrivKey()
+		ephemeralPubKey := ephemeralPrivKey.PubKey()
+
+		localSecretKey := [sizeOfSecretKey]byte{}
+		if _, err := io.ReadFull(cryptorand.Reader, localSecretKey[:]); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("generate local secret key: %v", err)
+		}
+
+		// Channel for passing errors from the writing goroutine to the reading
+		// goroutine (which has the ability to return the error).
+		errCh := make(chan error, 1)
+
+		// Channel for passing the ephemeral public key of the remote peer to
+		// the writing goroutine.
+		remoteEphemeralPubKeyCh := make(chan id.PubKey, 1)
+		defer close(remoteEphemeralPubKeyCh)
+
+		go func() {
+			defer close(errCh)
+
+			// If writing fails, the remote peer will never respond, so the
+			// connection is closed to stop the reading goroutine from
+			// blocking forever.
+			writeFailed := true
+			defer func() {
+				if writeFailed {
+					conn.Close()
+				}
+			}()
+
+			// Write the local public key, and the signed ephemeral public key.
+			xBuf := paddedTo32(ephemeralPubKey.X)
+			yBuf := paddedTo32(ephemeralPubKey.Y)
+			signed := make([]byte, 0, sizeOfSignedEphemeralKey)
+			signed = append(signed, localPubKey...)
+			signed = append(signed, xBuf[:]...)
+			signed = append(signed, yBuf[:]...)
+			signed = append(signed, ed25519.Sign(privKey, ed25519Message(xBuf, yBuf))...)
+			if err := writeFull(conn, signed); err != nil {
+				errCh <- fmt.Errorf("write signed ephemeral pubkey: %w", err)
+				return
+			}
+
+			// Encrypt the local secret key using the ephemeral public key of
+			// the remote peer, and write it to the remote peer.
+			remoteEphemeralPubKey, ok := <-remoteEphemeralPubKeyCh
+			if !ok {
+				writeFailed = false
+				return
+			}
+			importedRemotePubKey := ecies.ImportECDSAPublic((*ecdsa.PublicKey)(&remoteEphemeralPubKey))
+			encryptedLocalSecretKey, err := ecies.Encrypt(cryptorand.Reader, importedRemotePubKey, localSecretKey[:], nil, nil)
+			if err != nil {
+				errCh <- fmt.Errorf("encrypt local secret key: %v", err)
+				return
+			}
+			if err := writeFull(conn, encryptedLocalSecretKey); err != nil {
+				errCh <- fmt.Errorf("write local secret key: %w", err)
+				return
+			}
+			writeFailed = false
+		}()
+
+		// Read, and verify, the signed ephemeral public key of the remote
+		// peer.
+		signed := [sizeOfSignedEphemeralKey]byte{}
+		if _, err := io.ReadFull(conn, signed[:]); err != nil {
+			return nil, nil, id.Signatory{}, writeErrOr(errCh, fmt.Errorf("read signed ephemeral pubkey: %v", err))
+		}
+		remotePubKey := ed25519.PublicKey(signed[:ed25519.PublicKeySize])
+		xBuf, yBuf := [32]byte{}, [32]byte{}
+		copy(xBuf[:], signed[ed25519.PublicKeySize:])
+		copy(yBuf[:], signed[ed25519.PublicKeySize+32:])
+		if !ed25519.Verify(remotePubKey, ed25519Message(xBuf, yBuf), signed[ed25519.PublicKeySize+64:]) {
+			return nil, nil, id.Signatory{}, fmt.Errorf("verify ephemeral pubkey: bad signature")
+		}
+		remoteEphemeralPubKey := id.PubKey{
+			Curve: crypto.S256(),
+			X:     new(big.Int).SetBytes(xBuf[:]),
+			Y:     new(big.Int).SetBytes(yBuf[:]),
+		}
+		if !remoteEphemeralPubKey.Curve.IsOnCurve(remoteEphemeralPubKey.X, remoteEphemeralPubKey.Y) {
+			return nil, nil, id.Signatory{}, fmt.Errorf("verify ephemeral pubkey: not on curve")
+		}
+		remoteEphemeralPubKeyCh <- remoteEphemeralPubKey
+
+		// Read the encrypted remote secret key, and then decrypt it using the
+		// ephemeral private key.
+		encryptedRemoteSecretKey := [sizeOfEncryptedSecretKey]byte{}
+		if _, err := io.ReadFull(conn, encryptedRemoteSecretKey[:]); err != nil {
+			return nil, nil, id.Signatory{}, writeErrOr(errCh, fmt.Errorf("read remote secret key: %v", err))
+		}
+		remoteSecretKey, err := ecies.ImportECDSA((*ecdsa.PrivateKey)(ephemeralPrivKey)).Decrypt(encryptedRemoteSecretKey[:], nil, nil)
+		if err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("decrypt remote secret key: %v", err)
+		}
+		if len(remoteSecretKey) != sizeOfSecretKey {
+			return nil, nil, id.Signatory{}, fmt.Errorf("decrypt remote secret key: expected %v bytes, got %v bytes", sizeOfSecretKey, len(remoteSecretKey))
+		}
+
+		// Check whether or not that an error happened in the writing goroutine
+		// (and wait for the writing goroutine to end).
+		if err, ok := <-errCh; ok {
+			return nil, nil, id.Signatory{}, err
+		}
+
+		// Build the session key, and use this to build GCM encoders/decoders.
+		sessionKey := [sizeOfSecretKey]byte{}
+		for i := 0; i < sizeOfSecretKey; i++ {
+			sessionKey[i] = localSecretKey[i] ^ remoteSecretKey[i]
+		}
+
+		self := Ed25519Signatory(localPubKey)
+		remote := Ed25519Signatory(remotePubKey)
+		gcmSession, err := codec.NewGCMSession(sessionKey, self, remote)
+		if err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("establish gcm session: %v", err)
+		}
+		return codec.GCMEncoder(gcmSession, enc), codec.GCMDecoder(gcmSession, dec), remote, nil
+	}
+}
+
+// ed25519Message returns the message that is signed to prove ownership of an
+// ephemeral public key.
+func ed25519Message(x, y [32]byte) []byte {
+	msg := make([]byte, 0, len(ed25519SignatureDomain)+64)
+	msg = append(msg, ed25519SignatureDomain...)
+	msg = append(msg, x[:]...)
+	return append(msg, y[:]...)
+}
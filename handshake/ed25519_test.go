@@ -0,0 +1,63 @@
+package handshake_test
+
+import (
+	"crypto/ed25519"
+	"net"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Ed25519", func() {
+	type result struct {
+		enc    codec.Encoder
+		dec    codec.Decoder
+		remote id.Signatory
+		err    error
+	}
+
+	run := func(h handshake.Handshake, conn net.Conn) <-chan result {
+		resultCh := make(chan result, 1)
+		go func() {
+			enc, dec, remote, err := h(conn, codec.PlainEncoder, codec.PlainDecoder)
+			resultCh <- result{enc: enc, dec: dec, remote: remote, err: err}
+		}()
+		return resultCh
+	}
+
+	Context("when both peers use Ed25519 keys", func() {
+		It("should establish a session and identify the remote peers", func() {
+			clientPubKey, clientPrivKey, err := ed25519.GenerateKey(nil)
+			Expect(err).ToNot(HaveOccurred())
+			serverPubKey, serverPrivKey, err := ed25519.GenerateKey(nil)
+			Expect(err).ToNot(HaveOccurred())
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			clientResultCh := run(handshake.Ed25519(clientPrivKey), clientConn)
+			serverResultCh := run(handshake.Ed25519(serverPrivKey), serverConn)
+			clientResult, serverResult := <-clientResultCh, <-serverResultCh
+			Expect(clientResult.err).ToNot(HaveOccurred())
+			Expect(serverResult.err).ToNot(HaveOccurred())
+			Expect(clientResult.remote).To(Equal(handshake.Ed25519Signatory(serverPubKey)))
+			Expect(serverResult.remote).To(Equal(handshake.Ed25519Signatory(clientPubKey)))
+
+			// The session keys must match, so that data encrypted by one peer
+			// can be decrypted by the other.
+			go func() {
+				defer GinkgoRecover()
+				_, err := codec.LengthPrefixEncoder(codec.PlainEncoder, clientResult.enc)(clientConn, []byte("hello"))
+				Expect(err).ToNot(HaveOccurred())
+			}()
+			buf := make([]byte, 1024)
+			n, err := codec.LengthPrefixDecoder(codec.PlainDecoder, serverResult.dec)(serverConn, buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("hello"))
+		})
+	})
+})
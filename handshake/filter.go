@@ -1,8 +1,10 @@
 package handshake
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 
 	"github.com/renproject/aw/codec"
 	"github.com/renproject/id"
@@ -21,8 +23,88 @@ func Filter(f func(id.Signatory) error, h Handshake) Handshake {
 			return enc, dec, remote, err
 		}
 		if err := f(remote); err != nil {
-			return enc, dec, remote, fmt.Errorf("filter %v: %v", remote, err)
+			return enc, dec, remote, fmt.Errorf("filter %v: %w", remote, err)
 		}
 		return enc, dec, remote, nil
 	}
 }
+
+// ErrDenied is returned by DynamicFilter.Check when a remote peer is not
+// allowed to complete the handshake.
+var ErrDenied = errors.New("denied")
+
+// A DynamicFilter decides which remote peers are allowed to complete the
+// handshake, and can be changed while it is in use. Remote peers that have
+// been explicitly allowed, or denied, are filtered accordingly. All other
+// remote peers are filtered using the default. A DynamicFilter that denies by
+// default acts as a whitelist, and one that allows by default acts as a
+// blacklist. It is safe for concurrent use.
+//
+// Use DynamicFilter.Check with Filter to build a Handshake that respects the
+// DynamicFilter. The DynamicFilter is checked once the rest of the handshake
+// has completed, so changes made while a handshake is in progress are
+// respected.
+type DynamicFilter struct {
+	allowByDefault bool
+
+	decisionsMu *sync.RWMutex
+	decisions   map[id.Signatory]bool
+}
+
+// NewDynamicFilter returns a DynamicFilter that allows, or denies, remote peers
+// by default.
+func NewDynamicFilter(allowByDefault bool) *DynamicFilter {
+	return &DynamicFilter{
+		allowByDefault: allowByDefault,
+
+		decisionsMu: new(sync.RWMutex),
+		decisions:   map[id.Signatory]bool{},
+	}
+}
+
+// Allow the remote peer to complete the handshake. This overrides any previous
+// call to Deny for the remote peer.
+func (f *DynamicFilter) Allow(remote id.Signatory) {
+	f.decisionsMu.Lock()
+	defer f.decisionsMu.Unlock()
+
+	f.decisions[remote] = true
+}
+
+// Deny the remote peer from completing the handshake. This overrides any
+// previous call to Allow for the remote peer.
+func (f *DynamicFilter) Deny(remote id.Signatory) {
+	f.decisionsMu.Lock()
+	defer f.decisionsMu.Unlock()
+
+	f.decisions[remote] = false
+}
+
+// Forget any previous call to Allow, or Deny, for the remote peer, so that it
+// is filtered using the default.
+func (f *DynamicFilter) Forget(remote id.Signatory) {
+	f.decisionsMu.Lock()
+	defer f.decisionsMu.Unlock()
+
+	delete(f.decisions, remote)
+}
+
+// Filter returns true if the remote peer is allowed to complete the handshake.
+func (f *DynamicFilter) Filter(remote id.Signatory) bool {
+	f.decisionsMu.RLock()
+	defer f.decisionsMu.RUnlock()
+
+	if allowed, ok := f.decisions[remote]; ok {
+		return allowed
+	}
+	return f.allowByDefault
+}
+
+// Check returns ErrDenied if the remote peer is not allowed to complete the
+// handshake. It can be passed to Filter.
+func (f *DynamicFilter) Check(remote id.Signatory) error {
+	if !f.Filter(remote) {
+		return ErrDenied
+	}
+	return nil
+}
@@ -1 +1,71 @@
 package handshake_test
+
+import (
+	"errors"
+	"net"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DynamicFilter", func() {
+	Context("when denying by default", func() {
+		It("should only allow remote peers that have been allowed", func() {
+			f := handshake.NewDynamicFilter(false)
+			allowed := id.NewPrivKey().Signatory()
+			f.Allow(allowed)
+			Expect(f.Filter(allowed)).To(BeTrue())
+			Expect(f.Filter(id.NewPrivKey().Signatory())).To(BeFalse())
+
+			f.Forget(allowed)
+			Expect(f.Filter(allowed)).To(BeFalse())
+		})
+	})
+
+	Context("when allowing by default", func() {
+		It("should allow all remote peers that have not been denied", func() {
+			f := handshake.NewDynamicFilter(true)
+			denied := id.NewPrivKey().Signatory()
+			f.Deny(denied)
+			Expect(f.Filter(denied)).To(BeFalse())
+			Expect(errors.Is(f.Check(denied), handshake.ErrDenied)).To(BeTrue())
+			Expect(f.Filter(id.NewPrivKey().Signatory())).To(BeTrue())
+
+			// Allowing a denied remote peer does not deny anyone else.
+			f.Allow(denied)
+			Expect(f.Filter(denied)).To(BeTrue())
+			Expect(f.Filter(id.NewPrivKey().Signatory())).To(BeTrue())
+		})
+	})
+
+	Context("when changing the filter at runtime", func() {
+		It("should be respected by future handshakes", func() {
+			clientPrivKey := id.NewPrivKey()
+			serverPrivKey := id.NewPrivKey()
+			f := handshake.NewDynamicFilter(true)
+
+			handshakeOnce := func() error {
+				clientConn, serverConn := net.Pipe()
+				defer clientConn.Close()
+				defer serverConn.Close()
+
+				go handshake.ECIES(clientPrivKey)(clientConn, codec.PlainEncoder, codec.PlainDecoder)
+				_, _, _, err := handshake.Filter(f.Check, handshake.ECIES(serverPrivKey))(serverConn, codec.PlainEncoder, codec.PlainDecoder)
+				return err
+			}
+
+			Expect(handshakeOnce()).To(Succeed())
+
+			f.Deny(clientPrivKey.Signatory())
+			err := handshakeOnce()
+			Expect(errors.Is(err, handshake.ErrDenied)).To(BeTrue())
+
+			f.Allow(clientPrivKey.Signatory())
+			Expect(handshakeOnce()).To(Succeed())
+		})
+	})
+})
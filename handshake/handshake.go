@@ -1,6 +1,7 @@
 package handshake
 
 import (
+	"errors"
 	"fmt"
 	"net"
 
@@ -15,6 +16,10 @@ const encryptionHeaderSize = 113
 // encryptedKeySize specifiec the size in bytes of a single key encrypted using ECIES
 const encryptedKeySize = encryptionHeaderSize + keySize
 
+// ErrHandshakeOutOfOrder is returned when a remote peer sends a handshake
+// message for a different step than the one that is expected.
+var ErrHandshakeOutOfOrder = errors.New("handshake message out of order")
+
 // Handshake functions accept a connection, an encoder, and decoder. The encoder
 // and decoder are used to establish an authenticated and encrypted connection.
 // A new encoder and decoder are returned, which wrap the accpted encoder and
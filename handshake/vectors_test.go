@@ -0,0 +1,188 @@
+package handshake_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// detReader is a deterministic source of "randomness". It produces the stream
+// SHA256(seed || 0) || SHA256(seed || 1) || ...
+type detReader struct {
+	seed    []byte
+	counter uint64
+	buf     []byte
+}
+
+func (r *detReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			counterBuf := [8]byte{}
+			binary.BigEndian.PutUint64(counterBuf[:], r.counter)
+			r.counter++
+			block := sha256.Sum256(append(append([]byte{}, r.seed...), counterBuf[:]...))
+			r.buf = block[:]
+		}
+		m := copy(p[n:], r.buf)
+		r.buf = r.buf[m:]
+		n += m
+	}
+	return n, nil
+}
+
+// recordingConn records all bytes that are written to the connection.
+type recordingConn struct {
+	net.Conn
+
+	mu      *sync.Mutex
+	written *bytes.Buffer
+}
+
+func (conn recordingConn) Write(buf []byte) (int, error) {
+	n, err := conn.Conn.Write(buf)
+	conn.mu.Lock()
+	conn.written.Write(buf[:n])
+	conn.mu.Unlock()
+	return n, err
+}
+
+func (conn recordingConn) Bytes() []byte {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return append([]byte{}, conn.written.Bytes()...)
+}
+
+func fixedPrivKey(b byte) *id.PrivKey {
+	privKey, err := crypto.ToECDSA(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		panic(err)
+	}
+	return (*id.PrivKey)(privKey)
+}
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// eciesVectors are the bytes written by each peer, at each step of the ECIES
+// handshake, when using fixedPrivKey(0x01) and the seed "client" for the
+// dialing peer, and fixedPrivKey(0x02) and the seed "server" for the accepting
+// peer. If these change, then the handshake is no longer compatible with
+// previous versions.
+var eciesVectors = struct {
+	clientPubKey, clientLocalSecret, clientRemoteSecret, clientSealedHello []byte
+	serverPubKey, serverLocalSecret, serverRemoteSecret                    []byte
+}{
+	clientPubKey: unhex(
+		"1b84c5567b126440995d3ed5aaba0565d71e1834604819ff9c17f5e9d5dd078f" +
+			"70beaf8f588b541507fed6a642c5ab42dfdf8120a7f639de5122d47a69a8e8d1"),
+	clientLocalSecret: unhex(
+		"049e3aa1233346fe415276e60d68d9ade3ec5ae82b84806bf6aa1bcd1e0238d3" +
+			"50b15da8e74f5842033c3836917d90de638e26f43ecd23b39ecae959f7799301" +
+			"2d280efac97535e67a226f022bd1eab3825baeeafcfdff5c39e728f829442d19" +
+			"74c124c4fd47a2bacacdcb88eb560fe88d8e2dbd38bf0916447023141ad3d822" +
+			"fc59227beb51bebf1ea03c3c5682f53586"),
+	clientRemoteSecret: unhex(
+		"048049376a2b879743185c029c6626892691db372784dcc3fbf60a0f2090b0d3" +
+			"fbb1159dfcaa8a2c060c57d32e0a366c7a5c1a3f6eeda4fffe8cd404cc147b4b" +
+			"8b80369df6d955a447ef833ec1f75b24d01d0331a5674a8c56624859699094b3" +
+			"067002f18b584e6acee5f38780853e242c1f9d7e69b16353dc8a94601a89d4da" +
+			"be67c1eb0241414d1ca80d1fea495a3f34"),
+	clientSealedHello: unhex(
+		"8441dafc0228efbb2293da5dd98bb0273d9310c04a"),
+	serverPubKey: unhex(
+		"4d4b6cd1361032ca9bd2aeb9d900aa4d45d9ead80ac9423374c451a7254d0766" +
+			"2a3eada2d0fe208b6d257ceb0f064284662e857f57b66b54c198bd310ded36d0"),
+	serverLocalSecret: unhex(
+		"042f98e7b865bdac38edb19110e5463c72391361d8a275acd9429aa38ff81209" +
+			"07b926fe13e246e0973adbb7a5fcae6e1d1bf8c9d25018971efb03ddd83232fc" +
+			"ff734a7d6d45ee5bb639e08bb7d648e299abb91a6fa631e372b010319f48bdb5" +
+			"777f2caa81899f063fc50b7728f467ea5619cc56365d76220e730c13c83633c9" +
+			"813b700d5082082af6e0dc7c35125269be"),
+	serverRemoteSecret: unhex(
+		"04c02f1fd7d3b00c6034937b25171f82dc111dad9041cdcb8a5f5143862c9820" +
+			"9819bcf671c2572e2726b293bf778f0fd513466928bbd52d229d6108cc354bca" +
+			"84f2f70ebc030909560e3949c2ad60711611e46932973ce582e8eb8d4cae7cde" +
+			"8201d81138814195e5c86f61a1482e417f902a25c5176cdfdac91db4b3b709d2" +
+			"03050d41239cf6b312632ae155ff77d0bb"),
+}
+
+var _ = Describe("Handshake test vectors", func() {
+	Context("when running the ECIES handshake with fixed keys and randomness", func() {
+		It("should produce the recorded bytes at every step", func() {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+			client := recordingConn{Conn: clientConn, mu: new(sync.Mutex), written: new(bytes.Buffer)}
+			server := recordingConn{Conn: serverConn, mu: new(sync.Mutex), written: new(bytes.Buffer)}
+
+			type result struct {
+				enc codec.Encoder
+				dec codec.Decoder
+				err error
+			}
+			run := func(privKey *id.PrivKey, seed string, conn net.Conn) <-chan result {
+				resultCh := make(chan result, 1)
+				go func() {
+					h := handshake.ECIESWithOptions(privKey, handshake.DefaultECIESOptions().WithRand(&detReader{seed: []byte(seed)}))
+					enc, dec, _, err := h(conn, codec.PlainEncoder, codec.PlainDecoder)
+					resultCh <- result{enc: enc, dec: dec, err: err}
+				}()
+				return resultCh
+			}
+			clientResultCh := run(fixedPrivKey(0x01), "client", client)
+			serverResultCh := run(fixedPrivKey(0x02), "server", server)
+			clientResult, serverResult := <-clientResultCh, <-serverResultCh
+			Expect(clientResult.err).ToNot(HaveOccurred())
+			Expect(serverResult.err).ToNot(HaveOccurred())
+
+			// Send a message over the established session, so that the session
+			// key is also covered by the vectors.
+			encErrCh := make(chan error, 1)
+			go func() {
+				_, err := clientResult.enc(client, []byte("hello"))
+				encErrCh <- err
+			}()
+			buf := make([]byte, 5, 5+16)
+			n, err := serverResult.dec(server, buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("hello"))
+			Expect(<-encErrCh).ToNot(HaveOccurred())
+
+			clientBytes, serverBytes := client.Bytes(), server.Bytes()
+			Expect(clientBytes).To(HaveLen(64 + 145 + 145 + 21))
+			Expect(serverBytes).To(HaveLen(64 + 145 + 145))
+
+			By("writing the public key")
+			Expect(clientBytes[:64]).To(Equal(eciesVectors.clientPubKey))
+			Expect(serverBytes[:64]).To(Equal(eciesVectors.serverPubKey))
+
+			By("writing the encrypted local secret key")
+			Expect(clientBytes[64:209]).To(Equal(eciesVectors.clientLocalSecret))
+			Expect(serverBytes[64:209]).To(Equal(eciesVectors.serverLocalSecret))
+
+			By("writing the encrypted remote secret key")
+			Expect(clientBytes[209:354]).To(Equal(eciesVectors.clientRemoteSecret))
+			Expect(serverBytes[209:354]).To(Equal(eciesVectors.serverRemoteSecret))
+
+			By("sealing messages using the session key")
+			Expect(clientBytes[354:]).To(Equal(eciesVectors.clientSealedHello))
+		})
+	})
+})
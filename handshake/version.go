@@ -0,0 +1,94 @@
+package handshake
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/id"
+)
+
+// Version is the current version of the handshake protocol. It is the version
+// of the Handshake returned by ECIES, when it is wrapped using Versioned.
+const Version = uint8(1)
+
+// ErrUnsupportedVersion is returned when two peers do not support a common
+// version of the handshake protocol.
+var ErrUnsupportedVersion = errors.New("unsupported handshake version")
+
+// Versioned accepts Handshake functions for each supported version of the
+// handshake protocol, and returns a wrapping Handshake function. Before doing
+// anything else, both peers exchange the versions that they support, and then
+// run the Handshake for the highest version supported by both of them. If
+// there is no such version, then an error wrapping ErrUnsupportedVersion is
+// returned. This allows the handshake protocol to be changed without breaking
+// compatibility with peers that have not yet upgraded.
+//
+// Both peers must use Versioned, otherwise the handshake will fail. As such,
+// Versioned is the wrapper that should be used around every Handshake that is
+// given to a Transport, even if only one version is supported, so that another
+// version can be added later. Networks that use an unwrapped Handshake must
+// switch all of their peers to Versioned at once. See aw.NewHandshake for the
+// default versioned Handshake.
+func Versioned(handshakes map[uint8]Handshake) Handshake {
+	local := make([]byte, 0, len(handshakes))
+	for version := range handshakes {
+		local = append(local, version)
+	}
+	sort.Slice(local, func(i, j int) bool { return local[i] < local[j] })
+
+	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		if len(local) == 0 {
+			return nil, nil, id.Signatory{}, fmt.Errorf("%w: no local versions", ErrUnsupportedVersion)
+		}
+
+		// Write the local versions in the background, so that both peers can
+		// write at the same time without blocking each other.
+		errCh := make(chan error, 1)
+		go func() {
+			defer close(errCh)
+			if _, err := enc(conn, []byte{uint8(len(local))}); err != nil {
+				errCh <- fmt.Errorf("encoding local version count: %v", err)
+				return
+			}
+			if _, err := enc(conn, local); err != nil {
+				errCh <- fmt.Errorf("encoding local versions: %v", err)
+				return
+			}
+		}()
+
+		// The decoders used during handshakes can require the buffer to have
+		// additional capacity (for example, for authentication tags).
+		buf := make([]byte, 1, 256+64)
+		if _, err := dec(conn, buf); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("decoding remote version count: %v", err)
+		}
+		count := int(buf[0])
+		if count == 0 {
+			return nil, nil, id.Signatory{}, fmt.Errorf("%w: no remote versions", ErrUnsupportedVersion)
+		}
+		n, err := dec(conn, buf[:count])
+		if err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("decoding remote versions: %v", err)
+		}
+		remote := buf[:n]
+		if err := <-errCh; err != nil {
+			return nil, nil, id.Signatory{}, err
+		}
+
+		// Both peers pick the highest common version, so they always agree.
+		found := false
+		version := uint8(0)
+		for _, v := range remote {
+			if _, ok := handshakes[v]; ok && (!found || v > version) {
+				found, version = true, v
+			}
+		}
+		if !found {
+			return nil, nil, id.Signatory{}, fmt.Errorf("%w: local %v, remote %v", ErrUnsupportedVersion, local, remote)
+		}
+		return handshakes[version](conn, enc, dec)
+	}
+}
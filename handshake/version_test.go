@@ -0,0 +1,77 @@
+package handshake_test
+
+import (
+	"errors"
+	"net"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Versioned", func() {
+	type result struct {
+		version uint8
+		remote  id.Signatory
+		err     error
+	}
+
+	run := func(privKey *id.PrivKey, versions []uint8, conn net.Conn) <-chan result {
+		resultCh := make(chan result, 1)
+		go func() {
+			res := result{}
+			handshakes := map[uint8]handshake.Handshake{}
+			for _, version := range versions {
+				version := version
+				ecies := handshake.ECIES(privKey)
+				handshakes[version] = func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+					res.version = version
+					return ecies(conn, enc, dec)
+				}
+			}
+			_, _, res.remote, res.err = handshake.Versioned(handshakes)(conn, codec.PlainEncoder, codec.PlainDecoder)
+			resultCh <- res
+		}()
+		return resultCh
+	}
+
+	Context("when both peers support common versions", func() {
+		It("should use the highest common version", func() {
+			clientPrivKey := id.NewPrivKey()
+			serverPrivKey := id.NewPrivKey()
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			clientResultCh := run(clientPrivKey, []uint8{handshake.Version, 2, 4}, clientConn)
+			serverResultCh := run(serverPrivKey, []uint8{handshake.Version, 2, 3}, serverConn)
+			clientResult, serverResult := <-clientResultCh, <-serverResultCh
+			Expect(clientResult.err).ToNot(HaveOccurred())
+			Expect(serverResult.err).ToNot(HaveOccurred())
+
+			Expect(clientResult.version).To(Equal(uint8(2)))
+			Expect(serverResult.version).To(Equal(uint8(2)))
+			Expect(clientResult.remote).To(Equal(serverPrivKey.Signatory()))
+			Expect(serverResult.remote).To(Equal(clientPrivKey.Signatory()))
+		})
+	})
+
+	Context("when the peers do not support a common version", func() {
+		It("should return an error", func() {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			clientResultCh := run(id.NewPrivKey(), []uint8{handshake.Version}, clientConn)
+			serverResultCh := run(id.NewPrivKey(), []uint8{handshake.Version + 1}, serverConn)
+			clientResult, serverResult := <-clientResultCh, <-serverResultCh
+			Expect(errors.Is(clientResult.err, handshake.ErrUnsupportedVersion)).To(BeTrue())
+			Expect(errors.Is(serverResult.err, handshake.ErrUnsupportedVersion)).To(BeTrue())
+			Expect(clientResult.version).To(BeZero())
+			Expect(serverResult.version).To(BeZero())
+		})
+	})
+})
@@ -0,0 +1,44 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/transport"
+)
+
+// IsTransient returns whether or not an error, returned when sending to a
+// remote peer, is likely to go away if the send is retried. Timeouts (including
+// waiting for space in a full outbound queue, and streams that stop receiving
+// chunks), and network connections that are reset while a stream is being read
+// from them, are transient. Errors that will happen again, such as an unknown
+// peer, content that is too large, or a peer that is shutting down, are not.
+// Unrecognised errors are not considered transient.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch {
+	case errors.Is(err, ErrPeerNotFound),
+		errors.Is(err, transport.ErrSelfConnection),
+		errors.Is(err, ErrContentTooLarge),
+		errors.Is(err, codec.ErrMessageTooLarge),
+		errors.Is(err, ErrShuttingDown),
+		errors.Is(err, context.Canceled):
+		return false
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, ErrStreamTimeout),
+		errors.Is(err, syscall.ECONNRESET):
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return false
+}
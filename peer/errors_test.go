@@ -0,0 +1,162 @@
+package peer_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/peer"
+	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Errors", func() {
+	Context("when classifying errors", func() {
+		It("should only consider errors that might go away to be transient", func() {
+			timeout := &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}
+			transient := []error{
+				context.DeadlineExceeded,
+				fmt.Errorf("sending message %w", context.DeadlineExceeded),
+				fmt.Errorf("read: %w", syscall.ECONNRESET),
+				timeout,
+				peer.ErrStreamTimeout,
+			}
+			for _, err := range transient {
+				Expect(peer.IsTransient(err)).To(BeTrue(), err.Error())
+			}
+
+			permanent := []error{
+				nil,
+				context.Canceled,
+				fmt.Errorf("%w: %v", transport.ErrPeerNotFound, id.Signatory{}),
+				transport.ErrSelfConnection,
+				peer.ErrContentTooLarge,
+				fmt.Errorf("decoding data length: %w", codec.ErrMessageTooLarge),
+				peer.ErrShuttingDown,
+				errors.New("unknown"),
+			}
+			for _, err := range permanent {
+				Expect(peer.IsTransient(err)).To(BeFalse(), fmt.Sprintf("%v", err))
+			}
+		})
+
+		It("should classify the errors returned when sending", func() {
+			_, peers, _, _, _, _ := setup(1)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			err := peers[0].Send(ctx, id.NewPrivKey().Signatory(), wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("unknown")})
+			Expect(errors.Is(err, peer.ErrPeerNotFound)).To(BeTrue())
+			Expect(peer.IsTransient(err)).To(BeFalse())
+
+			Expect(peers[0].Shutdown(ctx)).To(Succeed())
+			err = peers[0].Send(ctx, id.NewPrivKey().Signatory(), wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("shut down")})
+			Expect(errors.Is(err, peer.ErrShuttingDown)).To(BeTrue())
+			Expect(peer.IsTransient(err)).To(BeFalse())
+		})
+
+		It("should consider a full outbound queue to be transient", func() {
+			_, peers, tables, _, _, _ := setup(1)
+
+			// The remote peer cannot be reached, so nothing is ever taken from
+			// the outbound queue.
+			remote := id.NewPrivKey().Signatory()
+			tables[0].AddPeer(remote, wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:1", uint64(time.Now().UnixNano())))
+			var err error
+			Eventually(func() error {
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				defer cancel()
+				err = peers[0].Send(ctx, remote, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("full")})
+				return err
+			}).Should(HaveOccurred())
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+			Expect(peer.IsTransient(err)).To(BeTrue())
+		})
+
+		It("should consider streams that time out to be transient", func() {
+			n := 2
+			opts, peers, tables, _, _, transports := setup(n)
+			receiver := peer.New(opts[1].WithStreamerOptions(opts[1].StreamerOptions.WithTimeout(100*time.Millisecond)), transports[1])
+			peers[1] = receiver
+
+			cancelPeerContext := createRingTopology(n, opts, peers, tables, transports)
+			defer cancelPeerContext()
+
+			errs := make(chan error, 1)
+			receiver.ReceiveStreams(func(from id.Signatory, r io.Reader) {
+				_, err := io.ReadAll(r)
+				errs <- err
+			})
+
+			// The sender sends one chunk, and then stops.
+			r, w := io.Pipe()
+			defer w.Close()
+			go w.Write(make([]byte, opts[0].StreamerOptions.ChunkSize))
+			go peers[0].SendStream(context.Background(), receiver.ID(), r)
+
+			var err error
+			Eventually(errs, 5*time.Second).Should(Receive(&err))
+			Expect(errors.Is(err, peer.ErrStreamTimeout)).To(BeTrue())
+			Expect(peer.IsTransient(err)).To(BeTrue())
+		})
+
+		It("should consider network connections that are reset, or time out, while streaming from them to be transient", func() {
+			_, peers, _, _, _, _ := setup(1)
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close()
+			accepted := make(chan net.Conn, 2)
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					accepted <- conn
+				}
+			}()
+
+			// The connection is reset by the remote end while it is being
+			// streamed from.
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			var remoteConn net.Conn
+			Eventually(accepted).Should(Receive(&remoteConn))
+			Expect(remoteConn.(*net.TCPConn).SetLinger(0)).To(Succeed())
+			Expect(remoteConn.Close()).To(Succeed())
+			err = peers[0].SendStream(context.Background(), id.NewPrivKey().Signatory(), conn)
+			Expect(errors.Is(err, syscall.ECONNRESET)).To(BeTrue(), fmt.Sprintf("%v", err))
+			Expect(peer.IsTransient(err)).To(BeTrue())
+
+			// The connection times out while it is being streamed from.
+			conn, err = net.Dial("tcp", listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			Eventually(accepted).Should(Receive(&remoteConn))
+			defer remoteConn.Close()
+			Expect(conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))).To(Succeed())
+			err = peers[0].SendStream(context.Background(), id.NewPrivKey().Signatory(), conn)
+			var netErr net.Error
+			Expect(errors.As(err, &netErr)).To(BeTrue(), fmt.Sprintf("%v", err))
+			Expect(netErr.Timeout()).To(BeTrue())
+			Expect(peer.IsTransient(err)).To(BeTrue())
+		})
+	})
+})
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
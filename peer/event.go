@@ -0,0 +1,165 @@
+package peer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/renproject/id"
+)
+
+// EventType distinguishes the different kinds of events that are emitted by a
+// peer.
+type EventType uint8
+
+const (
+	// EventPeerDiscovered is emitted when a remote peer, that was not already
+	// in the table, is added to the table by peer discovery.
+	EventPeerDiscovered EventType = 1
+	// EventPeerAsymmetric is emitted when a remote peer can reach the local
+	// peer, but the local peer cannot reach the remote peer (for example,
+	// because the remote peer is behind a NAT).
+	EventPeerAsymmetric EventType = 2
+	// EventPeerUpdated is emitted when the address of a remote peer, that was
+	// already in the table, is changed by peer discovery.
+	EventPeerUpdated EventType = 3
+	// EventPeerRemoved is emitted when a remote peer is removed from the table
+	// because it has expired.
+	EventPeerRemoved EventType = 4
+	// EventPeerConflict is emitted when an address is received for a remote
+	// peer, but the address is signed by a different key. This can be an
+	// attempt to impersonate the remote peer, so the address is rejected, and
+	// the known address of the remote peer is kept.
+	EventPeerConflict EventType = 5
+	// EventPeerConnected is emitted when the first network connection to a
+	// remote peer is established, whether it was dialed or accepted.
+	EventPeerConnected EventType = 6
+	// EventPeerDisconnected is emitted when the last network connection to a
+	// remote peer is closed. The remote peer can still be in the table.
+	EventPeerDisconnected EventType = 7
+)
+
+// String returns a human-readable representation of the event type.
+func (ty EventType) String() string {
+	switch ty {
+	case EventPeerDiscovered:
+		return "peer discovered"
+	case EventPeerAsymmetric:
+		return "peer asymmetric"
+	case EventPeerUpdated:
+		return "peer updated"
+	case EventPeerRemoved:
+		return "peer removed"
+	case EventPeerConflict:
+		return "peer conflict"
+	case EventPeerConnected:
+		return "peer connected"
+	case EventPeerDisconnected:
+		return "peer disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+// An Event is emitted by a peer when something notable happens to a remote
+// peer.
+type Event struct {
+	Type   EventType
+	Remote id.Signatory
+	Time   time.Time
+
+	// Addr is the remote address of the network connection for connection
+	// events. It is empty for other events.
+	Addr string
+}
+
+// events is a bounded queue of events, that is also copied to any number of
+// subscribers. Emitting an event never blocks: when a queue is full, the event
+// is dropped and counted instead, so that a slow consumer cannot stall the
+// peer, or the other consumers. Events are only queued once the queue is being
+// consumed, so that a peer whose events are never read does not count them as
+// dropped.
+type events struct {
+	// dropped, and subsDropped, must be the first fields, so that they are
+	// 64-bit aligned for atomic operations on 32-bit platforms. Events dropped
+	// from the queue, and from subscribers, are counted separately, so that a
+	// slow subscriber does not look like a slow consumer of the queue.
+	dropped     uint64
+	subsDropped uint64
+	// consumed is set to 1, atomically, once the queue has been returned to a
+	// consumer.
+	consumed uint32
+	ch       chan Event
+
+	subsMu *sync.RWMutex
+	subs   map[chan Event]struct{}
+}
+
+func newEvents(size int) *events {
+	if size < 0 {
+		size = 0
+	}
+	return &events{
+		ch: make(chan Event, size),
+
+		subsMu: new(sync.RWMutex),
+		subs:   map[chan Event]struct{}{},
+	}
+}
+
+func (evs *events) emit(ev Event) {
+	if atomic.LoadUint32(&evs.consumed) == 1 {
+		send(evs.ch, ev, &evs.dropped)
+	}
+
+	evs.subsMu.RLock()
+	defer evs.subsMu.RUnlock()
+	for sub := range evs.subs {
+		send(sub, ev, &evs.subsDropped)
+	}
+}
+
+// send an event without blocking, and count it as dropped if the channel is
+// full.
+func send(ch chan Event, ev Event, dropped *uint64) {
+	select {
+	case ch <- ev:
+	default:
+		atomic.AddUint64(dropped, 1)
+	}
+}
+
+// consume returns the queue, and starts queueing events.
+func (evs *events) consume() <-chan Event {
+	atomic.StoreUint32(&evs.consumed, 1)
+	return evs.ch
+}
+
+// subscribe returns a new channel, with its own buffer, that receives a copy
+// of every event emitted after subscribing. The returned function stops the
+// subscription and closes the channel. It is safe to call more than once.
+func (evs *events) subscribe() (<-chan Event, func()) {
+	sub := make(chan Event, cap(evs.ch))
+
+	evs.subsMu.Lock()
+	evs.subs[sub] = struct{}{}
+	evs.subsMu.Unlock()
+
+	once := new(sync.Once)
+	return sub, func() {
+		once.Do(func() {
+			evs.subsMu.Lock()
+			delete(evs.subs, sub)
+			evs.subsMu.Unlock()
+			close(sub)
+		})
+	}
+}
+
+func (evs *events) numDropped() uint64 {
+	return atomic.LoadUint64(&evs.dropped)
+}
+
+func (evs *events) numSubsDropped() uint64 {
+	return atomic.LoadUint64(&evs.subsDropped)
+}
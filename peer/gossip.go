@@ -3,6 +3,7 @@ package peer
 import (
 	"context"
 	"encoding/base64"
+	"fmt"
 	"sync"
 
 	"github.com/renproject/aw/channel"
@@ -20,13 +21,50 @@ type Gossiper struct {
 	transport *transport.Transport
 
 	subnetsMu *sync.Mutex
-	subnets   map[string]id.Hash
+	subnets   map[string]gossipRoute
 
 	resolverMu *sync.RWMutex
 	resolver   dht.ContentResolver
+
+	// forwarded remembers the content IDs that have recently been forwarded in
+	// each subnet, so that duplicate pushes do not cause the content to be
+	// pulled, and forwarded, again. It is nil when deduplication is disabled.
+	forwarded *subnetReplayCache
+
+	// propagations is a semaphore that bounds the number of goroutines
+	// re-propagating received content. It is nil when content is re-propagated
+	// inline.
+	propagations chan struct{}
+
+	// observer is true when content should be received, but never forwarded
+	// to other peers.
+	observer bool
+
+	// versions are the message versions supported by remote peers.
+	versions *remoteVersions
+}
+
+// gossipRoute stores how content, that is expected to be synchronised, should
+// be propagated once it has been received.
+type gossipRoute struct {
+	subnet id.Hash
+	// hops is the number of hops that the content can still travel. It is
+	// negative when the number of hops is unlimited.
+	hops int
+	// pushers are the other peers that pushed the content while it was being
+	// pulled. They are only remembered when deduplication is enabled.
+	pushers []id.Signatory
 }
 
 func NewGossiper(opts GossiperOptions, filter *channel.SyncFilter, transport *transport.Transport) *Gossiper {
+	var forwarded *subnetReplayCache
+	if opts.DedupCacheSize > 0 {
+		forwarded = newSubnetReplayCache(0, opts.DedupCacheSize)
+	}
+	var propagations chan struct{}
+	if opts.PropagationWorkers > 0 {
+		propagations = make(chan struct{}, opts.PropagationWorkers)
+	}
 	return &Gossiper{
 		opts: opts,
 
@@ -34,10 +72,15 @@ func NewGossiper(opts GossiperOptions, filter *channel.SyncFilter, transport *tr
 		transport: transport,
 
 		subnetsMu: new(sync.Mutex),
-		subnets:   make(map[string]id.Hash, 1024),
+		subnets:   make(map[string]gossipRoute, 1024),
 
 		resolverMu: new(sync.RWMutex),
 		resolver:   nil,
+
+		forwarded:    forwarded,
+		propagations: propagations,
+
+		versions: newRemoteVersions(),
 	}
 }
 
@@ -48,7 +91,37 @@ func (g *Gossiper) Resolve(resolver dht.ContentResolver) {
 	g.resolver = resolver
 }
 
-func (g *Gossiper) Gossip(ctx context.Context, contentID []byte, subnet *id.Hash) {
+// Gossip the content ID to peers in the subnet. Peers that do not know the
+// content will pull it. ErrContentTooLarge is returned if the content is larger
+// than the maximum content size.
+func (g *Gossiper) Gossip(ctx context.Context, contentID []byte, subnet *id.Hash) error {
+	return g.gossip(ctx, contentID, subnet, -1)
+}
+
+// GossipWithHopLimit is the same as Gossip, but the content stops being
+// propagated after it has travelled the given number of hops. A hop limit of
+// one means that only the peers that receive the gossip from the local peer
+// will receive the content. This is useful for local announcements that should
+// not spread across the entire network.
+func (g *Gossiper) GossipWithHopLimit(ctx context.Context, contentID []byte, subnet *id.Hash, hops uint8) error {
+	if hops == 0 {
+		return nil
+	}
+	return g.gossip(ctx, contentID, subnet, int(hops))
+}
+
+func (g *Gossiper) gossip(ctx context.Context, contentID []byte, subnet *id.Hash, hops int) error {
+	if g.opts.MaxContentSize > 0 {
+		g.resolverMu.RLock()
+		if g.resolver != nil {
+			if content, ok := g.resolver.QueryContent(contentID); ok && len(content) > g.opts.MaxContentSize {
+				g.resolverMu.RUnlock()
+				return fmt.Errorf("gossiping %v bytes: %w", len(content), ErrContentTooLarge)
+			}
+		}
+		g.resolverMu.RUnlock()
+	}
+
 	if subnet == nil {
 		subnet = &DefaultSubnet
 	}
@@ -62,7 +135,15 @@ func (g *Gossiper) Gossip(ctx context.Context, contentID []byte, subnet *id.Hash
 		}
 	}
 
-	msg := wire.Msg{Version: wire.MsgVersion1, To: *subnet, Type: wire.MsgTypePush, Data: contentID}
+	if g.forwarded != nil {
+		g.forwarded.replayed(*subnet, id.NewHash(contentID), g.opts.Clock.Now())
+	}
+
+	msg := wire.Msg{To: *subnet, Type: wire.MsgTypePush, Data: contentID}
+	if hops >= 0 {
+		msg.Type = wire.MsgTypePushLimited
+		msg.Data = append([]byte{uint8(hops)}, contentID...)
+	}
 	wg := new(sync.WaitGroup)
 	for i := range recipients {
 		recipient := recipients[i]
@@ -73,17 +154,36 @@ func (g *Gossiper) Gossip(ctx context.Context, contentID []byte, subnet *id.Hash
 			innerContext, cancel := context.WithTimeout(ctx, g.opts.Timeout)
 			defer cancel()
 
+			msg := msg
+			msg.Version = g.versions.msgVersion(recipient)
+
 			// Ignore the error, cause random recipient could be offline.
 			_ = g.transport.Send(innerContext, recipient, msg)
 		}()
 	}
 	wg.Wait()
+	return nil
 }
 
 func (g *Gossiper) DidReceiveMessage(from id.Signatory, msg wire.Msg) error {
 	switch msg.Type {
 	case wire.MsgTypePush:
-		g.didReceivePush(from, msg)
+		g.didReceivePush(from, msg, -1)
+	case wire.MsgTypePushLimited:
+		if len(msg.Data) < 1 {
+			return nil
+		}
+		if msg.Data[0] == 0 {
+			// Content with no hops left should never have been pushed. It is
+			// dropped, because a negative number of hops means there is no
+			// limit.
+			g.opts.Logger.Debug("push", zap.String("peer", from.String()), zap.String("hops", "none left"))
+			return nil
+		}
+		// The hop to the local peer has been travelled.
+		hops := int(msg.Data[0]) - 1
+		msg.Data = msg.Data[1:]
+		g.didReceivePush(from, msg, hops)
 	case wire.MsgTypePull:
 		g.didReceivePull(from, msg)
 	case wire.MsgTypeSync:
@@ -96,10 +196,15 @@ func (g *Gossiper) DidReceiveMessage(from id.Signatory, msg wire.Msg) error {
 	return nil
 }
 
-func (g *Gossiper) didReceivePush(from id.Signatory, msg wire.Msg) {
+func (g *Gossiper) didReceivePush(from id.Signatory, msg wire.Msg, hops int) {
 	if len(msg.Data) == 0 {
 		return
 	}
+	if g.forwarded != nil && g.forwarded.contains(msg.To, id.NewHash(msg.Data), g.opts.Clock.Now()) {
+		// The content has already been forwarded, even if it is no longer
+		// known by the content resolver.
+		return
+	}
 
 	// Check whether the content is already known. This can cause performance
 	// bottle-necks if the content resolver is slow.
@@ -114,18 +219,36 @@ func (g *Gossiper) didReceivePush(from id.Signatory, msg wire.Msg) {
 	}
 	g.resolverMu.RUnlock()
 
-	ctx, cancel := context.WithTimeout(context.Background(), g.opts.Timeout)
-
 	// Later, we will probably receive a synchronisation message for the content
 	// associated with this push. We store the subnet now, so that we know how
-	// to propagate the content later.
+	// to propagate the content later. If the content is already being pulled
+	// from another peer, there is no need to pull it again, but we remember
+	// this peer in case that pull fails.
 	g.subnetsMu.Lock()
-	g.subnets[string(msg.Data)] = msg.To
+	if g.forwarded != nil {
+		if route, ok := g.subnets[string(msg.Data)]; ok {
+			if len(route.pushers) < g.opts.Alpha {
+				route.pushers = append(route.pushers, from)
+				g.subnets[string(msg.Data)] = route
+			}
+			g.subnetsMu.Unlock()
+			return
+		}
+	}
+	g.subnets[string(msg.Data)] = gossipRoute{subnet: msg.To, hops: hops}
 	g.subnetsMu.Unlock()
 
+	g.pull(from, msg.Data)
+}
+
+// pull content from a remote peer. If the content has not been received by the
+// time the pull times out, it is pulled from the next peer that pushed it.
+func (g *Gossiper) pull(from id.Signatory, contentID []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.opts.Timeout)
+
 	// We are expecting a synchronisation message, because we are about to send
 	// out a pull message. So, we need to allow the content in the filter.
-	g.filter.Allow(msg.Data)
+	g.filter.Allow(contentID)
 
 	// Cleanup after the synchronisation timeout has passed. This prevents
 	// memory leaking in the filter and in the subnets map. It means that until
@@ -135,26 +258,52 @@ func (g *Gossiper) didReceivePush(from id.Signatory, msg wire.Msg) {
 		<-ctx.Done()
 		cancel()
 
+		received := g.hasContent(contentID)
+
 		g.subnetsMu.Lock()
-		delete(g.subnets, string(msg.Data))
+		route, ok := g.subnets[string(contentID)]
+		if ok && !received && len(route.pushers) > 0 {
+			next := route.pushers[0]
+			route.pushers = route.pushers[1:]
+			g.subnets[string(contentID)] = route
+			g.subnetsMu.Unlock()
+
+			g.filter.Deny(contentID)
+			g.pull(next, contentID)
+			return
+		}
+		delete(g.subnets, string(contentID))
 		g.subnetsMu.Unlock()
 
-		g.filter.Deny(msg.Data)
+		g.filter.Deny(contentID)
 	}()
 
 	if err := g.transport.Send(ctx, from, wire.Msg{
-		Version: wire.MsgVersion1,
+		Version: g.versions.msgVersion(from),
 		Type:    wire.MsgTypePull,
 		To:      id.Hash(from),
-		Data:    msg.Data,
+		Data:    contentID,
 	}); err != nil {
-		g.opts.Logger.Error("pull", zap.String("peer", from.String()), zap.String("id", base64.RawURLEncoding.EncodeToString(msg.Data)), zap.Error(err))
+		g.opts.Logger.Error("pull", zap.String("peer", from.String()), zap.String("id", base64.RawURLEncoding.EncodeToString(contentID)), zap.Error(err))
 		return
 	}
 }
 
+// hasContent returns whether or not the content is known by the content
+// resolver.
+func (g *Gossiper) hasContent(contentID []byte) bool {
+	g.resolverMu.RLock()
+	defer g.resolverMu.RUnlock()
+
+	if g.resolver == nil {
+		return false
+	}
+	_, ok := g.resolver.QueryContent(contentID)
+	return ok
+}
+
 func (g *Gossiper) didReceivePull(from id.Signatory, msg wire.Msg) {
-	if len(msg.Data) == 0 {
+	if len(msg.Data) == 0 || g.observer {
 		return
 	}
 
@@ -178,7 +327,7 @@ func (g *Gossiper) didReceivePull(from id.Signatory, msg wire.Msg) {
 	defer cancel()
 
 	if err := g.transport.Send(ctx, from, wire.Msg{
-		Version:  wire.MsgVersion1,
+		Version:  g.versions.msgVersion(from),
 		To:       id.Hash(from),
 		Type:     wire.MsgTypeSync,
 		Data:     msg.Data,
@@ -205,6 +354,11 @@ func (g *Gossiper) didReceiveSync(from id.Signatory, msg wire.Msg) {
 		g.resolverMu.RUnlock()
 		return
 	}
+	if g.opts.MaxContentSize > 0 && len(msg.SyncData) > g.opts.MaxContentSize {
+		g.resolverMu.RUnlock()
+		g.opts.Logger.Debug("sync", zap.String("peer", from.String()), zap.String("id", base64.RawURLEncoding.EncodeToString(msg.Data)), zap.Error(fmt.Errorf("receiving %v bytes: %w", len(msg.SyncData), ErrContentTooLarge)))
+		return
+	}
 
 	// We are relying on the correctness of the channel filtering to ensure that
 	// no synchronisation messages reach the gossiper unless the gossiper (or
@@ -212,8 +366,12 @@ func (g *Gossiper) didReceiveSync(from id.Signatory, msg wire.Msg) {
 	g.resolver.InsertContent(msg.Data, msg.SyncData)
 	g.resolverMu.RUnlock()
 
+	if g.observer {
+		return
+	}
+
 	g.subnetsMu.Lock()
-	subnet, ok := g.subnets[string(msg.Data)]
+	route, ok := g.subnets[string(msg.Data)]
 	g.subnetsMu.Unlock()
 
 	if !ok {
@@ -221,9 +379,31 @@ func (g *Gossiper) didReceiveSync(from id.Signatory, msg wire.Msg) {
 		// map to preserve memory. Gossiping cannot continue.
 		return
 	}
+	if route.hops == 0 {
+		// The content has travelled as far as it is allowed to.
+		return
+	}
 
+	if g.propagations == nil {
+		g.propagate(msg.Data, route)
+		return
+	}
+
+	// Re-propagate in the background, so that a slow recipient only holds up
+	// one worker, instead of the loop that receives messages. Once all workers
+	// are busy, receiving blocks until one of them is done.
+	g.propagations <- struct{}{}
+	go func() {
+		defer func() { <-g.propagations }()
+		g.propagate(msg.Data, route)
+	}()
+}
+
+func (g *Gossiper) propagate(contentID []byte, route gossipRoute) {
 	ctx, cancel := context.WithTimeout(context.Background(), g.opts.Timeout)
 	defer cancel()
 
-	g.Gossip(ctx, msg.Data, &subnet)
+	if err := g.gossip(ctx, contentID, &route.subnet, route.hops); err != nil {
+		g.opts.Logger.Error("gossip", zap.String("id", base64.RawURLEncoding.EncodeToString(contentID)), zap.Error(err))
+	}
 }
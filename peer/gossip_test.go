@@ -2,10 +2,12 @@ package peer_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/renproject/aw/peer"
@@ -120,4 +122,391 @@ var _ = Describe("Gossip", func() {
 			Expect(strings.Contains(string(buf[:n]), "message authentication failed")).To(BeFalse())
 		})
 	})
+	Context("when the content is larger than the maximum content size", func() {
+		It("should return an error when gossiping", func() {
+			opts, _, _, contentResolvers, _, transports := setup(1)
+
+			p := peer.New(opts[0].WithGossiperOptions(opts[0].GossiperOptions.WithMaxContentSize(8)), transports[0])
+			p.Resolve(context.Background(), contentResolvers[0])
+
+			content := []byte("more than eight bytes")
+			contentID := id.NewHash(content)
+			contentResolvers[0].InsertContent(contentID[:], content)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			err := p.Gossip(ctx, contentID[:], &peer.DefaultSubnet)
+			Expect(errors.Is(err, peer.ErrContentTooLarge)).To(BeTrue())
+		})
+
+		It("should drop the content when it is received", func() {
+			n := 2
+			opts, peers, tables, contentResolvers, _, transports := setup(n)
+
+			// The receiving peer has a maximum content size, but the sending
+			// peer does not.
+			receiver := peer.New(opts[1].WithGossiperOptions(opts[1].GossiperOptions.WithMaxContentSize(8)), transports[1])
+			receiver.Resolve(context.Background(), contentResolvers[1])
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			go peers[0].Run(ctx)
+			go receiver.Run(ctx)
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			tables[1].AddPeer(opts[0].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3333", uint64(time.Now().UnixNano())))
+
+			large := []byte("more than eight bytes")
+			largeID := id.NewHash(large)
+			contentResolvers[0].InsertContent(largeID[:], large)
+			Expect(peers[0].Gossip(ctx, largeID[:], &peer.DefaultSubnet)).To(Succeed())
+
+			small := []byte("small")
+			smallID := id.NewHash(small)
+			contentResolvers[0].InsertContent(smallID[:], small)
+			Expect(peers[0].Gossip(ctx, smallID[:], &peer.DefaultSubnet)).To(Succeed())
+
+			Eventually(func() bool {
+				_, ok := contentResolvers[1].QueryContent(smallID[:])
+				return ok
+			}, 5*time.Second).Should(BeTrue())
+			_, ok := contentResolvers[1].QueryContent(largeID[:])
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("when gossiping through an observer", func() {
+		It("should learn peers and receive content, but never forward it", func() {
+			n := 3
+			opts, peers, tables, contentResolvers, _, transports := setup(n)
+
+			observer := peer.New(opts[1].WithObserver(true), transports[1])
+			observer.Resolve(context.Background(), contentResolvers[1])
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			go peers[0].Run(ctx)
+			go observer.Run(ctx)
+			go peers[2].Run(ctx)
+
+			// The origin only knows the observer, and the observer knows the
+			// last peer.
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			tables[1].AddPeer(opts[2].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3335", uint64(time.Now().UnixNano())))
+
+			discoveryCtx, discoveryCancel := context.WithTimeout(ctx, 3*time.Second)
+			defer discoveryCancel()
+			go peers[0].DiscoverPeers(discoveryCtx)
+
+			// The observer learns about the origin from its pings, but does not
+			// tell the origin about the last peer.
+			Eventually(func() bool {
+				_, ok := tables[1].PeerAddress(opts[0].PrivKey.Signatory())
+				return ok
+			}, 3*time.Second).Should(BeTrue())
+			<-discoveryCtx.Done()
+			Expect(tables[0].NumPeers()).To(Equal(1))
+
+			content := []byte("observed")
+			contentID := id.NewHash(content)
+			contentResolvers[0].InsertContent(contentID[:], content)
+			Expect(peers[0].Gossip(ctx, contentID[:], &peer.DefaultSubnet)).To(Succeed())
+
+			Eventually(func() bool {
+				_, ok := contentResolvers[1].QueryContent(contentID[:])
+				return ok
+			}, 5*time.Second).Should(BeTrue())
+			Consistently(func() bool {
+				_, ok := contentResolvers[2].QueryContent(contentID[:])
+				return ok
+			}, time.Second).Should(BeFalse())
+		})
+	})
+
+	Context("when gossiping with a hop limit", func() {
+		It("should stop propagating the content after the hop limit", func() {
+			n := 3
+			opts, peers, tables, contentResolvers, _, _ := setup(n)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].Run(ctx)
+			}
+
+			// The peers form a line, so content must travel two hops to reach
+			// the last peer.
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			tables[1].AddPeer(opts[2].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3335", uint64(time.Now().UnixNano())))
+
+			limited := []byte("limited")
+			limitedID := id.NewHash(limited)
+			contentResolvers[0].InsertContent(limitedID[:], limited)
+			Expect(peers[0].GossipWithHopLimit(ctx, limitedID[:], &peer.DefaultSubnet, 1)).To(Succeed())
+
+			Eventually(func() bool {
+				_, ok := contentResolvers[1].QueryContent(limitedID[:])
+				return ok
+			}, 5*time.Second).Should(BeTrue())
+			Consistently(func() bool {
+				_, ok := contentResolvers[2].QueryContent(limitedID[:])
+				return ok
+			}, time.Second).Should(BeFalse())
+
+			further := []byte("further")
+			furtherID := id.NewHash(further)
+			contentResolvers[0].InsertContent(furtherID[:], further)
+			Expect(peers[0].GossipWithHopLimit(ctx, furtherID[:], &peer.DefaultSubnet, 2)).To(Succeed())
+
+			Eventually(func() bool {
+				_, ok := contentResolvers[2].QueryContent(furtherID[:])
+				return ok
+			}, 5*time.Second).Should(BeTrue())
+		})
+	})
+
+	Context("when content is pushed with no hops left", func() {
+		It("should not pull it", func() {
+			n := 2
+			opts, peers, tables, _, _, transports := setup(n)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			go peers[1].Run(ctx)
+			go transports[0].Run(ctx)
+			pullsMu := new(sync.Mutex)
+			pulls := map[id.Hash]bool{}
+			pulled := func(content string) func() bool {
+				return func() bool {
+					pullsMu.Lock()
+					defer pullsMu.Unlock()
+					return pulls[id.NewHash([]byte(content))]
+				}
+			}
+			transports[0].Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				if packet.Msg.Type == wire.MsgTypePull {
+					var contentID id.Hash
+					copy(contentID[:], packet.Msg.Data)
+					pullsMu.Lock()
+					pulls[contentID] = true
+					pullsMu.Unlock()
+				}
+				return nil
+			})
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			tables[1].AddPeer(opts[0].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3333", uint64(time.Now().UnixNano())))
+
+			push := func(hops uint8, content string) {
+				contentID := id.NewHash([]byte(content))
+				Expect(transports[0].Send(ctx, opts[1].PrivKey.Signatory(), wire.Msg{
+					Version: wire.MsgVersion1,
+					Type:    wire.MsgTypePushLimited,
+					To:      peer.DefaultSubnet,
+					Data:    append([]byte{hops}, contentID[:]...),
+				})).To(Succeed())
+			}
+			push(0, "exhausted")
+			push(1, "allowed")
+			Eventually(pulled("allowed"), 5*time.Second).Should(BeTrue())
+			Consistently(pulled("exhausted"), 500*time.Millisecond).Should(BeFalse())
+		})
+	})
+
+	Context("when the same content is pushed by many peers", func() {
+		It("should only pull and forward it once", func() {
+			n := 3
+			opts, peers, tables, contentResolvers, _, transports := setup(n)
+
+			// The middle peer forgets all content, so it can only avoid
+			// pulling content again by remembering what it has forwarded.
+			peers[1].Resolve(context.Background(), forgetfulResolver{})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].Run(ctx)
+			}
+			syncs := make(chan struct{}, 10)
+			transports[1].Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				if packet.Msg.Type == wire.MsgTypeSync {
+					syncs <- struct{}{}
+				}
+				return nil
+			})
+
+			for i := range peers {
+				for j := range peers {
+					if i != j {
+						tables[i].AddPeer(opts[j].PrivKey.Signatory(),
+							wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("localhost:%v", 3333+j), uint64(time.Now().UnixNano())))
+					}
+				}
+			}
+
+			content := []byte("duplicated")
+			contentID := id.NewHash(content)
+			contentResolvers[0].InsertContent(contentID[:], content)
+			contentResolvers[2].InsertContent(contentID[:], content)
+
+			Expect(peers[0].Gossip(ctx, contentID[:], &peer.DefaultSubnet)).To(Succeed())
+			Eventually(syncs, 5*time.Second).Should(Receive())
+			Expect(peers[2].Gossip(ctx, contentID[:], &peer.DefaultSubnet)).To(Succeed())
+			Consistently(syncs, time.Second).ShouldNot(Receive())
+		})
+	})
+
+	Context("when the first peer to push content does not send it", func() {
+		It("should pull it from the next peer that pushed it", func() {
+			n := 3
+			opts, peers, tables, contentResolvers, _, transports := setup(n)
+
+			// The receiving peer gives up on pulls quickly, so that it does
+			// not wait long for the first peer.
+			receiver := peer.New(opts[1].WithGossiperOptions(opts[1].GossiperOptions.WithTimeout(500*time.Millisecond)), transports[1])
+			receiver.Resolve(context.Background(), contentResolvers[1])
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			go receiver.Run(ctx)
+			go peers[2].Run(ctx)
+
+			// The first peer pushes the content, but ignores pulls.
+			go transports[0].Run(ctx)
+			pulls := make(chan struct{}, 10)
+			transports[0].Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				if packet.Msg.Type == wire.MsgTypePull {
+					pulls <- struct{}{}
+				}
+				return nil
+			})
+
+			for _, i := range []int{0, 2} {
+				tables[i].AddPeer(opts[1].PrivKey.Signatory(),
+					wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+				tables[1].AddPeer(opts[i].PrivKey.Signatory(),
+					wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("localhost:%v", 3333+i), uint64(time.Now().UnixNano())))
+			}
+
+			content := []byte("withheld")
+			contentID := id.NewHash(content)
+			Expect(transports[0].Send(ctx, opts[1].PrivKey.Signatory(), wire.Msg{
+				Version: wire.MsgVersion1,
+				Type:    wire.MsgTypePush,
+				To:      peer.DefaultSubnet,
+				Data:    contentID[:],
+			})).To(Succeed())
+			Eventually(pulls, 5*time.Second).Should(Receive())
+
+			// The second push arrives while the content is still being pulled
+			// from the first peer.
+			contentResolvers[2].InsertContent(contentID[:], content)
+			Expect(peers[2].Gossip(ctx, contentID[:], &peer.DefaultSubnet)).To(Succeed())
+
+			Eventually(func() bool {
+				_, ok := contentResolvers[1].QueryContent(contentID[:])
+				return ok
+			}, 5*time.Second).Should(BeTrue())
+		})
+	})
+
+	Context("when one subnet is flooded with content", func() {
+		It("should not forget the content forwarded in other subnets", func() {
+			n := 2
+			opts, peers, tables, contentResolvers, _, transports := setup(n)
+
+			// The receiving peer forgets all content, and only remembers a few
+			// content IDs per subnet.
+			receiver := peer.New(opts[1].WithGossiperOptions(opts[1].GossiperOptions.WithDedupCacheSize(4)), transports[1])
+			receiver.Resolve(context.Background(), forgetfulResolver{})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			go peers[0].Run(ctx)
+			go receiver.Run(ctx)
+			pulls := make(chan struct{}, 10)
+			transports[0].Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				if packet.Msg.Type == wire.MsgTypePull {
+					pulls <- struct{}{}
+				}
+				return nil
+			})
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+
+			content := []byte("default")
+			contentID := id.NewHash(content)
+			contentResolvers[0].InsertContent(contentID[:], content)
+			Expect(receiver.Gossip(ctx, contentID[:], &peer.DefaultSubnet)).To(Succeed())
+
+			// Flood another subnet with more content than can be remembered.
+			flooded := tables[0].AddSubnet([]id.Signatory{opts[1].PrivKey.Signatory()})
+			for i := 0; i < 10; i++ {
+				floodID := id.NewHash([]byte(fmt.Sprintf("flood %v", i)))
+				Expect(receiver.Gossip(ctx, floodID[:], &flooded)).To(Succeed())
+			}
+
+			Expect(peers[0].Gossip(ctx, contentID[:], &peer.DefaultSubnet)).To(Succeed())
+			Consistently(pulls, time.Second).ShouldNot(Receive())
+
+			// The oldest content in the flooded subnet has been forgotten.
+			floodID := id.NewHash([]byte("flood 0"))
+			contentResolvers[0].InsertContent(floodID[:], []byte("flood 0"))
+			Expect(peers[0].Gossip(ctx, floodID[:], &flooded)).To(Succeed())
+			Eventually(pulls, 5*time.Second).Should(Receive())
+		})
+	})
+
+	Context("when re-propagating content to a slow peer", func() {
+		It("should keep receiving other content", func() {
+			n := 2
+			opts, peers, tables, contentResolvers, _, transports := setup(n)
+
+			// The receiving peer waits a long time for unreachable peers
+			// before giving up on re-propagating content.
+			receiver := peer.New(opts[1].WithGossiperOptions(opts[1].GossiperOptions.WithTimeout(5*time.Second).WithPropagationWorkers(4)), transports[1])
+			receiver.Resolve(context.Background(), contentResolvers[1])
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			go peers[0].Run(ctx)
+			go receiver.Run(ctx)
+
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			unreachable := id.NewPrivKey().Signatory()
+			tables[1].AddPeer(unreachable,
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3399", uint64(time.Now().UnixNano())))
+
+			contentIDs := make([]id.Hash, 3)
+			for i := range contentIDs {
+				content := []byte(fmt.Sprintf("content %v", i))
+				contentIDs[i] = id.NewHash(content)
+				contentResolvers[0].InsertContent(contentIDs[i][:], content)
+				Expect(peers[0].Gossip(ctx, contentIDs[i][:], &peer.DefaultSubnet)).To(Succeed())
+			}
+
+			Eventually(func() bool {
+				for i := range contentIDs {
+					if _, ok := contentResolvers[1].QueryContent(contentIDs[i][:]); !ok {
+						return false
+					}
+				}
+				return true
+			}, 2*time.Second).Should(BeTrue())
+		})
+	})
 })
+
+// forgetfulResolver is a content resolver that never stores content.
+type forgetfulResolver struct{}
+
+func (forgetfulResolver) InsertContent([]byte, []byte) {}
+
+func (forgetfulResolver) QueryContent([]byte) ([]byte, bool) { return nil, false }
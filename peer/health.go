@@ -0,0 +1,52 @@
+package peer
+
+// Health is a snapshot of the state of a peer. Readiness checks are evaluated
+// against it.
+type Health struct {
+	// NumPeers is the number of remote peers in the table.
+	NumPeers int
+	// NumSubnets is the number of subnets that the peer belongs to.
+	NumSubnets int
+	// Bootstrapped is true once the peer has received at least one ping ack,
+	// which means that it has successfully joined the network.
+	Bootstrapped bool
+	// Paused is true while deliveries to receivers are paused.
+	Paused bool
+}
+
+// A ReadinessCheck decides whether or not a peer is ready, given its health.
+// Applications define ready differently, so they can provide their own checks.
+type ReadinessCheck func(Health) bool
+
+// DefaultReadinessCheck considers a peer to be ready when it knows about at
+// least one remote peer, and is not paused.
+func DefaultReadinessCheck(health Health) bool {
+	return health.NumPeers >= 1 && !health.Paused
+}
+
+// MinPeers returns a ReadinessCheck that considers a peer to be ready when it
+// knows about at least n remote peers.
+func MinPeers(n int) ReadinessCheck {
+	return func(health Health) bool {
+		return health.NumPeers >= n
+	}
+}
+
+// AllOf returns a ReadinessCheck that considers a peer to be ready when all of
+// the checks consider it to be ready.
+func AllOf(checks ...ReadinessCheck) ReadinessCheck {
+	return func(health Health) bool {
+		for _, check := range checks {
+			if !check(health) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Bootstrapped is a ReadinessCheck that considers a peer to be ready once it
+// has received at least one ping ack.
+func Bootstrapped(health Health) bool {
+	return health.Bootstrapped
+}
@@ -0,0 +1,77 @@
+package peer_test
+
+import (
+	"time"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/peer"
+	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health", func() {
+	newPeer := func(opts peer.Options) (*peer.Peer, dht.Table) {
+		self := opts.PrivKey.Signatory()
+		table := dht.NewInMemTable(self)
+		t := transport.New(
+			transport.DefaultOptions().WithLogger(zap.NewNop()),
+			self,
+			channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), self),
+			handshake.ECIES(opts.PrivKey),
+			table)
+		return peer.New(opts, t), table
+	}
+
+	addPeer := func(table dht.Table) {
+		table.AddPeer(id.NewPrivKey().Signatory(), wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:1", uint64(time.Now().UnixNano())))
+	}
+
+	Context("when using the default readiness check", func() {
+		It("should be ready once a peer is known, unless paused", func() {
+			p, table := newPeer(peer.DefaultOptions().WithLogger(zap.NewNop()))
+			Expect(p.Ready()).To(BeFalse())
+
+			addPeer(table)
+			Expect(p.Ready()).To(BeTrue())
+
+			p.Pause()
+			Expect(p.Health().Paused).To(BeTrue())
+			Expect(p.Ready()).To(BeFalse())
+			p.Resume()
+			Expect(p.Ready()).To(BeTrue())
+		})
+	})
+
+	Context("when using a custom readiness check", func() {
+		It("should only be ready once the check passes", func() {
+			p, table := newPeer(peer.DefaultOptions().
+				WithLogger(zap.NewNop()).
+				WithReadinessCheck(func(health peer.Health) bool {
+					return health.NumPeers >= 3
+				}))
+
+			for i := 1; i <= 5; i++ {
+				addPeer(table)
+				Expect(p.Health().NumPeers).To(Equal(i))
+				Expect(p.Ready()).To(Equal(i >= 3))
+			}
+		})
+
+		It("should combine checks", func() {
+			p, table := newPeer(peer.DefaultOptions().
+				WithLogger(zap.NewNop()).
+				WithReadinessCheck(peer.AllOf(peer.MinPeers(1), peer.Bootstrapped)))
+
+			addPeer(table)
+			Expect(p.Health().Bootstrapped).To(BeFalse())
+			Expect(p.Ready()).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,98 @@
+package peer
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+)
+
+// marshalIdempotent prefixes the data with the idempotency key.
+func marshalIdempotent(key string, data []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(key)+len(data))
+	n := binary.PutUvarint(buf, uint64(len(key)))
+	buf = append(buf[:n], key...)
+	return append(buf, data...)
+}
+
+// unmarshalIdempotent splits the data of an idempotent message into the
+// idempotency key and the application data.
+func unmarshalIdempotent(data []byte) (string, []byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 {
+		return "", nil, fmt.Errorf("unmarshal idempotency key: malformed length")
+	}
+	data = data[n:]
+	if size > uint64(len(data)) {
+		return "", nil, fmt.Errorf("unmarshal idempotency key: expected at most %v bytes, got %v bytes", len(data), size)
+	}
+	return string(data[:size]), data[size:], nil
+}
+
+// idempotencyHash identifies the idempotency key of a sender.
+func idempotencyHash(from id.Signatory, key string) id.Hash {
+	buf := make([]byte, 0, len(from)+len(key))
+	buf = append(buf, from[:]...)
+	buf = append(buf, key...)
+	return id.NewHash(buf)
+}
+
+// SendIdempotent sends data to a remote peer, along with an idempotency key.
+// The remote peer remembers the keys that it has recently received from each
+// sender, and only delivers the first message with a given key, so that
+// applications can safely retry sends. Receivers see the message as a normal
+// wire.MsgTypeSend message.
+func (p *Peer) SendIdempotent(ctx context.Context, to id.Signatory, key string, data []byte) error {
+	return p.Send(ctx, to, wire.Msg{
+		Version: LatestMsgVersion,
+		Type:    wire.MsgTypeSendIdempotent,
+		To:      id.Hash(to),
+		Data:    marshalIdempotent(key, data),
+	})
+}
+
+// deduplicate wraps a receiver, so that only the first idempotent (or
+// reliable) message with a given key, from each sender, is passed to it.
+// Reliable messages are acknowledged once they have been passed to the
+// receiver without error, and duplicates are acknowledged again, in case the
+// first acknowledgement was lost. Every receiver has its own cache, so that
+// every receiver gets to see every message once.
+func (p *Peer) deduplicate(f func(id.Signatory, wire.Packet) error) func(id.Signatory, wire.Packet) error {
+	cache := newReplayCache(p.opts.IdempotencyWindow, p.opts.IdempotencyCacheSize)
+	return func(from id.Signatory, packet wire.Packet) error {
+		if packet.Msg.Type != wire.MsgTypeSendIdempotent && packet.Msg.Type != wire.MsgTypeSendReliable {
+			return f(from, packet)
+		}
+		reliable := packet.Msg.Type == wire.MsgTypeSendReliable
+		key, data, err := unmarshalIdempotent(packet.Msg.Data)
+		if err != nil {
+			p.opts.Logger.Debug("receiving", zap.String("from", from.String()), zap.Error(err))
+			return nil
+		}
+		packet.Msg.Type = wire.MsgTypeSend
+		packet.Msg.Data = data
+		if !reliable {
+			if cache.replayed(idempotencyHash(from, key), p.opts.DiscoveryOptions.Clock.Now()) {
+				return nil
+			}
+			return f(from, packet)
+		}
+
+		// Reliable messages are only remembered once they have been delivered,
+		// so that they are delivered again when they are retried after a
+		// failure.
+		if cache.contains(idempotencyHash(from, key), p.opts.DiscoveryOptions.Clock.Now()) {
+			p.ack(from, key)
+			return nil
+		}
+		if err := f(from, packet); err != nil {
+			return err
+		}
+		cache.replayed(idempotencyHash(from, key), p.opts.DiscoveryOptions.Clock.Now())
+		p.ack(from, key)
+		return nil
+	}
+}
@@ -0,0 +1,67 @@
+package peer
+
+import (
+	"sync"
+
+	"github.com/renproject/id"
+	"golang.org/x/time/rate"
+)
+
+// insertionLimiter limits the rate at which each source peer can cause new
+// peers to be inserted into the table. It remembers a bounded number of
+// sources, forgetting the least recently seen sources first.
+type insertionLimiter struct {
+	r   rate.Limit
+	b   int
+	cap int
+
+	mu    *sync.Mutex
+	front map[id.Signatory]*rate.Limiter
+	back  map[id.Signatory]*rate.Limiter
+}
+
+func newInsertionLimiter(r rate.Limit, b, cap int) *insertionLimiter {
+	cap /= 2
+	if cap < 1 {
+		cap = 1
+	}
+	return &insertionLimiter{
+		r:   r,
+		b:   b,
+		cap: cap,
+
+		mu:    new(sync.Mutex),
+		front: make(map[id.Signatory]*rate.Limiter, cap),
+		back:  make(map[id.Signatory]*rate.Limiter, cap),
+	}
+}
+
+// allow returns true if the source is allowed to insert another peer into the
+// table. A nil limiter allows everything.
+func (limiter *insertionLimiter) allow(source id.Signatory) bool {
+	if limiter == nil {
+		return true
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if l, ok := limiter.front[source]; ok {
+		return l.Allow()
+	}
+	if l, ok := limiter.back[source]; ok {
+		limiter.promote(source, l)
+		return l.Allow()
+	}
+	l := rate.NewLimiter(limiter.r, limiter.b)
+	limiter.promote(source, l)
+	return l.Allow()
+}
+
+func (limiter *insertionLimiter) promote(source id.Signatory, l *rate.Limiter) {
+	if len(limiter.front) >= limiter.cap {
+		limiter.back = limiter.front
+		limiter.front = make(map[id.Signatory]*rate.Limiter, limiter.cap)
+	}
+	limiter.front[source] = l
+}
@@ -3,8 +3,11 @@ package peer
 import (
 	"time"
 
+	"github.com/renproject/aw/clock"
+	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 )
 
 type SyncerOptions struct {
@@ -41,9 +44,16 @@ func (opts SyncerOptions) WithWiggleTimeout(timeout time.Duration) SyncerOptions
 }
 
 type GossiperOptions struct {
-	Logger  *zap.Logger
-	Alpha   int
-	Timeout time.Duration
+	Logger             *zap.Logger
+	Alpha              int
+	Timeout            time.Duration
+	MaxContentSize     int
+	DedupCacheSize     int
+	PropagationWorkers int
+	// Clock is used to timestamp content IDs in the deduplication cache. The
+	// cache has no expiry window, so content IDs are only forgotten to make
+	// room for newer ones.
+	Clock clock.Clock
 }
 
 func DefaultGossiperOptions() GossiperOptions {
@@ -52,9 +62,12 @@ func DefaultGossiperOptions() GossiperOptions {
 		panic(err)
 	}
 	return GossiperOptions{
-		Logger:  logger,
-		Alpha:   DefaultAlpha,
-		Timeout: DefaultTimeout,
+		Logger:             logger,
+		Alpha:              DefaultAlpha,
+		Timeout:            DefaultTimeout,
+		DedupCacheSize:     DefaultGossipDedupCacheSize,
+		PropagationWorkers: DefaultGossipPropagationWorkers,
+		Clock:              clock.Real{},
 	}
 }
 
@@ -73,11 +86,74 @@ func (opts GossiperOptions) WithTimeout(timeout time.Duration) GossiperOptions {
 	return opts
 }
 
+// WithMaxContentSize sets the maximum number of bytes of content that can be
+// gossiped. Gossiping larger content returns an error, and larger content that
+// is received from remote peers is dropped instead of being stored and
+// propagated. A size of zero, or less, means there is no maximum.
+func (opts GossiperOptions) WithMaxContentSize(size int) GossiperOptions {
+	opts.MaxContentSize = size
+	return opts
+}
+
+// WithDedupCacheSize sets how many content IDs are remembered, per subnet,
+// after their content has been forwarded. Pushes for remembered content IDs
+// are ignored, so content that arrives from many peers is only pulled, and
+// forwarded, once. Each subnet is limited separately, so content flooding one
+// subnet cannot cause content in another subnet to be forgotten. A size of
+// zero, or less, disables deduplication.
+func (opts GossiperOptions) WithDedupCacheSize(size int) GossiperOptions {
+	opts.DedupCacheSize = size
+	return opts
+}
+
+// WithPropagationWorkers sets the maximum number of goroutines that can be
+// re-propagating received content at once. Re-propagation happens in the
+// background, so that a slow peer does not stop other content from being
+// received. When all workers are busy, receiving content blocks until a worker
+// is available. A value of zero, or less, means content is re-propagated
+// before the next message is received.
+func (opts GossiperOptions) WithPropagationWorkers(workers int) GossiperOptions {
+	opts.PropagationWorkers = workers
+	return opts
+}
+
+// WithClock sets the Clock used to timestamp content IDs in the deduplication
+// cache.
+func (opts GossiperOptions) WithClock(c clock.Clock) GossiperOptions {
+	opts.Clock = c
+	return opts
+}
+
 type DiscoveryOptions struct {
-	Logger           *zap.Logger
-	Alpha            int
-	MaxExpectedPeers int
-	PingTimePeriod   time.Duration
+	Logger             *zap.Logger
+	Alpha              int
+	MaxExpectedPeers   int
+	PingTimePeriod     time.Duration
+	RTTMultiplier      int
+	BootstrapPeers     []wire.SignatoryAndAddress
+	PresenceDigestSize int
+	InsertionRateLimit rate.Limit
+	InsertionBurst     int
+	MaxPassDuration    time.Duration
+	AsymmetryThreshold int
+	ExchangeOnConnect  bool
+
+	// MinPingTimePeriod, LowPeerThreshold, and HighPeerThreshold configure an
+	// adaptive ping time period. The period is MinPingTimePeriod when the
+	// table has LowPeerThreshold peers or fewer, and PingTimePeriod when it
+	// has HighPeerThreshold peers or more. It is zero when the ping time
+	// period is fixed.
+	MinPingTimePeriod time.Duration
+	LowPeerThreshold  int
+	HighPeerThreshold int
+
+	// AddressValidator is consulted before storing an address that has been
+	// learned from another peer. It is nil when all addresses are accepted.
+	AddressValidator PeerAddressValidator
+
+	// Clock is used to schedule passes of pinging peers, to measure
+	// round-trip times, and to timestamp when peers are seen.
+	Clock clock.Clock
 }
 
 func DefaultDiscoveryOptions() DiscoveryOptions {
@@ -90,6 +166,11 @@ func DefaultDiscoveryOptions() DiscoveryOptions {
 		Alpha:            DefaultAlpha,
 		MaxExpectedPeers: DefaultAlpha,
 		PingTimePeriod:   DefaultTimeout,
+		RTTMultiplier:    DefaultRTTMultiplier,
+
+		AsymmetryThreshold: DefaultAsymmetryThreshold,
+
+		Clock: clock.Real{},
 	}
 }
 
@@ -113,13 +194,252 @@ func (opts DiscoveryOptions) WithPingTimePeriod(period time.Duration) DiscoveryO
 	return opts
 }
 
+// WithAdaptivePingTimePeriod makes the time between passes of pinging peers
+// depend on the number of peers in the table. When the table has lowPeers
+// peers, or fewer, passes happen every minPeriod, so that a peer with few
+// peers (for example, after starting, or after a network partition) recovers
+// quickly. When the table has highPeers peers, or more, passes happen every
+// ping time period, which reduces the number of pings sent by well-connected
+// peers. Between the two thresholds, the period grows linearly. A minPeriod of
+// zero, or less, or one that is not less than the ping time period, means the
+// ping time period is fixed.
+func (opts DiscoveryOptions) WithAdaptivePingTimePeriod(minPeriod time.Duration, lowPeers, highPeers int) DiscoveryOptions {
+	opts.MinPingTimePeriod = minPeriod
+	opts.LowPeerThreshold = lowPeers
+	opts.HighPeerThreshold = highPeers
+	return opts
+}
+
+// WithBootstrapPeers sets the peers that are added to the table when the peer
+// is created. Bootstrap peers are deduplicated by signatory, keeping the
+// address with the latest nonce, so the same peer can safely be listed more
+// than once (for example, with different textual forms of its address).
+func (opts DiscoveryOptions) WithBootstrapPeers(peers []wire.SignatoryAndAddress) DiscoveryOptions {
+	opts.BootstrapPeers = peers
+	return opts
+}
+
+// WithRTTMultiplier sets the multiple of the last measured round-trip time that
+// is used as the ping timeout for a peer. Peers without a measured round-trip
+// time use the ping time period divided by alpha. A multiplier of zero, or
+// less, disables round-trip time based timeouts.
+func (opts DiscoveryOptions) WithRTTMultiplier(multiplier int) DiscoveryOptions {
+	opts.RTTMultiplier = multiplier
+	return opts
+}
+
+// WithPresenceDigestSize sets the maximum number of peers included in the
+// presence digest that is sent to peers after pinging them. The digest contains
+// the peers that were most recently seen alive, and allows the liveness view to
+// converge faster than with pings alone. A size of zero, or less, disables
+// presence digests.
+func (opts DiscoveryOptions) WithPresenceDigestSize(size int) DiscoveryOptions {
+	opts.PresenceDigestSize = size
+	return opts
+}
+
+// WithMaxPassDuration sets the maximum amount of time that one pass of pinging
+// peers can take, before the rest of the pass is canceled. This stops slow
+// pings from delaying the next pass. A duration of zero, or less, means that
+// 80% of the current ping interval is used.
+func (opts DiscoveryOptions) WithMaxPassDuration(duration time.Duration) DiscoveryOptions {
+	opts.MaxPassDuration = duration
+	return opts
+}
+
+// WithAsymmetryThreshold sets how many pings must be received from a peer,
+// while the same number of pings to that peer go unacknowledged, before the
+// connectivity with that peer is considered to be asymmetric. A threshold of
+// zero, or less, disables detection.
+func (opts DiscoveryOptions) WithAsymmetryThreshold(threshold int) DiscoveryOptions {
+	opts.AsymmetryThreshold = threshold
+	return opts
+}
+
+// WithExchangeOnConnect enables pinging remote peers as soon as a connection to
+// them is established, so that peers that connect for the first time learn the
+// peers that are known by each other immediately, instead of waiting for the
+// next pass of peer discovery. Addresses are merged into the table in the same
+// way as they are during peer discovery.
+func (opts DiscoveryOptions) WithExchangeOnConnect(enabled bool) DiscoveryOptions {
+	opts.ExchangeOnConnect = enabled
+	return opts
+}
+
+// WithAddressValidator sets the validator that is consulted before storing an
+// address that has been learned from another peer. Addresses that it rejects
+// are not stored. This allows operators to enforce their own policies, such as
+// rejecting private IP ranges in a public network. Bootstrap peers are not
+// validated.
+func (opts DiscoveryOptions) WithAddressValidator(validator PeerAddressValidator) DiscoveryOptions {
+	opts.AddressValidator = validator
+	return opts
+}
+
+// WithClock sets the Clock used to schedule passes of pinging peers, to measure
+// round-trip times, and to timestamp when peers are seen. It should be the
+// same Clock that is used by the table.
+func (opts DiscoveryOptions) WithClock(c clock.Clock) DiscoveryOptions {
+	opts.Clock = c
+	return opts
+}
+
+// WithInsertionRateLimit limits the rate at which new peers, learned from the
+// ping acks of a remote peer, are inserted into the table. Each remote peer
+// can insert at most burst new peers at once, and the allowance is refilled at
+// the given rate (in peers per second). Updates to peers that are already in
+// the table are not limited. A rate of zero, or less, means there is no limit.
+func (opts DiscoveryOptions) WithInsertionRateLimit(r rate.Limit, burst int) DiscoveryOptions {
+	opts.InsertionRateLimit = r
+	opts.InsertionBurst = burst
+	return opts
+}
+
+// Names of the components of a peer. These are passed to the logger factory
+// given to Options.WithLoggerFactory.
+const (
+	ComponentPeer      = "peer"
+	ComponentSync      = "sync"
+	ComponentGossip    = "gossip"
+	ComponentDiscovery = "discovery"
+	ComponentStream    = "stream"
+)
+
+type StreamerOptions struct {
+	Logger     *zap.Logger
+	ChunkSize  int
+	BufferSize int
+	Timeout    time.Duration
+	MaxStreams int
+	// Clock is used to time out received streams, and to find the oldest
+	// stream when one needs to be evicted.
+	Clock clock.Clock
+}
+
+func DefaultStreamerOptions() StreamerOptions {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		panic(err)
+	}
+	return StreamerOptions{
+		Logger:     logger,
+		ChunkSize:  DefaultStreamChunkSize,
+		BufferSize: DefaultStreamBufferSize,
+		Timeout:    DefaultStreamTimeout,
+		MaxStreams: DefaultStreamMaxStreams,
+		Clock:      clock.Real{},
+	}
+}
+
+func (opts StreamerOptions) WithLogger(logger *zap.Logger) StreamerOptions {
+	opts.Logger = logger
+	return opts
+}
+
+// WithChunkSize sets the maximum number of bytes sent in each chunk of a
+// stream. It must be smaller than the maximum message size of the channel.
+func (opts StreamerOptions) WithChunkSize(size int) StreamerOptions {
+	opts.ChunkSize = size
+	return opts
+}
+
+// WithBufferSize sets the number of chunks that are buffered for each received
+// stream. Together with the chunk size, this bounds the memory used by each
+// received stream. If a chunk is received while the buffer is full, because
+// the stream is not being read fast enough, the stream is reset and reading
+// from it returns ErrStreamOverflow.
+func (opts StreamerOptions) WithBufferSize(size int) StreamerOptions {
+	opts.BufferSize = size
+	return opts
+}
+
+// WithTimeout sets how long to wait for the next chunk of a received stream
+// before giving up on it.
+func (opts StreamerOptions) WithTimeout(timeout time.Duration) StreamerOptions {
+	opts.Timeout = timeout
+	return opts
+}
+
+// WithMaxStreams sets the maximum number of received streams that can be in
+// progress at the same time. When a new stream is received, and the maximum
+// has been reached, the oldest stream is evicted. Together with the chunk size
+// and buffer size, this bounds the memory used for reassembling streams. A
+// maximum of zero, or less, means there is no maximum.
+func (opts StreamerOptions) WithMaxStreams(max int) StreamerOptions {
+	opts.MaxStreams = max
+	return opts
+}
+
+// WithClock sets the Clock used to time out received streams.
+func (opts StreamerOptions) WithClock(c clock.Clock) StreamerOptions {
+	opts.Clock = c
+	return opts
+}
+
 type Options struct {
 	SyncerOptions
 	GossiperOptions
 	DiscoveryOptions
+	StreamerOptions
 
 	Logger  *zap.Logger
 	PrivKey *id.PrivKey
+
+	// MaxConcurrentSends bounds the number of sends that can be in progress at
+	// the same time. Excess sends block until capacity is available, or their
+	// context is done. A value of zero, or less, means there is no bound.
+	MaxConcurrentSends int
+
+	// MaxConcurrentGossips bounds the number of gossips that can be in
+	// progress at the same time, because each gossip fans out to many peers.
+	// Excess gossips block until capacity is available, or their context is
+	// done. A value of zero, or less, means there is no bound.
+	MaxConcurrentGossips int
+
+	// FanOutWorkers bounds the number of goroutines that Peer.SendMany uses to
+	// send to remote peers concurrently.
+	FanOutWorkers int
+
+	// ReplayWindow is how long the nonce of a received message is remembered,
+	// so that replays of the same message can be dropped before being
+	// delivered by Receive. A window of zero, or less, disables replay protection.
+	// ReplayCacheSize bounds the number of messages that are remembered.
+	ReplayWindow    time.Duration
+	ReplayCacheSize int
+
+	// IdempotencyWindow is how long the idempotency keys of received
+	// messages are remembered, so that duplicates can be suppressed.
+	// IdempotencyCacheSize bounds the number of keys that are remembered.
+	IdempotencyWindow    time.Duration
+	IdempotencyCacheSize int
+
+	// ReliableRetries is the number of times that Peer.SendReliable sends a
+	// message again, when it is not acknowledged. ReliableTimeout is how long
+	// to wait for the first acknowledgement, and it doubles after every retry.
+	ReliableRetries int
+	ReliableTimeout time.Duration
+
+	// PauseBufferSize is the maximum number of messages that are buffered for
+	// receivers while the peer is paused. Messages received while the buffer
+	// is full are dropped.
+	PauseBufferSize int
+
+	// EventBuffer is the number of events that are buffered for the consumer
+	// of Peer.Events, and for each subscriber. Events emitted while the buffer
+	// is full are dropped, and counted by Peer.DroppedEvents (or, for
+	// subscribers, by Peer.DroppedSubscriberEvents). A buffer of zero means
+	// that events are only delivered when the consumer is already waiting for
+	// them.
+	EventBuffer int
+
+	// Observer peers receive messages, and learn about other peers, but never
+	// forward anything. They do not propagate gossip, serve pulls, or share
+	// the peers that they know about.
+	Observer bool
+
+	// ReadinessCheck decides whether or not the peer is ready, given its
+	// health. It is used by Peer.Ready.
+	ReadinessCheck ReadinessCheck
 }
 
 func DefaultOptions() Options {
@@ -132,9 +452,22 @@ func DefaultOptions() Options {
 		SyncerOptions:    DefaultSyncerOptions(),
 		GossiperOptions:  DefaultGossiperOptions(),
 		DiscoveryOptions: DefaultDiscoveryOptions(),
+		StreamerOptions:  DefaultStreamerOptions(),
 
 		Logger:  logger,
 		PrivKey: privKey,
+
+		IdempotencyWindow:    DefaultIdempotencyWindow,
+		IdempotencyCacheSize: DefaultIdempotencyCacheSize,
+
+		ReliableRetries: DefaultReliableRetries,
+		ReliableTimeout: DefaultReliableTimeout,
+
+		FanOutWorkers: DefaultFanOutWorkers,
+
+		PauseBufferSize: DefaultPauseBufferSize,
+		EventBuffer:     DefaultEventBuffer,
+		ReadinessCheck:  DefaultReadinessCheck,
 	}
 }
 
@@ -153,12 +486,130 @@ func (opts Options) WithDiscoveryOptions(discoveryOptions DiscoveryOptions) Opti
 	return opts
 }
 
+func (opts Options) WithStreamerOptions(streamerOptions StreamerOptions) Options {
+	opts.StreamerOptions = streamerOptions
+	return opts
+}
+
 func (opts Options) WithLogger(logger *zap.Logger) Options {
 	opts.Logger = logger
 	return opts
 }
 
+// WithLoggerFactory sets the logger of the peer, and the loggers of all of its
+// components, by calling the factory with the name of each component. This
+// allows components to log at different levels, or to different places.
+func (opts Options) WithLoggerFactory(f func(component string) *zap.Logger) Options {
+	opts.Logger = f(ComponentPeer)
+	opts.SyncerOptions.Logger = f(ComponentSync)
+	opts.GossiperOptions.Logger = f(ComponentGossip)
+	opts.DiscoveryOptions.Logger = f(ComponentDiscovery)
+	opts.StreamerOptions.Logger = f(ComponentStream)
+	return opts
+}
+
+// WithClock sets the Clock used by the peer, and by all of its components, to
+// tell the time. It should be the same Clock that is used by the table, the
+// transport, and the channel client.
+func (opts Options) WithClock(c clock.Clock) Options {
+	opts.DiscoveryOptions.Clock = c
+	opts.GossiperOptions.Clock = c
+	opts.StreamerOptions.Clock = c
+	return opts
+}
+
+// ComponentLogger returns a logger factory that annotates the logger with the
+// name of the component, using the "component" field.
+func ComponentLogger(logger *zap.Logger) func(component string) *zap.Logger {
+	return func(component string) *zap.Logger {
+		return logger.With(zap.String("component", component))
+	}
+}
+
 func (opts Options) WithPrivKey(privKey *id.PrivKey) Options {
 	opts.PrivKey = privKey
 	return opts
 }
+
+// WithMaxConcurrentSends sets the maximum number of sends that can be in
+// progress at the same time. This provides backpressure to the application.
+func (opts Options) WithMaxConcurrentSends(max int) Options {
+	opts.MaxConcurrentSends = max
+	return opts
+}
+
+// WithMaxConcurrentGossips sets the maximum number of gossips that can be in
+// progress at the same time. This provides backpressure to the application.
+func (opts Options) WithMaxConcurrentGossips(max int) Options {
+	opts.MaxConcurrentGossips = max
+	return opts
+}
+
+// WithFanOutWorkers sets the maximum number of goroutines that Peer.SendMany
+// uses to send to remote peers concurrently. A value of zero, or less, means
+// that every remote peer is sent to concurrently.
+func (opts Options) WithFanOutWorkers(workers int) Options {
+	opts.FanOutWorkers = workers
+	return opts
+}
+
+// WithReplayProtection drops direct messages that have the same nonce as a
+// message that was received, from the same peer, within the window. At most
+// size messages are remembered. Every message sent using Peer.Send has its own
+// nonce, so this protects handlers that are not idempotent from replayed
+// messages, while messages with the same content are still delivered.
+func (opts Options) WithReplayProtection(window time.Duration, size int) Options {
+	opts.ReplayWindow = window
+	opts.ReplayCacheSize = size
+	return opts
+}
+
+// WithIdempotency sets how long the idempotency keys of messages sent using
+// Peer.SendIdempotent are remembered by receivers, and how many keys are
+// remembered. Duplicates that arrive after their key has been forgotten are
+// delivered again.
+func (opts Options) WithIdempotency(window time.Duration, size int) Options {
+	opts.IdempotencyWindow = window
+	opts.IdempotencyCacheSize = size
+	return opts
+}
+
+// WithReliability sets the number of times that messages sent using
+// Peer.SendReliable are retried when they are not acknowledged, and how long
+// to wait for the first acknowledgement. The timeout doubles after every
+// retry.
+func (opts Options) WithReliability(retries int, timeout time.Duration) Options {
+	opts.ReliableRetries = retries
+	opts.ReliableTimeout = timeout
+	return opts
+}
+
+// WithPauseBufferSize sets the maximum number of messages that are buffered
+// for receivers while the peer is paused.
+func (opts Options) WithPauseBufferSize(size int) Options {
+	opts.PauseBufferSize = size
+	return opts
+}
+
+// WithEventBuffer sets the number of events that are buffered for the consumer
+// of Peer.Events. Events are dropped, rather than blocking the peer, when the
+// buffer is full.
+func (opts Options) WithEventBuffer(size int) Options {
+	opts.EventBuffer = size
+	return opts
+}
+
+// WithObserver sets whether or not the peer is an observer. Observers take part
+// in the network, receiving and recording messages, but never forward content
+// or peer addresses to other peers. This is useful for monitoring nodes.
+func (opts Options) WithObserver(observer bool) Options {
+	opts.Observer = observer
+	return opts
+}
+
+// WithReadinessCheck sets the check that decides whether or not the peer is
+// ready. Checks can be combined using AllOf.
+func (opts Options) WithReadinessCheck(check ReadinessCheck) Options {
+	opts.ReadinessCheck = check
+	return opts
+}
@@ -1 +1,79 @@
 package peer_test
+
+import (
+	"time"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/clock"
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/peer"
+	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Options", func() {
+	Context("when using a component logger factory", func() {
+		It("should annotate logs with the name of the component", func() {
+			core, logs := observer.New(zapcore.DebugLevel)
+			opts := peer.DefaultOptions().WithLoggerFactory(peer.ComponentLogger(zap.New(core)))
+			self := opts.PrivKey.Signatory()
+			t := transport.New(
+				transport.DefaultOptions().WithLogger(zap.NewNop()),
+				self,
+				channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), self),
+				handshake.ECIES(opts.PrivKey),
+				dht.NewInMemTable(self))
+			p := peer.New(opts, t)
+			from := id.NewPrivKey().Signatory()
+
+			// Pulling unknown content is logged by the gossiper.
+			Expect(p.Gossiper().DidReceiveMessage(from, wire.Msg{Type: wire.MsgTypePull, Data: []byte("content")})).To(Succeed())
+			// Chunks of unknown streams are logged by the streamer.
+			chunk := make([]byte, 17)
+			chunk[15] = 1
+			Expect(p.Streamer().DidReceiveMessage(from, wire.Msg{Type: wire.MsgTypeStream, Data: chunk})).To(Succeed())
+
+			gossipLogs := logs.FilterField(zap.String("component", peer.ComponentGossip)).All()
+			Expect(gossipLogs).To(HaveLen(1))
+			Expect(gossipLogs[0].Message).To(Equal("content not found"))
+
+			streamLogs := logs.FilterField(zap.String("component", peer.ComponentStream)).All()
+			Expect(streamLogs).To(HaveLen(1))
+			Expect(streamLogs[0].Message).To(Equal("stream"))
+		})
+
+		It("should allow components to log at different levels", func() {
+			core, logs := observer.New(zapcore.DebugLevel)
+			opts := peer.DefaultOptions().WithLoggerFactory(func(component string) *zap.Logger {
+				logger := zap.New(core)
+				if component != peer.ComponentGossip {
+					logger = logger.WithOptions(zap.IncreaseLevel(zapcore.ErrorLevel))
+				}
+				return peer.ComponentLogger(logger)(component)
+			})
+
+			opts.GossiperOptions.Logger.Debug("gossip")
+			opts.DiscoveryOptions.Logger.Debug("discovery")
+			Expect(logs.FilterMessage("gossip").Len()).To(Equal(1))
+			Expect(logs.FilterMessage("discovery").Len()).To(Equal(0))
+		})
+	})
+
+	Context("when setting a clock", func() {
+		It("should be used by all components", func() {
+			c := clock.NewVirtual(time.Unix(0, 0))
+			opts := peer.DefaultOptions().WithClock(c)
+			Expect(opts.DiscoveryOptions.Clock).To(Equal(c))
+			Expect(opts.GossiperOptions.Clock).To(Equal(c))
+			Expect(opts.StreamerOptions.Clock).To(Equal(c))
+		})
+	})
+})
@@ -0,0 +1,89 @@
+package peer
+
+import (
+	"sync"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+)
+
+type pausedDelivery struct {
+	f      func(id.Signatory, wire.Packet) error
+	from   id.Signatory
+	packet wire.Packet
+}
+
+// pauser buffers deliveries to application receivers while paused, and
+// delivers them, in order, when resumed.
+type pauser struct {
+	logger     *zap.Logger
+	bufferSize int
+
+	mu       *sync.Mutex
+	paused   bool
+	buffered []pausedDelivery
+}
+
+func newPauser(logger *zap.Logger, bufferSize int) *pauser {
+	return &pauser{
+		logger:     logger,
+		bufferSize: bufferSize,
+
+		mu:       new(sync.Mutex),
+		paused:   false,
+		buffered: nil,
+	}
+}
+
+func (p *pauser) pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.paused = true
+}
+
+func (p *pauser) isPaused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.paused
+}
+
+func (p *pauser) resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.paused {
+		return
+	}
+	p.paused = false
+
+	// Deliver while holding the lock, so that new messages are not delivered
+	// before the buffered messages.
+	buffered := p.buffered
+	p.buffered = nil
+	for _, delivery := range buffered {
+		if err := delivery.f(delivery.from, delivery.packet); err != nil {
+			p.logger.Error("resume", zap.String("remote", delivery.from.String()), zap.Error(err))
+		}
+	}
+}
+
+// wrap a receiver so that it is not called while paused.
+func (p *pauser) wrap(f func(id.Signatory, wire.Packet) error) func(id.Signatory, wire.Packet) error {
+	return func(from id.Signatory, packet wire.Packet) error {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		if !p.paused {
+			return f(from, packet)
+		}
+		if len(p.buffered) >= p.bufferSize {
+			p.logger.Warn("paused", zap.String("remote", from.String()), zap.String("message", "buffer full"))
+			return nil
+		}
+		p.buffered = append(p.buffered, pausedDelivery{f: f, from: from, packet: packet})
+		return nil
+	}
+}
@@ -2,8 +2,12 @@ package peer
 
 import (
 	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/renproject/aw/channel"
@@ -18,10 +22,37 @@ var (
 	DefaultAlpha         = 5
 	DefaultTimeout       = time.Second
 	DefaultGossipTimeout = 3 * time.Second
+	DefaultRTTMultiplier = 5
+
+	DefaultGossipDedupCacheSize     = 4096
+	DefaultGossipPropagationWorkers = 16
+
+	DefaultAsymmetryThreshold = 3
+
+	DefaultInsertionLimiterCap = 1024
+
+	DefaultStreamChunkSize  = 64 * 1024
+	DefaultStreamBufferSize = 16
+	DefaultStreamTimeout    = 30 * time.Second
+	DefaultStreamMaxStreams = 64
+
+	DefaultPauseBufferSize = 1024
+	DefaultEventBuffer     = 64
+
+	DefaultIdempotencyWindow    = time.Minute
+	DefaultIdempotencyCacheSize = 4096
+
+	DefaultReliableRetries = 3
+	DefaultReliableTimeout = time.Second
+
+	DefaultFanOutWorkers = 16
 )
 
 var (
-	ErrPeerNotFound = errors.New("peer not found")
+	ErrPeerNotFound    = transport.ErrPeerNotFound
+	ErrContentTooLarge = errors.New("content too large")
+	ErrShuttingDown    = errors.New("shutting down")
+	ErrRTTUnknown      = errors.New("round-trip time unknown")
 )
 
 type Peer struct {
@@ -30,17 +61,70 @@ type Peer struct {
 	syncer          *Syncer
 	gossiper        *Gossiper
 	discoveryClient *DiscoveryClient
+	streamer        *Streamer
+
+	// sends is a semaphore that bounds the number of concurrent sends. It is
+	// nil when sends are unbounded.
+	sends chan struct{}
+	// gossips is a semaphore that bounds the number of concurrent gossips. It
+	// is nil when gossips are unbounded.
+	gossips chan struct{}
+
+	pauser   *pauser
+	events   *events
+	acks     *acks
+	shutdown *shutdown
+
+	versions *remoteVersions
 }
 
 func New(opts Options, transport *transport.Transport) *Peer {
 	filter := channel.NewSyncFilter()
-	return &Peer{
+	p := &Peer{
 		opts:            opts,
 		transport:       transport,
 		syncer:          NewSyncer(opts.SyncerOptions, filter, transport),
 		gossiper:        NewGossiper(opts.GossiperOptions, filter, transport),
 		discoveryClient: NewDiscoveryClient(opts.DiscoveryOptions, transport),
+		streamer:        NewStreamer(opts.StreamerOptions, transport),
+		pauser:          newPauser(opts.Logger, opts.PauseBufferSize),
+		events:          newEvents(opts.EventBuffer),
+		acks:            newAcks(),
+		shutdown:        newShutdown(),
+		versions:        newRemoteVersions(),
+	}
+	if opts.MaxConcurrentSends > 0 {
+		p.sends = make(chan struct{}, opts.MaxConcurrentSends)
 	}
+	if opts.MaxConcurrentGossips > 0 {
+		p.gossips = make(chan struct{}, opts.MaxConcurrentGossips)
+	}
+	p.syncer.versions = p.versions
+	p.gossiper.versions = p.versions
+	p.discoveryClient.versions = p.versions
+	p.streamer.versions = p.versions
+	p.gossiper.observer = opts.Observer
+	p.discoveryClient.observer = opts.Observer
+	p.discoveryClient.emit = p.events.emit
+	p.discoveryClient.addBootstrapPeers()
+	if opts.DiscoveryOptions.ExchangeOnConnect {
+		transport.OnConnect(p.discoveryClient.exchangeOnConnect)
+	}
+	transport.OnConnectionChange(p.didChangeConnection)
+	return p
+}
+
+// didChangeConnection emits an EventPeerConnected, or EventPeerDisconnected,
+// when a remote peer becomes connected, or disconnected. Connection changes are
+// reported in the background, so the events for a connection that is closed
+// soon after it is established can be emitted out of order. The transport can
+// be used to check whether a remote peer is currently connected.
+func (p *Peer) didChangeConnection(remote id.Signatory, addr string, connected bool) {
+	ty := EventPeerDisconnected
+	if connected {
+		ty = EventPeerConnected
+	}
+	p.events.emit(Event{Type: ty, Remote: remote, Time: p.opts.DiscoveryOptions.Clock.Now(), Addr: addr})
 }
 
 func (p *Peer) ID() id.Signatory {
@@ -55,10 +139,86 @@ func (p *Peer) Gossiper() *Gossiper {
 	return p.gossiper
 }
 
+func (p *Peer) DiscoveryClient() *DiscoveryClient {
+	return p.discoveryClient
+}
+
+func (p *Peer) Streamer() *Streamer {
+	return p.streamer
+}
+
 func (p *Peer) Transport() *transport.Transport {
 	return p.transport
 }
 
+// Events returns the channel on which the peer emits events. Events are
+// buffered, up to the event buffer size, and events that are emitted while the
+// buffer is full are dropped, so the peer never blocks on a slow consumer.
+// Events are only emitted on the channel after Events has been called, so
+// events that happen before then are neither buffered, nor dropped.
+func (p *Peer) Events() <-chan Event {
+	return p.events.consume()
+}
+
+// Subscribe returns a new channel on which the peer emits events, and a
+// function that unsubscribes and closes the channel. Each subscriber has its
+// own buffer, of the event buffer size, so a slow subscriber cannot block the
+// peer, or other subscribers. Events emitted while the buffer of a subscriber
+// is full are dropped for that subscriber, and counted by
+// DroppedSubscriberEvents. Subscribing does not affect the
+// channel returned by Events.
+func (p *Peer) Subscribe() (<-chan Event, func()) {
+	return p.events.subscribe()
+}
+
+// RemoveExpiredPeers removes all peers that have neither been added, nor seen
+// alive, within the given duration from the table. Pinned peers are never
+// removed. An EventPeerRemoved is emitted for every removed peer, and the
+// removed peers are returned.
+func (p *Peer) RemoveExpiredPeers(maxAge time.Duration) []id.Signatory {
+	removed := p.transport.Table().RemoveExpired(maxAge)
+	now := p.opts.DiscoveryOptions.Clock.Now()
+	for _, remote := range removed {
+		p.events.emit(Event{Type: EventPeerRemoved, Remote: remote, Time: now})
+	}
+	return removed
+}
+
+// DroppedEvents returns the number of events that have been dropped from the
+// channel returned by Events, because its buffer was full when they were
+// emitted. Events dropped by subscribers are not included.
+func (p *Peer) DroppedEvents() uint64 {
+	return p.events.numDropped()
+}
+
+// DroppedSubscriberEvents returns the total number of events that have been
+// dropped by subscribers, because their buffers were full when the events were
+// emitted.
+func (p *Peer) DroppedSubscriberEvents() uint64 {
+	return p.events.numSubsDropped()
+}
+
+// Health returns a snapshot of the state of the peer.
+func (p *Peer) Health() Health {
+	table := p.transport.Table()
+	return Health{
+		NumPeers:     table.NumPeers(),
+		NumSubnets:   len(table.PeerSubnets(p.ID())),
+		Bootstrapped: p.discoveryClient.Bootstrapped(),
+		Paused:       p.pauser.isPaused(),
+	}
+}
+
+// Ready returns true if the readiness check of the peer considers it to be
+// ready. If no readiness check has been configured, the default is used.
+func (p *Peer) Ready() bool {
+	check := p.opts.ReadinessCheck
+	if check == nil {
+		check = DefaultReadinessCheck
+	}
+	return check(p.Health())
+}
+
 func (p *Peer) Link(remote id.Signatory) {
 	p.transport.Link(remote)
 }
@@ -67,28 +227,256 @@ func (p *Peer) Unlink(remote id.Signatory) {
 	p.transport.Unlink(remote)
 }
 
+// WarmConnections links the peer to the remote peers, and dials them, so that
+// later sends do not pay the cost of dialing and handshaking. It blocks until
+// all of the remote peers are connected, or the context is done. The remote
+// peers stay linked until they are unlinked.
+func (p *Peer) WarmConnections(ctx context.Context, remotes []id.Signatory) error {
+	for _, remote := range remotes {
+		p.transport.Link(remote)
+		if err := p.transport.Dial(ctx, remote); err != nil {
+			return fmt.Errorf("warming connection to %v: %w", remote, err)
+		}
+	}
+
+	for _, remote := range remotes {
+		if err := p.awaitConnection(ctx, remote); err != nil {
+			return fmt.Errorf("warming connection to %v: %w", remote, err)
+		}
+	}
+	return nil
+}
+
+// Connect to a remote peer, and block until the connection has been
+// established and the handshake has completed, or the context is done. An
+// existing connection is reused. If the address of the remote peer is not in
+// the table, it is resolved before dialing. Like WarmConnections, the remote
+// peer stays linked until it is unlinked, so the connection is kept alive for
+// the sends that follow.
+func (p *Peer) Connect(ctx context.Context, remote id.Signatory) error {
+	if p.transport.IsConnected(remote) {
+		return nil
+	}
+	if _, ok := p.transport.Table().PeerAddress(remote); !ok {
+		if err := p.transport.ResolveAddress(ctx, remote); err != nil {
+			return fmt.Errorf("connecting to %v: %w", remote, err)
+		}
+	}
+	p.transport.Link(remote)
+	if err := p.transport.Dial(ctx, remote); err != nil {
+		return fmt.Errorf("connecting to %v: %w", remote, err)
+	}
+	if err := p.awaitConnection(ctx, remote); err != nil {
+		return fmt.Errorf("connecting to %v: %w", remote, err)
+	}
+	return nil
+}
+
+// awaitConnection blocks until the remote peer is connected, or the context is
+// done.
+func (p *Peer) awaitConnection(ctx context.Context, remote id.Signatory) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !p.transport.IsConnected(remote) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// PinPeer prevents a peer from being evicted from the table, regardless of its
+// liveness. Pinned peers continue to be pinged during peer discovery.
+func (p *Peer) PinPeer(remote id.Signatory) {
+	p.transport.Table().PinPeer(remote)
+}
+
+// UnpinPeer allows a previously pinned peer to be evicted from the table.
+func (p *Peer) UnpinPeer(remote id.Signatory) {
+	p.transport.Table().UnpinPeer(remote)
+}
+
+// PeerSubnets returns the hashes of all subnets, known to this peer, that
+// contain the remote peer.
+func (p *Peer) PeerSubnets(remote id.Signatory) []id.Hash {
+	return p.transport.Table().PeerSubnets(remote)
+}
+
 func (p *Peer) Ping(ctx context.Context) error {
 	return fmt.Errorf("unimplemented")
 }
 
+// Send a message to a remote peer. Direct messages that have no nonce are given
+// a random one, so that receivers with replay protection can tell a replayed
+// message apart from a new message with the same content. If the remote peer
+// has advertised the message version that it supports, the message is sent
+// with that version.
 func (p *Peer) Send(ctx context.Context, to id.Signatory, msg wire.Msg) error {
+	end, err := p.shutdown.begin()
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	if msg.Type == wire.MsgTypeSend && msg.Nonce == 0 {
+		var nonce [8]byte
+		if _, err := cryptorand.Read(nonce[:]); err != nil {
+			return fmt.Errorf("generating nonce: %v", err)
+		}
+		msg.Nonce = binary.BigEndian.Uint64(nonce[:])
+	}
+	if version, ok := p.versions.get(to); ok {
+		msg.Version = version
+	}
+
+	if p.sends != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case p.sends <- struct{}{}:
+		}
+		defer func() { <-p.sends }()
+	}
 	return p.transport.Send(ctx, to, msg)
 }
 
+// SendMany sends the same message to many remote peers concurrently, using at
+// most FanOutWorkers goroutines. The To field of the message is set to each
+// remote peer in turn. If sending to any of the remote peers fails, a
+// *SendErrors is returned, containing the error for each remote peer that
+// failed, so that only those remote peers need to be retried.
+func (p *Peer) SendMany(ctx context.Context, to []id.Signatory, msg wire.Msg) error {
+	workers := p.opts.FanOutWorkers
+	if workers <= 0 || workers > len(to) {
+		workers = len(to)
+	}
+
+	results := make([]error, len(to))
+	indices := make(chan int)
+	wg := new(sync.WaitGroup)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				msg := msg
+				msg.To = id.Hash(to[i])
+				results[i] = p.Send(ctx, to[i], msg)
+			}
+		}()
+	}
+	for i := range to {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	errs := new(SendErrors)
+	for i, remote := range to {
+		errs.add(remote, results[i])
+	}
+	return errs.Err()
+}
+
+// SendStream sends the data from a reader to a remote peer, one chunk at a time,
+// so that the entire payload never needs to be held in memory.
+func (p *Peer) SendStream(ctx context.Context, to id.Signatory, r io.Reader) error {
+	end, err := p.shutdown.begin()
+	if err != nil {
+		return err
+	}
+	defer end()
+	return p.streamer.Send(ctx, to, r)
+}
+
+// ReceiveStreams sets the function that is called, with a reader for the
+// reassembled data, whenever a new stream is received from a remote peer.
+func (p *Peer) ReceiveStreams(f func(id.Signatory, io.Reader)) {
+	p.streamer.Receive(f)
+}
+
+// QueueDepths returns the number of outbound messages, by message type, that
+// are waiting to be written to network connections. This can be used to find
+// which kind of message is backing up.
+func (p *Peer) QueueDepths() map[uint16]int {
+	return p.transport.QueueDepths()
+}
+
 func (p *Peer) Sync(ctx context.Context, contentID []byte, hint *id.Signatory) ([]byte, error) {
+	end, err := p.shutdown.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer end()
 	return p.syncer.Sync(ctx, contentID, hint)
 }
 
-func (p *Peer) Gossip(ctx context.Context, contentID []byte, subnet *id.Hash) {
-	p.gossiper.Gossip(ctx, contentID, subnet)
+func (p *Peer) Gossip(ctx context.Context, contentID []byte, subnet *id.Hash) error {
+	return p.gossip(ctx, func() error {
+		return p.gossiper.Gossip(ctx, contentID, subnet)
+	})
+}
+
+// GossipWithHopLimit gossips content that stops being propagated after it has
+// travelled the given number of hops. See Gossiper.GossipWithHopLimit.
+func (p *Peer) GossipWithHopLimit(ctx context.Context, contentID []byte, subnet *id.Hash, hops uint8) error {
+	return p.gossip(ctx, func() error {
+		return p.gossiper.GossipWithHopLimit(ctx, contentID, subnet, hops)
+	})
+}
+
+func (p *Peer) gossip(ctx context.Context, f func() error) error {
+	end, err := p.shutdown.begin()
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	if p.gossips != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case p.gossips <- struct{}{}:
+		}
+		defer func() { <-p.gossips }()
+	}
+	return f()
 }
 
 func (p *Peer) DiscoverPeers(ctx context.Context) {
 	p.discoveryClient.DiscoverPeers(ctx)
 }
 
+// Run the peer until the context is done, or the peer is shut down.
 func (p *Peer) Run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-p.shutdown.done:
+			cancel()
+		}
+	}()
+
 	p.transport.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+		// Protocol messages with unsupported versions are not understood, so
+		// instead of handling them, the remote peer is told which version to
+		// use. Application messages are left to the application.
+		if packet.Msg.Version != LatestMsgVersion && isProtocolMsgType(packet.Msg.Type) {
+			p.didReceiveUnsupportedVersion(from, packet.Msg)
+			return nil
+		}
+		if packet.Msg.Type == wire.MsgTypeVersionUnsupported {
+			return p.didReceiveVersionUnsupported(from, packet.Msg)
+		}
+		if packet.Msg.Type == wire.MsgTypeSendAck {
+			p.acks.didReceiveAck(from, string(packet.Msg.Data))
+			return nil
+		}
+
 		// TODO(ross): Think about merging the syncer and the gossiper.
 		if err := p.syncer.DidReceiveMessage(from, packet.Msg); err != nil {
 			return err
@@ -99,13 +487,62 @@ func (p *Peer) Run(ctx context.Context) {
 		if err := p.discoveryClient.DidReceiveMessage(from, packet.IPAddr, packet.Msg); err != nil {
 			return err
 		}
+		if err := p.streamer.DidReceiveMessage(from, packet.Msg); err != nil {
+			return err
+		}
 		return nil
 	})
 	p.transport.Run(ctx)
 }
 
+// Receive messages from remote peers. If replay protection is enabled, direct
+// messages with a nonce that has already been received from the same remote
+// peer within the replay window are not passed to the function. Direct messages
+// without a nonce, from peers that do not set one, are always passed to the
+// function. Idempotent messages are passed to the function, as
+// normal direct messages, only the first time that their key is received.
+// While the peer is paused, messages are buffered instead of being passed to
+// the function.
 func (p *Peer) Receive(ctx context.Context, f func(id.Signatory, wire.Packet) error) {
-	p.transport.Receive(ctx, f)
+	// Deduplication happens when buffered messages are delivered, so that
+	// reliable messages are only acknowledged, and remembered, once they have
+	// been passed to the function. Reliable messages that are dropped, because
+	// the pause buffer is full, are retried by the sender.
+	f = p.pauser.wrap(p.deduplicate(f))
+	if p.opts.ReplayWindow <= 0 {
+		p.transport.Receive(ctx, f)
+		return
+	}
+
+	// Every receiver has its own cache, so that every receiver gets to see
+	// every message once.
+	cache := newReplayCache(p.opts.ReplayWindow, p.opts.ReplayCacheSize)
+	p.transport.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+		if packet.Msg.Type == wire.MsgTypeSend && packet.Msg.Nonce != 0 {
+			buf := make([]byte, len(from)+8)
+			copy(buf, from[:])
+			binary.BigEndian.PutUint64(buf[len(from):], packet.Msg.Nonce)
+			if cache.replayed(id.NewHash(buf), p.opts.DiscoveryOptions.Clock.Now()) {
+				return nil
+			}
+		}
+		return f(from, packet)
+	})
+}
+
+// Pause stops messages from being passed to the functions given to Receive.
+// Messages are buffered, up to the pause buffer size, until Resume is called.
+// Connections, syncing, gossiping, and peer discovery are not affected. Pause
+// must not be called from within a function given to Receive.
+func (p *Peer) Pause() {
+	p.pauser.pause()
+}
+
+// Resume passes buffered messages, in the order that they were received, to
+// the functions given to Receive, and then continues passing messages as
+// normal. Resume must not be called from within a function given to Receive.
+func (p *Peer) Resume() {
+	p.pauser.resume()
 }
 
 func (p *Peer) Resolve(ctx context.Context, contentResolver dht.ContentResolver) {
@@ -2,15 +2,26 @@ package peer_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/clock"
 	"github.com/renproject/aw/dht"
 	"github.com/renproject/aw/handshake"
 	"github.com/renproject/aw/peer"
 	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
 )
 
 func setup(numPeers int) ([]peer.Options, []*peer.Peer, []dht.Table, []dht.ContentResolver, []*channel.Client, []*transport.Transport) {
@@ -63,3 +74,587 @@ func setupWithLogger(numPeers int, logger *zap.Logger) ([]peer.Options, []*peer.
 	}
 	return opts, peers, tables, contentResolvers, clients, transports
 }
+
+// blockingTable is a Table that blocks when looking up peer addresses, until it
+// is released. It keeps track of how many lookups are blocked, which is the
+// same as the number of sends that are in progress.
+type blockingTable struct {
+	dht.Table
+
+	mu          *sync.Mutex
+	inFlight    int
+	maxInFlight int
+	release     chan struct{}
+}
+
+func (table *blockingTable) PeerAddress(peerID id.Signatory) (wire.Address, bool) {
+	table.mu.Lock()
+	table.inFlight++
+	if table.inFlight > table.maxInFlight {
+		table.maxInFlight = table.inFlight
+	}
+	table.mu.Unlock()
+
+	<-table.release
+
+	table.mu.Lock()
+	table.inFlight--
+	table.mu.Unlock()
+	return table.Table.PeerAddress(peerID)
+}
+
+func (table *blockingTable) InFlight() int {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	return table.inFlight
+}
+
+// newBlockedPeer returns a peer, and its table, which blocks when looking up
+// peer addresses until it is released. The port on which the peer listens is
+// assigned by the operating system, so that running the peer never conflicts
+// with other peers.
+func newBlockedPeer(opts peer.Options) (*peer.Peer, *blockingTable) {
+	self := opts.PrivKey.Signatory()
+	table := &blockingTable{
+		Table:   dht.NewInMemTable(self),
+		mu:      new(sync.Mutex),
+		release: make(chan struct{}),
+	}
+	t := transport.New(
+		transport.DefaultOptions().WithLogger(zap.NewNop()).WithPort(0),
+		self,
+		channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), self),
+		handshake.ECIES(opts.PrivKey),
+		table)
+	return peer.New(opts, t), table
+}
+
+var _ = Describe("Peer", func() {
+	Context("when warming connections", func() {
+		It("should not dial again when sending to a warmed peer", func() {
+			core, logs := observer.New(zapcore.DebugLevel)
+			n := 2
+			opts, peers, tables, _, _, transports := setupWithLogger(n, zap.New(core))
+
+			cancelPeerContext := createRingTopology(n, opts, peers, tables, transports)
+			defer cancelPeerContext()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			received := make(chan wire.Msg, 1)
+			peers[1].Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				if packet.Msg.Type == wire.MsgTypeSend {
+					select {
+					case received <- packet.Msg:
+					default:
+					}
+				}
+				return nil
+			})
+
+			Expect(peers[0].WarmConnections(ctx, []id.Signatory{peers[1].ID()})).To(Succeed())
+			Expect(transports[0].IsConnected(peers[1].ID())).To(BeTrue())
+			numDials := logs.FilterMessage("dialing").Len()
+			Expect(numDials).To(BeNumerically(">", 0))
+
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, To: id.Hash(peers[1].ID()), Data: []byte("hello")}
+			Expect(peers[0].Send(ctx, peers[1].ID(), msg)).To(Succeed())
+			Eventually(received).Should(Receive())
+			Expect(logs.FilterMessage("dialing").Len()).To(Equal(numDials))
+		})
+
+		It("should return an error for unknown peers", func() {
+			_, peers, _, _, _, _ := setup(1)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			Expect(peers[0].WarmConnections(ctx, []id.Signatory{id.NewPrivKey().Signatory()})).ToNot(Succeed())
+		})
+	})
+
+	Context("when connecting to a peer", func() {
+		It("should resolve its address, and reuse the connection", func() {
+			opts, peers, tables, _, clients, _ := setup(2)
+
+			// The local peer does not know the address of the remote peer,
+			// so it must be resolved.
+			resolves := int64(0)
+			resolver := transport.ResolverFunc(func(ctx context.Context, remote id.Signatory) ([]wire.Address, error) {
+				atomic.AddInt64(&resolves, 1)
+				return []wire.Address{wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano()))}, nil
+			})
+			self := opts[0].PrivKey.Signatory()
+			t := transport.New(
+				transport.DefaultOptions().
+					WithLogger(zap.NewNop()).
+					WithResolver(resolver).
+					WithPort(3333),
+				self,
+				clients[0],
+				handshake.ECIES(opts[0].PrivKey),
+				tables[0])
+			local := peer.New(opts[0], t)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			go local.Run(ctx)
+			go peers[1].Run(ctx)
+
+			Expect(local.Connect(ctx, peers[1].ID())).To(Succeed())
+			Expect(t.IsConnected(peers[1].ID())).To(BeTrue())
+			numResolves := atomic.LoadInt64(&resolves)
+			Expect(numResolves).To(BeNumerically(">", 0))
+
+			// The existing connection is reused, without resolving or
+			// dialing again.
+			Expect(local.Connect(ctx, peers[1].ID())).To(Succeed())
+			Expect(atomic.LoadInt64(&resolves)).To(Equal(numResolves))
+		})
+
+		It("should return an error for unknown peers", func() {
+			_, peers, _, _, _, _ := setup(1)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			Expect(peers[0].Connect(ctx, id.NewPrivKey().Signatory())).To(MatchError(transport.ErrPeerNotFound))
+		})
+	})
+
+	Context("when a remote peer connects, and disconnects", func() {
+		It("should emit connection events", func() {
+			opts, peers, tables, _, clients, _ := setup(2)
+
+			// The local peer drops connections that it accepts, from remote
+			// peers that it is not linked to, soon after accepting them.
+			t := transport.New(
+				transport.DefaultOptions().
+					WithLogger(zap.NewNop()).
+					WithServerTimeout(500*time.Millisecond).
+					WithPort(3333),
+				peers[0].ID(),
+				clients[0],
+				handshake.ECIES(opts[0].PrivKey),
+				tables[0])
+			local := peer.New(opts[0], t)
+			events, unsubscribe := local.Subscribe()
+			defer unsubscribe()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			go local.Run(ctx)
+			go peers[1].Run(ctx)
+
+			expectEvent := func(ty peer.EventType) peer.Event {
+				var ev peer.Event
+				Eventually(events, 2*time.Second).Should(Receive(&ev))
+				Expect(ev.Type).To(Equal(ty), ev.Type.String())
+				Expect(ev.Remote).To(Equal(peers[1].ID()))
+				Expect(ev.Addr).ToNot(BeEmpty())
+				return ev
+			}
+
+			tables[0].AddPeer(peers[1].ID(), wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			tables[1].AddPeer(local.ID(), wire.NewUnsignedAddress(wire.TCP, "localhost:3333", uint64(time.Now().UnixNano())))
+			Expect(peers[1].Connect(ctx, local.ID())).To(Succeed())
+			connected := expectEvent(peer.EventPeerConnected)
+			Expect(t.IsConnected(peers[1].ID())).To(BeTrue())
+
+			// The connection is dropped, but the remote peer is still in the
+			// table.
+			disconnected := expectEvent(peer.EventPeerDisconnected)
+			Expect(disconnected.Addr).To(Equal(connected.Addr))
+			Expect(t.IsConnected(peers[1].ID())).To(BeFalse())
+			_, ok := tables[0].PeerAddress(peers[1].ID())
+			Expect(ok).To(BeTrue())
+		})
+	})
+
+	Context("when sending the same message to many peers", func() {
+		It("should report which peers could not be sent to", func() {
+			n := 3
+			opts, peers, tables, _, _, transports := setup(n)
+			peers[0] = peer.New(opts[0].WithFanOutWorkers(2), transports[0])
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			received := make(chan [2]id.Hash, n)
+			for i := range peers {
+				i := i
+				go peers[i].Run(ctx)
+				peers[i].Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					if packet.Msg.Type == wire.MsgTypeSend {
+						received <- [2]id.Hash{id.Hash(peers[i].ID()), packet.Msg.To}
+					}
+					return nil
+				})
+			}
+			for i := 1; i < n; i++ {
+				tables[0].AddPeer(opts[i].PrivKey.Signatory(),
+					wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("localhost:%v", 3333+i), uint64(time.Now().UnixNano())))
+			}
+
+			// The last remote peer is unknown, so sending to it fails.
+			unknown := id.NewPrivKey().Signatory()
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hello")}
+			err := peers[0].SendMany(ctx, []id.Signatory{peers[1].ID(), peers[2].ID(), unknown}, msg)
+
+			var errs *peer.SendErrors
+			Expect(errors.As(err, &errs)).To(BeTrue())
+			Expect(errs.Total).To(Equal(3))
+			Expect(errs.Failed).To(Equal(1))
+			Expect(errs.Failures).To(HaveLen(1))
+			Expect(errors.Is(errs.Failures[unknown], peer.ErrPeerNotFound)).To(BeTrue())
+
+			// Every remote peer receives the message addressed to itself.
+			// Deliveries are waited for until the test context is done.
+			sent := map[id.Hash]bool{}
+			for len(sent) < 2 {
+				select {
+				case <-ctx.Done():
+					Fail(fmt.Sprintf("received %v of 2 messages: %v", len(sent), ctx.Err()))
+				case receiverAndTo := <-received:
+					Expect(receiverAndTo[1]).To(Equal(receiverAndTo[0]))
+					sent[receiverAndTo[0]] = true
+				}
+			}
+			Expect(sent).To(HaveKey(id.Hash(peers[1].ID())))
+			Expect(sent).To(HaveKey(id.Hash(peers[2].ID())))
+		})
+	})
+
+	Context("when sending more messages than the maximum number of concurrent sends", func() {
+		It("should block the excess sends until capacity is available", func() {
+			opts := peer.DefaultOptions().WithLogger(zap.NewNop()).WithMaxConcurrentSends(3)
+			p, table := newBlockedPeer(opts)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			n := 10
+			wg := new(sync.WaitGroup)
+			wg.Add(n)
+			for i := 0; i < n; i++ {
+				go func() {
+					defer wg.Done()
+					// The remote peer is not in the table, so this will fail
+					// once the table is released.
+					p.Send(ctx, id.NewPrivKey().Signatory(), wire.Msg{})
+				}()
+			}
+
+			Eventually(table.InFlight).Should(Equal(3))
+			Consistently(table.InFlight, 100*time.Millisecond).Should(Equal(3))
+
+			close(table.release)
+			wg.Wait()
+			Expect(table.maxInFlight).To(Equal(3))
+		})
+
+		It("should return when the context is done while waiting", func() {
+			opts := peer.DefaultOptions().WithLogger(zap.NewNop()).WithMaxConcurrentSends(1)
+			p, table := newBlockedPeer(opts)
+			defer close(table.release)
+
+			go p.Send(context.Background(), id.NewPrivKey().Signatory(), wire.Msg{})
+			Eventually(table.InFlight).Should(Equal(1))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			Expect(p.Send(ctx, id.NewPrivKey().Signatory(), wire.Msg{})).To(Equal(context.DeadlineExceeded))
+		})
+	})
+	Context("when gossiping more than the maximum number of concurrent gossips", func() {
+		It("should block the excess gossips until capacity is available", func() {
+			opts := peer.DefaultOptions().WithLogger(zap.NewNop()).WithMaxConcurrentGossips(2)
+			opts.GossiperOptions = opts.GossiperOptions.WithLogger(zap.NewNop())
+			p, table := newBlockedPeer(opts)
+			// Every gossip is sent to this one peer, so every gossip that is
+			// in progress blocks on exactly one lookup.
+			table.AddPeer(id.NewPrivKey().Signatory(), wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:1", uint64(time.Now().UnixNano())))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			n := 6
+			wg := new(sync.WaitGroup)
+			wg.Add(n)
+			for i := 0; i < n; i++ {
+				go func(i int) {
+					defer wg.Done()
+					p.Gossip(ctx, []byte{byte(i)}, nil)
+				}(i)
+			}
+
+			Eventually(table.InFlight).Should(Equal(2))
+			Consistently(table.InFlight, 100*time.Millisecond).Should(Equal(2))
+
+			close(table.release)
+			wg.Wait()
+			Expect(table.maxInFlight).To(Equal(2))
+		})
+	})
+	Context("when replay protection is enabled", func() {
+		It("should drop replayed messages, but deliver new messages with the same content", func() {
+			n := 2
+			opts, peers, tables, _, _, transports := setup(n)
+
+			cancelPeerContext := createRingTopology(n, opts, peers, tables, transports)
+			defer cancelPeerContext()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			protected := peer.New(opts[1].WithReplayProtection(time.Minute, 100), transports[1])
+			received := make(chan string, 10)
+			protected.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				if packet.Msg.Type == wire.MsgTypeSend {
+					received <- string(packet.Msg.Data)
+				}
+				return nil
+			})
+
+			// A replayed message has the same nonce as the original. The
+			// transport sends messages as they are, so it is used to replay
+			// them.
+			replayed := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, To: id.Hash(peers[1].ID()), Data: []byte("replayed"), Nonce: 1}
+			Expect(transports[0].Send(ctx, peers[1].ID(), replayed)).To(Succeed())
+			Expect(transports[0].Send(ctx, peers[1].ID(), replayed)).To(Succeed())
+
+			// Every message sent by a peer has its own nonce.
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, To: id.Hash(peers[1].ID()), Data: []byte("hello")}
+			Expect(peers[0].Send(ctx, peers[1].ID(), msg)).To(Succeed())
+			Expect(peers[0].Send(ctx, peers[1].ID(), msg)).To(Succeed())
+
+			Eventually(received).Should(Receive(Equal("replayed")))
+			Eventually(received).Should(Receive(Equal("hello")))
+			Eventually(received).Should(Receive(Equal("hello")))
+			Consistently(received, 100*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+	Context("when shutting down", func() {
+		It("should wait for sends in progress, and then stop running", func() {
+			p, table := newBlockedPeer(peer.DefaultOptions().WithLogger(zap.NewNop()))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				p.Run(ctx)
+			}()
+
+			sent := make(chan error, 1)
+			go func() {
+				sent <- p.Send(ctx, id.NewPrivKey().Signatory(), wire.Msg{})
+			}()
+			Eventually(table.InFlight).Should(Equal(1))
+
+			shutdown := make(chan error, 1)
+			go func() {
+				shutdown <- p.Shutdown(ctx)
+			}()
+			// Sends to other peers that begin before the peer starts draining
+			// would block on the table. Sends to the local peer fail without
+			// looking it up, so they are used to wait for draining to start.
+			Eventually(func() error {
+				return p.Send(ctx, p.ID(), wire.Msg{})
+			}).Should(Equal(peer.ErrShuttingDown))
+			Expect(p.Send(ctx, id.NewPrivKey().Signatory(), wire.Msg{})).To(Equal(peer.ErrShuttingDown))
+			Consistently(shutdown, 100*time.Millisecond).ShouldNot(Receive())
+			Consistently(stopped, 100*time.Millisecond).ShouldNot(BeClosed())
+
+			close(table.release)
+			Eventually(sent).Should(Receive())
+			Eventually(shutdown).Should(Receive(BeNil()))
+			Eventually(stopped, 4*time.Second).Should(BeClosed())
+		})
+
+		It("should return an error when sends in progress do not finish in time", func() {
+			p, table := newBlockedPeer(peer.DefaultOptions().WithLogger(zap.NewNop()))
+			defer close(table.release)
+
+			go p.Send(context.Background(), id.NewPrivKey().Signatory(), wire.Msg{})
+			Eventually(table.InFlight).Should(Equal(1))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			err := p.Shutdown(ctx)
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		})
+	})
+	Context("when sending idempotent messages", func() {
+		It("should deliver messages with the same key only once", func() {
+			n := 2
+			opts, peers, tables, _, _, transports := setup(n)
+
+			cancelPeerContext := createRingTopology(n, opts, peers, tables, transports)
+			defer cancelPeerContext()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			received := make(chan string, 10)
+			peers[1].Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				if packet.Msg.Type == wire.MsgTypeSend {
+					received <- string(packet.Msg.Data)
+				}
+				return nil
+			})
+
+			Expect(peers[0].SendIdempotent(ctx, peers[1].ID(), "key", []byte("hello"))).To(Succeed())
+			Expect(peers[0].SendIdempotent(ctx, peers[1].ID(), "key", []byte("hello"))).To(Succeed())
+			Expect(peers[0].SendIdempotent(ctx, peers[1].ID(), "other key", []byte("hello"))).To(Succeed())
+
+			Eventually(received, 3*time.Second).Should(Receive(Equal("hello")))
+			Eventually(received).Should(Receive(Equal("hello")))
+			Consistently(received, 100*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+	Context("when sending reliably", func() {
+		It("should retry until the message is delivered and acknowledged", func() {
+			n := 2
+			opts, peers, tables, _, _, transports := setup(n)
+			sender := peer.New(opts[0].WithReliability(5, 100*time.Millisecond), transports[0])
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			tables[1].AddPeer(opts[0].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3333", uint64(time.Now().UnixNano())))
+			go sender.Run(ctx)
+
+			received := make(chan string, 10)
+			peers[1].Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				if packet.Msg.Type == wire.MsgTypeSend {
+					received <- string(packet.Msg.Data)
+				}
+				return nil
+			})
+
+			// The receiver is not running when the message is first sent, so
+			// the message can only be delivered by a retry.
+			sent := make(chan error, 1)
+			go func() {
+				sent <- sender.SendReliable(ctx, peers[1].ID(), []byte("hello"))
+			}()
+			Consistently(sent, 200*time.Millisecond).ShouldNot(Receive())
+			go peers[1].Run(ctx)
+
+			Eventually(sent, 5*time.Second).Should(Receive(BeNil()))
+			Expect(received).To(Receive(Equal("hello")))
+			Consistently(received, 100*time.Millisecond).ShouldNot(Receive())
+		})
+
+		It("should return an error when the message is never acknowledged", func() {
+			opts, _, _, _, _, transports := setup(1)
+			p := peer.New(opts[0].WithReliability(1, 50*time.Millisecond), transports[0])
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := p.SendReliable(ctx, id.NewPrivKey().Signatory(), []byte("hello"))
+			Expect(errors.Is(err, peer.ErrNotAcknowledged)).To(BeTrue())
+		})
+
+		It("should only retry when the clock advances", func() {
+			opts, _, _, _, _, transports := setup(1)
+			c := clock.NewVirtual(time.Unix(0, 0))
+			p := peer.New(opts[0].WithClock(c).WithReliability(1, time.Minute), transports[0])
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			sent := make(chan error, 1)
+			go func() {
+				sent <- p.SendReliable(ctx, id.NewPrivKey().Signatory(), []byte("hello"))
+			}()
+			Consistently(sent, 300*time.Millisecond).ShouldNot(Receive())
+			Eventually(func() error {
+				c.Advance(time.Minute)
+				select {
+				case err := <-sent:
+					return err
+				default:
+					return nil
+				}
+			}).Should(MatchError(peer.ErrNotAcknowledged))
+		})
+	})
+	Context("when paused", func() {
+		It("should buffer deliveries until resumed, without dropping connections", func() {
+			n := 2
+			opts, peers, tables, _, _, transports := setup(n)
+
+			cancelPeerContext := createRingTopology(n, opts, peers, tables, transports)
+			defer cancelPeerContext()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			received := make(chan string, 10)
+			peers[1].Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				if packet.Msg.Type == wire.MsgTypeSend {
+					received <- string(packet.Msg.Data)
+				}
+				return nil
+			})
+
+			send := func(data string) {
+				msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, To: id.Hash(peers[1].ID()), Data: []byte(data)}
+				Expect(peers[0].Send(ctx, peers[1].ID(), msg)).To(Succeed())
+			}
+
+			peers[1].Pause()
+			send("1")
+			send("2")
+			send("3")
+			Consistently(received, 200*time.Millisecond).ShouldNot(Receive())
+			Expect(transports[1].IsConnected(peers[0].ID())).To(BeTrue())
+
+			peers[1].Resume()
+			for _, data := range []string{"1", "2", "3"} {
+				Eventually(received).Should(Receive(Equal(data)))
+			}
+			send("4")
+			Eventually(received).Should(Receive(Equal("4")))
+		})
+
+		It("should not acknowledge reliable messages that overflow the buffer", func() {
+			n := 2
+			opts, _, tables, _, _, transports := setup(n)
+			sender := peer.New(opts[0].WithReliability(10, 100*time.Millisecond), transports[0])
+			receiver := peer.New(opts[1].WithPauseBufferSize(1), transports[1])
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			tables[1].AddPeer(opts[0].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3333", uint64(time.Now().UnixNano())))
+			go sender.Run(ctx)
+			go receiver.Run(ctx)
+
+			received := make(chan string, 10)
+			receiver.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				if packet.Msg.Type == wire.MsgTypeSend {
+					received <- string(packet.Msg.Data)
+				}
+				return nil
+			})
+
+			// The first message fills the buffer, so the second message is
+			// dropped until the receiver is resumed.
+			receiver.Pause()
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, To: id.Hash(receiver.ID()), Data: []byte("fill")}
+			Expect(sender.Send(ctx, receiver.ID(), msg)).To(Succeed())
+			sent := make(chan error, 1)
+			go func() {
+				sent <- sender.SendReliable(ctx, receiver.ID(), []byte("hello"))
+			}()
+			Consistently(sent, 300*time.Millisecond).ShouldNot(Receive())
+
+			receiver.Resume()
+			Eventually(sent, 5*time.Second).Should(Receive(BeNil()))
+			Expect(received).To(Receive(Equal("fill")))
+			Expect(received).To(Receive(Equal("hello")))
+		})
+	})
+})
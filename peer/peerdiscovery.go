@@ -3,10 +3,16 @@ package peer
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/renproject/aw/clock"
 	"github.com/renproject/aw/transport"
 	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
@@ -19,57 +25,418 @@ type DiscoveryClient struct {
 	opts DiscoveryOptions
 
 	transport *transport.Transport
+
+	// pingsSentAt stores the nonce of, and the time at which, the most recent
+	// ping was sent to a peer. It is cleared when the corresponding ping ack
+	// is received. The nonce of the next ping is also guarded by the mutex.
+	pingsSentAtMu *sync.Mutex
+	pingsSentAt   map[id.Signatory]sentPing
+	pingNonce     uint64
+
+	// reachability tracks, for each peer, how many pings have been received
+	// from the peer, and how many pings to the peer have failed, since the
+	// last ping ack from the peer. It is guarded by the pingsSentAt mutex.
+	reachability map[id.Signatory]*reachability
+
+	// nonces stores the peers that are known to accept pings with a nonce.
+	// Other peers are sent pings without a nonce, because older peers reject
+	// them. It is guarded by the pingsSentAt mutex.
+	nonces map[id.Signatory]bool
+
+	rttsMu *sync.RWMutex
+	rtts   map[id.Signatory]time.Duration
+
+	// insertions limits the rate at which each remote peer can add new peers
+	// to the table. It is nil when insertions are not limited.
+	insertions *insertionLimiter
+
+	// observer is true when the table should be learned from remote peers,
+	// but never shared with them.
+	observer bool
+
+	// bootstrapped is set to 1, atomically, when the first ping ack is
+	// received.
+	bootstrapped uint32
+
+	// emit is called with the events that happen during discovery. It must not
+	// block.
+	emit func(Event)
+
+	// versions are the message versions supported by remote peers.
+	versions *remoteVersions
 }
 
+// sentPing is a ping that is waiting for an ack.
+type sentPing struct {
+	nonce  uint64
+	sentAt time.Time
+}
+
+// reachability of a peer, since its last ping ack.
+type reachability struct {
+	pingsReceived int
+	pingsFailed   int
+	asymmetric    bool
+}
+
+// Pings carry the port of the sender, followed by a nonce that is echoed back
+// at the end of the ping ack, so that acks can be matched to pings. Older peers
+// only accept pings without a nonce, so a nonce is only sent to peers that have
+// shown that they accept one, by sending a ping with a nonce, or by echoing a
+// nonce in a ping ack.
+const (
+	pingSizeWithoutNonce = 2
+	pingSize             = pingSizeWithoutNonce + 8
+)
+
 func NewDiscoveryClient(opts DiscoveryOptions, transport *transport.Transport) *DiscoveryClient {
+	var insertions *insertionLimiter
+	if opts.InsertionRateLimit > 0 {
+		insertions = newInsertionLimiter(opts.InsertionRateLimit, opts.InsertionBurst, DefaultInsertionLimiterCap)
+	}
 	return &DiscoveryClient{
 		opts:      opts,
 		transport: transport,
+
+		pingsSentAtMu: new(sync.Mutex),
+		pingsSentAt:   map[id.Signatory]sentPing{},
+		reachability:  map[id.Signatory]*reachability{},
+		nonces:        map[id.Signatory]bool{},
+
+		rttsMu: new(sync.RWMutex),
+		rtts:   map[id.Signatory]time.Duration{},
+
+		insertions: insertions,
+
+		emit:     func(Event) {},
+		versions: newRemoteVersions(),
 	}
 }
 
-func (dc *DiscoveryClient) DiscoverPeers(ctx context.Context) {
-	var pingData [2]byte
-	binary.LittleEndian.PutUint16(pingData[:], dc.transport.Port())
+// Bootstrapped returns true once at least one ping ack has been received.
+func (dc *DiscoveryClient) Bootstrapped() bool {
+	return atomic.LoadUint32(&dc.bootstrapped) == 1
+}
 
-	msg := wire.Msg{
-		Version: wire.MsgVersion1,
-		Type:    wire.MsgTypePing,
-		Data:    pingData[:],
+// A PeerAddressValidator decides whether an address, learned from another
+// peer, can be stored in the table. It returns an error to reject the address.
+type PeerAddressValidator func(sig id.Signatory, addr wire.Address) error
+
+// addPeer to the table, and emit an event if the peer was not already in the
+// table, or if its address changed. Addresses that are older than the known
+// address of the peer are ignored. Signed addresses that are not signed by the
+// peer are rejected, and an EventPeerConflict is emitted. Addresses that are
+// rejected by the address validator are ignored.
+func (dc *DiscoveryClient) addPeer(sig id.Signatory, addr wire.Address) {
+	if signer, err := addr.Signatory(); err != nil || !(signer.Equal(&id.Signatory{}) || signer.Equal(&sig)) {
+		dc.opts.Logger.Warn("conflicting address", zap.String("peer", sig.String()), zap.String("signer", signer.String()), zap.NamedError("signature", err))
+		dc.emit(Event{Type: EventPeerConflict, Remote: sig, Time: dc.opts.Clock.Now()})
+		return
 	}
+	if dc.opts.AddressValidator != nil {
+		if err := dc.opts.AddressValidator(sig, addr); err != nil {
+			dc.opts.Logger.Debug("rejected address", zap.String("peer", sig.String()), zap.String("addr", addr.String()), zap.Error(err))
+			return
+		}
+	}
+	existing, known := dc.transport.Table().PeerAddress(sig)
+	if known && existing.Nonce >= addr.Nonce {
+		return
+	}
+	dc.transport.Table().AddPeer(sig, addr)
+	if known {
+		if updated, ok := dc.transport.Table().PeerAddress(sig); ok && !updated.Equal(&existing) {
+			dc.emit(Event{Type: EventPeerUpdated, Remote: sig, Time: dc.opts.Clock.Now()})
+		}
+		return
+	}
+	if _, ok := dc.transport.Table().PeerAddress(sig); ok {
+		dc.emit(Event{Type: EventPeerDiscovered, Remote: sig, Time: dc.opts.Clock.Now()})
+	}
+}
 
-	ticker := time.NewTicker(dc.opts.PingTimePeriod)
-	defer ticker.Stop()
+// addBootstrapPeers to the table. Bootstrap peers are deduplicated by
+// signatory, and the address with the latest nonce is used.
+func (dc *DiscoveryClient) addBootstrapPeers() {
+	self := dc.transport.Self()
+	addrs := make(map[id.Signatory]wire.Address, len(dc.opts.BootstrapPeers))
+	for _, sigAndAddr := range dc.opts.BootstrapPeers {
+		if sigAndAddr.Signatory.Equal(&self) {
+			continue
+		}
+		if addr, ok := addrs[sigAndAddr.Signatory]; ok && addr.Nonce >= sigAndAddr.Address.Nonce {
+			continue
+		}
+		addrs[sigAndAddr.Signatory] = sigAndAddr.Address
+	}
+	for sig, addr := range addrs {
+		dc.transport.Table().AddPeer(sig, addr)
+	}
+}
+
+// resolveBootstrapPeers adds the bootstrap peers that are not in the table
+// using the resolver of the transport (if it has one), so that bootstrap peers
+// can be found even if their addresses are not known.
+func (dc *DiscoveryClient) resolveBootstrapPeers(ctx context.Context) {
+	self := dc.transport.Self()
+	for _, sigAndAddr := range dc.opts.BootstrapPeers {
+		if sigAndAddr.Signatory.Equal(&self) {
+			continue
+		}
+		if err := dc.transport.ResolveAddress(ctx, sigAndAddr.Signatory); err != nil {
+			dc.opts.Logger.Debug("resolving bootstrap peer", zap.String("peer", sigAndAddr.Signatory.String()), zap.Error(err))
+		}
+	}
+}
+
+// reachabilityLocked returns the reachability of a peer, creating it if it
+// does not exist. The pingsSentAt mutex must be held.
+func (dc *DiscoveryClient) reachabilityLocked(peer id.Signatory) *reachability {
+	r, ok := dc.reachability[peer]
+	if !ok {
+		r = &reachability{}
+		dc.reachability[peer] = r
+	}
+	return r
+}
+
+// didReceivePingFrom a peer, and emit an event if the peer can repeatedly
+// reach us, but we cannot reach it.
+func (dc *DiscoveryClient) didReceivePingFrom(peer id.Signatory) {
+	if dc.opts.AsymmetryThreshold <= 0 {
+		return
+	}
+
+	dc.pingsSentAtMu.Lock()
+	r := dc.reachabilityLocked(peer)
+	r.pingsReceived++
+	detected := !r.asymmetric && r.pingsReceived >= dc.opts.AsymmetryThreshold && r.pingsFailed >= dc.opts.AsymmetryThreshold
+	if detected {
+		r.asymmetric = true
+	}
+	dc.pingsSentAtMu.Unlock()
+
+	if detected {
+		dc.opts.Logger.Debug("asymmetric connectivity", zap.String("peer", peer.String()))
+		dc.emit(Event{Type: EventPeerAsymmetric, Remote: peer, Time: dc.opts.Clock.Now()})
+	}
+}
+
+// IsAsymmetric returns true if the remote peer can reach the local peer, but
+// the local peer cannot reach the remote peer. This is reset when a ping ack is
+// received from the remote peer.
+func (dc *DiscoveryClient) IsAsymmetric(peer id.Signatory) bool {
+	dc.pingsSentAtMu.Lock()
+	defer dc.pingsSentAtMu.Unlock()
+
+	r, ok := dc.reachability[peer]
+	return ok && r.asymmetric
+}
+
+// RTT returns the most recently measured round-trip time of a ping to the
+// remote peer. An error is returned if no round-trip time has been measured.
+func (dc *DiscoveryClient) RTT(peer id.Signatory) (time.Duration, error) {
+	dc.rttsMu.RLock()
+	defer dc.rttsMu.RUnlock()
+
+	rtt, ok := dc.rtts[peer]
+	if !ok {
+		return 0, ErrRTTUnknown
+	}
+	return rtt, nil
+}
+
+// PingTimeout returns the timeout used when pinging a peer. If a round-trip
+// time has been measured for the peer, then the timeout is a multiple of that
+// round-trip time (bounded above by the default). Otherwise, the default of the
+// ping time period divided by alpha is used.
+func (dc *DiscoveryClient) PingTimeout(peer id.Signatory) time.Duration {
+	timeout := dc.opts.PingTimePeriod / time.Duration(dc.opts.Alpha)
+	if dc.opts.RTTMultiplier <= 0 {
+		return timeout
+	}
+
+	dc.rttsMu.RLock()
+	rtt, ok := dc.rtts[peer]
+	dc.rttsMu.RUnlock()
+	if !ok {
+		return timeout
+	}
+	if rttTimeout := time.Duration(dc.opts.RTTMultiplier) * rtt; rttTimeout < timeout {
+		return rttTimeout
+	}
+	return timeout
+}
+
+func (dc *DiscoveryClient) DiscoverPeers(ctx context.Context) {
+	interval := dc.PingInterval()
+	tick := dc.opts.Clock.After(interval)
 
-	alpha := dc.opts.Alpha
-	sendDuration := dc.opts.PingTimePeriod / time.Duration(alpha)
-Outer:
 	for {
-		for _, sig := range dc.transport.Table().Peers(alpha) {
-			err := func() error {
-				innerCtx, innerCancel := context.WithTimeout(ctx, sendDuration)
-				defer innerCancel()
-				msg.To = id.Hash(sig)
-				return dc.transport.Send(innerCtx, sig, msg)
-			}()
-			if err != nil {
-				dc.opts.Logger.Debug("pinging", zap.Error(err))
-				if err == context.Canceled || err == context.DeadlineExceeded {
-					break
-				}
-			}
-			select {
-			case <-ticker.C:
-				continue Outer
-			default:
-			}
+		ticked := dc.discoverPass(ctx, tick)
+		// The number of peers in the table can change during a pass, so the
+		// interval is checked after every pass.
+		if next := dc.PingInterval(); ticked || next != interval {
+			interval = next
+			tick = dc.opts.Clock.After(interval)
+		}
+		if ticked {
+			continue
 		}
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-tick:
+			tick = dc.opts.Clock.After(interval)
+		}
+	}
+}
+
+// PingInterval returns the amount of time between passes of pinging peers. It
+// is the ping time period, unless an adaptive ping time period has been
+// configured, in which case it shrinks towards the minimum ping time period as
+// the number of peers in the table falls.
+func (dc *DiscoveryClient) PingInterval() time.Duration {
+	max, min := dc.opts.PingTimePeriod, dc.opts.MinPingTimePeriod
+	if min <= 0 || min >= max {
+		return max
+	}
+	numPeers := dc.transport.Table().NumPeers()
+	low, high := dc.opts.LowPeerThreshold, dc.opts.HighPeerThreshold
+	if numPeers <= low {
+		return min
+	}
+	if numPeers >= high {
+		return max
+	}
+	return min + (max-min)*time.Duration(numPeers-low)/time.Duration(high-low)
+}
+
+// MaxPassDuration returns the maximum amount of time that one pass of pinging
+// peers can take. Passes that take longer are canceled, so that they do not run
+// into the next pass. Unless it has been configured, it is 80% of the ping
+// interval.
+func (dc *DiscoveryClient) MaxPassDuration() time.Duration {
+	if dc.opts.MaxPassDuration > 0 {
+		return dc.opts.MaxPassDuration
+	}
+	return dc.PingInterval() * 4 / 5
+}
+
+// discoverPass pings peers from the table, and returns true if the next tick
+// happened during the pass (in which case, the next pass should begin
+// immediately).
+func (dc *DiscoveryClient) discoverPass(ctx context.Context, tick <-chan time.Time) bool {
+	passStartedAt := dc.opts.Clock.Now()
+	passCtx, passCancel := context.WithTimeout(ctx, dc.MaxPassDuration())
+	defer passCancel()
+
+	dc.resolveBootstrapPeers(passCtx)
+	presence := dc.presenceDigest()
+	pinged := 0
+	errs := new(SendErrors)
+	defer func() {
+		if err := errs.Err(); err != nil {
+			dc.opts.Logger.Debug("pinging", zap.Error(err))
+		}
+	}()
+	for _, sig := range dc.transport.Table().Peers(dc.opts.Alpha) {
+		if passCtx.Err() != nil {
+			if ctx.Err() == nil {
+				dc.opts.Logger.Debug("pinging", zap.String("pass", "timeout"), zap.Int("pinged", pinged), zap.Duration("elapsed", clock.Since(dc.opts.Clock, passStartedAt)))
+			}
+			return false
+		}
+		pinged++
+		err := func() error {
+			innerCtx, innerCancel := context.WithTimeout(passCtx, dc.PingTimeout(sig))
+			defer innerCancel()
+			return dc.ping(innerCtx, sig, presence)
+		}()
+		errs.add(sig, err)
+		if passCtx.Err() != nil {
+			// The pass is over, and the next iteration reports why.
+			continue
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			// Only the ping of this peer timed out, so the remaining peers
+			// are still pinged.
+			dc.opts.Logger.Debug("pinging", zap.String("peer", sig.String()), zap.String("ping", "timeout"))
+		}
+		select {
+		case <-tick:
+			return true
+		default:
 		}
 	}
+	return false
+}
+
+// ping a remote peer, followed by a presence digest if it has any data. The
+// remote peer acks the ping with the peers that it knows about.
+func (dc *DiscoveryClient) ping(ctx context.Context, sig id.Signatory, presence wire.Msg) error {
+	dc.pingsSentAtMu.Lock()
+	if _, ok := dc.pingsSentAt[sig]; ok {
+		// The previous ping was never acknowledged. The remote peer might no
+		// longer accept nonces, so the next ping does not have one.
+		dc.reachabilityLocked(sig).pingsFailed++
+		delete(dc.nonces, sig)
+	}
+	withNonce := dc.nonces[sig]
+	nonce := uint64(0)
+	if withNonce {
+		dc.pingNonce++
+		nonce = dc.pingNonce
+	}
+	dc.pingsSentAtMu.Unlock()
+
+	pingData := make([]byte, pingSizeWithoutNonce, pingSize)
+	binary.LittleEndian.PutUint16(pingData, dc.transport.Port())
+	if withNonce {
+		pingData = pingData[:pingSize]
+		binary.LittleEndian.PutUint64(pingData[pingSizeWithoutNonce:], nonce)
+	}
+	msg := wire.Msg{
+		Version:  dc.versions.msgVersion(sig),
+		Type:     wire.MsgTypePing,
+		To:       id.Hash(sig),
+		Data:     pingData,
+		Priority: wire.MsgPriorityHigh,
+	}
+	sentAt := dc.opts.Clock.Now()
+	if err := dc.transport.Send(ctx, sig, msg); err != nil {
+		dc.pingsSentAtMu.Lock()
+		dc.reachabilityLocked(sig).pingsFailed++
+		dc.pingsSentAtMu.Unlock()
+		return err
+	}
+	dc.pingsSentAtMu.Lock()
+	dc.pingsSentAt[sig] = sentPing{nonce: nonce, sentAt: sentAt}
+	dc.pingsSentAtMu.Unlock()
+	if presence.Data != nil {
+		presence.Version = dc.versions.msgVersion(sig)
+		presence.To = id.Hash(sig)
+		return dc.transport.Send(ctx, sig, presence)
+	}
+	return nil
+}
+
+// exchangeOnConnect pings a remote peer as soon as a connection to it is
+// established, instead of waiting for the next pass of peer discovery. Both
+// peers do this, so each learns the peers that the other knows about.
+func (dc *DiscoveryClient) exchangeOnConnect(remote id.Signatory) {
+	dc.pingNow(remote, "exchanging on connect")
+}
+
+// pingNow pings a remote peer straight away, instead of waiting for the next
+// pass of peer discovery. Errors are logged with the given reason.
+func (dc *DiscoveryClient) pingNow(remote id.Signatory, reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dc.PingTimeout(remote))
+	defer cancel()
+
+	if err := dc.ping(ctx, remote, wire.Msg{}); err != nil {
+		dc.opts.Logger.Debug(reason, zap.String("remote", remote.String()), zap.Error(err))
+	}
 }
 
 func (dc *DiscoveryClient) DidReceiveMessage(from id.Signatory, ipAddr net.Addr, msg wire.Msg) error {
@@ -82,6 +449,10 @@ func (dc *DiscoveryClient) DidReceiveMessage(from id.Signatory, ipAddr net.Addr,
 		if err := dc.didReceivePingAck(from, msg); err != nil {
 			return err
 		}
+	case wire.MsgTypePresence:
+		if err := dc.didReceivePresence(from, msg); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -90,37 +461,64 @@ func (dc *DiscoveryClient) didReceivePing(from id.Signatory, ipAddr net.Addr, ms
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	if dataLen := len(msg.Data); dataLen != 2 {
-		return fmt.Errorf("malformed port received in ping message. expected: 2 bytes, received: %v bytes", dataLen)
+	if dataLen := len(msg.Data); dataLen != pingSizeWithoutNonce && dataLen != pingSize {
+		return fmt.Errorf("malformed port received in ping message. expected: %v or %v bytes, received: %v bytes", pingSizeWithoutNonce, pingSize, dataLen)
 	}
 	port := binary.LittleEndian.Uint16(msg.Data)
+	if len(msg.Data) == pingSize {
+		dc.pingsSentAtMu.Lock()
+		dc.nonces[from] = true
+		dc.pingsSentAtMu.Unlock()
+	}
 
-	dc.transport.Table().AddPeer(
-		from,
-		wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("%v:%v", ipAddr.(*net.TCPAddr).IP.String(), port), uint64(time.Now().UnixNano())),
-	)
-
-	peers := dc.transport.Table().Peers(dc.opts.MaxExpectedPeers)
-	addrAndSig := make([]wire.SignatoryAndAddress, 0, len(peers))
-	for _, sig := range peers {
-		addr, addrOk := dc.transport.Table().PeerAddress(sig)
-		if !addrOk {
-			dc.opts.Logger.DPanic("acking ping", zap.String("peer", "does not exist in table"))
-			continue
+	// The ping advertises the port on which the remote peer accepts TCP
+	// connections, so the observed address is only used for peers that are
+	// reached over TCP. Peers that are reached using another protocol, such as
+	// WebSockets, keep their existing address.
+	protocol := wire.TCP
+	if existing, ok := dc.transport.Table().PeerAddress(from); ok {
+		protocol = existing.Protocol
+	}
+	if tcpAddr, ok := ipAddr.(*net.TCPAddr); ok && protocol == wire.TCP {
+		dc.addPeer(
+			from,
+			wire.NewUnsignedAddress(protocol, net.JoinHostPort(tcpAddr.IP.String(), strconv.Itoa(int(port))), uint64(dc.opts.Clock.Now().UnixNano())),
+		)
+	}
+	dc.transport.Table().MarkSeen(from, dc.opts.Clock.Now())
+	dc.didReceivePingFrom(from)
+
+	// Observers still ack pings, so that they are known to be alive, but they
+	// do not share the peers that they know about.
+	addrAndSig := make([]wire.SignatoryAndAddress, 0, dc.opts.MaxExpectedPeers)
+	if !dc.observer {
+		if err := dc.transport.Table().IteratePeerAddresses(ctx, func(sigAndAddr wire.SignatoryAndAddress) bool {
+			if len(addrAndSig) >= dc.opts.MaxExpectedPeers {
+				return false
+			}
+			addrAndSig = append(addrAndSig, sigAndAddr)
+			return true
+		}); err != nil {
+			return fmt.Errorf("acking ping: %v", err)
 		}
-		sigAndAddr := wire.SignatoryAndAddress{Signatory: sig, Address: addr}
-		addrAndSig = append(addrAndSig, sigAndAddr)
 	}
 
 	addrAndSigBytes, err := surge.ToBinary(addrAndSig)
 	if err != nil {
 		return fmt.Errorf("bad ping ack: %v", err)
 	}
+	// Echo the nonce after the peers, or a zero nonce if the ping did not have
+	// one, so that the remote peer learns that nonces are accepted. Older
+	// peers ignore it, because unmarshaling ignores trailing bytes.
+	nonce := make([]byte, pingSize-pingSizeWithoutNonce)
+	copy(nonce, msg.Data[pingSizeWithoutNonce:])
+	addrAndSigBytes = append(addrAndSigBytes, nonce...)
 	response := wire.Msg{
-		Version: wire.MsgVersion1,
-		Type:    wire.MsgTypePingAck,
-		To:      id.Hash(from),
-		Data:    addrAndSigBytes,
+		Version:  dc.versions.msgVersion(from),
+		Type:     wire.MsgTypePingAck,
+		To:       id.Hash(from),
+		Data:     addrAndSigBytes,
+		Priority: wire.MsgPriorityHigh,
 	}
 	if err := dc.transport.Send(ctx, from, response); err != nil {
 		dc.opts.Logger.Debug("acking ping", zap.Error(err))
@@ -129,14 +527,111 @@ func (dc *DiscoveryClient) didReceivePing(from id.Signatory, ipAddr net.Addr, ms
 }
 
 func (dc *DiscoveryClient) didReceivePingAck(from id.Signatory, msg wire.Msg) error {
+	dc.transport.Table().MarkSeen(from, dc.opts.Clock.Now())
+	atomic.StoreUint32(&dc.bootstrapped, 1)
+
 	slice := []wire.SignatoryAndAddress{}
-	err := surge.FromBinary(&slice, msg.Data)
+	rest, _, err := surge.Unmarshal(&slice, msg.Data, surge.MaxBytes)
 	if err != nil {
 		return fmt.Errorf("bad ping ack: %v", err)
 	}
 
+	// Acks from older peers do not echo the nonce, so they are matched to
+	// the most recent ping. Otherwise, acks for earlier pings are ignored.
+	// Pings without a nonce are echoed a zero nonce, which still shows that
+	// the remote peer accepts nonces.
+	dc.pingsSentAtMu.Lock()
+	echoed := len(rest) == pingSize-pingSizeWithoutNonce
+	if echoed {
+		dc.nonces[from] = true
+	}
+	sent, ok := dc.pingsSentAt[from]
+	if ok && echoed && binary.LittleEndian.Uint64(rest) != sent.nonce {
+		ok = false
+	}
+	if ok {
+		delete(dc.pingsSentAt, from)
+	}
+	delete(dc.reachability, from)
+	dc.pingsSentAtMu.Unlock()
+	if ok {
+		dc.rttsMu.Lock()
+		dc.rtts[from] = clock.Since(dc.opts.Clock, sent.sentAt)
+		dc.rttsMu.Unlock()
+	}
+
 	for _, x := range slice {
-		dc.transport.Table().AddPeer(x.Signatory, x.Address)
+		if _, ok := dc.transport.Table().PeerAddress(x.Signatory); !ok && !dc.insertions.allow(from) {
+			dc.opts.Logger.Debug("ping ack", zap.String("from", from.String()), zap.String("peer", x.Signatory.String()), zap.String("dropped", "insertion rate limited"))
+			continue
+		}
+		dc.addPeer(x.Signatory, x.Address)
+	}
+	return nil
+}
+
+// presenceDigest returns a presence message containing the peers that were most
+// recently seen alive. The message has no data if presence digests are
+// disabled, the peer is an observer, or no peers have been seen.
+func (dc *DiscoveryClient) presenceDigest() wire.Msg {
+	msg := wire.Msg{
+		Version:  wire.MsgVersion1,
+		Type:     wire.MsgTypePresence,
+		Priority: wire.MsgPriorityHigh,
+	}
+	if dc.opts.PresenceDigestSize <= 0 || dc.observer {
+		return msg
+	}
+
+	table := dc.transport.Table()
+	digest := []wire.Presence{}
+	if err := table.IteratePeerAddresses(context.Background(), func(sigAndAddr wire.SignatoryAndAddress) bool {
+		if lastSeen, ok := table.LastSeen(sigAndAddr.Signatory); ok {
+			digest = append(digest, wire.Presence{Signatory: sigAndAddr.Signatory, LastSeen: uint64(lastSeen.UnixNano())})
+		}
+		return true
+	}); err != nil {
+		dc.opts.Logger.Debug("building presence digest", zap.Error(err))
+		return msg
+	}
+	if len(digest) == 0 {
+		return msg
+	}
+	sort.Slice(digest, func(i, j int) bool {
+		return digest[i].LastSeen > digest[j].LastSeen
+	})
+	if len(digest) > dc.opts.PresenceDigestSize {
+		digest = digest[:dc.opts.PresenceDigestSize]
+	}
+
+	data, err := surge.ToBinary(digest)
+	if err != nil {
+		dc.opts.Logger.DPanic("building presence digest", zap.Error(err))
+		return msg
+	}
+	msg.Data = data
+	return msg
+}
+
+func (dc *DiscoveryClient) didReceivePresence(from id.Signatory, msg wire.Msg) error {
+	digest := []wire.Presence{}
+	if err := surge.FromBinary(&digest, msg.Data); err != nil {
+		return fmt.Errorf("bad presence: %v", err)
+	}
+
+	// Peers cannot be seen in the future. Clamping the time prevents a remote
+	// peer from keeping another peer alive indefinitely.
+	now := dc.opts.Clock.Now()
+	self := dc.transport.Self()
+	for _, presence := range digest {
+		if presence.Signatory.Equal(&self) {
+			continue
+		}
+		lastSeen := time.Unix(0, int64(presence.LastSeen))
+		if lastSeen.After(now) {
+			lastSeen = now
+		}
+		dc.transport.Table().MarkSeen(presence.Signatory, lastSeen)
 	}
 	return nil
 }
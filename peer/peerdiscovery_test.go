@@ -3,15 +3,25 @@ package peer_test
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/clock"
 	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/handshake"
 	"github.com/renproject/aw/peer"
 	"github.com/renproject/aw/transport"
 	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
+	"github.com/renproject/surge"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -53,6 +63,37 @@ func testPeerDiscovery(n int, peers []*peer.Peer, tables []dht.Table, transports
 	return cancel
 }
 
+// slowTable is a Table that is slow to look up peer addresses, which makes
+// every send (and so every ping) slow. It records when each lookup started and
+// finished.
+type slowTable struct {
+	dht.Table
+
+	delay time.Duration
+
+	mu      *sync.Mutex
+	lookups [][2]time.Time
+}
+
+func (table *slowTable) PeerAddress(peerID id.Signatory) (wire.Address, bool) {
+	start := time.Now()
+	time.Sleep(table.delay)
+	table.mu.Lock()
+	table.lookups = append(table.lookups, [2]time.Time{start, time.Now()})
+	table.mu.Unlock()
+	return table.Table.PeerAddress(peerID)
+}
+
+// forgetfulTable is a Table that lists peers, but has forgotten their
+// addresses, so every send to them fails.
+type forgetfulTable struct {
+	dht.Table
+}
+
+func (forgetfulTable) PeerAddress(id.Signatory) (wire.Address, bool) {
+	return wire.Address{}, false
+}
+
 func createRingTopology(n int, opts []peer.Options, peers []*peer.Peer, tables []dht.Table, transports []*transport.Transport) context.CancelFunc {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	for i := range peers {
@@ -132,6 +173,758 @@ var _ = Describe("Peer Discovery", func() {
 		})
 	})
 
+	Context("when bootstrapping with duplicate bootstrap peers", func() {
+		It("should only add one entry per signatory", func() {
+			opts, _, tables, _, _, transports := setup(1)
+
+			dup := id.NewPrivKey().Signatory()
+			other := id.NewPrivKey().Signatory()
+			bootstrapPeers := []wire.SignatoryAndAddress{
+				{Signatory: dup, Address: wire.NewUnsignedAddress(wire.TCP, "localhost:3334", 1)},
+				{Signatory: other, Address: wire.NewUnsignedAddress(wire.TCP, "localhost:3335", 1)},
+				{Signatory: dup, Address: wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3334", 2)},
+				{Signatory: dup, Address: wire.NewUnsignedAddress(wire.TCP, "[::1]:3334", 0)},
+				{Signatory: opts[0].PrivKey.Signatory(), Address: wire.NewUnsignedAddress(wire.TCP, "localhost:3333", 1)},
+			}
+			peer.New(opts[0].WithDiscoveryOptions(opts[0].DiscoveryOptions.WithBootstrapPeers(bootstrapPeers)), transports[0])
+
+			Expect(tables[0].NumPeers()).To(Equal(2))
+			addr, ok := tables[0].PeerAddress(dup)
+			Expect(ok).To(BeTrue())
+			Expect(addr.Value).To(Equal("127.0.0.1:3334"))
+			_, ok = tables[0].PeerAddress(other)
+			Expect(ok).To(BeTrue())
+		})
+	})
+
+	Context("when the event buffer is full", func() {
+		It("should drop and count events without blocking discovery", func() {
+			opts, _, tables, _, _, transports := setup(1)
+			p := peer.New(opts[0].WithEventBuffer(2), transports[0])
+			events := p.Events()
+
+			discovered := make([]wire.SignatoryAndAddress, 5)
+			for i := range discovered {
+				discovered[i] = wire.SignatoryAndAddress{
+					Signatory: id.NewPrivKey().Signatory(),
+					Address:   wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("localhost:%v", 4000+i), 1),
+				}
+			}
+			data, err := surge.ToBinary(discovered)
+			Expect(err).ToNot(HaveOccurred())
+			ack := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypePingAck, Data: data}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- p.DiscoveryClient().DidReceiveMessage(id.NewPrivKey().Signatory(), nil, ack)
+			}()
+			Eventually(done).Should(Receive(BeNil()))
+
+			Expect(tables[0].NumPeers()).To(Equal(len(discovered)))
+			Expect(p.DroppedEvents()).To(Equal(uint64(3)))
+			for i := 0; i < 2; i++ {
+				var ev peer.Event
+				Expect(events).To(Receive(&ev))
+				Expect(ev.Type).To(Equal(peer.EventPeerDiscovered))
+				Expect(ev.Remote).To(Equal(discovered[i].Signatory))
+			}
+			Expect(events).ToNot(Receive())
+
+			// Receiving the same peers again does not emit new events.
+			Expect(p.DiscoveryClient().DidReceiveMessage(id.NewPrivKey().Signatory(), nil, ack)).To(Succeed())
+			Expect(p.DroppedEvents()).To(Equal(uint64(3)))
+			Expect(events).ToNot(Receive())
+		})
+	})
+
+	Context("when nothing is consuming events", func() {
+		It("should neither queue nor drop events until they are consumed", func() {
+			opts, _, _, _, _, transports := setup(1)
+			p := peer.New(opts[0].WithEventBuffer(2), transports[0])
+
+			ackWith := func(remote id.Signatory) wire.Msg {
+				addr := wire.NewUnsignedAddress(wire.TCP, "localhost:4000", 1)
+				data, err := surge.ToBinary([]wire.SignatoryAndAddress{{Signatory: remote, Address: addr}})
+				Expect(err).ToNot(HaveOccurred())
+				return wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypePingAck, Data: data}
+			}
+			for i := 0; i < 5; i++ {
+				Expect(p.DiscoveryClient().DidReceiveMessage(id.NewPrivKey().Signatory(), nil, ackWith(id.NewPrivKey().Signatory()))).To(Succeed())
+			}
+			Expect(p.DroppedEvents()).To(Equal(uint64(0)))
+
+			// Once the events are consumed, later events are queued.
+			events := p.Events()
+			Expect(events).ToNot(Receive())
+			remote := id.NewPrivKey().Signatory()
+			Expect(p.DiscoveryClient().DidReceiveMessage(id.NewPrivKey().Signatory(), nil, ackWith(remote))).To(Succeed())
+			var ev peer.Event
+			Expect(events).To(Receive(&ev))
+			Expect(ev.Type).To(Equal(peer.EventPeerDiscovered))
+			Expect(ev.Remote).To(Equal(remote))
+			Expect(p.DroppedEvents()).To(Equal(uint64(0)))
+		})
+	})
+
+	Context("when subscribing to events", func() {
+		It("should give each subscriber its own copy of the events", func() {
+			opts, _, tables, _, _, transports := setup(1)
+			p := peer.New(opts[0].WithEventBuffer(2), transports[0])
+
+			// The slow subscriber never reads, but this does not stop the fast
+			// subscriber from receiving every event.
+			slow, unsubscribeSlow := p.Subscribe()
+			fast, unsubscribeFast := p.Subscribe()
+			defer unsubscribeFast()
+
+			remote := id.NewPrivKey().Signatory()
+			ackWith := func(addr wire.Address) wire.Msg {
+				data, err := surge.ToBinary([]wire.SignatoryAndAddress{{Signatory: remote, Address: addr}})
+				Expect(err).ToNot(HaveOccurred())
+				return wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypePingAck, Data: data}
+			}
+			expectEvent := func(ty peer.EventType) {
+				var ev peer.Event
+				Expect(fast).To(Receive(&ev))
+				Expect(ev.Type).To(Equal(ty))
+				Expect(ev.Remote).To(Equal(remote))
+			}
+
+			Expect(p.DiscoveryClient().DidReceiveMessage(id.NewPrivKey().Signatory(), nil, ackWith(wire.NewUnsignedAddress(wire.TCP, "localhost:4000", 1)))).To(Succeed())
+			expectEvent(peer.EventPeerDiscovered)
+
+			Expect(p.DiscoveryClient().DidReceiveMessage(id.NewPrivKey().Signatory(), nil, ackWith(wire.NewUnsignedAddress(wire.TCP, "localhost:4001", 2)))).To(Succeed())
+			expectEvent(peer.EventPeerUpdated)
+
+			time.Sleep(20 * time.Millisecond)
+			Expect(p.RemoveExpiredPeers(10 * time.Millisecond)).To(Equal([]id.Signatory{remote}))
+			Expect(tables[0].NumPeers()).To(Equal(0))
+			expectEvent(peer.EventPeerRemoved)
+
+			// The slow subscriber only has the events that fit in its buffer.
+			var ev peer.Event
+			Expect(slow).To(Receive(&ev))
+			Expect(ev.Type).To(Equal(peer.EventPeerDiscovered))
+			Expect(slow).To(Receive(&ev))
+			Expect(ev.Type).To(Equal(peer.EventPeerUpdated))
+			Expect(slow).ToNot(Receive())
+
+			// Only the removal was dropped, and only by the slow subscriber.
+			Expect(p.DroppedSubscriberEvents()).To(Equal(uint64(1)))
+			Expect(p.DroppedEvents()).To(Equal(uint64(0)))
+
+			// Unsubscribing closes the channel, and stops further events.
+			unsubscribeSlow()
+			unsubscribeSlow()
+			Expect(slow).To(BeClosed())
+			Expect(p.DiscoveryClient().DidReceiveMessage(id.NewPrivKey().Signatory(), nil, ackWith(wire.NewUnsignedAddress(wire.TCP, "localhost:4002", 3)))).To(Succeed())
+			expectEvent(peer.EventPeerDiscovered)
+		})
+	})
+
+	Context("when an address is signed by a different key", func() {
+		It("should keep the known address and emit a conflict event", func() {
+			opts, _, tables, _, _, transports := setup(1)
+			p := peer.New(opts[0], transports[0])
+			events := p.Events()
+
+			privKey := id.NewPrivKey()
+			remote := privKey.Signatory()
+			known := wire.NewUnsignedAddress(wire.TCP, "localhost:4000", 1)
+			Expect(known.Sign(privKey)).To(Succeed())
+			tables[0].AddPeer(remote, known)
+
+			// The conflicting address is newer, but it is signed by someone
+			// other than the remote peer.
+			conflicting := wire.NewUnsignedAddress(wire.TCP, "localhost:4001", 2)
+			Expect(conflicting.Sign(id.NewPrivKey())).To(Succeed())
+			data, err := surge.ToBinary([]wire.SignatoryAndAddress{{Signatory: remote, Address: conflicting}})
+			Expect(err).ToNot(HaveOccurred())
+			ack := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypePingAck, Data: data}
+			Expect(p.DiscoveryClient().DidReceiveMessage(id.NewPrivKey().Signatory(), nil, ack)).To(Succeed())
+
+			addr, ok := tables[0].PeerAddress(remote)
+			Expect(ok).To(BeTrue())
+			Expect(addr).To(Equal(known))
+			var ev peer.Event
+			Expect(events).To(Receive(&ev))
+			Expect(ev.Type).To(Equal(peer.EventPeerConflict))
+			Expect(ev.Remote).To(Equal(remote))
+
+			// Newer addresses that are signed by the remote peer are accepted.
+			updated := wire.NewUnsignedAddress(wire.TCP, "localhost:4002", 3)
+			Expect(updated.Sign(privKey)).To(Succeed())
+			data, err = surge.ToBinary([]wire.SignatoryAndAddress{{Signatory: remote, Address: updated}})
+			Expect(err).ToNot(HaveOccurred())
+			ack = wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypePingAck, Data: data}
+			Expect(p.DiscoveryClient().DidReceiveMessage(id.NewPrivKey().Signatory(), nil, ack)).To(Succeed())
+
+			addr, ok = tables[0].PeerAddress(remote)
+			Expect(ok).To(BeTrue())
+			Expect(addr).To(Equal(updated))
+			Expect(events).To(Receive(&ev))
+			Expect(ev.Type).To(Equal(peer.EventPeerUpdated))
+		})
+	})
+
+	Context("when an address validator is configured", func() {
+		It("should only store the addresses that it accepts", func() {
+			_, private10, _ := net.ParseCIDR("10.0.0.0/8")
+			_, private172, _ := net.ParseCIDR("172.16.0.0/12")
+			_, private192, _ := net.ParseCIDR("192.168.0.0/16")
+			rejectPrivate := func(sig id.Signatory, addr wire.Address) error {
+				host, _, err := net.SplitHostPort(addr.Value)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip != nil && (private10.Contains(ip) || private172.Contains(ip) || private192.Contains(ip)) {
+					return fmt.Errorf("private address %v", host)
+				}
+				return nil
+			}
+
+			opts, _, tables, _, _, transports := setup(1)
+			p := peer.New(opts[0].WithDiscoveryOptions(opts[0].DiscoveryOptions.WithAddressValidator(rejectPrivate)), transports[0])
+
+			private := []wire.SignatoryAndAddress{
+				{Signatory: id.NewPrivKey().Signatory(), Address: wire.NewUnsignedAddress(wire.TCP, "10.1.2.3:3333", 1)},
+				{Signatory: id.NewPrivKey().Signatory(), Address: wire.NewUnsignedAddress(wire.TCP, "172.20.0.1:3333", 1)},
+				{Signatory: id.NewPrivKey().Signatory(), Address: wire.NewUnsignedAddress(wire.TCP, "192.168.1.1:3333", 1)},
+			}
+			public := []wire.SignatoryAndAddress{
+				{Signatory: id.NewPrivKey().Signatory(), Address: wire.NewUnsignedAddress(wire.TCP, "8.8.8.8:3333", 1)},
+				{Signatory: id.NewPrivKey().Signatory(), Address: wire.NewUnsignedAddress(wire.TCP, "172.32.0.1:3333", 1)},
+			}
+			data, err := surge.ToBinary(append(private, public...))
+			Expect(err).ToNot(HaveOccurred())
+			ack := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypePingAck, Data: data}
+			Expect(p.DiscoveryClient().DidReceiveMessage(id.NewPrivKey().Signatory(), nil, ack)).To(Succeed())
+
+			for _, sigAndAddr := range private {
+				_, ok := tables[0].PeerAddress(sigAndAddr.Signatory)
+				Expect(ok).To(BeFalse())
+			}
+			for _, sigAndAddr := range public {
+				addr, ok := tables[0].PeerAddress(sigAndAddr.Signatory)
+				Expect(ok).To(BeTrue())
+				Expect(addr).To(Equal(sigAndAddr.Address))
+			}
+		})
+	})
+
+	Context("when receiving a ping", func() {
+		ping := func(port uint16) wire.Msg {
+			data := make([]byte, 2)
+			binary.LittleEndian.PutUint16(data, port)
+			return wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypePing, Data: data}
+		}
+
+		It("should update the address of peers that are reached over TCP", func() {
+			opts, _, tables, _, _, transports := setup(1)
+			p := peer.New(opts[0], transports[0])
+
+			remote := id.NewPrivKey().Signatory()
+			tables[0].AddPeer(remote, wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:4000", 1))
+			go p.DiscoveryClient().DidReceiveMessage(remote, &net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5000}, ping(4001))
+			Eventually(func() bool {
+				_, ok := tables[0].LastSeen(remote)
+				return ok
+			}).Should(BeTrue())
+
+			addr, ok := tables[0].PeerAddress(remote)
+			Expect(ok).To(BeTrue())
+			Expect(addr.Protocol).To(Equal(wire.TCP))
+			Expect(addr.Value).To(Equal("127.0.0.2:4001"))
+		})
+
+		It("should keep the address of peers that are reached using another protocol", func() {
+			opts, _, tables, _, _, transports := setup(1)
+			p := peer.New(opts[0], transports[0])
+
+			remote := id.NewPrivKey().Signatory()
+			known := wire.NewUnsignedAddress(wire.WebSocket, "127.0.0.1:4000", 1)
+			tables[0].AddPeer(remote, known)
+			go p.DiscoveryClient().DidReceiveMessage(remote, &net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 5000}, ping(4001))
+			Eventually(func() bool {
+				_, ok := tables[0].LastSeen(remote)
+				return ok
+			}).Should(BeTrue())
+
+			addr, ok := tables[0].PeerAddress(remote)
+			Expect(ok).To(BeTrue())
+			Expect(addr).To(Equal(known))
+		})
+
+		It("should not add an address when the connection is not over TCP", func() {
+			opts, _, tables, _, _, transports := setup(1)
+			p := peer.New(opts[0], transports[0])
+
+			remote := id.NewPrivKey().Signatory()
+			Expect(p.DiscoveryClient().DidReceiveMessage(remote, &net.UnixAddr{Name: "aw.sock", Net: "unix"}, ping(4001))).To(Succeed())
+			_, ok := tables[0].PeerAddress(remote)
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("when exchanging peers on connect", func() {
+		It("should learn the peers of the remote peer without waiting for discovery", func() {
+			n := 4
+			opts, _, tables, contentResolvers, _, transports := setup(n)
+			peers := make([]*peer.Peer, 2)
+			for i := range peers {
+				peers[i] = peer.New(opts[i].WithDiscoveryOptions(opts[i].DiscoveryOptions.WithExchangeOnConnect(true)), transports[i])
+				peers[i].Resolve(context.Background(), contentResolvers[i])
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].Run(ctx)
+			}
+
+			// The first two peers know disjoint sets of peers, which are not
+			// running, so they can only be learned from each other.
+			tables[0].AddPeer(opts[2].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3335", uint64(time.Now().UnixNano())))
+			tables[1].AddPeer(opts[3].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3336", uint64(time.Now().UnixNano())))
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			transports[0].Link(opts[1].PrivKey.Signatory())
+			defer transports[0].Unlink(opts[1].PrivKey.Signatory())
+			Expect(transports[0].Dial(ctx, opts[1].PrivKey.Signatory())).To(Succeed())
+
+			Eventually(func() bool {
+				_, ok := tables[0].PeerAddress(opts[3].PrivKey.Signatory())
+				return ok
+			}, 5*time.Second).Should(BeTrue())
+			Eventually(func() bool {
+				_, ok := tables[1].PeerAddress(opts[2].PrivKey.Signatory())
+				return ok
+			}, 5*time.Second).Should(BeTrue())
+			addr, ok := tables[1].PeerAddress(opts[0].PrivKey.Signatory())
+			Expect(ok).To(BeTrue())
+			Expect(addr.Value).To(HaveSuffix(":3333"))
+		})
+	})
+
+	Context("when a remote peer floods the table with new peers", func() {
+		It("should limit the rate of insertions from that peer", func() {
+			opts, _, tables, _, _, transports := setup(1)
+			p := peer.New(opts[0].WithDiscoveryOptions(opts[0].DiscoveryOptions.WithInsertionRateLimit(0.001, 10)), transports[0])
+
+			ack := func(n int) wire.Msg {
+				flood := make([]wire.SignatoryAndAddress, n)
+				for i := range flood {
+					flood[i] = wire.SignatoryAndAddress{
+						Signatory: id.NewPrivKey().Signatory(),
+						Address:   wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("localhost:%v", 4000+i), 1),
+					}
+				}
+				data, err := surge.ToBinary(flood)
+				Expect(err).ToNot(HaveOccurred())
+				return wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypePingAck, Data: data}
+			}
+
+			flooder := id.NewPrivKey().Signatory()
+			Expect(p.DiscoveryClient().DidReceiveMessage(flooder, nil, ack(50))).To(Succeed())
+			Expect(tables[0].NumPeers()).To(Equal(10))
+			Expect(p.DiscoveryClient().DidReceiveMessage(flooder, nil, ack(50))).To(Succeed())
+			Expect(tables[0].NumPeers()).To(Equal(10))
+
+			// Other remote peers have their own allowance.
+			Expect(p.DiscoveryClient().DidReceiveMessage(id.NewPrivKey().Signatory(), nil, ack(5))).To(Succeed())
+			Expect(tables[0].NumPeers()).To(Equal(15))
+		})
+	})
+
+	Context("when pinging peers with a measured round-trip time", func() {
+		It("should use a tighter ping timeout for low latency peers", func() {
+			n := 2
+			opts, peers, tables, _, _, transports := setup(n)
+
+			cancelPeerContext := createRingTopology(n, opts, peers, tables, transports)
+			defer cancelPeerContext()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			go peers[0].DiscoverPeers(ctx)
+			<-ctx.Done()
+
+			defaultTimeout := opts[0].DiscoveryOptions.PingTimePeriod / time.Duration(opts[0].DiscoveryOptions.Alpha)
+			Expect(peers[0].DiscoveryClient().PingTimeout(peers[1].ID())).To(BeNumerically("<", defaultTimeout))
+			Expect(peers[0].DiscoveryClient().PingTimeout(id.NewPrivKey().Signatory())).To(Equal(defaultTimeout))
+		})
+
+		It("should expose the measured round-trip times", func() {
+			n := 2
+			opts, peers, tables, _, _, transports := setup(n)
+
+			cancelPeerContext := createRingTopology(n, opts, peers, tables, transports)
+			defer cancelPeerContext()
+
+			_, err := peers[0].DiscoveryClient().RTT(peers[1].ID())
+			Expect(err).To(Equal(peer.ErrRTTUnknown))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			go peers[0].DiscoverPeers(ctx)
+
+			Eventually(func() error {
+				_, err := peers[0].DiscoveryClient().RTT(peers[1].ID())
+				return err
+			}, 3*time.Second).Should(Succeed())
+			rtt, _ := peers[0].DiscoveryClient().RTT(peers[1].ID())
+			Expect(rtt).To(BeNumerically(">", 0))
+			Expect(rtt).To(BeNumerically("<", time.Second))
+		})
+	})
+
+	Context("when pings are slow", func() {
+		It("should cancel the pass before the next one begins", func() {
+			period := time.Second
+			opts := peer.DefaultOptions().WithLogger(zap.NewNop())
+			opts = opts.WithDiscoveryOptions(opts.DiscoveryOptions.
+				WithPingTimePeriod(period).
+				WithAlpha(10))
+			self := opts.PrivKey.Signatory()
+			table := &slowTable{
+				Table: dht.NewInMemTable(self),
+				delay: 300 * time.Millisecond,
+				mu:    new(sync.Mutex),
+			}
+			for i := 0; i < 10; i++ {
+				table.AddPeer(id.NewPrivKey().Signatory(), wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:1", uint64(time.Now().UnixNano())))
+			}
+			t := transport.New(
+				transport.DefaultOptions().WithLogger(zap.NewNop()),
+				self,
+				channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), self),
+				handshake.ECIES(opts.PrivKey),
+				table)
+			p := peer.New(opts, t)
+			Expect(p.DiscoveryClient().MaxPassDuration()).To(Equal(period * 4 / 5))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*period/2)
+			defer cancel()
+			start := time.Now()
+			p.DiscoverPeers(ctx)
+
+			table.mu.Lock()
+			defer table.mu.Unlock()
+			// Without the guard, the first pass would take three seconds.
+			// With it, each pass pings at most three peers, and every ping
+			// finishes before the next pass begins.
+			passes := map[time.Duration]int{}
+			for _, lookup := range table.lookups {
+				pass := lookup[0].Sub(start) / period
+				Expect(lookup[1].Sub(start) / period).To(Equal(pass))
+				passes[pass]++
+			}
+			Expect(passes[0]).To(Equal(3))
+			Expect(passes[1]).To(Equal(3))
+		})
+	})
+
+	Context("when the ping time period is adaptive", func() {
+		newPeer := func(table dht.Table, period, minPeriod time.Duration) *peer.Peer {
+			opts := peer.DefaultOptions().WithLogger(zap.NewNop())
+			opts = opts.WithDiscoveryOptions(opts.DiscoveryOptions.
+				WithLogger(zap.NewNop()).
+				WithPingTimePeriod(period).
+				WithAdaptivePingTimePeriod(minPeriod, 5, 10))
+			t := transport.New(
+				transport.DefaultOptions().WithLogger(zap.NewNop()),
+				table.Self(),
+				channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), table.Self()),
+				handshake.ECIES(opts.PrivKey),
+				table)
+			return peer.New(opts, t)
+		}
+		addPeers := func(table dht.Table, n int) {
+			for i := 0; i < n; i++ {
+				table.AddPeer(id.NewPrivKey().Signatory(), wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:1", uint64(time.Now().UnixNano())))
+			}
+		}
+
+		It("should shorten the interval when there are few peers", func() {
+			table := dht.NewInMemTable(id.NewPrivKey().Signatory())
+			p := newPeer(table, time.Second, 100*time.Millisecond)
+
+			Expect(p.DiscoveryClient().PingInterval()).To(Equal(100 * time.Millisecond))
+			addPeers(table, 5)
+			Expect(p.DiscoveryClient().PingInterval()).To(Equal(100 * time.Millisecond))
+			addPeers(table, 2)
+			Expect(p.DiscoveryClient().PingInterval()).To(Equal(460 * time.Millisecond))
+			addPeers(table, 3)
+			Expect(p.DiscoveryClient().PingInterval()).To(Equal(time.Second))
+			addPeers(table, 10)
+			Expect(p.DiscoveryClient().PingInterval()).To(Equal(time.Second))
+			Expect(p.DiscoveryClient().MaxPassDuration()).To(Equal(800 * time.Millisecond))
+		})
+
+		It("should not change the interval when the minimum is not configured", func() {
+			table := dht.NewInMemTable(id.NewPrivKey().Signatory())
+			p := newPeer(table, time.Second, 0)
+			Expect(p.DiscoveryClient().PingInterval()).To(Equal(time.Second))
+
+			p = newPeer(table, time.Second, 2*time.Second)
+			Expect(p.DiscoveryClient().PingInterval()).To(Equal(time.Second))
+		})
+
+		It("should ping more often when there are few peers", func() {
+			self := id.NewPrivKey().Signatory()
+			table := &slowTable{
+				Table: dht.NewInMemTable(self),
+				mu:    new(sync.Mutex),
+			}
+			addPeers(table, 1)
+			p := newPeer(table, 10*time.Second, 100*time.Millisecond)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 550*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			p.DiscoverPeers(ctx)
+
+			table.mu.Lock()
+			defer table.mu.Unlock()
+			passes := map[time.Duration]struct{}{}
+			for _, lookup := range table.lookups {
+				passes[lookup[0].Sub(start)/(100*time.Millisecond)] = struct{}{}
+			}
+			Expect(len(passes)).To(BeNumerically(">=", 4))
+		})
+	})
+
+	Context("when using a virtual clock", func() {
+		It("should only begin the next pass when the clock advances", func() {
+			self := id.NewPrivKey().Signatory()
+			table := &slowTable{
+				Table: forgetfulTable{Table: dht.NewInMemTable(self)},
+				mu:    new(sync.Mutex),
+			}
+			table.AddPeer(id.NewPrivKey().Signatory(), wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:1", uint64(time.Now().UnixNano())))
+			lookups := func() int {
+				table.mu.Lock()
+				defer table.mu.Unlock()
+				return len(table.lookups)
+			}
+
+			c := clock.NewVirtual(time.Unix(0, 0))
+			opts := peer.DefaultOptions().WithLogger(zap.NewNop()).WithClock(c)
+			opts = opts.WithDiscoveryOptions(opts.DiscoveryOptions.
+				WithLogger(zap.NewNop()).
+				WithPingTimePeriod(time.Minute))
+			t := transport.New(
+				transport.DefaultOptions().WithLogger(zap.NewNop()),
+				self,
+				channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), self),
+				handshake.ECIES(opts.PrivKey),
+				table)
+			p := peer.New(opts, t)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			go p.DiscoverPeers(ctx)
+
+			Eventually(lookups).Should(BeNumerically(">", 0))
+			n := lookups()
+			Consistently(lookups, 300*time.Millisecond).Should(Equal(n))
+			c.Advance(time.Minute)
+			Eventually(lookups).Should(BeNumerically(">", n))
+		})
+	})
+
+	Context("when pinging several peers fails", func() {
+		It("should report how many pings failed, and why", func() {
+			core, logs := observer.New(zapcore.DebugLevel)
+			period := time.Second
+			opts := peer.DefaultOptions().WithLogger(zap.NewNop())
+			opts = opts.WithDiscoveryOptions(opts.DiscoveryOptions.
+				WithLogger(zap.New(core)).
+				WithPingTimePeriod(period).
+				WithAlpha(10))
+			self := opts.PrivKey.Signatory()
+			table := forgetfulTable{Table: dht.NewInMemTable(self)}
+			for i := 0; i < 3; i++ {
+				table.AddPeer(id.NewPrivKey().Signatory(), wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:1", uint64(time.Now().UnixNano())))
+			}
+			t := transport.New(
+				transport.DefaultOptions().WithLogger(zap.NewNop()),
+				self,
+				channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), self),
+				handshake.ECIES(opts.PrivKey),
+				table)
+			p := peer.New(opts, t)
+
+			// None of the peers can be found, so every ping fails.
+			ctx, cancel := context.WithTimeout(context.Background(), period/2)
+			defer cancel()
+			p.DiscoverPeers(ctx)
+
+			entries := logs.FilterMessage("pinging").All()
+			Expect(entries).To(HaveLen(1))
+			err, ok := entries[0].Context[0].Interface.(error)
+			Expect(ok).To(BeTrue())
+			var errs *peer.SendErrors
+			Expect(errors.As(err, &errs)).To(BeTrue())
+			Expect(errs.Total).To(Equal(3))
+			Expect(errs.Failed).To(Equal(3))
+			Expect(errs.Causes).To(HaveLen(3))
+			for _, cause := range errs.Causes {
+				Expect(errors.Is(cause, transport.ErrPeerNotFound)).To(BeTrue())
+			}
+			Expect(err.Error()).To(HavePrefix("3 of 3 sends failed: "))
+		})
+	})
+
+	Context("when a peer in the middle of the table does not respond", func() {
+		It("should still ping the peers after it", func() {
+			n := 3
+			opts, _, tables, _, _, transports := setup(n)
+			period := time.Second
+
+			ctx, cancel := context.WithTimeout(context.Background(), period)
+			defer cancel()
+			pings := make(chan id.Signatory, 10)
+			for i := 1; i < n; i++ {
+				i := i
+				go transports[i].Run(ctx)
+				transports[i].Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					if packet.Msg.Type == wire.MsgTypePing {
+						pings <- transports[i].Self()
+					}
+					return nil
+				})
+				tables[0].AddPeer(opts[i].PrivKey.Signatory(),
+					wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("localhost:%v", 3333+i), uint64(time.Now().UnixNano())))
+			}
+
+			// The unresponsive peer is closer than the other peers, so it is
+			// pinged before them.
+			for {
+				unresponsive := id.NewPrivKey().Signatory()
+				tables[0].AddPeer(unresponsive, wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:1", uint64(time.Now().UnixNano())))
+				if tables[0].Peers(1)[0].Equal(&unresponsive) {
+					break
+				}
+				tables[0].DeletePeer(unresponsive)
+			}
+
+			p := peer.New(opts[0].WithDiscoveryOptions(opts[0].DiscoveryOptions.
+				WithPingTimePeriod(period).
+				WithAlpha(10)), transports[0])
+			go p.DiscoverPeers(ctx)
+
+			pinged := map[id.Signatory]bool{}
+			for i := 1; i < n; i++ {
+				var sig id.Signatory
+				Eventually(pings).Should(Receive(&sig))
+				pinged[sig] = true
+			}
+			Expect(pinged).To(HaveLen(n - 1))
+		})
+	})
+
+	Context("when a peer can reach us, but we cannot reach it", func() {
+		It("should emit an asymmetric event", func() {
+			n := 2
+			opts, _, tables, _, _, transports := setup(n)
+			for i := range opts {
+				opts[i] = opts[i].WithDiscoveryOptions(opts[i].DiscoveryOptions.WithPingTimePeriod(200 * time.Millisecond))
+				tables[i].AddPeer(opts[(i+1)%n].PrivKey.Signatory(),
+					wire.NewUnsignedAddress(wire.TCP,
+						fmt.Sprintf("%v:%v", "localhost", uint16(3333+((i+1)%n))), uint64(time.Now().UnixNano())))
+			}
+			local := peer.New(opts[0], transports[0])
+			remote := peer.New(opts[1], transports[1])
+			events := local.Events()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			// The remote peer pings the local peer, but never handles the
+			// pings of the local peer, so they are never acknowledged.
+			go local.Run(ctx)
+			go transports[1].Run(ctx)
+			go local.DiscoverPeers(ctx)
+			go remote.DiscoverPeers(ctx)
+
+			Eventually(func() bool {
+				for {
+					select {
+					case ev := <-events:
+						if ev.Type == peer.EventPeerAsymmetric {
+							Expect(ev.Remote).To(Equal(remote.ID()))
+							return true
+						}
+					default:
+						return false
+					}
+				}
+			}, 4*time.Second).Should(BeTrue())
+			Expect(local.DiscoveryClient().IsAsymmetric(remote.ID())).To(BeTrue())
+			Expect(remote.DiscoveryClient().IsAsymmetric(local.ID())).To(BeFalse())
+		})
+	})
+
+	Context("when sharing presence digests", func() {
+		// converge runs n fully connected peers, where only the first peer is
+		// discovering peers, and returns the number of (peer, remote) pairs for
+		// which the peer has seen the remote peer alive.
+		converge := func(presenceDigestSize int) int {
+			n := 5
+			opts, _, tables, _, _, transports := setup(n)
+
+			peers := make([]*peer.Peer, n)
+			for i := range peers {
+				peers[i] = peer.New(opts[i].WithDiscoveryOptions(opts[i].DiscoveryOptions.WithPresenceDigestSize(presenceDigestSize)), transports[i])
+				for j := range peers {
+					if i != j {
+						tables[i].AddPeer(opts[j].PrivKey.Signatory(),
+							wire.NewUnsignedAddress(wire.TCP,
+								fmt.Sprintf("%v:%v", "localhost", uint16(3333+j)), uint64(time.Now().UnixNano())))
+					}
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].Run(ctx)
+			}
+			time.Sleep(100 * time.Millisecond)
+			go peers[0].DiscoverPeers(ctx)
+			<-ctx.Done()
+
+			seen := 0
+			for i := range peers {
+				for j := range peers {
+					if i == j {
+						continue
+					}
+					if _, ok := tables[i].LastSeen(opts[j].PrivKey.Signatory()); ok {
+						seen++
+					}
+				}
+			}
+			return seen
+		}
+
+		It("should converge on a liveness view faster than pinging alone", func() {
+			n := 5
+			pingOnly := converge(0)
+			// Only the pinging peer, and the peers that it pings, have seen
+			// each other alive.
+			Expect(pingOnly).To(Equal(2 * (n - 1)))
+
+			withPresence := converge(n)
+			// Every peer has learnt about every other peer.
+			Expect(withPresence).To(Equal(n * (n - 1)))
+		})
+	})
+
 	Context("when sending malformed pings to peer", func() {
 		It("peer should not panic", func() {
 
@@ -193,4 +986,137 @@ var _ = Describe("Peer Discovery", func() {
 			}(ctx)
 		})
 	})
+	Context("when pinging a peer that might not accept nonces", func() {
+		It("should only send a nonce once the peer has shown that it accepts one", func() {
+			n := 2
+			opts, _, tables, _, _, transports := setup(n)
+			p := peer.New(opts[0].WithDiscoveryOptions(opts[0].DiscoveryOptions.WithPingTimePeriod(100*time.Millisecond)), transports[0])
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			tables[1].AddPeer(opts[0].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3333", uint64(time.Now().UnixNano())))
+
+			// The remote peer only runs a transport. It behaves like an older
+			// peer, which never acks pings, until it is upgraded.
+			upgraded := int32(0)
+			pings := make(chan int, 100)
+			transports[1].Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				if packet.Msg.Type != wire.MsgTypePing {
+					return nil
+				}
+				select {
+				case pings <- len(packet.Msg.Data):
+				default:
+				}
+				if atomic.LoadInt32(&upgraded) == 0 {
+					return nil
+				}
+				data, err := surge.ToBinary([]wire.SignatoryAndAddress{})
+				Expect(err).ToNot(HaveOccurred())
+				nonce := make([]byte, 8)
+				copy(nonce, packet.Msg.Data[2:])
+				return transports[1].Send(ctx, from, wire.Msg{
+					Version: wire.MsgVersion1,
+					Type:    wire.MsgTypePingAck,
+					To:      id.Hash(from),
+					Data:    append(data, nonce...),
+				})
+			})
+			go transports[1].Run(ctx)
+			go p.Run(ctx)
+			go p.DiscoverPeers(ctx)
+
+			for i := 0; i < 3; i++ {
+				Eventually(pings, 2*time.Second).Should(Receive(Equal(2)))
+			}
+			atomic.StoreInt32(&upgraded, 1)
+			Eventually(pings, 2*time.Second).Should(Receive(Equal(10)))
+		})
+	})
+
+	Context("when sending pings with an unsupported version", func() {
+		It("should notify the sender, so that it retries with a supported version", func() {
+			n := 2
+			opts, peers, tables, _, _, transports := setup(n)
+
+			cancelPeerContext := createRingTopology(n, opts, peers, tables, transports)
+			defer cancelPeerContext()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var pingData [2]byte
+			binary.LittleEndian.PutUint16(pingData[:], transports[0].Port())
+			ping := wire.Msg{
+				Version: wire.MsgVersion1 + 1,
+				Type:    wire.MsgTypePing,
+				To:      id.Hash(peers[1].ID()),
+				Data:    pingData[:],
+			}
+			Expect(transports[0].Send(ctx, peers[1].ID(), ping)).To(Succeed())
+
+			Eventually(func() bool {
+				_, ok := peers[0].RemoteVersion(peers[1].ID())
+				return ok
+			}, 3*time.Second).Should(BeTrue())
+			version, _ := peers[0].RemoteVersion(peers[1].ID())
+			Expect(version).To(Equal(wire.MsgVersion1))
+
+			// Peer discovery is not running, so the remote peer only sees the
+			// local peer if the ping is retried at the supported version.
+			Eventually(func() bool {
+				_, ok := tables[1].LastSeen(peers[0].ID())
+				return ok
+			}, 3*time.Second).Should(BeTrue())
+		})
+
+		It("should send later messages with the supported version", func() {
+			n := 2
+			opts, peers, tables, _, _, transports := setup(n)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			go peers[0].Run(ctx)
+			go transports[1].Run(ctx)
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			tables[1].AddPeer(opts[0].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3333", uint64(time.Now().UnixNano())))
+
+			versions := make(chan uint16, 10)
+			transports[1].Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				if packet.Msg.Type == wire.MsgTypeSend {
+					versions <- packet.Msg.Version
+				}
+				return nil
+			})
+
+			// The remote peer only runs a transport, so it can advertise any
+			// version.
+			data := make([]byte, 4)
+			binary.BigEndian.PutUint16(data[:2], 7)
+			binary.BigEndian.PutUint16(data[2:], wire.MsgTypeSend)
+			Expect(transports[1].Send(ctx, peers[0].ID(), wire.Msg{
+				Version: wire.MsgVersion1,
+				Type:    wire.MsgTypeVersionUnsupported,
+				To:      id.Hash(peers[0].ID()),
+				Data:    data,
+			})).To(Succeed())
+			Eventually(func() bool {
+				_, ok := peers[0].RemoteVersion(peers[1].ID())
+				return ok
+			}, 3*time.Second).Should(BeTrue())
+
+			Expect(peers[0].Send(ctx, peers[1].ID(), wire.Msg{
+				Version: peer.LatestMsgVersion,
+				Type:    wire.MsgTypeSend,
+				To:      id.Hash(peers[1].ID()),
+				Data:    []byte("hello"),
+			})).To(Succeed())
+			Eventually(versions, 3*time.Second).Should(Receive(Equal(uint16(7))))
+		})
+	})
 })
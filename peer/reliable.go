@@ -0,0 +1,135 @@
+package peer
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+)
+
+// ErrNotAcknowledged is returned by SendReliable when the remote peer does not
+// acknowledge the message after all retries.
+var ErrNotAcknowledged = errors.New("message not acknowledged")
+
+// reliableKeySize is the number of random bytes in the idempotency key of a
+// reliable message.
+const reliableKeySize = 16
+
+// acks tracks the reliable messages that are waiting to be acknowledged.
+type acks struct {
+	mu      *sync.Mutex
+	pending map[string]pendingAck
+}
+
+// pendingAck is a reliable message that is waiting to be acknowledged by the
+// peer to which it was sent.
+type pendingAck struct {
+	to id.Signatory
+	ch chan struct{}
+}
+
+func newAcks() *acks {
+	return &acks{
+		mu:      new(sync.Mutex),
+		pending: map[string]pendingAck{},
+	}
+}
+
+// wait returns a channel that is closed when the message with the given key is
+// acknowledged by the remote peer, and a function that stops waiting.
+func (acks *acks) wait(to id.Signatory, key string) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+
+	acks.mu.Lock()
+	acks.pending[key] = pendingAck{to: to, ch: ch}
+	acks.mu.Unlock()
+
+	return ch, func() {
+		acks.mu.Lock()
+		delete(acks.pending, key)
+		acks.mu.Unlock()
+	}
+}
+
+// didReceiveAck for the message with the given key. Acks are ignored, unless
+// they come from the peer to which the message was sent.
+func (acks *acks) didReceiveAck(from id.Signatory, key string) {
+	acks.mu.Lock()
+	defer acks.mu.Unlock()
+
+	pending, ok := acks.pending[key]
+	if !ok || !pending.to.Equal(&from) {
+		return
+	}
+	close(pending.ch)
+	delete(acks.pending, key)
+}
+
+// SendReliable sends data to a remote peer, and waits for the remote peer to
+// acknowledge that the data has been delivered to its receivers. If no
+// acknowledgement arrives within the reliable timeout, the data is sent again,
+// up to the configured number of retries, doubling the timeout each time.
+// Retries are deduplicated by the remote peer, in the same way as
+// SendIdempotent, so the data is delivered at most once (within the
+// idempotency window). ErrNotAcknowledged is returned if all retries fail,
+// and the error of the context is returned if it is done first. Receivers see
+// the message as a normal wire.MsgTypeSend message.
+func (p *Peer) SendReliable(ctx context.Context, to id.Signatory, data []byte) error {
+	keyBuf := [reliableKeySize]byte{}
+	if _, err := cryptorand.Read(keyBuf[:]); err != nil {
+		return fmt.Errorf("generating message key: %v", err)
+	}
+	key := string(keyBuf[:])
+
+	acked, stop := p.acks.wait(to, key)
+	defer stop()
+
+	msg := wire.Msg{
+		Version: LatestMsgVersion,
+		Type:    wire.MsgTypeSendReliable,
+		To:      id.Hash(to),
+		Data:    marshalIdempotent(key, data),
+	}
+	timeout := p.opts.ReliableTimeout
+	for attempt := 0; attempt <= p.opts.ReliableRetries; attempt++ {
+		if err := p.Send(ctx, to, msg); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			p.opts.Logger.Debug("sending reliable", zap.String("to", to.String()), zap.Int("attempt", attempt), zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-acked:
+			return nil
+		case <-p.opts.DiscoveryOptions.Clock.After(timeout):
+			timeout *= 2
+		}
+	}
+	return fmt.Errorf("sending to %v after %v attempts: %w", to, p.opts.ReliableRetries+1, ErrNotAcknowledged)
+}
+
+// ack a reliable message, in the background, so that the receiver is not
+// blocked by the send.
+func (p *Peer) ack(to id.Signatory, key string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), p.opts.ReliableTimeout)
+		defer cancel()
+
+		if err := p.transport.Send(ctx, to, wire.Msg{
+			Version: LatestMsgVersion,
+			Type:    wire.MsgTypeSendAck,
+			To:      id.Hash(to),
+			Data:    []byte(key),
+		}); err != nil {
+			p.opts.Logger.Debug("acking", zap.String("to", to.String()), zap.Error(err))
+		}
+	}()
+}
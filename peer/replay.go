@@ -0,0 +1,148 @@
+package peer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/renproject/id"
+)
+
+// replayCache remembers the messages that have been seen within a window of
+// time, so that replayed messages can be dropped. It is bounded in size, and
+// forgets the oldest messages first. A window of zero, or less, means that
+// messages are only forgotten to make room for newer ones.
+type replayCache struct {
+	window  time.Duration
+	maxSize int
+
+	mu    *sync.Mutex
+	seen  map[id.Hash]time.Time
+	order []id.Hash
+}
+
+func newReplayCache(window time.Duration, maxSize int) *replayCache {
+	return &replayCache{
+		window:  window,
+		maxSize: maxSize,
+
+		mu:    new(sync.Mutex),
+		seen:  map[id.Hash]time.Time{},
+		order: []id.Hash{},
+	}
+}
+
+// replayed returns true if the message was already seen within the window.
+// Otherwise, it remembers the message and returns false.
+func (cache *replayCache) replayed(hash id.Hash, now time.Time) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.expire(now)
+	if _, ok := cache.seen[hash]; ok {
+		return true
+	}
+
+	if cache.maxSize > 0 && len(cache.order) >= cache.maxSize {
+		delete(cache.seen, cache.order[0])
+		cache.order = cache.order[1:]
+	}
+	cache.seen[hash] = now
+	cache.order = append(cache.order, hash)
+	return false
+}
+
+// contains returns true if the message was already seen within the window,
+// without remembering it.
+func (cache *replayCache) contains(hash id.Hash, now time.Time) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.expire(now)
+	_, ok := cache.seen[hash]
+	return ok
+}
+
+// expire forgets messages that were seen before the window. It must be called
+// while holding the mutex.
+func (cache *replayCache) expire(now time.Time) {
+	if cache.window <= 0 {
+		return
+	}
+	// Messages are remembered in the order that they are seen, so expired
+	// messages are always at the front.
+	for len(cache.order) > 0 {
+		oldest := cache.order[0]
+		if now.Sub(cache.seen[oldest]) < cache.window {
+			break
+		}
+		delete(cache.seen, oldest)
+		cache.order = cache.order[1:]
+	}
+}
+
+// maxReplayCacheSubnets is the maximum number of subnets for which a
+// subnetReplayCache keeps a separate partition.
+const maxReplayCacheSubnets = 256
+
+// subnetReplayCache is a replayCache that is partitioned by subnet. Each
+// subnet has its own partition with its own maximum size, so that flooding one
+// subnet with messages cannot cause messages from another subnet to be
+// forgotten. When there are too many subnets, the partition of the oldest
+// subnet is forgotten, except for the default subnet which is never forgotten.
+type subnetReplayCache struct {
+	window  time.Duration
+	maxSize int
+
+	mu         *sync.Mutex
+	partitions map[id.Hash]*replayCache
+	order      []id.Hash
+}
+
+func newSubnetReplayCache(window time.Duration, maxSize int) *subnetReplayCache {
+	return &subnetReplayCache{
+		window:  window,
+		maxSize: maxSize,
+
+		mu:         new(sync.Mutex),
+		partitions: map[id.Hash]*replayCache{},
+		order:      []id.Hash{},
+	}
+}
+
+// replayed returns true if the message was already seen in the subnet within
+// the window. Otherwise, it remembers the message and returns false.
+func (cache *subnetReplayCache) replayed(subnet id.Hash, hash id.Hash, now time.Time) bool {
+	return cache.partition(subnet, true).replayed(hash, now)
+}
+
+// contains returns true if the message was already seen in the subnet within
+// the window, without remembering it.
+func (cache *subnetReplayCache) contains(subnet id.Hash, hash id.Hash, now time.Time) bool {
+	partition := cache.partition(subnet, false)
+	if partition == nil {
+		return false
+	}
+	return partition.contains(hash, now)
+}
+
+// partition returns the replayCache for the subnet. If there is none, and
+// create is true, then a new one is created. Otherwise, nil is returned.
+func (cache *subnetReplayCache) partition(subnet id.Hash, create bool) *replayCache {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if partition, ok := cache.partitions[subnet]; ok || !create {
+		return partition
+	}
+
+	if len(cache.order) >= maxReplayCacheSubnets {
+		delete(cache.partitions, cache.order[0])
+		cache.order = cache.order[1:]
+	}
+	partition := newReplayCache(cache.window, cache.maxSize)
+	cache.partitions[subnet] = partition
+	if !subnet.Equal(&DefaultSubnet) {
+		cache.order = append(cache.order, subnet)
+	}
+	return partition
+}
@@ -0,0 +1,72 @@
+package peer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/renproject/id"
+)
+
+// maxSendErrorCauses is the maximum number of distinct causes that are kept by
+// SendErrors.
+const maxSendErrorCauses = 4
+
+// SendErrors combines the errors returned when sending to many peers. It
+// counts how many of the sends failed, and keeps a sample of the distinct
+// causes, so that partial failures can be diagnosed without logging every
+// error. Failures contains the error of each peer that could not be sent to,
+// so that sending can be retried for only those peers.
+type SendErrors struct {
+	Total    int
+	Failed   int
+	Causes   []error
+	Failures map[id.Signatory]error
+}
+
+// add the result of sending to one peer.
+func (errs *SendErrors) add(remote id.Signatory, err error) {
+	errs.Total++
+	if err == nil {
+		return
+	}
+	errs.Failed++
+	if errs.Failures == nil {
+		errs.Failures = map[id.Signatory]error{}
+	}
+	errs.Failures[remote] = err
+	if len(errs.Causes) >= maxSendErrorCauses {
+		return
+	}
+	for _, cause := range errs.Causes {
+		if cause.Error() == err.Error() {
+			return
+		}
+	}
+	errs.Causes = append(errs.Causes, err)
+}
+
+// Err returns nil if none of the sends failed. Otherwise, it returns the
+// SendErrors.
+func (errs *SendErrors) Err() error {
+	if errs.Failed == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (errs *SendErrors) Error() string {
+	causes := make([]string, len(errs.Causes))
+	for i, cause := range errs.Causes {
+		causes[i] = cause.Error()
+	}
+	return fmt.Sprintf("%v of %v sends failed: %v", errs.Failed, errs.Total, strings.Join(causes, "; "))
+}
+
+// Unwrap returns the first cause, so that errors.Is and errors.As can be used
+// to check why sending failed.
+func (errs *SendErrors) Unwrap() error {
+	if len(errs.Causes) == 0 {
+		return nil
+	}
+	return errs.Causes[0]
+}
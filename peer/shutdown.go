@@ -0,0 +1,75 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// shutdown tracks the operations that are in progress, so that they can be
+// drained when the peer is shut down.
+type shutdown struct {
+	mu       *sync.RWMutex
+	draining bool
+	inFlight *sync.WaitGroup
+
+	once *sync.Once
+	done chan struct{}
+}
+
+func newShutdown() *shutdown {
+	return &shutdown{
+		mu:       new(sync.RWMutex),
+		draining: false,
+		inFlight: new(sync.WaitGroup),
+
+		once: new(sync.Once),
+		done: make(chan struct{}),
+	}
+}
+
+// begin an operation. It returns an error if the peer is shutting down.
+// Otherwise, the returned function must be called when the operation ends.
+func (s *shutdown) begin() (func(), error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.draining {
+		return nil, ErrShuttingDown
+	}
+	s.inFlight.Add(1)
+	return s.inFlight.Done, nil
+}
+
+// drain stops new operations from beginning, and waits for the operations that
+// are in progress to end, or for the context to be done.
+func (s *shutdown) drain(ctx context.Context) error {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(drained)
+	}()
+
+	defer s.once.Do(func() { close(s.done) })
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("draining: %w", ctx.Err())
+	}
+}
+
+// Shutdown the peer gracefully. New sends, streams, syncs, and gossips are
+// rejected with ErrShuttingDown, and the ones that are already in progress are
+// given until the context is done to finish. Messages continue to be handled
+// while draining, so that in progress syncs can complete. Afterwards, Run
+// returns, and the peer stops accepting network connections. An error is
+// returned if the context is done before the operations in progress have
+// finished, in which case the peer is still shut down.
+func (p *Peer) Shutdown(ctx context.Context) error {
+	return p.shutdown.drain(ctx)
+}
@@ -0,0 +1,293 @@
+package peer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+)
+
+// streamHeaderSize is the number of bytes prepended to every stream chunk. It
+// contains the stream ID (8 bytes), the sequence number of the chunk (8 bytes),
+// and flags (1 byte).
+const streamHeaderSize = 17
+
+// streamFlagEnd is set on the last chunk of a stream.
+const streamFlagEnd = uint8(1)
+
+// ErrStreamTimeout is returned when reading from a stream that has not received
+// a chunk within the stream timeout.
+var ErrStreamTimeout = errors.New("stream timeout")
+
+// ErrStreamEvicted is returned when reading from a stream that was evicted,
+// because too many streams were in progress at the same time.
+var ErrStreamEvicted = errors.New("stream evicted")
+
+// ErrStreamOverflow is returned when reading from a stream that was reset,
+// because its chunks were received faster than they were read, and its buffer
+// overflowed.
+var ErrStreamOverflow = errors.New("stream overflow")
+
+type streamKey struct {
+	from id.Signatory
+	id   uint64
+}
+
+type stream struct {
+	startedAt time.Time
+	chunks    chan streamChunk
+	// done is closed when the stream is no longer accepting chunks.
+	done chan struct{}
+	// evict is closed when the stream is evicted to make room for newer
+	// streams.
+	evict chan struct{}
+	// overflow is closed when a chunk is received while the buffer is full.
+	overflow chan struct{}
+}
+
+type streamChunk struct {
+	seq  uint64
+	end  bool
+	data []byte
+}
+
+// A Streamer sends large payloads as a sequence of chunks, so that neither the
+// sending peer nor the receiving peer need to hold the entire payload in
+// memory.
+type Streamer struct {
+	opts      StreamerOptions
+	transport *transport.Transport
+
+	handlerMu *sync.RWMutex
+	handler   func(id.Signatory, io.Reader)
+
+	streamsMu *sync.Mutex
+	streams   map[streamKey]stream
+
+	// versions are the message versions supported by remote peers.
+	versions *remoteVersions
+}
+
+func NewStreamer(opts StreamerOptions, transport *transport.Transport) *Streamer {
+	return &Streamer{
+		opts:      opts,
+		transport: transport,
+
+		handlerMu: new(sync.RWMutex),
+		handler:   nil,
+
+		streamsMu: new(sync.Mutex),
+		streams:   map[streamKey]stream{},
+
+		versions: newRemoteVersions(),
+	}
+}
+
+// Receive sets the function that is called whenever a new stream is received.
+// The function is called in its own goroutine, and should read from the reader
+// until it returns an error (io.EOF when the stream is complete). Streams are
+// dropped if no function has been set, and reset if the function does not read
+// fast enough to keep the buffer of the stream from overflowing.
+func (s *Streamer) Receive(f func(id.Signatory, io.Reader)) {
+	s.handlerMu.Lock()
+	defer s.handlerMu.Unlock()
+
+	s.handler = f
+}
+
+// Send the data from a reader to a remote peer. The data is read, and sent, one
+// chunk at a time. It returns once the reader returns io.EOF and all chunks have
+// been sent, or an error happens.
+func (s *Streamer) Send(ctx context.Context, to id.Signatory, r io.Reader) error {
+	var streamIDBytes [8]byte
+	if _, err := rand.Read(streamIDBytes[:]); err != nil {
+		return fmt.Errorf("generating stream id: %v", err)
+	}
+	streamID := binary.BigEndian.Uint64(streamIDBytes[:])
+
+	for seq := uint64(0); ; seq++ {
+		// A new buffer is needed for every chunk, because the transport can
+		// hold on to messages after they have been sent.
+		buf := make([]byte, streamHeaderSize+s.opts.ChunkSize)
+		binary.BigEndian.PutUint64(buf[:8], streamID)
+		n, err := io.ReadFull(r, buf[streamHeaderSize:])
+		end := false
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			end = true
+		default:
+			return fmt.Errorf("reading chunk %v: %w", seq, err)
+		}
+
+		binary.BigEndian.PutUint64(buf[8:16], seq)
+		buf[16] = 0
+		if end {
+			buf[16] = streamFlagEnd
+		}
+		msg := wire.Msg{
+			Version: s.versions.msgVersion(to),
+			Type:    wire.MsgTypeStream,
+			To:      id.Hash(to),
+			Data:    buf[:streamHeaderSize+n],
+		}
+		if err := s.transport.Send(ctx, to, msg); err != nil {
+			return fmt.Errorf("sending chunk %v: %w", seq, err)
+		}
+		if end {
+			return nil
+		}
+	}
+}
+
+func (s *Streamer) DidReceiveMessage(from id.Signatory, msg wire.Msg) error {
+	if msg.Type != wire.MsgTypeStream {
+		return nil
+	}
+	if len(msg.Data) < streamHeaderSize {
+		return fmt.Errorf("malformed stream chunk: expected at least %v bytes, received %v bytes", streamHeaderSize, len(msg.Data))
+	}
+
+	key := streamKey{from: from, id: binary.BigEndian.Uint64(msg.Data[:8])}
+	chunk := streamChunk{
+		seq:  binary.BigEndian.Uint64(msg.Data[8:16]),
+		end:  msg.Data[16]&streamFlagEnd != 0,
+		data: make([]byte, len(msg.Data)-streamHeaderSize),
+	}
+	copy(chunk.data, msg.Data[streamHeaderSize:])
+
+	s.streamsMu.Lock()
+	st, ok := s.streams[key]
+	if !ok {
+		if chunk.seq != 0 {
+			// We have missed the start of this stream (or it has already
+			// timed out), so there is no way to recover it.
+			s.streamsMu.Unlock()
+			s.opts.Logger.Debug("stream", zap.String("from", from.String()), zap.Uint64("seq", chunk.seq), zap.String("chunk", "unknown stream"))
+			return nil
+		}
+		s.handlerMu.RLock()
+		handler := s.handler
+		s.handlerMu.RUnlock()
+		if handler == nil {
+			s.streamsMu.Unlock()
+			s.opts.Logger.Debug("stream", zap.String("from", from.String()), zap.String("chunk", "no handler"))
+			return nil
+		}
+		if s.opts.MaxStreams > 0 && len(s.streams) >= s.opts.MaxStreams {
+			s.evictOldest()
+		}
+		st = stream{
+			startedAt: s.opts.Clock.Now(),
+			chunks:    make(chan streamChunk, s.opts.BufferSize),
+			done:      make(chan struct{}),
+			evict:     make(chan struct{}),
+			overflow:  make(chan struct{}),
+		}
+		s.streams[key] = st
+		go s.reassemble(key, st, handler)
+	}
+	defer s.streamsMu.Unlock()
+
+	// Never block when the buffer is full, because messages from the remote
+	// peer are received one at a time, and a slow handler would stop all other
+	// messages from being received. Instead, the stream is reset.
+	select {
+	case <-st.done:
+	case st.chunks <- chunk:
+	default:
+		delete(s.streams, key)
+		close(st.overflow)
+		s.opts.Logger.Debug("stream", zap.String("from", from.String()), zap.String("reset", "buffer full"))
+	}
+	return nil
+}
+
+// NumStreams returns the number of received streams that are in progress.
+func (s *Streamer) NumStreams() int {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+
+	return len(s.streams)
+}
+
+// evictOldest removes the stream that was started first, and stops its
+// reassembly. It must be called while holding the streams mutex.
+func (s *Streamer) evictOldest() {
+	var oldestKey streamKey
+	var oldest stream
+	found := false
+	for key, st := range s.streams {
+		if !found || st.startedAt.Before(oldest.startedAt) {
+			oldestKey, oldest, found = key, st, true
+		}
+	}
+	if !found {
+		return
+	}
+	delete(s.streams, oldestKey)
+	close(oldest.evict)
+	s.opts.Logger.Debug("stream", zap.String("from", oldestKey.from.String()), zap.String("evicted", "too many streams"))
+}
+
+// reassemble the chunks of a stream, in order, and write them to the reader
+// that is given to the handler.
+func (s *Streamer) reassemble(key streamKey, st stream, handler func(id.Signatory, io.Reader)) {
+	r, w := io.Pipe()
+	go func() {
+		handler(key.from, r)
+		// Unblock writes in case the handler did not read everything.
+		r.CloseWithError(io.ErrClosedPipe)
+	}()
+
+	defer func() {
+		s.streamsMu.Lock()
+		// The stream might have been evicted and replaced by a new stream
+		// with the same key.
+		if current, ok := s.streams[key]; ok && current.done == st.done {
+			delete(s.streams, key)
+		}
+		s.streamsMu.Unlock()
+		close(st.done)
+	}()
+
+	timeout := s.opts.Clock.After(s.opts.Timeout)
+	next := uint64(0)
+	for {
+		select {
+		case <-timeout:
+			w.CloseWithError(ErrStreamTimeout)
+			return
+		case <-st.evict:
+			w.CloseWithError(ErrStreamEvicted)
+			return
+		case <-st.overflow:
+			w.CloseWithError(ErrStreamOverflow)
+			return
+		case chunk := <-st.chunks:
+			if chunk.seq != next {
+				w.CloseWithError(fmt.Errorf("unexpected stream chunk: expected %v, got %v", next, chunk.seq))
+				return
+			}
+			next++
+			// Errors are ignored, because they only happen when the handler
+			// has stopped reading. We still need to consume the remaining
+			// chunks.
+			_, _ = w.Write(chunk.data)
+			if chunk.end {
+				w.Close()
+				return
+			}
+			timeout = s.opts.Clock.After(s.opts.Timeout)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package peer_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/renproject/aw/clock"
+	"github.com/renproject/aw/peer"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Streaming", func() {
+	// chunk returns a stream message, as it would be sent by a remote peer.
+	chunk := func(streamID, seq uint64, end bool, data string) wire.Msg {
+		buf := make([]byte, 17+len(data))
+		binary.BigEndian.PutUint64(buf[:8], streamID)
+		binary.BigEndian.PutUint64(buf[8:16], seq)
+		if end {
+			buf[16] = 1
+		}
+		copy(buf[17:], data)
+		return wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeStream, Data: buf}
+	}
+
+	Context("when streaming a large payload to a peer", func() {
+		It("should reassemble the exact same bytes", func() {
+			n := 2
+			opts, peers, tables, _, _, transports := setup(n)
+
+			cancelPeerContext := createRingTopology(n, opts, peers, tables, transports)
+			defer cancelPeerContext()
+
+			// The payload is generated lazily, so that it is never held in
+			// memory by the sender.
+			size := int64(3 * 1024 * 1024)
+			seed := time.Now().UnixNano()
+			payload := func() io.Reader {
+				return io.LimitReader(rand.New(rand.NewSource(seed)), size)
+			}
+			expected := sha256.New()
+			_, err := io.Copy(expected, payload())
+			Expect(err).ToNot(HaveOccurred())
+
+			type result struct {
+				from id.Signatory
+				n    int64
+				hash []byte
+				err  error
+			}
+			results := make(chan result, 1)
+			peers[1].ReceiveStreams(func(from id.Signatory, r io.Reader) {
+				hash := sha256.New()
+				n, err := io.Copy(hash, r)
+				results <- result{from: from, n: n, hash: hash.Sum(nil), err: err}
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			Expect(peers[0].SendStream(ctx, peers[1].ID(), payload())).To(Succeed())
+
+			var res result
+			Eventually(results, 5*time.Second).Should(Receive(&res))
+			Expect(res.err).ToNot(HaveOccurred())
+			Expect(res.from).To(Equal(peers[0].ID()))
+			Expect(res.n).To(Equal(size))
+			Expect(res.hash).To(Equal(expected.Sum(nil)))
+		})
+	})
+	Context("when flooded with incomplete streams", func() {
+		It("should bound the number of streams in progress, and still reassemble complete streams", func() {
+			maxStreams := 4
+			opts := peer.DefaultStreamerOptions().WithLogger(zap.NewNop()).WithMaxStreams(maxStreams)
+			streamer := peer.NewStreamer(opts, nil)
+
+			type result struct {
+				data []byte
+				err  error
+			}
+			results := make(chan result, 200)
+			streamer.Receive(func(from id.Signatory, r io.Reader) {
+				data, err := io.ReadAll(r)
+				results <- result{data: data, err: err}
+			})
+
+			from := id.NewPrivKey().Signatory()
+			n := 100
+			for i := 0; i < n; i++ {
+				Expect(streamer.DidReceiveMessage(from, chunk(uint64(i), 0, false, "incomplete"))).To(Succeed())
+				Expect(streamer.NumStreams()).To(BeNumerically("<=", maxStreams))
+			}
+
+			// All but the most recent streams have been evicted.
+			for i := 0; i < n-maxStreams; i++ {
+				var res result
+				Eventually(results).Should(Receive(&res))
+				Expect(errors.Is(res.err, peer.ErrStreamEvicted)).To(BeTrue())
+			}
+
+			Expect(streamer.DidReceiveMessage(from, chunk(uint64(n), 0, false, "hello, "))).To(Succeed())
+			Expect(streamer.DidReceiveMessage(from, chunk(uint64(n), 1, true, "world"))).To(Succeed())
+			Expect(streamer.NumStreams()).To(BeNumerically("<=", maxStreams))
+
+			// One more stream was evicted to make room for the complete
+			// stream.
+			complete := false
+			for i := 0; i < 2; i++ {
+				var res result
+				Eventually(results).Should(Receive(&res))
+				if res.err == nil {
+					Expect(string(res.data)).To(Equal("hello, world"))
+					complete = true
+				} else {
+					Expect(errors.Is(res.err, peer.ErrStreamEvicted)).To(BeTrue())
+				}
+			}
+			Expect(complete).To(BeTrue())
+		})
+	})
+	Context("when a stream is not read fast enough", func() {
+		It("should reset the stream instead of blocking", func() {
+			bufferSize := 4
+			opts := peer.DefaultStreamerOptions().WithLogger(zap.NewNop()).WithBufferSize(bufferSize)
+			streamer := peer.NewStreamer(opts, nil)
+
+			release := make(chan struct{})
+			errs := make(chan error, 1)
+			streamer.Receive(func(from id.Signatory, r io.Reader) {
+				<-release
+				_, err := io.ReadAll(r)
+				errs <- err
+			})
+
+			from := id.NewPrivKey().Signatory()
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				for seq := uint64(0); seq < uint64(bufferSize+2); seq++ {
+					Expect(streamer.DidReceiveMessage(from, chunk(1, seq, false, "chunk"))).To(Succeed())
+				}
+			}()
+			Eventually(done).Should(BeClosed())
+			Expect(streamer.NumStreams()).To(Equal(0))
+
+			close(release)
+			var err error
+			Eventually(errs).Should(Receive(&err))
+			Expect(errors.Is(err, peer.ErrStreamOverflow)).To(BeTrue())
+		})
+	})
+
+	Context("when no chunk is received within the timeout", func() {
+		It("should time out the stream using the clock", func() {
+			c := clock.NewVirtual(time.Unix(0, 0))
+			opts := peer.DefaultStreamerOptions().WithLogger(zap.NewNop()).WithTimeout(time.Minute).WithClock(c)
+			streamer := peer.NewStreamer(opts, nil)
+
+			errs := make(chan error, 1)
+			streamer.Receive(func(from id.Signatory, r io.Reader) {
+				_, err := io.ReadAll(r)
+				errs <- err
+			})
+
+			Expect(streamer.DidReceiveMessage(id.NewPrivKey().Signatory(), chunk(1, 0, false, "hello"))).To(Succeed())
+			Consistently(errs, 100*time.Millisecond).ShouldNot(Receive())
+
+			c.Advance(time.Minute)
+			var err error
+			Eventually(errs).Should(Receive(&err))
+			Expect(errors.Is(err, peer.ErrStreamTimeout)).To(BeTrue())
+		})
+	})
+})
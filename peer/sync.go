@@ -57,6 +57,9 @@ type Syncer struct {
 
 	pendingMu *sync.Mutex
 	pending   map[string]*pendingContent
+
+	// versions are the message versions supported by remote peers.
+	versions *remoteVersions
 }
 
 func NewSyncer(opts SyncerOptions, filter *channel.SyncFilter, transport *transport.Transport) *Syncer {
@@ -67,6 +70,8 @@ func NewSyncer(opts SyncerOptions, filter *channel.SyncFilter, transport *transp
 
 		pendingMu: new(sync.Mutex),
 		pending:   make(map[string]*pendingContent, 1024),
+
+		versions: newRemoteVersions(),
 	}
 }
 
@@ -127,7 +132,7 @@ func (syncer *Syncer) Sync(ctx context.Context, contentID []byte, hint *id.Signa
 		p := peers[i]
 		go func() {
 			err := syncer.transport.Send(ctx, p, wire.Msg{
-				Version: wire.MsgVersion1,
+				Version: syncer.versions.msgVersion(p),
 				Type:    wire.MsgTypePull,
 				Data:    contentID,
 			})
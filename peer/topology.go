@@ -0,0 +1,47 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/renproject/aw/wire"
+)
+
+// TopologyDOT renders the view that the peer has of the network as a Graphviz
+// DOT graph. There is a node for the local peer, and for every peer in the
+// table (labelled with its address). There is an edge from the local peer to
+// every remote peer with which it has an active network connection, and remote
+// peers with which it is linked are drawn with bold edges.
+func (p *Peer) TopologyDOT() (string, error) {
+	self := p.ID()
+
+	b := strings.Builder{}
+	b.WriteString("digraph aw {\n")
+	fmt.Fprintf(&b, "\t%q [label=%q, shape=doublecircle];\n", self.String(), self.String())
+
+	edges := []string{}
+	err := p.transport.Table().IteratePeerAddresses(context.Background(), func(sigAndAddr wire.SignatoryAndAddress) bool {
+		remote := sigAndAddr.Signatory
+		label := fmt.Sprintf("%v\n%v", remote.String(), sigAndAddr.Address.String())
+		fmt.Fprintf(&b, "\t%q [label=%q];\n", remote.String(), label)
+
+		if p.transport.IsConnected(remote) {
+			style := "solid"
+			if p.transport.IsLinked(remote) {
+				style = "bold"
+			}
+			edges = append(edges, fmt.Sprintf("\t%q -> %q [style=%v];\n", self.String(), remote.String(), style))
+		}
+		return true
+	})
+	if err != nil {
+		return "", fmt.Errorf("iterating peers: %w", err)
+	}
+
+	for _, edge := range edges {
+		b.WriteString(edge)
+	}
+	b.WriteString("}\n")
+	return b.String(), nil
+}
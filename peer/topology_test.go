@@ -0,0 +1,50 @@
+package peer_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/renproject/aw/wire"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Topology", func() {
+	Context("when rendering the topology as a DOT graph", func() {
+		It("should have a node per peer, and edges for active connections", func() {
+			n := 3
+			opts, peers, tables, _, _, transports := setup(n)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			go peers[0].Run(ctx)
+			go peers[1].Run(ctx)
+
+			// The last peer is known, but is not running, so it cannot be
+			// connected to.
+			for i := 1; i < n; i++ {
+				tables[0].AddPeer(opts[i].PrivKey.Signatory(),
+					wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("localhost:%v", 3333+i), uint64(time.Now().UnixNano())))
+			}
+			transports[0].Link(peers[1].ID())
+			defer transports[0].Unlink(peers[1].ID())
+			Expect(transports[0].Dial(ctx, peers[1].ID())).To(Succeed())
+			Eventually(func() bool {
+				return transports[0].IsConnected(peers[1].ID())
+			}, 5*time.Second).Should(BeTrue())
+
+			dot, err := peers[0].TopologyDOT()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dot).To(HavePrefix("digraph aw {"))
+			for i := range peers {
+				Expect(dot).To(ContainSubstring(fmt.Sprintf("%q [label=", peers[i].ID().String())))
+			}
+			Expect(dot).To(ContainSubstring(fmt.Sprintf("%q -> %q", peers[0].ID().String(), peers[1].ID().String())))
+			Expect(dot).ToNot(ContainSubstring(fmt.Sprintf("-> %q", peers[2].ID().String())))
+			Expect(strings.Count(dot, "->")).To(Equal(1))
+		})
+	})
+})
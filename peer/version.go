@@ -0,0 +1,121 @@
+package peer
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+)
+
+// LatestMsgVersion is the latest message version that is supported. Messages
+// with any other version are rejected, and the sender is notified so that it
+// can downgrade.
+const LatestMsgVersion = wire.MsgVersion1
+
+// RemoteVersion returns the latest message version supported by a remote peer.
+// This is only known after the remote peer has rejected a message because of
+// its version, and from then on, messages to the remote peer use this version.
+func (p *Peer) RemoteVersion(remote id.Signatory) (uint16, bool) {
+	return p.versions.get(remote)
+}
+
+// remoteVersions remembers the latest message versions supported by remote
+// peers, as advertised by them when they reject messages. It is shared by the
+// peer and all of its components, so that all messages to a remote peer use
+// the same version.
+type remoteVersions struct {
+	mu       *sync.RWMutex
+	versions map[id.Signatory]uint16
+}
+
+func newRemoteVersions() *remoteVersions {
+	return &remoteVersions{
+		mu:       new(sync.RWMutex),
+		versions: map[id.Signatory]uint16{},
+	}
+}
+
+func (rv *remoteVersions) get(remote id.Signatory) (uint16, bool) {
+	rv.mu.RLock()
+	defer rv.mu.RUnlock()
+
+	version, ok := rv.versions[remote]
+	return version, ok
+}
+
+// set the version supported by the remote peer, and return true if it is
+// different from the version that was previously known.
+func (rv *remoteVersions) set(remote id.Signatory, version uint16) bool {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+
+	previous, ok := rv.versions[remote]
+	rv.versions[remote] = version
+	return !ok || previous != version
+}
+
+// msgVersion returns the version of messages that are sent to the remote peer.
+// It is the latest version, unless the remote peer has advertised another.
+func (rv *remoteVersions) msgVersion(remote id.Signatory) uint16 {
+	if version, ok := rv.get(remote); ok {
+		return version
+	}
+	return LatestMsgVersion
+}
+
+// isProtocolMsgType returns true if messages of the given type are handled by
+// the peer itself, rather than by the application.
+func isProtocolMsgType(ty uint16) bool {
+	switch ty {
+	case wire.MsgTypePush, wire.MsgTypePull, wire.MsgTypeSync,
+		wire.MsgTypePing, wire.MsgTypePingAck, wire.MsgTypePresence,
+		wire.MsgTypeStream, wire.MsgTypePushLimited, wire.MsgTypeSendAck:
+		return true
+	}
+	return false
+}
+
+// didReceiveUnsupportedVersion notifies the remote peer that the version of
+// its message is not supported, and which version is.
+func (p *Peer) didReceiveUnsupportedVersion(from id.Signatory, msg wire.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.opts.DiscoveryOptions.PingTimePeriod)
+	defer cancel()
+
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint16(data[:2], LatestMsgVersion)
+	binary.BigEndian.PutUint16(data[2:], msg.Type)
+	notice := wire.Msg{
+		Version:  wire.MsgVersion1,
+		Type:     wire.MsgTypeVersionUnsupported,
+		To:       id.Hash(from),
+		Data:     data,
+		Priority: wire.MsgPriorityHigh,
+	}
+	if err := p.transport.Send(ctx, from, notice); err != nil {
+		p.opts.Logger.Debug("version unsupported", zap.String("peer", from.String()), zap.Uint16("version", msg.Version), zap.Error(err))
+	}
+}
+
+func (p *Peer) didReceiveVersionUnsupported(from id.Signatory, msg wire.Msg) error {
+	if dataLen := len(msg.Data); dataLen != 4 {
+		return fmt.Errorf("malformed version unsupported message: expected 4 bytes, received %v bytes", dataLen)
+	}
+	version := binary.BigEndian.Uint16(msg.Data[:2])
+	ty := binary.BigEndian.Uint16(msg.Data[2:])
+
+	changed := p.versions.set(from, version)
+	p.opts.Logger.Debug("version unsupported", zap.String("peer", from.String()), zap.Uint16("supported", version), zap.Uint16("type", ty))
+
+	// Rejected pings are sent again straight away, at the supported version,
+	// so that the remote peer does not look unreachable until the next pass of
+	// peer discovery. They are only sent again when the version has changed,
+	// so that a remote peer that keeps rejecting pings cannot cause a loop.
+	if ty == wire.MsgTypePing && changed {
+		go p.discoveryClient.pingNow(from, "retrying ping")
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package policy
 
 import (
 	"math"
+	"math/rand"
 	"time"
 )
 
@@ -45,3 +46,13 @@ func ExponentialBackoff(rate float64, timeout Timeout) Timeout {
 		return time.Duration(math.Pow(rate, float64(attempt))) * timeout(attempt)
 	}
 }
+
+// Jitter returns a Timeout function that randomly scales the duration returned
+// by another Timeout function by up to the given fraction, in either
+// direction. This stops many peers from retrying in lockstep.
+func Jitter(fraction float64, timeout Timeout) Timeout {
+	return func(attempt int) time.Duration {
+		duration := timeout(attempt)
+		return duration + time.Duration((2*rand.Float64()-1)*fraction*float64(duration))
+	}
+}
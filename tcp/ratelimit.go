@@ -0,0 +1,46 @@
+package tcp
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitedConn is a network connection that limits the rate at which data
+// can be read from it.
+type rateLimitedConn struct {
+	net.Conn
+	limiter *rate.Limiter
+}
+
+// RateLimitReads wraps a network connection so that data can be read from it
+// at no more than the given number of bytes per second. Reading blocks until
+// the rate limit allows it, instead of failing, so a remote peer that sends
+// too quickly is slowed down by TCP back-pressure rather than disconnected. Up
+// to one second of data can be read at once. A rate of zero, or less, means
+// that reads are not limited, and the connection is returned unchanged.
+func RateLimitReads(conn net.Conn, bytesPerSecond int) net.Conn {
+	if bytesPerSecond <= 0 {
+		return conn
+	}
+	return &rateLimitedConn{
+		Conn:    conn,
+		limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), bytesPerSecond),
+	}
+}
+
+// Read at most one second of data from the connection, and then wait until
+// the rate limit allows the data to have been read.
+func (conn *rateLimitedConn) Read(buf []byte) (int, error) {
+	if burst := conn.limiter.Burst(); len(buf) > burst {
+		buf = buf[:burst]
+	}
+	n, err := conn.Conn.Read(buf)
+	if n > 0 {
+		// The wait cannot fail, because the context is never done, and n is
+		// never more than the burst.
+		_ = conn.limiter.WaitN(context.Background(), n)
+	}
+	return n, err
+}
@@ -0,0 +1,45 @@
+package tcp_test
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/tcp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rate limited reads", func() {
+	Context("when reading faster than the rate limit", func() {
+		It("should block until the rate limit allows the read", func() {
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+
+			data := make([]byte, 2500)
+			go remote.Write(data)
+
+			// One second of data can be read immediately, and the rest must
+			// wait for the limit.
+			conn := tcp.RateLimitReads(local, 1000)
+			start := time.Now()
+			buf := make([]byte, len(data))
+			_, err := io.ReadFull(conn, buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(buf).To(Equal(data))
+			Expect(time.Since(start)).To(BeNumerically(">=", 1400*time.Millisecond))
+		})
+	})
+
+	Context("when the rate limit is zero", func() {
+		It("should not wrap the connection", func() {
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+
+			Expect(tcp.RateLimitReads(local, 0)).To(Equal(local))
+		})
+	})
+})
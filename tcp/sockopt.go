@@ -0,0 +1,112 @@
+package tcp
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// SocketOptions are applied to TCP connections after they are dialed or
+// accepted. They allow operators to tune connections for latency or
+// throughput.
+type SocketOptions struct {
+	// NoDelay disables Nagle's algorithm, so that small messages are written
+	// immediately instead of being coalesced.
+	NoDelay bool
+	// ReadBufferSize and WriteBufferSize are the sizes of the operating
+	// system buffers of the connection, in bytes. If they are zero, or less,
+	// the operating system defaults are used.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// KeepAlivePeriod is the time between TCP keep-alive probes. If it is
+	// zero, the operating system default is used. If it is negative, TCP
+	// keep-alive probes are disabled.
+	KeepAlivePeriod time.Duration
+	// DSCP is the differentiated services code point (between 0 and 63) that
+	// is used to mark the packets sent by the connection, on networks that
+	// honor it. It applies to the whole connection, so peers that want to
+	// prioritise control messages over bulk data should use separate
+	// connections for them. If it is zero, packets are not marked.
+	DSCP uint8
+}
+
+// DefaultSocketOptions returns SocketOptions with Nagle's algorithm disabled,
+// for low latency, and operating system defaults for everything else.
+func DefaultSocketOptions() SocketOptions {
+	return SocketOptions{
+		NoDelay: true,
+	}
+}
+
+func (opts SocketOptions) WithNoDelay(noDelay bool) SocketOptions {
+	opts.NoDelay = noDelay
+	return opts
+}
+
+func (opts SocketOptions) WithReadBufferSize(size int) SocketOptions {
+	opts.ReadBufferSize = size
+	return opts
+}
+
+func (opts SocketOptions) WithWriteBufferSize(size int) SocketOptions {
+	opts.WriteBufferSize = size
+	return opts
+}
+
+func (opts SocketOptions) WithKeepAlivePeriod(period time.Duration) SocketOptions {
+	opts.KeepAlivePeriod = period
+	return opts
+}
+
+// WithDSCP sets the differentiated services code point (between 0 and 63) that
+// is used to mark packets. Setting it is only supported on Unix platforms.
+func (opts SocketOptions) WithDSCP(dscp uint8) SocketOptions {
+	opts.DSCP = dscp
+	return opts
+}
+
+// Apply the socket options to a connection. Connections that are not TCP
+// connections are left alone.
+func (opts SocketOptions) Apply(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcpConn.SetNoDelay(opts.NoDelay); err != nil {
+		return fmt.Errorf("setting no delay: %w", err)
+	}
+	if opts.ReadBufferSize > 0 {
+		if err := tcpConn.SetReadBuffer(opts.ReadBufferSize); err != nil {
+			return fmt.Errorf("setting read buffer size: %w", err)
+		}
+	}
+	if opts.WriteBufferSize > 0 {
+		if err := tcpConn.SetWriteBuffer(opts.WriteBufferSize); err != nil {
+			return fmt.Errorf("setting write buffer size: %w", err)
+		}
+	}
+	switch {
+	case opts.KeepAlivePeriod < 0:
+		if err := tcpConn.SetKeepAlive(false); err != nil {
+			return fmt.Errorf("disabling keep-alive: %w", err)
+		}
+	case opts.KeepAlivePeriod > 0:
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			return fmt.Errorf("enabling keep-alive: %w", err)
+		}
+		if err := tcpConn.SetKeepAlivePeriod(opts.KeepAlivePeriod); err != nil {
+			return fmt.Errorf("setting keep-alive period: %w", err)
+		}
+	}
+	if opts.DSCP != 0 {
+		if opts.DSCP > 63 {
+			return fmt.Errorf("setting dscp: expected at most 63, got %v", opts.DSCP)
+		}
+		// The code point occupies the upper six bits of the type of service
+		// (or traffic class) byte.
+		if err := setTOS(tcpConn, int(opts.DSCP)<<2); err != nil {
+			return fmt.Errorf("setting dscp: %w", err)
+		}
+	}
+	return nil
+}
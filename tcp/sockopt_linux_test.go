@@ -0,0 +1,94 @@
+//go:build linux
+// +build linux
+
+package tcp_test
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/renproject/aw/tcp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Socket options", func() {
+	getsockopt := func(conn net.Conn, level, opt int) int {
+		raw, err := conn.(*net.TCPConn).SyscallConn()
+		Expect(err).ToNot(HaveOccurred())
+		var value int
+		var sockErr error
+		Expect(raw.Control(func(fd uintptr) {
+			value, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+		})).To(Succeed())
+		Expect(sockErr).ToNot(HaveOccurred())
+		return value
+	}
+
+	Context("when applying socket options to dialed and accepted connections", func() {
+		It("should configure the underlying sockets", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close()
+
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				defer GinkgoRecover()
+				conn, err := listener.Accept()
+				Expect(err).ToNot(HaveOccurred())
+				accepted <- conn
+			}()
+			dialed, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			defer dialed.Close()
+			var acceptedConn net.Conn
+			Eventually(accepted).Should(Receive(&acceptedConn))
+			defer acceptedConn.Close()
+
+			opts := tcp.DefaultSocketOptions().
+				WithReadBufferSize(64 * 1024).
+				WithWriteBufferSize(128 * 1024).
+				WithKeepAlivePeriod(30 * time.Second)
+			for _, conn := range []net.Conn{dialed, acceptedConn} {
+				Expect(opts.Apply(conn)).To(Succeed())
+
+				// Linux doubles the requested buffer sizes, to make room for
+				// bookkeeping overhead.
+				Expect(getsockopt(conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF)).To(BeNumerically(">=", 64*1024))
+				Expect(getsockopt(conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF)).To(BeNumerically(">=", 128*1024))
+				Expect(getsockopt(conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY)).ToNot(Equal(0))
+				Expect(getsockopt(conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)).ToNot(Equal(0))
+				Expect(getsockopt(conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)).To(Equal(30))
+			}
+
+			Expect(tcp.DefaultSocketOptions().WithNoDelay(false).WithKeepAlivePeriod(-1).Apply(dialed)).To(Succeed())
+			Expect(getsockopt(dialed, syscall.IPPROTO_TCP, syscall.TCP_NODELAY)).To(Equal(0))
+			Expect(getsockopt(dialed, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)).To(Equal(0))
+		})
+	})
+
+	Context("when marking packets with a differentiated services code point", func() {
+		It("should set the type of service of the socket", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close()
+			go func() {
+				conn, err := listener.Accept()
+				if err == nil {
+					conn.Close()
+				}
+			}()
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			// Expedited forwarding.
+			Expect(tcp.DefaultSocketOptions().WithDSCP(46).Apply(conn)).To(Succeed())
+			Expect(getsockopt(conn, syscall.IPPROTO_IP, syscall.IP_TOS)).To(Equal(46 << 2))
+
+			Expect(tcp.DefaultSocketOptions().WithDSCP(64).Apply(conn)).ToNot(Succeed())
+		})
+	})
+})
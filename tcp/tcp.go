@@ -7,6 +7,8 @@ import (
 	"time"
 
 	"github.com/renproject/aw/policy"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
 )
 
 // Listen for connections from remote peers until the context is done. The
@@ -91,7 +93,7 @@ func ListenWithListener(ctx context.Context, listener net.Listener, handle func(
 // ListenerWithAssignedPort creates a new listener on a random port assigned by
 // the OS. On success, both the listener and port are returned.
 func ListenerWithAssignedPort(ctx context.Context, ip string) (net.Listener, int, error) {
-	listener, err := new(net.ListenConfig).Listen(ctx, "tcp", fmt.Sprintf("%v:%v", ip, 0))
+	listener, err := new(net.ListenConfig).Listen(ctx, "tcp", net.JoinHostPort(ip, "0"))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -99,14 +101,37 @@ func ListenerWithAssignedPort(ctx context.Context, ip string) (net.Listener, int
 	return listener, port, nil
 }
 
+// PeerAddressFromConn returns the address of the remote peer on the other end
+// of a connection, so that return traffic can be sent to it. The address is
+// unsigned and has a zero nonce, because it is observed rather than
+// advertised, and any address learned from the remote peer itself should take
+// precedence. For accepted connections, the port is usually the ephemeral port
+// from which the remote peer dialed, so the address is only reliable while the
+// connection is alive.
+func PeerAddressFromConn(conn net.Conn, remote id.Signatory) (wire.SignatoryAndAddress, error) {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return wire.SignatoryAndAddress{}, fmt.Errorf("unsupported remote address: expected tcp, got %v", conn.RemoteAddr().Network())
+	}
+	return wire.SignatoryAndAddress{
+		Signatory: remote,
+		Address:   wire.NewUnsignedAddress(wire.TCP, addr.String(), 0),
+	}, nil
+}
+
 // Dial a remote peer until a connection is successfully established, or until
 // the context is done. Multiple dial attempts can be made, and the timeout
 // function is used to define an upper bound on dial attempts. This function
 // blocks until the connection is handled (and the handle function returns).
 // This function will clean-up the connection.
 func Dial(ctx context.Context, address string, handle func(net.Conn), handleErr func(error), timeout func(int) time.Duration) error {
-	dialer := new(net.Dialer)
+	return DialWithDialer(ctx, new(net.Dialer), address, handle, handleErr, timeout)
+}
 
+// DialWithDialer is the same as Dial but instead of using a default dialer, it
+// accepts an already configured dialer. This can be used to control the local
+// address from which connections originate.
+func DialWithDialer(ctx context.Context, dialer *net.Dialer, address string, handle func(net.Conn), handleErr func(error), timeout func(int) time.Duration) error {
 	if handle == nil {
 		return fmt.Errorf("nil handle function")
 	}
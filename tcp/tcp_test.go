@@ -6,6 +6,7 @@ import (
 	"io"
 	"math/rand"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/renproject/aw/policy"
@@ -211,4 +212,74 @@ var _ = Describe("TCP", func() {
 			}
 		})
 	})
+	Context("when dialing using a dialer with a local address", func() {
+		It("should originate the connection from the local address", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			listener, port, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+			remoteAddrs := make(chan net.Addr, 1)
+			go tcp.ListenWithListener(ctx, listener, func(conn net.Conn) {
+				remoteAddrs <- conn.RemoteAddr()
+			}, nil, nil)
+
+			// Every address in 127.0.0.0/8 is a loopback address, so this
+			// address is different from the address of the listener.
+			dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}
+			err = tcp.DialWithDialer(ctx, dialer, fmt.Sprintf("127.0.0.1:%v", port), func(conn net.Conn) {
+				defer GinkgoRecover()
+				Expect(conn.LocalAddr().(*net.TCPAddr).IP.String()).To(Equal("127.0.0.2"))
+			}, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			var remoteAddr net.Addr
+			Eventually(remoteAddrs).Should(Receive(&remoteAddr))
+			Expect(remoteAddr.(*net.TCPAddr).IP.String()).To(Equal("127.0.0.2"))
+		})
+	})
+})
+
+var _ = Describe("TCP addresses", func() {
+	for _, host := range []string{"127.0.0.1", "::1", "localhost"} {
+		host := host
+		Context(fmt.Sprintf("when dialing a listener on %v", host), func() {
+			It("should send and receive messages", func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				listener, port, err := tcp.ListenerWithAssignedPort(ctx, host)
+				if err != nil {
+					Skip(fmt.Sprintf("cannot listen on %v: %v", host, err))
+				}
+				message := []byte("hello")
+				go tcp.ListenWithListener(
+					ctx,
+					listener,
+					func(conn net.Conn) {
+						buf := make([]byte, len(message))
+						if _, err := io.ReadFull(conn, buf); err == nil {
+							conn.Write(buf)
+						}
+					},
+					nil,
+					nil)
+
+				// Hostnames are resolved when dialing, not before.
+				received := make([]byte, len(message))
+				Expect(tcp.Dial(
+					ctx,
+					net.JoinHostPort(host, strconv.Itoa(port)),
+					func(conn net.Conn) {
+						_, err := conn.Write(message)
+						Expect(err).ToNot(HaveOccurred())
+						_, err = io.ReadFull(conn, received)
+						Expect(err).ToNot(HaveOccurred())
+					},
+					nil,
+					policy.ConstantTimeout(time.Second))).To(Succeed())
+				Expect(received).To(Equal(message))
+			})
+		})
+	}
 })
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package tcp
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// setTOS is not supported on this platform.
+func setTOS(conn *net.TCPConn, tos int) error {
+	return fmt.Errorf("setting type of service is not supported on %v", runtime.GOOS)
+}
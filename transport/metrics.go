@@ -0,0 +1,90 @@
+package transport
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultHandshakeBuckets are the upper bounds of the buckets into which
+// handshake durations are counted.
+var DefaultHandshakeBuckets = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// A Histogram counts durations into buckets. It is safe for concurrent use.
+type Histogram struct {
+	mu     *sync.Mutex
+	bounds []time.Duration
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+}
+
+// NewHistogram returns a Histogram with buckets that have the given upper
+// bounds. Durations greater than all bounds are counted in an extra, final,
+// bucket.
+func NewHistogram(bounds []time.Duration) *Histogram {
+	sorted := make([]time.Duration, len(bounds))
+	copy(sorted, bounds)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return &Histogram{
+		mu:     new(sync.Mutex),
+		bounds: sorted,
+		counts: make([]uint64, len(sorted)+1),
+	}
+}
+
+// Observe a duration.
+func (h *Histogram) Observe(d time.Duration) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] })
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+// Snapshot returns a copy of the current state of the histogram.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	snapshot := HistogramSnapshot{
+		Bounds: make([]time.Duration, len(h.bounds)),
+		Counts: make([]uint64, len(h.counts)),
+		Count:  h.count,
+		Sum:    h.sum,
+	}
+	copy(snapshot.Bounds, h.bounds)
+	copy(snapshot.Counts, h.counts)
+	return snapshot
+}
+
+// A HistogramSnapshot is a point-in-time copy of a Histogram. Counts[i] is the
+// number of durations that were no greater than Bounds[i] (and greater than
+// Bounds[i-1]), and the last count is the number of durations that were
+// greater than all bounds.
+type HistogramSnapshot struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// Mean returns the mean of all observed durations, or zero if no durations
+// have been observed.
+func (snapshot HistogramSnapshot) Mean() time.Duration {
+	if snapshot.Count == 0 {
+		return 0
+	}
+	return snapshot.Sum / time.Duration(snapshot.Count)
+}
@@ -0,0 +1,130 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+)
+
+// A Resolver resolves the network addresses of remote peers, for example by
+// using DNS or a service discovery system. Addresses are returned in order of
+// preference.
+type Resolver interface {
+	Resolve(ctx context.Context, remote id.Signatory) ([]wire.Address, error)
+}
+
+// ResolverFunc is a function that implements the Resolver interface.
+type ResolverFunc func(ctx context.Context, remote id.Signatory) ([]wire.Address, error)
+
+// Resolve implements the Resolver interface.
+func (f ResolverFunc) Resolve(ctx context.Context, remote id.Signatory) ([]wire.Address, error) {
+	return f(ctx, remote)
+}
+
+// DNSResolver resolves the addresses of remote peers using DNS SRV records.
+// Each remote peer is mapped to a domain name, and the SRV records for the
+// service and protocol at that name are looked up (for example,
+// "_aw._tcp.node1.example.com").
+type DNSResolver struct {
+	Service string
+	Proto   string
+	Names   map[id.Signatory]string
+
+	// Resolver is used to look up records. If it is nil, the default
+	// resolver is used.
+	Resolver *net.Resolver
+}
+
+// NewDNSResolver returns a DNSResolver for the given service and protocol,
+// that maps remote peers to domain names.
+func NewDNSResolver(service, proto string, names map[id.Signatory]string) *DNSResolver {
+	return &DNSResolver{
+		Service: service,
+		Proto:   proto,
+		Names:   names,
+	}
+}
+
+// Resolve implements the Resolver interface. Addresses are ordered by the
+// priority, and randomised by the weight, of their SRV records.
+func (r *DNSResolver) Resolve(ctx context.Context, remote id.Signatory) ([]wire.Address, error) {
+	name, ok := r.Names[remote]
+	if !ok {
+		return nil, fmt.Errorf("no name for %v", remote)
+	}
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, srvs, err := resolver.LookupSRV(ctx, r.Service, r.Proto, name)
+	if err != nil {
+		return nil, fmt.Errorf("looking up srv records for %v: %w", name, err)
+	}
+	addrs := make([]wire.Address, 0, len(srvs))
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		value := net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))
+		// Resolved addresses are not advertised by the remote peer, so they
+		// have no nonce, and any address that is advertised takes precedence.
+		addrs = append(addrs, wire.NewUnsignedAddress(wire.TCP, value, 0))
+	}
+	return addrs, nil
+}
+
+// ResolveAddress uses the resolver of the Transport to add the remote peer to
+// the table, using the most preferred address. It does nothing if the remote
+// peer is already in the table, because the known address may have been
+// advertised by the remote peer, or if the Transport has no resolver.
+func (t *Transport) ResolveAddress(ctx context.Context, remote id.Signatory) error {
+	if _, ok := t.table.PeerAddress(remote); ok {
+		return nil
+	}
+	addrs, err := t.resolve(ctx, remote)
+	if err != nil || len(addrs) == 0 {
+		return err
+	}
+	t.table.AddPeer(remote, addrs[0])
+	return nil
+}
+
+// resolve the addresses of the remote peer, keeping only the addresses that
+// can be dialed. Nothing is returned if the Transport has no resolver.
+func (t *Transport) resolve(ctx context.Context, remote id.Signatory) ([]wire.Address, error) {
+	if t.opts.Resolver == nil {
+		return nil, nil
+	}
+	addrs, err := t.opts.Resolver.Resolve(ctx, remote)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %v: %w", remote, err)
+	}
+	dialable := addrs[:0:0]
+	for _, addr := range addrs {
+		if addr.Protocol == wire.TCP || addr.Protocol == wire.WebSocket {
+			dialable = append(dialable, addr)
+		}
+	}
+	if len(dialable) == 0 {
+		return nil, fmt.Errorf("resolving %v: no tcp or websocket addresses", remote)
+	}
+	return dialable, nil
+}
+
+// dialAddresses returns the addresses to try, in turn, when dialing the remote
+// peer. Resolved addresses are preferred, and the known address is used if the
+// addresses cannot be resolved.
+func (t *Transport) dialAddresses(ctx context.Context, remote id.Signatory, known wire.Address) []wire.Address {
+	addrs, err := t.resolve(ctx, remote)
+	if err != nil {
+		t.opts.Logger.Debug("resolve", zap.String("remote", remote.String()), zap.Error(err))
+	}
+	if len(addrs) == 0 {
+		return []wire.Address{known}
+	}
+	return addrs
+}
@@ -5,7 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"net/http"
+	"net/url"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -13,11 +17,13 @@ import (
 	"github.com/renproject/aw/dht"
 
 	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/clock"
 	"github.com/renproject/aw/codec"
 	"github.com/renproject/aw/handshake"
 	"github.com/renproject/aw/policy"
 	"github.com/renproject/aw/tcp"
 	"github.com/renproject/aw/wire"
+	"github.com/renproject/aw/ws"
 	"github.com/renproject/id"
 
 	"go.uber.org/zap"
@@ -29,10 +35,41 @@ var (
 	DefaultPort          = uint16(3333)
 	DefaultEncoder       = codec.PlainEncoder
 	DefaultDecoder       = codec.PlainDecoder
+	DefaultFramer        = codec.LengthPrefixFramer
 	DefaultDialTimeout   = policy.ConstantTimeout(time.Second)
 	DefaultClientTimeout = 10 * time.Second
 	DefaultServerTimeout = 10 * time.Second
 	DefaultExpiryTimeout = time.Minute
+
+	DefaultMinBackoff        = 100 * time.Millisecond
+	DefaultMaxBackoff        = 10 * time.Second
+	DefaultBackoffMultiplier = 2.0
+)
+
+// backoffJitter is the fraction by which backoff durations are randomised.
+const backoffJitter = 0.2
+
+// ErrSelfConnection is returned when attempting to connect to the local peer.
+// This usually means that the address of the local peer has been added to the
+// table (for example, as a bootstrap peer).
+var ErrSelfConnection = errors.New("self connection")
+
+// ErrPeerNotFound is returned when attempting to connect to a remote peer that
+// has no known address. Errors that wrap it can be checked using errors.Is.
+var ErrPeerNotFound = errors.New("peer not found")
+
+// ConnectionPreference controls whether sending to a remote peer reuses an
+// existing network connection, or establishes a fresh one.
+type ConnectionPreference uint8
+
+const (
+	// PreferExisting reuses an existing network connection to the remote
+	// peer, whether it was dialed or accepted, and only dials when there is
+	// no connection.
+	PreferExisting ConnectionPreference = iota
+	// PreferNew always dials the remote peer. The new network connection
+	// replaces any existing connection once it is established.
+	PreferNew
 )
 
 // Options used to parameterise the behaviour of a Transport.
@@ -42,11 +79,62 @@ type Options struct {
 	Port            uint16
 	Encoder         codec.Encoder
 	Decoder         codec.Decoder
+	Framer          codec.Framer
 	DialTimeout     policy.Timeout
 	ClientTimeout   time.Duration
 	ServerTimeout   time.Duration
 	OncePoolOptions handshake.OncePoolOptions
 	ExpiryDuration  time.Duration
+
+	// AdvertisedAddress is exchanged with remote peers during the handshake,
+	// so that accepting peers learn the address at which they can reach the
+	// dialing peer. No address is advertised if it is empty.
+	AdvertisedAddress wire.Address
+
+	// LocalAddr is the local address from which outbound connections
+	// originate. If it is nil, the local address is chosen automatically.
+	LocalAddr net.Addr
+
+	// SocketOptions are applied to every dialed and accepted connection.
+	SocketOptions tcp.SocketOptions
+
+	// ConnectionPreference controls whether sends reuse existing network
+	// connections, or dial new ones.
+	ConnectionPreference ConnectionPreference
+
+	// Resolver is consulted for the addresses of remote peers before dialing
+	// them. If it is nil, only the addresses in the table are used.
+	Resolver Resolver
+
+	// HandshakeBuckets are the upper bounds of the buckets into which
+	// handshake durations are counted.
+	HandshakeBuckets []time.Duration
+
+	// MinBackoff, MaxBackoff, and BackoffMultiplier control how long the
+	// Transport waits before redialing a remote peer that recently failed to
+	// connect. The wait starts at MinBackoff, and is multiplied by
+	// BackoffMultiplier after every consecutive failure, up to MaxBackoff. It
+	// is reset by a successful handshake. Backoff is disabled if MinBackoff is
+	// zero.
+	MinBackoff        time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+
+	// Clock is used to measure handshake durations and to schedule backoff.
+	Clock clock.Clock
+
+	// Allow filters accepted connections before the handshake begins. If it
+	// is nil, all connections are accepted.
+	Allow policy.Allow
+
+	// ReadBytesPerSecond limits the rate at which data is read from each
+	// accepted connection. Reads block, rather than fail, when the limit is
+	// reached. A limit of zero, or less, means there is no limit.
+	ReadBytesPerSecond int
+
+	// WebSocketPath is the HTTP path that is used when dialing the WebSocket
+	// addresses of remote peers.
+	WebSocketPath string
 }
 
 // DefaultOptions returns Options with sensible defaults.
@@ -61,11 +149,22 @@ func DefaultOptions() Options {
 		Port:            DefaultPort,
 		Encoder:         DefaultEncoder,
 		Decoder:         DefaultDecoder,
+		Framer:          DefaultFramer,
 		DialTimeout:     DefaultDialTimeout,
 		ClientTimeout:   DefaultClientTimeout,
 		ServerTimeout:   DefaultServerTimeout,
 		OncePoolOptions: handshake.DefaultOncePoolOptions(),
 		ExpiryDuration:  DefaultExpiryTimeout,
+		SocketOptions:   tcp.DefaultSocketOptions(),
+		WebSocketPath:   ws.DefaultPath,
+
+		HandshakeBuckets: DefaultHandshakeBuckets,
+
+		MinBackoff:        DefaultMinBackoff,
+		MaxBackoff:        DefaultMaxBackoff,
+		BackoffMultiplier: DefaultBackoffMultiplier,
+
+		Clock: clock.Real{},
 	}
 }
 
@@ -84,11 +183,32 @@ func (opts Options) WithPort(port uint16) Options {
 	return opts
 }
 
+// WithFramer sets the Framer used to recover message boundaries from network
+// connections. All peers in a network must use the same Framer.
+func (opts Options) WithFramer(framer codec.Framer) Options {
+	opts.Framer = framer
+	return opts
+}
+
+// WithDialTimeout sets the Timeout function that bounds each attempt to dial a
+// remote peer.
+func (opts Options) WithDialTimeout(timeout policy.Timeout) Options {
+	opts.DialTimeout = timeout
+	return opts
+}
+
+// WithClientTimeout sets how long dialed connections to unlinked remote peers
+// are kept alive. It also bounds how long dialing, and the handshake of dialed
+// connections, can take.
 func (opts Options) WithClientTimeout(timeout time.Duration) Options {
 	opts.ClientTimeout = timeout
 	return opts
 }
 
+// WithServerTimeout sets how long accepted connections from unlinked remote
+// peers are kept alive. It also bounds how long the handshake of accepted
+// connections can take, so remote peers that stall during the handshake are
+// disconnected.
 func (opts Options) WithServerTimeout(timeout time.Duration) Options {
 	opts.ServerTimeout = timeout
 	return opts
@@ -99,6 +219,96 @@ func (opts Options) WithOncePoolOptions(oncePoolOpts handshake.OncePoolOptions)
 	return opts
 }
 
+// WithAdvertisedAddress sets the address of the local peer that will be
+// exchanged with remote peers during the handshake. Remote peers must also
+// exchange addresses, otherwise handshakes will fail.
+func (opts Options) WithAdvertisedAddress(addr wire.Address) Options {
+	opts.AdvertisedAddress = addr
+	return opts
+}
+
+// WithLocalAddr sets the local address from which outbound connections
+// originate. This is useful on hosts with multiple network interfaces. The port
+// should usually be zero, so that it is chosen automatically.
+func (opts Options) WithLocalAddr(addr net.Addr) Options {
+	opts.LocalAddr = addr
+	return opts
+}
+
+// WithSocketOptions sets the options that are applied to the underlying TCP
+// socket of every dialed and accepted connection.
+func (opts Options) WithSocketOptions(socketOpts tcp.SocketOptions) Options {
+	opts.SocketOptions = socketOpts
+	return opts
+}
+
+// WithConnectionPreference sets whether sends reuse existing network
+// connections (including connections accepted from the remote peer), or always
+// dial new ones.
+func (opts Options) WithConnectionPreference(preference ConnectionPreference) Options {
+	opts.ConnectionPreference = preference
+	return opts
+}
+
+// WithResolver sets the Resolver that is consulted for the addresses of remote
+// peers before dialing them. Resolved addresses are tried in turn, and the
+// address in the table is used if resolution fails.
+func (opts Options) WithResolver(resolver Resolver) Options {
+	opts.Resolver = resolver
+	return opts
+}
+
+// WithHandshakeBuckets sets the upper bounds of the buckets into which
+// handshake durations are counted.
+func (opts Options) WithHandshakeBuckets(buckets []time.Duration) Options {
+	opts.HandshakeBuckets = buckets
+	return opts
+}
+
+// WithBackoff sets the exponential backoff that is applied before redialing a
+// remote peer that recently failed to connect. Setting the minimum backoff to
+// zero disables backoff.
+func (opts Options) WithBackoff(min, max time.Duration, multiplier float64) Options {
+	opts.MinBackoff = min
+	opts.MaxBackoff = max
+	opts.BackoffMultiplier = multiplier
+	return opts
+}
+
+// WithClock sets the Clock used to measure handshake durations and to schedule
+// backoff.
+func (opts Options) WithClock(c clock.Clock) Options {
+	opts.Clock = c
+	return opts
+}
+
+// WithAllow sets the function that filters accepted connections, before the
+// handshake begins. This can be used to reject connections based on custom
+// logic (for example, maintenance mode, or a global connection budget). See
+// the policy package for functions that can be composed.
+func (opts Options) WithAllow(allow policy.Allow) Options {
+	opts.Allow = allow
+	return opts
+}
+
+// WithWebSocketPath sets the HTTP path that is used when dialing the WebSocket
+// addresses of remote peers. It must match the path at which remote peers
+// serve their WebSocketHandler.
+func (opts Options) WithWebSocketPath(path string) Options {
+	opts.WebSocketPath = path
+	return opts
+}
+
+// WithReadBytesPerSecond sets the maximum rate at which data is read from each
+// accepted connection. Every connection is limited independently, and reads
+// block until the limit allows them, so a remote peer that sends too quickly
+// is slowed down instead of disconnected. This happens before the handshake,
+// so it also limits remote peers that never complete the handshake.
+func (opts Options) WithReadBytesPerSecond(bytesPerSecond int) Options {
+	opts.ReadBytesPerSecond = bytesPerSecond
+	return opts
+}
+
 func (opts Options) WithExpiry(minimumDuration time.Duration) Options {
 	opts.ExpiryDuration = minimumDuration
 	return opts
@@ -117,11 +327,47 @@ type Transport struct {
 	connsMu *sync.RWMutex
 	conns   map[id.Signatory]int64
 
+	// onConnect are the functions that are called whenever a remote peer
+	// becomes connected.
+	onConnectMu *sync.RWMutex
+	onConnect   []func(id.Signatory)
+
+	// onConnectionChange are the functions that are called whenever a remote
+	// peer becomes connected, or disconnected.
+	onConnectionChangeMu *sync.RWMutex
+	onConnectionChange   []func(id.Signatory, string, bool)
+
+	// observed stores the addresses of remote peers, as observed from their
+	// accepted connections, for as long as those connections are alive.
+	observedMu *sync.RWMutex
+	observed   map[id.Signatory]wire.Address
+
+	// handshakeDurations stores the duration of the latest successful
+	// handshake with each remote peer.
+	handshakeDurationsMu *sync.RWMutex
+	handshakeDurations   map[id.Signatory]time.Duration
+	handshakeHistogram   *Histogram
+
+	// backoffs stores, for each remote peer that recently failed to connect,
+	// the number of consecutive failures and when it can next be dialed.
+	backoffsMu *sync.Mutex
+	backoffs   map[id.Signatory]dialBackoff
+
 	table dht.Table
 }
 
 func New(opts Options, self id.Signatory, client *channel.Client, h handshake.Handshake, table dht.Table) *Transport {
 	oncePool := handshake.NewOncePool(opts.OncePoolOptions)
+	if opts.AdvertisedAddress.Value != "" {
+		h = handshake.Advertise(opts.AdvertisedAddress, h, func(remote id.Signatory, addr wire.Address) {
+			// Only learn the advertised address if it is newer than what we
+			// already know about the remote peer.
+			if existing, ok := table.PeerAddress(remote); ok && existing.Nonce >= addr.Nonce {
+				return
+			}
+			table.AddPeer(remote, addr)
+		})
+	}
 	return &Transport{
 		opts: opts,
 
@@ -135,6 +381,22 @@ func New(opts Options, self id.Signatory, client *channel.Client, h handshake.Ha
 		connsMu: new(sync.RWMutex),
 		conns:   map[id.Signatory]int64{},
 
+		onConnectMu: new(sync.RWMutex),
+		onConnect:   []func(id.Signatory){},
+
+		onConnectionChangeMu: new(sync.RWMutex),
+		onConnectionChange:   []func(id.Signatory, string, bool){},
+
+		observedMu: new(sync.RWMutex),
+		observed:   map[id.Signatory]wire.Address{},
+
+		handshakeDurationsMu: new(sync.RWMutex),
+		handshakeDurations:   map[id.Signatory]time.Duration{},
+		handshakeHistogram:   NewHistogram(opts.HandshakeBuckets),
+
+		backoffsMu: new(sync.Mutex),
+		backoffs:   map[id.Signatory]dialBackoff{},
+
 		table: table,
 	}
 }
@@ -156,12 +418,21 @@ func (t *Transport) Port() uint16 {
 }
 
 func (t *Transport) Send(ctx context.Context, remote id.Signatory, msg wire.Msg) error {
+	if remote.Equal(&t.self) {
+		return ErrSelfConnection
+	}
 	remoteAddr, ok := t.table.PeerAddress(remote)
+	if !ok && t.opts.Resolver != nil {
+		if err := t.ResolveAddress(ctx, remote); err != nil {
+			t.opts.Logger.Debug("resolve", zap.String("remote", remote.String()), zap.Error(err))
+		}
+		remoteAddr, ok = t.table.PeerAddress(remote)
+	}
 	if !ok {
-		return fmt.Errorf("peer not found: %v", remote)
+		return fmt.Errorf("%w: %v", ErrPeerNotFound, remote)
 	}
 
-	if t.IsConnected(remote) {
+	if t.IsConnected(remote) && t.opts.ConnectionPreference == PreferExisting {
 		t.opts.Logger.Debug("send", zap.Bool("connected", true), zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()))
 		return t.client.Send(ctx, remote, msg)
 	}
@@ -181,8 +452,39 @@ func (t *Transport) Send(ctx context.Context, remote id.Signatory, msg wire.Msg)
 	return t.client.Send(ctx, remote, msg)
 }
 
+// Dial the remote peer in the background, unless it is already connected. If
+// the remote peer is linked, the network connection will be kept alive until
+// the remote peer is unlinked. Dialing is retried until the context is done.
+func (t *Transport) Dial(ctx context.Context, remote id.Signatory) error {
+	if remote.Equal(&t.self) {
+		return ErrSelfConnection
+	}
+	remoteAddr, ok := t.table.PeerAddress(remote)
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrPeerNotFound, remote)
+	}
+	if t.IsConnected(remote) {
+		return nil
+	}
+	go t.dial(ctx, remote, remoteAddr)
+	return nil
+}
+
+// QueueDepths returns the number of outbound messages, by message type, that
+// are waiting to be written to network connections.
+func (t *Transport) QueueDepths() map[uint16]int {
+	return t.client.QueueDepths()
+}
+
+// Receive messages from remote peers. Remote peers that are not in the table,
+// but that have sent a message over a connection accepted by the Transport,
+// are added to the table (using their observed address), so that replies can
+// be sent without waiting for the remote peer to be discovered.
 func (t *Transport) Receive(ctx context.Context, receiver func(id.Signatory, wire.Packet) error) {
-	t.client.Receive(ctx, receiver)
+	t.client.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+		t.learnObservedPeer(from)
+		return receiver(from, packet)
+	})
 }
 
 func (t *Transport) Link(remote id.Signatory) {
@@ -220,6 +522,31 @@ func (t *Transport) IsConnected(remote id.Signatory) bool {
 	return t.conns[remote] > 0
 }
 
+// HandshakeDuration returns the duration of the latest successful handshake
+// with a remote peer. For dialed connections, this is the time from dialing to
+// establishing the session. For accepted connections, it is the time taken by
+// the handshake alone.
+func (t *Transport) HandshakeDuration(remote id.Signatory) (time.Duration, bool) {
+	t.handshakeDurationsMu.RLock()
+	defer t.handshakeDurationsMu.RUnlock()
+	d, ok := t.handshakeDurations[remote]
+	return d, ok
+}
+
+// HandshakeDurations returns a histogram of the durations of all successful
+// handshakes.
+func (t *Transport) HandshakeDurations() HistogramSnapshot {
+	return t.handshakeHistogram.Snapshot()
+}
+
+func (t *Transport) observeHandshake(remote id.Signatory, d time.Duration) {
+	t.handshakeHistogram.Observe(d)
+
+	t.handshakeDurationsMu.Lock()
+	defer t.handshakeDurationsMu.Unlock()
+	t.handshakeDurations[remote] = d
+}
+
 func (t *Transport) Run(ctx context.Context) {
 	for {
 		select {
@@ -242,117 +569,235 @@ func (t *Transport) run(ctx context.Context) {
 	t.opts.Logger.Info("listening", zap.String("host", t.opts.Host), zap.Uint16("port", t.opts.Port))
 	err := tcp.Listen(
 		ctx,
-		fmt.Sprintf("%v:%v", t.opts.Host, t.opts.Port),
-		func(conn net.Conn) {
-			addr := conn.RemoteAddr().String()
-			enc, dec, remote, err := t.once(conn, t.opts.Encoder, t.opts.Decoder)
-			if err != nil {
-				var e wire.NegligibleError
-				if !errors.As(err, &e) {
-					t.opts.Logger.Error("handshake", zap.String("addr", addr), zap.Error(err))
-				}
-				return
-			}
+		net.JoinHostPort(t.opts.Host, strconv.Itoa(int(t.opts.Port))),
+		func(conn net.Conn) { t.accept(ctx, conn) },
+		t.handleListenErr,
+		t.opts.Allow)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			t.opts.Logger.Error("listen", zap.Error(err))
+		}
+	}
+}
 
-			enc = codec.LengthPrefixEncoder(codec.PlainEncoder, enc)
-			dec = codec.LengthPrefixDecoder(codec.PlainDecoder, dec)
-
-			// If the Transport is linked to the remote peer, then the
-			// network connection should be kept alive until the remote peer
-			// is unlinked (or the network connection faults).
-			if t.IsLinked(remote) {
-				t.opts.Logger.Debug("accepted", zap.Bool("linked", true), zap.String("remote", remote.String()), zap.String("addr", addr))
-				defer t.opts.Logger.Debug("accepted: drop", zap.Bool("linked", true), zap.String("remote", remote.String()), zap.String("addr", addr))
-
-				// Attaching a connection will block until the Channel is
-				// unbound (which happens when the Transport is unlinked), the
-				// connection is replaced, or the connection faults.
-				t.connect(remote)
-				defer t.disconnect(remote)
-				if err := t.client.Attach(ctx, remote, conn, enc, dec); err != nil {
-					// If ctx is canceled, this usually means the entire transport has been shutdown
-					// and we can safely ignore all errors with client.Attach.
-					if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
-						t.opts.Logger.Error("incoming attachment", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
-					}
-				}
-				return
+// accept a network connection from a remote peer. The handshake is performed,
+// and the connection is attached to the Channel of the remote peer until it is
+// no longer needed.
+func (t *Transport) accept(ctx context.Context, conn net.Conn) {
+	addr := conn.RemoteAddr().String()
+	if err := t.opts.SocketOptions.Apply(conn); err != nil {
+		t.opts.Logger.Debug("socket options", zap.String("addr", addr), zap.Error(err))
+	}
+	conn = tcp.RateLimitReads(conn, t.opts.ReadBytesPerSecond)
+	handshakeStart := t.opts.Clock.Now()
+	// Remote peers that stall during the handshake should not block
+	// the connection forever.
+	handshakeCtx, handshakeCancel := context.WithTimeout(ctx, t.opts.ServerTimeout)
+	enc, dec, remote, err := handshake.WithContext(handshakeCtx, t.once)(conn, t.opts.Encoder, t.opts.Decoder)
+	handshakeCancel()
+	if err != nil {
+		var e wire.NegligibleError
+		if !errors.As(err, &e) {
+			t.opts.Logger.Error("handshake", zap.String("addr", addr), zap.Error(err))
+		}
+		return
+	}
+	if remote.Equal(&t.self) {
+		t.opts.Logger.Error("handshake", zap.String("addr", addr), zap.Error(ErrSelfConnection))
+		return
+	}
+	t.observeHandshake(remote, clock.Since(t.opts.Clock, handshakeStart))
+	defer t.observe(conn, remote)()
+
+	enc, dec = t.opts.Framer(enc, dec)
+
+	// If the Transport is linked to the remote peer, then the
+	// network connection should be kept alive until the remote peer
+	// is unlinked (or the network connection faults).
+	if t.IsLinked(remote) {
+		t.opts.Logger.Debug("accepted", zap.Bool("linked", true), zap.String("remote", remote.String()), zap.String("addr", addr))
+		defer t.opts.Logger.Debug("accepted: drop", zap.Bool("linked", true), zap.String("remote", remote.String()), zap.String("addr", addr))
+
+		// Attaching a connection will block until the Channel is
+		// unbound (which happens when the Transport is unlinked), the
+		// connection is replaced, or the connection faults.
+		t.connect(remote, addr)
+		defer t.disconnect(remote, addr)
+		if err := t.client.Attach(ctx, remote, conn, enc, dec); err != nil {
+			// If ctx is canceled, this usually means the entire transport has been shutdown
+			// and we can safely ignore all errors with client.Attach.
+			if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+				t.opts.Logger.Error("incoming attachment", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
 			}
+		}
+		return
+	}
 
-			// Otherwise, this connection should be short-lived. A Channel still
-			// needs to be created (because one probably does not exist), but a
-			// bounded time should be used.
-			ctx, cancel := context.WithTimeout(ctx, t.opts.ServerTimeout)
-			defer cancel()
+	// Otherwise, this connection should be short-lived. A Channel still
+	// needs to be created (because one probably does not exist), but a
+	// bounded time should be used.
+	ctx, cancel := context.WithTimeout(ctx, t.opts.ServerTimeout)
+	defer cancel()
 
-			t.opts.Logger.Debug("accepted", zap.Bool("linked", false), zap.Duration("timeout", t.opts.ServerTimeout), zap.String("remote", remote.String()), zap.String("addr", addr))
-			defer t.opts.Logger.Debug("accepted: drop", zap.Bool("linked", false), zap.Duration("timeout", t.opts.ServerTimeout), zap.String("remote", remote.String()), zap.String("addr", addr))
+	t.opts.Logger.Debug("accepted", zap.Bool("linked", false), zap.Duration("timeout", t.opts.ServerTimeout), zap.String("remote", remote.String()), zap.String("addr", addr))
+	defer t.opts.Logger.Debug("accepted: drop", zap.Bool("linked", false), zap.Duration("timeout", t.opts.ServerTimeout), zap.String("remote", remote.String()), zap.String("addr", addr))
 
-			t.client.Bind(remote)
-			defer t.client.Unbind(remote)
+	t.client.Bind(remote)
+	defer t.client.Unbind(remote)
 
-			t.connect(remote)
-			defer t.disconnect(remote)
-			if err := t.client.Attach(ctx, remote, conn, enc, dec); err != nil {
-				if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
-					t.opts.Logger.Error("incoming attachment", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
-				}
-			}
-		},
+	t.connect(remote, addr)
+	defer t.disconnect(remote, addr)
+	if err := t.client.Attach(ctx, remote, conn, enc, dec); err != nil {
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			t.opts.Logger.Error("incoming attachment", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
+		}
+	}
+}
+
+func (t *Transport) handleListenErr(err error) {
+	if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) && !errors.Is(err, syscall.ECONNRESET) {
+		t.opts.Logger.Error("listen", zap.Error(err))
+	}
+}
+
+// WebSocketHandler returns an http.Handler that accepts WebSocket connections
+// from remote peers, in the same way that TCP connections are accepted while
+// the Transport is running, until the context is done. This allows remote
+// peers that cannot use raw TCP connections to connect, and allows the local
+// peer to share an existing HTTP server (by mounting the handler on its mux).
+// Remote peers reach it by dialing WebSocket addresses, using the
+// WebSocketPath at which the handler is mounted.
+func (t *Transport) WebSocketHandler(ctx context.Context) http.Handler {
+	return ws.Handler(
+		func(conn net.Conn) { t.accept(ctx, conn) },
 		func(err error) {
-			if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) && !errors.Is(err, syscall.ECONNRESET) {
-				t.opts.Logger.Error("listen", zap.Error(err))
-			}
+			// Bad upgrade requests are usually not from remote peers.
+			t.opts.Logger.Debug("websocket", zap.Error(err))
 		},
-		nil)
+		t.opts.Allow)
+}
+
+// observe the address of the remote peer of an accepted connection. The
+// returned function must be called when the connection is closed. It forgets
+// the observed address, and removes it from the table (unless it has since been
+// replaced), because it is usually not possible to dial it.
+func (t *Transport) observe(conn net.Conn, remote id.Signatory) func() {
+	sigAndAddr, err := tcp.PeerAddressFromConn(conn, remote)
 	if err != nil {
-		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
-			t.opts.Logger.Error("listen", zap.Error(err))
+		t.opts.Logger.Debug("accepted", zap.String("remote", remote.String()), zap.Error(err))
+		return func() {}
+	}
+
+	t.observedMu.Lock()
+	t.observed[remote] = sigAndAddr.Address
+	t.observedMu.Unlock()
+
+	return func() {
+		t.observedMu.Lock()
+		if addr, ok := t.observed[remote]; ok && addr.Equal(&sigAndAddr.Address) {
+			delete(t.observed, remote)
+		}
+		t.observedMu.Unlock()
+
+		if addr, ok := t.table.PeerAddress(remote); ok && addr.Equal(&sigAndAddr.Address) {
+			t.table.DeletePeer(remote)
 		}
 	}
 }
 
-func (t *Transport) dial(retryCtx context.Context, remote id.Signatory, remoteAddr wire.Address) {
+// learnObservedPeer adds a remote peer to the table using its observed
+// address. Peers that are already in the table are left alone, because their
+// known address is more reliable than the observed one.
+func (t *Transport) learnObservedPeer(remote id.Signatory) {
+	t.observedMu.RLock()
+	addr, ok := t.observed[remote]
+	t.observedMu.RUnlock()
+	if !ok {
+		return
+	}
+	if _, ok := t.table.PeerAddress(remote); ok {
+		return
+	}
+	t.table.AddPeer(remote, addr)
+}
+
+func (t *Transport) dial(retryCtx context.Context, remote id.Signatory, knownAddr wire.Address) {
 	// It is tempting to skip dialing if there is already a connection. However,
 	// it is desirable to be able to re-dial in the case that the network
 	// address has changed. As such, we do not do any skip checks, and assume
 	// that dial is only called when the caller is absolutely sure that a dial
 	// should happen.
 
-	if remoteAddr.Protocol != wire.TCP {
-		t.opts.Logger.Debug("skipping non-tcp address", zap.String("addr", remoteAddr.String()))
-		return
-	}
-
+	remoteAddrs := t.dialAddresses(retryCtx, remote, knownAddr)
 	exit := make(chan struct{})
-	for {
+	unsupported := 0
+	for attempt := 0; ; attempt++ {
+		// Resolved addresses are tried in turn, so that an unreachable
+		// address does not stop the remote peer from being reached.
+		remoteAddr := remoteAddrs[attempt%len(remoteAddrs)]
+		dialWithDialer, address := tcp.DialWithDialer, remoteAddr.Value
+		switch remoteAddr.Protocol {
+		case wire.TCP:
+		case wire.WebSocket:
+			dialWithDialer = ws.DialWithDialer
+			address = (&url.URL{Scheme: "ws", Host: remoteAddr.Value, Path: t.opts.WebSocketPath}).String()
+		default:
+			t.opts.Logger.Debug("skipping unsupported address", zap.String("addr", remoteAddr.String()))
+			// Try the next address, unless none of the addresses can be
+			// dialed.
+			if unsupported++; unsupported >= len(remoteAddrs) {
+				return
+			}
+			continue
+		}
+		unsupported = 0
+
+		// Wait before redialing a remote peer that recently failed to
+		// connect, so that a flapping peer does not cause a tight loop.
+		if err := t.waitForBackoff(retryCtx, remote); err != nil {
+			return
+		}
+
 		dialCtx, cancel := context.WithTimeout(context.Background(), t.opts.ClientTimeout)
 
 		t.opts.Logger.Debug("dialing", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()))
+		dialStart := t.opts.Clock.Now()
 
-		err := tcp.Dial(
+		err := dialWithDialer(
 			dialCtx,
-			remoteAddr.Value,
+			&net.Dialer{LocalAddr: t.opts.LocalAddr},
+			address,
 			func(conn net.Conn) {
 				addr := conn.RemoteAddr().String()
-				enc, dec, r, err := t.once(conn, t.opts.Encoder, t.opts.Decoder)
+				if err := t.opts.SocketOptions.Apply(conn); err != nil {
+					t.opts.Logger.Debug("socket options", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
+				}
+				enc, dec, r, err := handshake.WithContext(dialCtx, t.once)(conn, t.opts.Encoder, t.opts.Decoder)
 				if err != nil {
 					var e wire.NegligibleError
 					if !errors.As(err, &e) {
 						t.opts.Logger.Error("handshake", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
+						t.dialFailed(remote)
 					}
 					return
 				}
+				if r.Equal(&t.self) {
+					// The address of the remote peer is actually our own
+					// address, so there is no point in retrying.
+					t.opts.Logger.Error("handshake", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(ErrSelfConnection))
+					return
+				}
 				if !r.Equal(&remote) {
 					t.opts.Logger.Error("handshake", zap.String("expected", remote.String()), zap.String("got", r.String()), zap.Error(fmt.Errorf("bad remote")))
 					return
 				}
+				t.observeHandshake(remote, clock.Since(t.opts.Clock, dialStart))
+				t.dialSucceeded(remote)
 
-				enc = codec.LengthPrefixEncoder(codec.PlainEncoder, enc)
-				dec = codec.LengthPrefixDecoder(codec.PlainDecoder, dec)
+				enc, dec = t.opts.Framer(enc, dec)
 
-				t.connect(remote)
-				defer t.disconnect(remote)
+				t.connect(remote, addr)
+				defer t.disconnect(remote, addr)
 
 				if t.IsLinked(remote) {
 					t.opts.Logger.Debug("dialed", zap.Bool("linked", true), zap.String("remote", remote.String()), zap.String("addr", addr))
@@ -380,6 +825,7 @@ func (t *Transport) dial(retryCtx context.Context, remote id.Signatory, remoteAd
 			},
 			func(err error) {
 				t.opts.Logger.Debug("dial", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()), zap.Error(err))
+				t.dialFailed(remote)
 				t.table.AddExpiry(remote, t.opts.ExpiryDuration)
 				if t.table.HandleExpired(remote) {
 					close(exit)
@@ -410,20 +856,145 @@ func (t *Transport) dial(retryCtx context.Context, remote id.Signatory, remoteAd
 	}
 }
 
-func (t *Transport) connect(remote id.Signatory) {
-	t.connsMu.Lock()
-	defer t.connsMu.Unlock()
+type dialBackoff struct {
+	failures int
+	until    time.Time
+}
 
-	t.conns[remote]++
+// DialBackoff returns how long the Transport will wait before dialing a remote
+// peer, because it recently failed to connect. It returns zero if the remote
+// peer can be dialed immediately.
+func (t *Transport) DialBackoff(remote id.Signatory) time.Duration {
+	t.backoffsMu.Lock()
+	defer t.backoffsMu.Unlock()
+
+	if d := clock.Until(t.opts.Clock, t.backoffs[remote].until); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// waitForBackoff blocks until the remote peer can be dialed, or the context is
+// done, in which case the context error is returned.
+func (t *Transport) waitForBackoff(ctx context.Context, remote id.Signatory) error {
+	d := t.DialBackoff(remote)
+	if d == 0 {
+		return nil
+	}
+	t.opts.Logger.Debug("backoff", zap.String("remote", remote.String()), zap.Duration("duration", d))
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.opts.Clock.After(d):
+		return nil
+	}
+}
+
+// dialFailed increases the backoff for a remote peer.
+func (t *Transport) dialFailed(remote id.Signatory) {
+	if t.opts.MinBackoff <= 0 {
+		return
+	}
+	backoff := policy.Jitter(backoffJitter, func(failures int) time.Duration {
+		d := float64(t.opts.MinBackoff) * math.Pow(t.opts.BackoffMultiplier, float64(failures-1))
+		if t.opts.MaxBackoff > 0 && d > float64(t.opts.MaxBackoff) {
+			return t.opts.MaxBackoff
+		}
+		return time.Duration(d)
+	})
+
+	t.backoffsMu.Lock()
+	defer t.backoffsMu.Unlock()
+
+	b := t.backoffs[remote]
+	b.failures++
+	b.until = t.opts.Clock.Now().Add(backoff(b.failures))
+	t.backoffs[remote] = b
 }
 
-func (t *Transport) disconnect(remote id.Signatory) {
+// dialSucceeded resets the backoff for a remote peer.
+func (t *Transport) dialSucceeded(remote id.Signatory) {
+	t.backoffsMu.Lock()
+	defer t.backoffsMu.Unlock()
+
+	delete(t.backoffs, remote)
+}
+
+// OnConnect adds a function that is called, in the background, whenever a
+// remote peer becomes connected (that is, when the first network connection
+// to the remote peer is established, whether it was dialed or accepted).
+// Remote peers that are not in the table are learned from their connection
+// before the function is called, so that the function can send messages to
+// them.
+func (t *Transport) OnConnect(f func(remote id.Signatory)) {
+	t.onConnectMu.Lock()
+	defer t.onConnectMu.Unlock()
+
+	t.onConnect = append(t.onConnect, f)
+}
+
+// OnConnectionChange adds a function that is called, in the background,
+// whenever a remote peer becomes connected (that is, when the first network
+// connection to the remote peer is established), or disconnected (that is,
+// when the last network connection to the remote peer is closed). The function
+// is given the remote address of the network connection that caused the
+// change. Unlike OnConnect, remote peers are not learned from their connection
+// before the function is called.
+//
+// Being connected is different from being in the table: a remote peer can be
+// in the table while it is unreachable, and a remote peer that is not in the
+// table can connect to the local peer.
+func (t *Transport) OnConnectionChange(f func(remote id.Signatory, addr string, connected bool)) {
+	t.onConnectionChangeMu.Lock()
+	defer t.onConnectionChangeMu.Unlock()
+
+	t.onConnectionChange = append(t.onConnectionChange, f)
+}
+
+func (t *Transport) connect(remote id.Signatory, addr string) {
 	t.connsMu.Lock()
-	defer t.connsMu.Unlock()
+	t.conns[remote]++
+	connected := t.conns[remote] == 1
+	t.connsMu.Unlock()
+
+	if !connected {
+		return
+	}
+	t.connectionChanged(remote, addr, true)
 
+	t.onConnectMu.RLock()
+	defer t.onConnectMu.RUnlock()
+	if len(t.onConnect) == 0 {
+		return
+	}
+	t.learnObservedPeer(remote)
+	for _, f := range t.onConnect {
+		go f(remote)
+	}
+}
+
+func (t *Transport) disconnect(remote id.Signatory, addr string) {
+	t.connsMu.Lock()
+	disconnected := false
 	if t.conns[remote] > 0 {
 		if t.conns[remote]--; t.conns[remote] == 0 {
 			delete(t.conns, remote)
+			disconnected = true
 		}
 	}
+	t.connsMu.Unlock()
+
+	if disconnected {
+		t.connectionChanged(remote, addr, false)
+	}
+}
+
+func (t *Transport) connectionChanged(remote id.Signatory, addr string, connected bool) {
+	t.onConnectionChangeMu.RLock()
+	defer t.onConnectionChangeMu.RUnlock()
+
+	for _, f := range t.onConnectionChange {
+		go f(remote, addr, connected)
+	}
 }
@@ -2,14 +2,25 @@ package transport_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"time"
 
 	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/codec"
 	"github.com/renproject/aw/dht"
 	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/policy"
 	"github.com/renproject/aw/transport"
 	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -57,4 +68,576 @@ var _ = Describe("Transport", func() {
 			})
 		})
 	})
+	Describe("Self connections", func() {
+		Context("when sending to, or dialing, the local peer", func() {
+			It("should return an error", func() {
+				privKey := id.NewPrivKey()
+				self := privKey.Signatory()
+				table := dht.NewInMemTable(self)
+				t := transport.New(
+					transport.DefaultOptions().WithLogger(zap.NewNop()).WithPort(uint16(3335)),
+					self,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), self),
+					handshake.ECIES(privKey),
+					table,
+				)
+				table.AddPeer(self, wire.NewUnsignedAddress(wire.TCP, "localhost:3335", uint64(time.Now().UnixNano())))
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				Expect(t.Dial(ctx, self)).To(Equal(transport.ErrSelfConnection))
+				Expect(t.Send(ctx, self, wire.Msg{})).To(Equal(transport.ErrSelfConnection))
+			})
+		})
+
+		Context("when sending to, or dialing, an unknown peer", func() {
+			It("should return an error that wraps ErrPeerNotFound", func() {
+				privKey := id.NewPrivKey()
+				self := privKey.Signatory()
+				t := transport.New(
+					transport.DefaultOptions().WithLogger(zap.NewNop()).WithPort(uint16(3335)),
+					self,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), self),
+					handshake.ECIES(privKey),
+					dht.NewInMemTable(self),
+				)
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				other := id.NewPrivKey().Signatory()
+				Expect(errors.Is(t.Dial(ctx, other), transport.ErrPeerNotFound)).To(BeTrue())
+				Expect(errors.Is(t.Send(ctx, other, wire.Msg{}), transport.ErrPeerNotFound)).To(BeTrue())
+			})
+		})
+
+		Context("when the address of another peer is actually the address of the local peer", func() {
+			It("should refuse the connection", func() {
+				core, logs := observer.New(zapcore.DebugLevel)
+				privKey := id.NewPrivKey()
+				self := privKey.Signatory()
+				table := dht.NewInMemTable(self)
+				t := transport.New(
+					transport.DefaultOptions().WithLogger(zap.New(core)).WithPort(uint16(3335)),
+					self,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), self),
+					handshake.ECIES(privKey),
+					table,
+				)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				go t.Run(ctx)
+
+				// Misconfigure the table, so that some other peer appears to
+				// be at the address of the local peer.
+				other := id.NewPrivKey().Signatory()
+				table.AddPeer(other, wire.NewUnsignedAddress(wire.TCP, "localhost:3335", uint64(time.Now().UnixNano())))
+				t.Link(other)
+				Expect(t.Dial(ctx, other)).To(Succeed())
+
+				Eventually(func() int {
+					return logs.FilterField(zap.Error(transport.ErrSelfConnection)).Len()
+				}, 4*time.Second).Should(BeNumerically(">", 0))
+				Expect(t.IsConnected(other)).To(BeFalse())
+				Expect(t.IsConnected(self)).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("Accepting connections", func() {
+		Context("when a remote peer that is not in the table sends a message", func() {
+			It("should add the remote peer to the table", func() {
+				newTransport := func(port uint16) (*transport.Transport, id.Signatory, dht.Table) {
+					privKey := id.NewPrivKey()
+					self := privKey.Signatory()
+					table := dht.NewInMemTable(self)
+					t := transport.New(
+						transport.DefaultOptions().WithLogger(zap.NewNop()).WithPort(port),
+						self,
+						channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), self),
+						handshake.ECIES(privKey),
+						table,
+					)
+					return t, self, table
+				}
+				server, serverSig, serverTable := newTransport(3336)
+				client, clientSig, clientTable := newTransport(3337)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				received := make(chan struct{}, 1)
+				server.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					select {
+					case received <- struct{}{}:
+					default:
+					}
+					return nil
+				})
+				go server.Run(ctx)
+
+				clientTable.AddPeer(serverSig, wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3336", uint64(time.Now().UnixNano())))
+				_, ok := serverTable.PeerAddress(clientSig)
+				Expect(ok).To(BeFalse())
+
+				client.Link(serverSig)
+				defer client.Unlink(serverSig)
+				Eventually(func() error {
+					return client.Send(ctx, serverSig, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, To: id.Hash(serverSig)})
+				}, 4*time.Second).Should(Succeed())
+				Eventually(received, 4*time.Second).Should(Receive())
+
+				Eventually(func() bool {
+					_, ok := serverTable.PeerAddress(clientSig)
+					return ok
+				}, 4*time.Second).Should(BeTrue())
+				addr, _ := serverTable.PeerAddress(clientSig)
+				Expect(addr.Protocol).To(Equal(wire.TCP))
+				Expect(addr.Value).To(HavePrefix("127.0.0.1:"))
+			})
+		})
+	})
+
+	Describe("Connection preference", func() {
+		// replyOverAcceptedConnection has a client send a message to a server,
+		// and then has the server reply over the connection that it accepted.
+		// It returns the messages logged by the server.
+		replyOverAcceptedConnection := func(preference transport.ConnectionPreference, serverPort, clientPort uint16) *observer.ObservedLogs {
+			core, logs := observer.New(zapcore.DebugLevel)
+			newTransport := func(logger *zap.Logger, port uint16) (*transport.Transport, id.Signatory, dht.Table) {
+				privKey := id.NewPrivKey()
+				self := privKey.Signatory()
+				table := dht.NewInMemTable(self)
+				t := transport.New(
+					transport.DefaultOptions().WithLogger(logger).WithPort(port).WithConnectionPreference(preference),
+					self,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), self),
+					handshake.ECIES(privKey),
+					table,
+				)
+				return t, self, table
+			}
+			server, serverSig, _ := newTransport(zap.New(core), serverPort)
+			client, clientSig, clientTable := newTransport(zap.NewNop(), clientPort)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			received := make(chan struct{}, 1)
+			server.Receive(ctx, func(id.Signatory, wire.Packet) error {
+				select {
+				case received <- struct{}{}:
+				default:
+				}
+				return nil
+			})
+			replies := make(chan struct{}, 1)
+			client.Receive(ctx, func(id.Signatory, wire.Packet) error {
+				select {
+				case replies <- struct{}{}:
+				default:
+				}
+				return nil
+			})
+			go server.Run(ctx)
+
+			clientTable.AddPeer(serverSig, wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("127.0.0.1:%v", serverPort), uint64(time.Now().UnixNano())))
+			client.Link(serverSig)
+			defer client.Unlink(serverSig)
+			Eventually(func() error {
+				return client.Send(ctx, serverSig, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, To: id.Hash(serverSig)})
+			}, 4*time.Second).Should(Succeed())
+			Eventually(received, 4*time.Second).Should(Receive())
+			Expect(server.IsConnected(clientSig)).To(BeTrue())
+
+			Expect(server.Send(ctx, clientSig, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, To: id.Hash(clientSig)})).To(Succeed())
+			Eventually(replies, 4*time.Second).Should(Receive())
+			return logs
+		}
+
+		Context("when preferring existing connections", func() {
+			It("should reply over the accepted connection without dialing", func() {
+				logs := replyOverAcceptedConnection(transport.PreferExisting, 3338, 3339)
+				Expect(logs.FilterMessage("dialing").Len()).To(Equal(0))
+			})
+		})
+
+		Context("when preferring new connections", func() {
+			It("should dial the remote peer", func() {
+				logs := replyOverAcceptedConnection(transport.PreferNew, 3340, 3341)
+				Expect(logs.FilterMessage("dialing").Len()).ToNot(Equal(0))
+			})
+		})
+	})
+
+	Describe("Resolving addresses", func() {
+		Context("when a resolver is used", func() {
+			It("should dial the resolved addresses", func() {
+				serverPrivKey := id.NewPrivKey()
+				serverSig := serverPrivKey.Signatory()
+				server := transport.New(
+					transport.DefaultOptions().WithLogger(zap.NewNop()).WithPort(3342),
+					serverSig,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), serverSig),
+					handshake.ECIES(serverPrivKey),
+					dht.NewInMemTable(serverSig),
+				)
+
+				resolved := make(chan id.Signatory, 10)
+				resolver := transport.ResolverFunc(func(ctx context.Context, remote id.Signatory) ([]wire.Address, error) {
+					resolved <- remote
+					return []wire.Address{
+						wire.NewUnsignedAddress(wire.UDP, "127.0.0.1:3342", uint64(time.Now().UnixNano())),
+						wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3342", uint64(time.Now().UnixNano())),
+					}, nil
+				})
+				clientPrivKey := id.NewPrivKey()
+				clientSig := clientPrivKey.Signatory()
+				clientTable := dht.NewInMemTable(clientSig)
+				client := transport.New(
+					transport.DefaultOptions().WithLogger(zap.NewNop()).WithPort(3343).WithResolver(resolver),
+					clientSig,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), clientSig),
+					handshake.ECIES(clientPrivKey),
+					clientTable,
+				)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				received := make(chan struct{}, 1)
+				server.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					select {
+					case received <- struct{}{}:
+					default:
+					}
+					return nil
+				})
+				go server.Run(ctx)
+
+				// The server is not in the table, so its address can only be
+				// found by resolving it.
+				_, ok := clientTable.PeerAddress(serverSig)
+				Expect(ok).To(BeFalse())
+				Eventually(func() error {
+					return client.Send(ctx, serverSig, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, To: id.Hash(serverSig)})
+				}, 4*time.Second).Should(Succeed())
+				Eventually(received, 4*time.Second).Should(Receive())
+				Expect(resolved).To(Receive(Equal(serverSig)))
+
+				addr, ok := clientTable.PeerAddress(serverSig)
+				Expect(ok).To(BeTrue())
+				Expect(addr.Value).To(Equal("127.0.0.1:3342"))
+			})
+		})
+
+		Context("when the remote peer is already in the table", func() {
+			It("should not replace its address", func() {
+				resolver := transport.ResolverFunc(func(ctx context.Context, remote id.Signatory) ([]wire.Address, error) {
+					return []wire.Address{wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3345", 0)}, nil
+				})
+				privKey := id.NewPrivKey()
+				sig := privKey.Signatory()
+				table := dht.NewInMemTable(sig)
+				t := transport.New(
+					transport.DefaultOptions().WithLogger(zap.NewNop()).WithResolver(resolver),
+					sig,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), sig),
+					handshake.ECIES(privKey),
+					table,
+				)
+
+				remote := id.NewPrivKey().Signatory()
+				known := wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3344", 1)
+				table.AddPeer(remote, known)
+				Expect(t.ResolveAddress(context.Background(), remote)).To(Succeed())
+				addr, ok := table.PeerAddress(remote)
+				Expect(ok).To(BeTrue())
+				Expect(addr.Equal(&known)).To(BeTrue())
+
+				unknown := id.NewPrivKey().Signatory()
+				Expect(t.ResolveAddress(context.Background(), unknown)).To(Succeed())
+				addr, ok = table.PeerAddress(unknown)
+				Expect(ok).To(BeTrue())
+				Expect(addr.Value).To(Equal("127.0.0.1:3345"))
+			})
+		})
+	})
+
+	Describe("WebSockets", func() {
+		Context("when a remote peer has a websocket address", func() {
+			It("should dial the websocket and send messages over it", func() {
+				serverPrivKey := id.NewPrivKey()
+				serverSig := serverPrivKey.Signatory()
+				server := transport.New(
+					transport.DefaultOptions().WithLogger(zap.NewNop()),
+					serverSig,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), serverSig),
+					handshake.ECIES(serverPrivKey),
+					dht.NewInMemTable(serverSig),
+				)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				// The server does not listen for TCP connections. Instead,
+				// its websocket handler is mounted on an existing HTTP server.
+				mux := http.NewServeMux()
+				mux.Handle("/aw", server.WebSocketHandler(ctx))
+				httpServer := httptest.NewServer(mux)
+				defer httpServer.Close()
+
+				received := make(chan id.Signatory, 1)
+				server.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					if string(packet.Msg.Data) == "hello" {
+						select {
+						case received <- from:
+						default:
+						}
+					}
+					return nil
+				})
+
+				clientPrivKey := id.NewPrivKey()
+				clientSig := clientPrivKey.Signatory()
+				clientTable := dht.NewInMemTable(clientSig)
+				client := transport.New(
+					transport.DefaultOptions().WithLogger(zap.NewNop()).WithWebSocketPath("/aw"),
+					clientSig,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), clientSig),
+					handshake.ECIES(clientPrivKey),
+					clientTable,
+				)
+				clientTable.AddPeer(serverSig, wire.NewUnsignedAddress(wire.WebSocket, httpServer.Listener.Addr().String(), uint64(time.Now().UnixNano())))
+
+				Expect(client.Send(ctx, serverSig, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, To: id.Hash(serverSig), Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 4*time.Second).Should(Receive(Equal(clientSig)))
+				Expect(client.IsConnected(serverSig)).To(BeTrue())
+				Expect(server.IsConnected(clientSig)).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("Handshake durations", func() {
+		Context("when the handshake is delayed", func() {
+			It("should record a duration that reflects the delay", func() {
+				delay := 200 * time.Millisecond
+
+				serverPrivKey := id.NewPrivKey()
+				serverSig := serverPrivKey.Signatory()
+				ecies := handshake.ECIES(serverPrivKey)
+				slow := func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+					time.Sleep(delay)
+					return ecies(conn, enc, dec)
+				}
+				server := transport.New(
+					transport.DefaultOptions().WithLogger(zap.NewNop()).WithPort(3344),
+					serverSig,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), serverSig),
+					slow,
+					dht.NewInMemTable(serverSig),
+				)
+
+				clientPrivKey := id.NewPrivKey()
+				clientSig := clientPrivKey.Signatory()
+				clientTable := dht.NewInMemTable(clientSig)
+				client := transport.New(
+					transport.DefaultOptions().WithLogger(zap.NewNop()).WithPort(3345),
+					clientSig,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), clientSig),
+					handshake.ECIES(clientPrivKey),
+					clientTable,
+				)
+				_, ok := client.HandshakeDuration(serverSig)
+				Expect(ok).To(BeFalse())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				received := make(chan struct{}, 1)
+				server.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					select {
+					case received <- struct{}{}:
+					default:
+					}
+					return nil
+				})
+				go server.Run(ctx)
+
+				clientTable.AddPeer(serverSig, wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3344", uint64(time.Now().UnixNano())))
+				Eventually(func() error {
+					return client.Send(ctx, serverSig, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, To: id.Hash(serverSig)})
+				}, 4*time.Second).Should(Succeed())
+				Eventually(received, 4*time.Second).Should(Receive())
+
+				d, ok := client.HandshakeDuration(serverSig)
+				Expect(ok).To(BeTrue())
+				Expect(d).To(BeNumerically(">=", delay))
+				d, ok = server.HandshakeDuration(clientSig)
+				Expect(ok).To(BeTrue())
+				Expect(d).To(BeNumerically(">=", delay))
+
+				snapshot := client.HandshakeDurations()
+				Expect(snapshot.Count).To(Equal(uint64(1)))
+				Expect(snapshot.Mean()).To(Equal(snapshot.Sum))
+				for i, bound := range snapshot.Bounds {
+					if bound < delay {
+						Expect(snapshot.Counts[i]).To(BeZero())
+					}
+				}
+			})
+		})
+	})
+
+	Describe("Dial backoff", func() {
+		Context("when a remote peer fails to connect", func() {
+			It("should back off before redialing, until a handshake succeeds", func() {
+				serverPrivKey := id.NewPrivKey()
+				serverSig := serverPrivKey.Signatory()
+				server := transport.New(
+					transport.DefaultOptions().WithLogger(zap.NewNop()).WithPort(3347),
+					serverSig,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), serverSig),
+					handshake.ECIES(serverPrivKey),
+					dht.NewInMemTable(serverSig),
+				)
+
+				core, logs := observer.New(zapcore.DebugLevel)
+				clientPrivKey := id.NewPrivKey()
+				clientSig := clientPrivKey.Signatory()
+				clientTable := dht.NewInMemTable(clientSig)
+				client := transport.New(
+					transport.DefaultOptions().
+						WithLogger(zap.New(core)).
+						WithPort(3346).
+						WithDialTimeout(policy.ConstantTimeout(100*time.Millisecond)).
+						WithClientTimeout(5*time.Second).
+						WithBackoff(time.Second, 10*time.Second, 2),
+					clientSig,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), clientSig),
+					handshake.ECIES(clientPrivKey),
+					clientTable,
+				)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				// Nothing is listening on the address of the server yet, so
+				// dialing fails.
+				clientTable.AddPeer(serverSig, wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3347", uint64(time.Now().UnixNano())))
+				Expect(client.DialBackoff(serverSig)).To(BeZero())
+				client.Link(serverSig)
+				defer client.Unlink(serverSig)
+				Expect(client.Dial(ctx, serverSig)).To(Succeed())
+				Eventually(func() time.Duration {
+					return client.DialBackoff(serverSig)
+				}, 2*time.Second).Should(BeNumerically(">", 0))
+
+				// Redialing waits for the backoff.
+				Expect(client.Dial(ctx, serverSig)).To(Succeed())
+				Eventually(func() int {
+					return logs.FilterMessage("backoff").Len()
+				}, 2*time.Second).Should(BeNumerically(">", 0))
+
+				// Once the server is listening, a handshake succeeds, and the
+				// backoff is reset.
+				go server.Run(ctx)
+				Eventually(func() bool {
+					return client.IsConnected(serverSig)
+				}, 5*time.Second).Should(BeTrue())
+				Expect(client.DialBackoff(serverSig)).To(BeZero())
+			})
+		})
+	})
+
+	Describe("Filtering accepted connections", func() {
+		Context("when the filter rejects all connections", func() {
+			It("should close connections before the handshake", func() {
+				rejected := make(chan struct{}, 10)
+				serverPrivKey := id.NewPrivKey()
+				serverSig := serverPrivKey.Signatory()
+				server := transport.New(
+					transport.DefaultOptions().
+						WithLogger(zap.NewNop()).
+						WithPort(3348).
+						WithAllow(func(net.Conn) (error, policy.Cleanup) {
+							rejected <- struct{}{}
+							return errors.New("maintenance"), nil
+						}),
+					serverSig,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), serverSig),
+					handshake.ECIES(serverPrivKey),
+					dht.NewInMemTable(serverSig),
+				)
+
+				clientPrivKey := id.NewPrivKey()
+				clientSig := clientPrivKey.Signatory()
+				clientTable := dht.NewInMemTable(clientSig)
+				client := transport.New(
+					transport.DefaultOptions().WithLogger(zap.NewNop()).WithPort(3349),
+					clientSig,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), clientSig),
+					handshake.ECIES(clientPrivKey),
+					clientTable,
+				)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				received := make(chan struct{}, 1)
+				server.Receive(ctx, func(id.Signatory, wire.Packet) error {
+					received <- struct{}{}
+					return nil
+				})
+				go server.Run(ctx)
+
+				clientTable.AddPeer(serverSig, wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3348", uint64(time.Now().UnixNano())))
+				client.Link(serverSig)
+				defer client.Unlink(serverSig)
+				Expect(client.Dial(ctx, serverSig)).To(Succeed())
+
+				Eventually(rejected, 4*time.Second).Should(Receive())
+				Consistently(received, time.Second).ShouldNot(Receive())
+				_, ok := server.HandshakeDuration(clientSig)
+				Expect(ok).To(BeFalse())
+				_, ok = client.HandshakeDuration(serverSig)
+				Expect(ok).To(BeFalse())
+				Expect(client.IsConnected(serverSig)).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("Stalled handshakes", func() {
+		Context("when a remote peer stops responding during the handshake", func() {
+			It("should close the connection after the server timeout", func() {
+				serverPrivKey := id.NewPrivKey()
+				serverSig := serverPrivKey.Signatory()
+				server := transport.New(
+					transport.DefaultOptions().
+						WithLogger(zap.NewNop()).
+						WithPort(3350).
+						WithServerTimeout(200*time.Millisecond),
+					serverSig,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), serverSig),
+					handshake.ECIES(serverPrivKey),
+					dht.NewInMemTable(serverSig),
+				)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				go server.Run(ctx)
+
+				// The remote peer connects, but never writes anything.
+				var conn net.Conn
+				Eventually(func() error {
+					var err error
+					conn, err = net.Dial("tcp", "127.0.0.1:3350")
+					return err
+				}, time.Second).Should(Succeed())
+				defer conn.Close()
+
+				closed := make(chan error, 1)
+				go func() {
+					_, err := io.Copy(io.Discard, conn)
+					closed <- err
+				}()
+				Eventually(closed, 2*time.Second).Should(Receive(BeNil()))
+			})
+		})
+	})
 })
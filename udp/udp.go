@@ -0,0 +1,188 @@
+// Package udp sends and receives messages as individual datagrams. Unlike the
+// tcp package, there are no connections, and so no sessions: every datagram is
+// signed by its sender, and its signature is verified by its receiver. This
+// makes it suitable for small, frequent, messages (like pings) where the
+// overhead of establishing a connection is not worth it.
+package udp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+)
+
+// DefaultMaxDatagramSize is the largest datagram that can be sent over an
+// Ethernet link without being fragmented (a 1500 byte MTU, minus the IPv4 and
+// UDP headers).
+const DefaultMaxDatagramSize = 1472
+
+// ErrDatagramTooLarge is returned when a message does not fit into a single
+// datagram. Messages are never truncated.
+var ErrDatagramTooLarge = errors.New("datagram too large")
+
+// Options for sending and receiving datagrams.
+type Options struct {
+	// MaxDatagramSize is the maximum size of a datagram, including the
+	// signature. It should be no larger than the MTU of the network.
+	MaxDatagramSize int
+	// MsgCodec converts messages to, and from, their representation in a
+	// datagram. All peers must use the same codec.
+	MsgCodec wire.MsgCodec
+}
+
+// DefaultOptions returns Options with sensible defaults.
+func DefaultOptions() Options {
+	return Options{
+		MaxDatagramSize: DefaultMaxDatagramSize,
+		MsgCodec:        wire.SurgeCodec{},
+	}
+}
+
+func (opts Options) WithMaxDatagramSize(size int) Options {
+	opts.MaxDatagramSize = size
+	return opts
+}
+
+func (opts Options) WithMsgCodec(codec wire.MsgCodec) Options {
+	opts.MsgCodec = codec
+	return opts
+}
+
+// Marshal a message into a datagram that is signed by the private key. The
+// datagram is the signature, followed by the message. ErrDatagramTooLarge is
+// returned if the datagram would be larger than the maximum datagram size.
+func Marshal(opts Options, privKey *id.PrivKey, msg wire.Msg) ([]byte, error) {
+	if opts.MaxDatagramSize <= id.SizeHintSignature {
+		return nil, fmt.Errorf("marshal: %w: expected at most %v bytes, got %v bytes", ErrDatagramTooLarge, opts.MaxDatagramSize, id.SizeHintSignature)
+	}
+	buf := make([]byte, opts.MaxDatagramSize)
+	n, err := opts.MsgCodec.MarshalMsg(msg, buf[id.SizeHintSignature:])
+	if err != nil {
+		// Codecs fail when the buffer is too small, so the message size is
+		// checked to give a clearer error.
+		if size := id.SizeHintSignature + msg.SizeHint(); size > opts.MaxDatagramSize {
+			return nil, fmt.Errorf("marshal: %w: expected at most %v bytes, got %v bytes", ErrDatagramTooLarge, opts.MaxDatagramSize, size)
+		}
+		return nil, fmt.Errorf("marshal: %v", err)
+	}
+	hash := id.NewHash(buf[id.SizeHintSignature : id.SizeHintSignature+n])
+	signature, err := privKey.Sign(&hash)
+	if err != nil {
+		return nil, fmt.Errorf("sign: %v", err)
+	}
+	copy(buf, signature[:])
+	return buf[:id.SizeHintSignature+n], nil
+}
+
+// Unmarshal a datagram, verifying its signature, and return the message along
+// with the signatory of its sender. The signatory is recovered from the
+// signature, so a datagram that has been tampered with appears to come from a
+// different signatory. Receivers must check that the signatory is expected.
+func Unmarshal(opts Options, datagram []byte) (id.Signatory, wire.Msg, error) {
+	if len(datagram) < id.SizeHintSignature {
+		return id.Signatory{}, wire.Msg{}, fmt.Errorf("unmarshal: expected at least %v bytes, got %v bytes", id.SizeHintSignature, len(datagram))
+	}
+	signature := id.Signature{}
+	copy(signature[:], datagram)
+	data := datagram[id.SizeHintSignature:]
+	hash := id.NewHash(data)
+	from, err := signature.Signatory(&hash)
+	if err != nil {
+		return id.Signatory{}, wire.Msg{}, fmt.Errorf("verify: %v", err)
+	}
+	msg := wire.Msg{}
+	if err := opts.MsgCodec.UnmarshalMsg(data, &msg); err != nil {
+		return id.Signatory{}, wire.Msg{}, fmt.Errorf("unmarshal: %v", err)
+	}
+	return from, msg, nil
+}
+
+// Listen for datagrams until the context is done. The signature of every
+// datagram is verified, and the handle function is called with the signatory
+// of the sender, the address from which it was sent, and the message. Datagrams
+// that are too large, or that cannot be verified, are passed to the error
+// handling function instead. This function blocks until the context is done.
+func Listen(ctx context.Context, opts Options, address string, handle func(id.Signatory, net.Addr, wire.Msg), handleErr func(error)) error {
+	conn, err := new(net.ListenConfig).ListenPacket(ctx, "udp", address)
+	if err != nil {
+		return err
+	}
+	return ListenWithConn(ctx, opts, conn, handle, handleErr)
+}
+
+// ListenWithConn is the same as Listen but instead of specifying an address, it
+// accepts an already constructed packet connection.
+//
+// NOTE: The connection passed to this function will be closed when the given
+// context finishes.
+func ListenWithConn(ctx context.Context, opts Options, conn net.PacketConn, handle func(id.Signatory, net.Addr, wire.Msg), handleErr func(error)) error {
+	if handle == nil {
+		return fmt.Errorf("nil handle function")
+	}
+
+	if handleErr == nil {
+		handleErr = func(error) {}
+	}
+
+	// Reading from the connection does not unblock when the context is done,
+	// so the connection is closed instead.
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	// The buffer is one byte larger than the maximum datagram size, so that
+	// datagrams that are too large can be detected (instead of being silently
+	// truncated).
+	buf := make([]byte, opts.MaxDatagramSize+1)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			handleErr(fmt.Errorf("read datagram: %w", err))
+			continue
+		}
+		if n > opts.MaxDatagramSize {
+			handleErr(fmt.Errorf("read datagram from %v: %w", addr, ErrDatagramTooLarge))
+			continue
+		}
+		from, msg, err := Unmarshal(opts, buf[:n])
+		if err != nil {
+			handleErr(fmt.Errorf("read datagram from %v: %w", addr, err))
+			continue
+		}
+		handle(from, addr, msg)
+	}
+}
+
+// Send a message, as a single datagram signed by the private key, to the
+// address. Delivery is not guaranteed.
+func Send(ctx context.Context, opts Options, privKey *id.PrivKey, address string, msg wire.Msg) error {
+	datagram, err := Marshal(opts, privKey, msg)
+	if err != nil {
+		return err
+	}
+	conn, err := new(net.Dialer).DialContext(ctx, "udp", address)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetWriteDeadline(deadline); err != nil {
+			return fmt.Errorf("set write deadline: %w", err)
+		}
+	}
+	if _, err := conn.Write(datagram); err != nil {
+		return fmt.Errorf("write datagram: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package udp_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/udp"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("UDP", func() {
+	type received struct {
+		from id.Signatory
+		msg  wire.Msg
+	}
+
+	listen := func(ctx context.Context, opts udp.Options) (string, <-chan received, <-chan error) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		receivedCh := make(chan received, 10)
+		errCh := make(chan error, 10)
+		go udp.ListenWithConn(ctx, opts, conn,
+			func(from id.Signatory, addr net.Addr, msg wire.Msg) {
+				receivedCh <- received{from: from, msg: msg}
+			},
+			func(err error) {
+				errCh <- err
+			})
+		return conn.LocalAddr().String(), receivedCh, errCh
+	}
+
+	Context("when sending a message", func() {
+		It("should be received with the signatory of the sender", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			opts := udp.DefaultOptions()
+			address, receivedCh, _ := listen(ctx, opts)
+
+			privKey := id.NewPrivKey()
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypePing, Data: []byte("hello")}
+			Expect(udp.Send(ctx, opts, privKey, address, msg)).To(Succeed())
+
+			var r received
+			Eventually(receivedCh).Should(Receive(&r))
+			Expect(r.from).To(Equal(privKey.Signatory()))
+			Expect(r.msg.Type).To(Equal(wire.MsgTypePing))
+			Expect(r.msg.Data).To(Equal([]byte("hello")))
+		})
+	})
+
+	Context("when a message is larger than the maximum datagram size", func() {
+		It("should return an error, instead of truncating the message", func() {
+			opts := udp.DefaultOptions().WithMaxDatagramSize(128)
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: make([]byte, 128)}
+			_, err := udp.Marshal(opts, id.NewPrivKey(), msg)
+			Expect(errors.Is(err, udp.ErrDatagramTooLarge)).To(BeTrue())
+		})
+
+		It("should be rejected by the receiver", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			address, receivedCh, errCh := listen(ctx, udp.DefaultOptions().WithMaxDatagramSize(128))
+
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: make([]byte, 256)}
+			Expect(udp.Send(ctx, udp.DefaultOptions(), id.NewPrivKey(), address, msg)).To(Succeed())
+
+			var err error
+			Eventually(errCh).Should(Receive(&err))
+			Expect(errors.Is(err, udp.ErrDatagramTooLarge)).To(BeTrue())
+			Consistently(receivedCh, 100*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+
+	Context("when a datagram has been tampered with", func() {
+		It("should not be attributed to the sender", func() {
+			privKey := id.NewPrivKey()
+			opts := udp.DefaultOptions()
+			datagram, err := udp.Marshal(opts, privKey, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hello")})
+			Expect(err).ToNot(HaveOccurred())
+
+			datagram[len(datagram)-1] ^= 0xFF
+			from, _, err := udp.Unmarshal(opts, datagram)
+			if err == nil {
+				Expect(from).ToNot(Equal(privKey.Signatory()))
+			}
+		})
+	})
+})
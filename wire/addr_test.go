@@ -2,8 +2,13 @@ package wire_test
 
 import (
 	"math/rand"
+	"net"
+	"strconv"
+	"testing/quick"
 
 	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"github.com/renproject/surge"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -44,3 +49,37 @@ var _ = Describe("Address", func() {
 		})
 	})
 })
+
+var _ = Describe("Address encoding", func() {
+	hosts := []string{"127.0.0.1", "::1", "fe80::1:2:3", "localhost", "node-1.example.com"}
+
+	Context("when encoding and decoding addresses with different kinds of hosts", func() {
+		It("should return the same address", func() {
+			f := func(hostIndex uint8, port uint16, nonce uint64, sig id.Signature) bool {
+				value := net.JoinHostPort(hosts[int(hostIndex)%len(hosts)], strconv.Itoa(int(port)))
+				addr := wire.Address{Protocol: wire.TCP, Value: value, Nonce: nonce, Signature: sig}
+
+				// Decoding the string representation.
+				decoded, err := wire.DecodeString(addr.String())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(decoded).To(Equal(addr))
+
+				// Unmarshaling the binary representation.
+				data, err := surge.ToBinary(addr)
+				Expect(err).ToNot(HaveOccurred())
+				unmarshaled := wire.Address{}
+				Expect(surge.FromBinary(&unmarshaled, data)).To(Succeed())
+				Expect(unmarshaled).To(Equal(addr))
+
+				// The host and port can be recovered, without resolving the
+				// host, so that hostnames are only resolved when dialing.
+				host, portStr, err := net.SplitHostPort(decoded.Value)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(host).To(Equal(hosts[int(hostIndex)%len(hosts)]))
+				Expect(portStr).To(Equal(strconv.Itoa(int(port))))
+				return true
+			}
+			Expect(quick.Check(f, nil)).To(Succeed())
+		})
+	})
+})
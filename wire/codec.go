@@ -0,0 +1,230 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/renproject/id"
+)
+
+// A MsgCodec converts messages to, and from, their on-the-wire representation.
+// The SyncData of a message is never part of its representation, because it
+// is written separately (immediately after the message) by Channels.
+type MsgCodec interface {
+	// MarshalMsg writes the message to the buffer, and returns the number of
+	// bytes written. An error is returned if the buffer is too small.
+	MarshalMsg(msg Msg, buf []byte) (int, error)
+	// UnmarshalMsg reads a message from data.
+	UnmarshalMsg(data []byte, msg *Msg) error
+}
+
+// SurgeCodec is the default MsgCodec. It uses the surge binary format that is
+// implemented by Msg.Marshal and Msg.Unmarshal.
+type SurgeCodec struct{}
+
+// MarshalMsg implements the MsgCodec interface.
+func (SurgeCodec) MarshalMsg(msg Msg, buf []byte) (int, error) {
+	tail, _, err := msg.Marshal(buf, len(buf))
+	if err != nil {
+		return 0, err
+	}
+	return len(buf) - len(tail), nil
+}
+
+// UnmarshalMsg implements the MsgCodec interface.
+func (SurgeCodec) UnmarshalMsg(data []byte, msg *Msg) error {
+	_, _, err := msg.Unmarshal(data, len(data))
+	return err
+}
+
+// Field numbers used by the ProtobufCodec.
+const (
+	protoFieldVersion  = 1
+	protoFieldType     = 2
+	protoFieldTo       = 3
+	protoFieldData     = 4
+	protoFieldPriority = 6
+	protoFieldNonce    = 7
+)
+
+// Protobuf wire types.
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+// ProtobufCodec is a MsgCodec that is compatible with the following protobuf
+// (proto3) message, so that messages can be exchanged with other stacks:
+//
+//	message Msg {
+//	    uint32 version  = 1;
+//	    uint32 type     = 2;
+//	    bytes  to       = 3;
+//	    bytes  data     = 4;
+//	    reserved 5; // sync_data is written separately
+//	    uint32 priority = 6;
+//	    fixed64 nonce   = 7;
+//	}
+//
+// Fields with default values are omitted, and unknown fields are skipped.
+type ProtobufCodec struct{}
+
+// MarshalMsg implements the MsgCodec interface.
+func (ProtobufCodec) MarshalMsg(msg Msg, buf []byte) (int, error) {
+	w := protoWriter{buf: buf}
+	w.varintField(protoFieldVersion, uint64(msg.Version))
+	w.varintField(protoFieldType, uint64(msg.Type))
+	if !msg.To.Equal(&id.Hash{}) {
+		w.bytesField(protoFieldTo, msg.To[:])
+	}
+	w.bytesField(protoFieldData, msg.Data)
+	w.varintField(protoFieldPriority, uint64(msg.Priority))
+	w.fixed64Field(protoFieldNonce, msg.Nonce)
+	if w.overflow {
+		return 0, fmt.Errorf("marshal: buffer too small")
+	}
+	return w.n, nil
+}
+
+// UnmarshalMsg implements the MsgCodec interface.
+func (ProtobufCodec) UnmarshalMsg(data []byte, msg *Msg) error {
+	*msg = Msg{}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("unmarshal key: malformed varint")
+		}
+		data = data[n:]
+		field, wireType := key>>3, key&7
+
+		switch wireType {
+		case protoWireVarint:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("unmarshal field %v: malformed varint", field)
+			}
+			data = data[n:]
+			switch field {
+			case protoFieldVersion, protoFieldType:
+				if value > math.MaxUint16 {
+					return fmt.Errorf("unmarshal field %v: expected at most %v, got %v", field, math.MaxUint16, value)
+				}
+				if field == protoFieldVersion {
+					msg.Version = uint16(value)
+				} else {
+					msg.Type = uint16(value)
+				}
+			case protoFieldPriority:
+				if value > math.MaxUint8 {
+					return fmt.Errorf("unmarshal field %v: expected at most %v, got %v", field, math.MaxUint8, value)
+				}
+				msg.Priority = uint8(value)
+			}
+		case protoWireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("unmarshal field %v: malformed length", field)
+			}
+			data = data[n:]
+			if size > uint64(len(data)) {
+				return fmt.Errorf("unmarshal field %v: expected at most %v bytes, got %v bytes", field, len(data), size)
+			}
+			value := data[:size]
+			data = data[size:]
+			switch field {
+			case protoFieldTo:
+				if len(value) != len(msg.To) {
+					return fmt.Errorf("unmarshal to: expected %v bytes, got %v bytes", len(msg.To), len(value))
+				}
+				copy(msg.To[:], value)
+			case protoFieldData:
+				msg.Data = make([]byte, len(value))
+				copy(msg.Data, value)
+			}
+		case protoWireFixed64:
+			if len(data) < 8 {
+				return fmt.Errorf("unmarshal field %v: expected 8 bytes, got %v bytes", field, len(data))
+			}
+			if field == protoFieldNonce {
+				msg.Nonce = binary.LittleEndian.Uint64(data[:8])
+			}
+			data = data[8:]
+		case protoWireFixed32:
+			if len(data) < 4 {
+				return fmt.Errorf("unmarshal field %v: expected 4 bytes, got %v bytes", field, len(data))
+			}
+			data = data[4:]
+		default:
+			return fmt.Errorf("unmarshal field %v: unsupported wire type %v", field, wireType)
+		}
+	}
+	return nil
+}
+
+// protoWriter appends protobuf fields to a fixed size buffer, remembering
+// whether or not the buffer was too small.
+type protoWriter struct {
+	buf      []byte
+	n        int
+	overflow bool
+}
+
+func (w *protoWriter) varint(value uint64) {
+	if w.overflow {
+		return
+	}
+	if len(w.buf)-w.n < binary.MaxVarintLen64 {
+		var tmp [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(tmp[:], value)
+		if len(w.buf)-w.n < n {
+			w.overflow = true
+			return
+		}
+		w.n += copy(w.buf[w.n:], tmp[:n])
+		return
+	}
+	w.n += binary.PutUvarint(w.buf[w.n:], value)
+}
+
+func (w *protoWriter) varintField(field, value uint64) {
+	if value == 0 {
+		return
+	}
+	w.varint(field<<3 | protoWireVarint)
+	w.varint(value)
+}
+
+func (w *protoWriter) fixed64Field(field, value uint64) {
+	if value == 0 {
+		return
+	}
+	w.varint(field<<3 | protoWireFixed64)
+	if w.overflow {
+		return
+	}
+	if len(w.buf)-w.n < 8 {
+		w.overflow = true
+		return
+	}
+	binary.LittleEndian.PutUint64(w.buf[w.n:], value)
+	w.n += 8
+}
+
+func (w *protoWriter) bytesField(field uint64, value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	w.varint(field<<3 | protoWireBytes)
+	w.varint(uint64(len(value)))
+	if w.overflow {
+		return
+	}
+	if len(w.buf)-w.n < len(value) {
+		w.overflow = true
+		return
+	}
+	w.n += copy(w.buf[w.n:], value)
+}
@@ -0,0 +1,93 @@
+package wire_test
+
+import (
+	"bytes"
+	"math/rand"
+
+	"github.com/renproject/aw/wire"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Message codecs", func() {
+	codecs := map[string]wire.MsgCodec{
+		"surge":    wire.SurgeCodec{},
+		"protobuf": wire.ProtobufCodec{},
+	}
+
+	for name, msgCodec := range codecs {
+		name, msgCodec := name, msgCodec
+
+		Context("when marshaling and unmarshaling a message using the "+name+" codec", func() {
+			It("should equal itself", func() {
+				r := rand.New(rand.NewSource(GinkgoRandomSeed()))
+				buf := make([]byte, 1024)
+				for i := 0; i < 100; i++ {
+					msg := wire.Msg{
+						Version:  wire.MsgVersion1,
+						Type:     uint16(r.Intn(11) + 1),
+						Data:     make([]byte, r.Intn(100)),
+						Priority: uint8(r.Intn(2)),
+						Nonce:    r.Uint64(),
+					}
+					if r.Intn(2) == 0 {
+						r.Read(msg.To[:])
+					}
+					r.Read(msg.Data)
+
+					n, err := msgCodec.MarshalMsg(msg, buf)
+					Expect(err).ToNot(HaveOccurred())
+
+					unmarshaled := wire.Msg{}
+					Expect(msgCodec.UnmarshalMsg(buf[:n], &unmarshaled)).To(Succeed())
+					Expect(unmarshaled.Version).To(Equal(msg.Version))
+					Expect(unmarshaled.Type).To(Equal(msg.Type))
+					Expect(unmarshaled.To).To(Equal(msg.To))
+					Expect(bytes.Equal(unmarshaled.Data, msg.Data)).To(BeTrue())
+					Expect(unmarshaled.Priority).To(Equal(msg.Priority))
+					Expect(unmarshaled.Nonce).To(Equal(msg.Nonce))
+				}
+			})
+		})
+
+		Context("when marshaling into a buffer that is too small using the "+name+" codec", func() {
+			It("should return an error", func() {
+				msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: make([]byte, 64)}
+				_, err := msgCodec.MarshalMsg(msg, make([]byte, 32))
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	}
+
+	Context("when marshaling a message using the protobuf codec", func() {
+		It("should use the protobuf encoding", func() {
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hi"), Priority: wire.MsgPriorityHigh}
+			buf := make([]byte, 64)
+			n, err := wire.ProtobufCodec{}.MarshalMsg(msg, buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(buf[:n]).To(Equal([]byte{0x08, 0x01, 0x10, 0x04, 0x22, 0x02, 'h', 'i', 0x30, 0x01}))
+		})
+
+		It("should encode the nonce as a fixed64 field", func() {
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Nonce: 0x0102030405060708}
+			buf := make([]byte, 64)
+			n, err := wire.ProtobufCodec{}.MarshalMsg(msg, buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(buf[:n]).To(Equal([]byte{0x08, 0x01, 0x10, 0x04, 0x39, 0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}))
+		})
+
+		It("should skip unknown fields when unmarshaling", func() {
+			data := []byte{
+				0x08, 0x01, // version
+				0x48, 0x96, 0x01, // unknown varint field 9
+				0x52, 0x01, 0xFF, // unknown bytes field 10
+				0x10, 0x04, // type
+			}
+			msg := wire.Msg{}
+			Expect(wire.ProtobufCodec{}.UnmarshalMsg(data, &msg)).To(Succeed())
+			Expect(msg.Version).To(Equal(wire.MsgVersion1))
+			Expect(msg.Type).To(Equal(wire.MsgTypeSend))
+		})
+	})
+})
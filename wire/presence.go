@@ -0,0 +1,43 @@
+package wire
+
+import (
+	"fmt"
+
+	"github.com/renproject/id"
+	"github.com/renproject/surge"
+)
+
+// Presence is a compact summary of when a peer was last seen alive. LastSeen is
+// interpreted as nanoseconds since UNIX epoch.
+type Presence struct {
+	Signatory id.Signatory
+	LastSeen  uint64
+}
+
+func (presence Presence) SizeHint() int {
+	return presence.Signatory.SizeHint() + surge.SizeHintU64
+}
+
+func (presence Presence) Marshal(buf []byte, rem int) ([]byte, int, error) {
+	buf, rem, err := presence.Signatory.Marshal(buf, rem)
+	if err != nil {
+		return buf, rem, fmt.Errorf("marshal signatory: %v", err)
+	}
+	buf, rem, err = surge.MarshalU64(presence.LastSeen, buf, rem)
+	if err != nil {
+		return buf, rem, fmt.Errorf("marshal last seen: %v", err)
+	}
+	return buf, rem, err
+}
+
+func (presence *Presence) Unmarshal(buf []byte, rem int) ([]byte, int, error) {
+	buf, rem, err := (&presence.Signatory).Unmarshal(buf, rem)
+	if err != nil {
+		return buf, rem, fmt.Errorf("unmarshal signatory: %v", err)
+	}
+	buf, rem, err = surge.UnmarshalU64(&presence.LastSeen, buf, rem)
+	if err != nil {
+		return buf, rem, fmt.Errorf("unmarshal last seen: %v", err)
+	}
+	return buf, rem, err
+}
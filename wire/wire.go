@@ -22,6 +22,55 @@ const (
 	MsgTypeSend    = uint16(4)
 	MsgTypePing    = uint16(5)
 	MsgTypePingAck = uint16(6)
+
+	// MsgTypePresence messages carry a digest of the peers that the sender
+	// has recently seen alive.
+	MsgTypePresence = uint16(7)
+
+	// MsgTypeStream messages carry one chunk of a stream.
+	MsgTypeStream = uint16(8)
+
+	// MsgTypeVersionUnsupported messages are sent in response to a message
+	// with a version that the receiver does not support. They are always sent
+	// using MsgVersion1, so that every peer can understand them. The data is
+	// the latest version supported by the sender, followed by the type of the
+	// message that was rejected (both as 2 byte big-endian integers), so that
+	// the rejected message can be retried using a supported version.
+	MsgTypeVersionUnsupported = uint16(9)
+
+	// MsgTypeKeepAlive and MsgTypeKeepAliveAck messages are sent by Channels
+	// over idle network connections, to keep them alive and to detect when
+	// they are dead. They are never passed to the inbound messaging channel.
+	MsgTypeKeepAlive    = uint16(10)
+	MsgTypeKeepAliveAck = uint16(11)
+
+	// MsgTypeSendIdempotent messages are direct messages that carry an
+	// idempotency key, so that receivers can suppress duplicates. The data is
+	// the length of the key (as a uvarint), followed by the key, followed by
+	// the application data.
+	MsgTypeSendIdempotent = uint16(12)
+
+	// MsgTypePushLimited messages are push messages with a hop limit. The data
+	// is the number of hops that the content can still travel (as 1 byte),
+	// followed by the content ID. Receivers only propagate the content if the
+	// hop limit is greater than one.
+	MsgTypePushLimited = uint16(13)
+
+	// MsgTypeSendReliable messages are idempotent messages that the receiver
+	// acknowledges, using a MsgTypeSendAck message, once they have been
+	// delivered. The data has the same format as MsgTypeSendIdempotent
+	// messages, and the idempotency key identifies the message. The data of
+	// MsgTypeSendAck messages is the idempotency key of the acknowledged
+	// message.
+	MsgTypeSendReliable = uint16(14)
+	MsgTypeSendAck      = uint16(15)
+)
+
+// Enumerate all valid MsgPriority values. Messages default to normal priority,
+// so messages from peers that do not set a priority are treated as normal.
+const (
+	MsgPriorityNormal = uint8(0)
+	MsgPriorityHigh   = uint8(1)
 )
 
 // Msg defines the low-level message structure that is sent on-the-wire between
@@ -32,6 +81,20 @@ type Msg struct {
 	To       id.Hash `json:"to"`
 	Data     []byte  `json:"data"`
 	SyncData []byte  `json:"syncData"`
+
+	// Priority is a hint that is used by the sending side when scheduling
+	// messages: messages with a high priority are written ahead of messages
+	// with a normal priority that are still queued for the same remote peer.
+	// It does not change the semantics of the message, and it is carried on
+	// the wire so that receiving and forwarding sides can schedule in the same
+	// way. Control messages (such as pings) should use a high priority.
+	Priority uint8 `json:"priority"`
+
+	// Nonce identifies the message, so that receivers can recognise a message
+	// that is delivered more than once, even if its content is the same as
+	// the content of another message. It is zero when the message has no
+	// nonce.
+	Nonce uint64 `json:"nonce"`
 }
 
 // Packet defines a struct that captures the incoming message and the corresponding IP address
@@ -45,7 +108,9 @@ func (msg Msg) SizeHint() int {
 	return surge.SizeHintU16 +
 		surge.SizeHintU16 +
 		id.SizeHintHash +
-		surge.SizeHintBytes(msg.Data)
+		surge.SizeHintBytes(msg.Data) +
+		surge.SizeHintU8 +
+		surge.SizeHintU64
 }
 
 // Marshal a Msg to binary.
@@ -66,6 +131,14 @@ func (msg Msg) Marshal(buf []byte, rem int) ([]byte, int, error) {
 	if err != nil {
 		return buf, rem, fmt.Errorf("marshal data: %v", err)
 	}
+	buf, rem, err = surge.MarshalU8(msg.Priority, buf, rem)
+	if err != nil {
+		return buf, rem, fmt.Errorf("marshal priority: %v", err)
+	}
+	buf, rem, err = surge.MarshalU64(msg.Nonce, buf, rem)
+	if err != nil {
+		return buf, rem, fmt.Errorf("marshal nonce: %v", err)
+	}
 	return buf, rem, err
 }
 
@@ -87,5 +160,27 @@ func (msg *Msg) Unmarshal(buf []byte, rem int) ([]byte, int, error) {
 	if err != nil {
 		return buf, rem, fmt.Errorf("unmarshal data: %v", err)
 	}
+	// The priority is appended to the end of the message so that it can be
+	// omitted by peers that do not support it. In this case, the message has
+	// normal priority.
+	if len(buf) == 0 {
+		msg.Priority = MsgPriorityNormal
+		msg.Nonce = 0
+		return buf, rem, nil
+	}
+	buf, rem, err = surge.UnmarshalU8(&msg.Priority, buf, rem)
+	if err != nil {
+		return buf, rem, fmt.Errorf("unmarshal priority: %v", err)
+	}
+	// Similarly, the nonce is appended after the priority, and the message has
+	// no nonce when it is omitted.
+	if len(buf) == 0 {
+		msg.Nonce = 0
+		return buf, rem, nil
+	}
+	buf, rem, err = surge.UnmarshalU64(&msg.Nonce, buf, rem)
+	if err != nil {
+		return buf, rem, fmt.Errorf("unmarshal nonce: %v", err)
+	}
 	return buf, rem, err
 }
@@ -1 +1,102 @@
 package wire_test
+
+import (
+	"math/rand"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"github.com/renproject/surge"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Msg", func() {
+	randomMsg := func(r *rand.Rand) wire.Msg {
+		msg := wire.Msg{
+			Version:  wire.MsgVersion1,
+			Type:     uint16(r.Intn(6) + 1),
+			Data:     make([]byte, r.Intn(100)),
+			Priority: uint8(r.Intn(2)),
+			Nonce:    r.Uint64(),
+		}
+		r.Read(msg.To[:])
+		r.Read(msg.Data)
+		return msg
+	}
+
+	Context("when marshaling and unmarshaling a message", func() {
+		It("should equal itself", func() {
+			r := rand.New(rand.NewSource(GinkgoRandomSeed()))
+			for i := 0; i < 100; i++ {
+				msg := randomMsg(r)
+				data, err := surge.ToBinary(msg)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(len(data)).To(Equal(msg.SizeHint()))
+
+				unmarshaled := wire.Msg{}
+				Expect(surge.FromBinary(&unmarshaled, data)).To(Succeed())
+				Expect(unmarshaled.Version).To(Equal(msg.Version))
+				Expect(unmarshaled.Type).To(Equal(msg.Type))
+				Expect(unmarshaled.To).To(Equal(msg.To))
+				Expect(unmarshaled.Data).To(Equal(msg.Data))
+				Expect(unmarshaled.Priority).To(Equal(msg.Priority))
+				Expect(unmarshaled.Nonce).To(Equal(msg.Nonce))
+			}
+		})
+	})
+
+	Context("when unmarshaling a message without a priority", func() {
+		It("should default to normal priority", func() {
+			r := rand.New(rand.NewSource(GinkgoRandomSeed()))
+			msg := randomMsg(r)
+			msg.Priority = wire.MsgPriorityHigh
+
+			// Marshal the message in the format used before priorities
+			// existed.
+			buf := make([]byte, msg.SizeHint())
+			tail, _, err := surge.MarshalU16(msg.Version, buf, len(buf))
+			Expect(err).ToNot(HaveOccurred())
+			tail, _, err = surge.MarshalU16(msg.Type, tail, len(tail))
+			Expect(err).ToNot(HaveOccurred())
+			tail, _, err = surge.Marshal(msg.To, tail, len(tail))
+			Expect(err).ToNot(HaveOccurred())
+			tail, _, err = surge.MarshalBytes(msg.Data, tail, len(tail))
+			Expect(err).ToNot(HaveOccurred())
+			data := buf[:len(buf)-len(tail)]
+
+			unmarshaled := wire.Msg{Priority: wire.MsgPriorityHigh, Nonce: 1}
+			Expect(surge.FromBinary(&unmarshaled, data)).To(Succeed())
+			Expect(unmarshaled.Type).To(Equal(msg.Type))
+			Expect(unmarshaled.To).To(Equal(msg.To))
+			Expect(unmarshaled.Data).To(Equal(msg.Data))
+			Expect(unmarshaled.Priority).To(Equal(wire.MsgPriorityNormal))
+			Expect(unmarshaled.Nonce).To(BeZero())
+		})
+	})
+
+	Context("when unmarshaling a message without a nonce", func() {
+		It("should have no nonce", func() {
+			r := rand.New(rand.NewSource(GinkgoRandomSeed()))
+			msg := randomMsg(r)
+			msg.Nonce = 0
+			data, err := surge.ToBinary(msg)
+			Expect(err).ToNot(HaveOccurred())
+
+			// Drop the nonce, to get the format used before nonces existed.
+			data = data[:len(data)-surge.SizeHintU64]
+			unmarshaled := wire.Msg{Nonce: 1}
+			Expect(surge.FromBinary(&unmarshaled, data)).To(Succeed())
+			Expect(unmarshaled.Data).To(Equal(msg.Data))
+			Expect(unmarshaled.Priority).To(Equal(msg.Priority))
+			Expect(unmarshaled.Nonce).To(BeZero())
+		})
+	})
+
+	Context("when creating a message without a priority", func() {
+		It("should have normal priority", func() {
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, To: id.Hash{}, Data: []byte("hello")}
+			Expect(msg.Priority).To(Equal(wire.MsgPriorityNormal))
+		})
+	})
+})
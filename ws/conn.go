@@ -0,0 +1,268 @@
+package ws
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Opcodes of the WebSocket frames that are sent and received.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+const (
+	finBit  = 0x80
+	maskBit = 0x80
+
+	// maxControlPayload is the maximum payload length of a control frame.
+	maxControlPayload = 125
+	// maxHeaderSize is the maximum size of a frame header: two bytes, an
+	// eight byte extended payload length, and a four byte mask.
+	maxHeaderSize = 2 + 8 + 4
+)
+
+// closeNormal is the status code sent when a Conn is closed.
+const closeNormal = 1000
+
+// closeTimeout is the maximum amount of time spent sending a close frame, so
+// that closing a Conn does not block when the remote peer is not reading.
+const closeTimeout = time.Second
+
+// ErrUnsupportedFrame is returned when reading a WebSocket frame that is not a
+// binary frame, a continuation of a binary frame, or a control frame.
+var ErrUnsupportedFrame = errors.New("unsupported frame")
+
+// A Conn is a network connection that sends and receives data as binary
+// WebSocket frames. Every call to Write sends exactly one frame, and Read
+// returns the payloads of received frames as a stream of bytes, so that any
+// framing (such as a length prefix) is left to the caller. Pings are answered
+// while reading, and a close frame from the remote peer ends the stream with
+// io.EOF.
+type Conn struct {
+	net.Conn
+
+	// client is true when the Conn was dialed. Clients must mask the frames
+	// that they write, and servers must not.
+	client bool
+
+	readMu    *sync.Mutex
+	r         *bufio.Reader
+	remaining uint64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+	closed    bool
+
+	writeMu   *sync.Mutex
+	closeSent bool
+
+	closeOnce *sync.Once
+}
+
+func newConn(conn net.Conn, r *bufio.Reader, client bool) *Conn {
+	return &Conn{
+		Conn:   conn,
+		client: client,
+
+		readMu: new(sync.Mutex),
+		r:      r,
+
+		writeMu: new(sync.Mutex),
+
+		closeOnce: new(sync.Once),
+	}
+}
+
+// Read the payloads of binary frames into the buffer.
+func (conn *Conn) Read(buf []byte) (int, error) {
+	conn.readMu.Lock()
+	defer conn.readMu.Unlock()
+
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	for conn.remaining == 0 {
+		if conn.closed {
+			return 0, io.EOF
+		}
+		if err := conn.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(buf)) > conn.remaining {
+		buf = buf[:conn.remaining]
+	}
+	n, err := conn.r.Read(buf)
+	if conn.masked {
+		for i := range buf[:n] {
+			buf[i] ^= conn.mask[conn.maskPos]
+			conn.maskPos = (conn.maskPos + 1) % 4
+		}
+	}
+	conn.remaining -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// readHeader reads the header of the next frame. Control frames are handled
+// immediately. For data frames, the length and mask of the payload are stored,
+// so that the payload can be read by the caller.
+func (conn *Conn) readHeader() error {
+	var header [maxHeaderSize]byte
+	if _, err := io.ReadFull(conn.r, header[:2]); err != nil {
+		return err
+	}
+	fin := header[0]&finBit != 0
+	opcode := header[0] & 0x0f
+	if header[0]&0x70 != 0 {
+		return fmt.Errorf("reading frame: %w: reserved bits are set", ErrUnsupportedFrame)
+	}
+	masked := header[1]&maskBit != 0
+	if masked == conn.client {
+		// Frames from clients must be masked, and frames from servers must
+		// not be.
+		return fmt.Errorf("reading frame: bad mask: expected %v, got %v", !conn.client, masked)
+	}
+
+	length := uint64(header[1] &^ maskBit)
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(conn.r, header[2:4]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		if _, err := io.ReadFull(conn.r, header[2:10]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(header[2:10])
+		if length&(1<<63) != 0 {
+			return fmt.Errorf("reading frame: bad payload length %v", length)
+		}
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(conn.r, mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case opBinary, opContinuation:
+		conn.remaining = length
+		conn.masked = masked
+		conn.mask = mask
+		conn.maskPos = 0
+		return nil
+	case opClose, opPing, opPong:
+		if !fin || length > maxControlPayload {
+			return fmt.Errorf("reading frame: bad control frame")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(conn.r, payload); err != nil {
+			return err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+		switch opcode {
+		case opPing:
+			return conn.writeFrame(opPong, payload)
+		case opClose:
+			conn.closed = true
+			// Echo the status code, as required by the protocol. The
+			// connection is being closed, so errors are ignored.
+			if len(payload) >= 2 {
+				payload = payload[:2]
+			}
+			conn.writeFrame(opClose, payload)
+		}
+		return nil
+	default:
+		return fmt.Errorf("reading frame: %w: opcode %v", ErrUnsupportedFrame, opcode)
+	}
+}
+
+// Write the data as one binary frame.
+func (conn *Conn) Write(data []byte) (int, error) {
+	if err := conn.writeFrame(opBinary, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (conn *Conn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 2, maxHeaderSize+len(payload))
+	frame[0] = finBit | opcode
+	switch {
+	case len(payload) <= maxControlPayload:
+		frame[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		frame[1] = 126
+		frame = frame[:4]
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame[1] = 127
+		frame = frame[:10]
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	if conn.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return fmt.Errorf("generating mask: %v", err)
+		}
+		frame[1] |= maskBit
+		frame = append(frame, mask[:]...)
+		offset := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[offset:] {
+			frame[offset+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+
+	// At most one close frame is sent, whether it is sent in response to
+	// the remote peer, or because the Conn is closed.
+	if opcode == opClose {
+		if conn.closeSent {
+			return nil
+		}
+		conn.closeSent = true
+	}
+	_, err := conn.Conn.Write(frame)
+	return err
+}
+
+// Close the connection. A close frame is sent to the remote peer before the
+// underlying network connection is closed. It is safe to call more than once.
+func (conn *Conn) Close() (err error) {
+	conn.closeOnce.Do(func() {
+		var payload [2]byte
+		binary.BigEndian.PutUint16(payload[:], closeNormal)
+		conn.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		conn.writeFrame(opClose, payload[:])
+		err = conn.Conn.Close()
+	})
+	return err
+}
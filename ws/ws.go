@@ -0,0 +1,261 @@
+// Package ws implements connections between peers over WebSockets, for peers
+// that cannot use raw TCP connections (for example, because they are behind an
+// HTTP proxy, or running in a browser). Accepted connections are served by an
+// http.Handler, so that they can share an existing HTTP server. Once a
+// WebSocket has been established, it is used in the same way as a TCP
+// connection, and the usual handshakes and framing are applied on top of it.
+package ws
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/renproject/aw/policy"
+)
+
+// DefaultPath is the HTTP path that is used when dialing an address that does
+// not specify one.
+const DefaultPath = "/"
+
+// acceptGUID is appended to the key of a client when computing the accept
+// value of a server, as defined by RFC 6455.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Handler returns an http.Handler that upgrades requests to WebSockets, and
+// runs the handle function with each established WebSocket. The connection is
+// cleaned-up after the handle function returns. The allow function is called
+// with the underlying network connection before the upgrade is completed, and
+// can be used to reject connections in the same way as when listening for TCP
+// connections. Requests that are not valid WebSocket upgrades are rejected.
+func Handler(handle func(net.Conn), handleErr func(error), allow policy.Allow) http.Handler {
+	if handleErr == nil {
+		handleErr = func(error) {}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, status, err := checkUpgrade(r)
+		if err != nil {
+			if status == http.StatusUpgradeRequired {
+				w.Header().Set("Sec-WebSocket-Version", "13")
+			}
+			http.Error(w, err.Error(), status)
+			handleErr(fmt.Errorf("upgrade: %w", err))
+			return
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "websockets are not supported", http.StatusInternalServerError)
+			handleErr(fmt.Errorf("upgrade: response cannot be hijacked"))
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			handleErr(fmt.Errorf("upgrade: %w", err))
+			return
+		}
+		defer conn.Close()
+
+		if allow != nil {
+			err, cleanup := allow(conn)
+			if cleanup != nil {
+				defer cleanup()
+			}
+			if err != nil {
+				return
+			}
+		}
+
+		// The HTTP server can leave deadlines on the connection.
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			handleErr(fmt.Errorf("upgrade: %w", err))
+			return
+		}
+		if _, err := fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %v\r\n\r\n", acceptKey(key)); err != nil {
+			handleErr(fmt.Errorf("upgrade: %w", err))
+			return
+		}
+
+		wsConn := newConn(conn, rw.Reader, false)
+		defer wsConn.Close()
+		handle(wsConn)
+	})
+}
+
+// checkUpgrade returns the key of a valid WebSocket upgrade request. Otherwise,
+// it returns an error, and the HTTP status with which the request should be
+// rejected.
+func checkUpgrade(r *http.Request) (string, int, error) {
+	if r.Method != http.MethodGet {
+		return "", http.StatusMethodNotAllowed, fmt.Errorf("bad method: expected %v, got %v", http.MethodGet, r.Method)
+	}
+	if !hasToken(r.Header, "Connection", "upgrade") || !hasToken(r.Header, "Upgrade", "websocket") {
+		return "", http.StatusBadRequest, fmt.Errorf("not a websocket upgrade")
+	}
+	if version := r.Header.Get("Sec-WebSocket-Version"); version != "13" {
+		return "", http.StatusUpgradeRequired, fmt.Errorf("bad version: expected 13, got %q", version)
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return "", http.StatusBadRequest, fmt.Errorf("bad key %q", key)
+	}
+	return key, 0, nil
+}
+
+// Dial a remote peer until a WebSocket is successfully established, or until
+// the context is done. It behaves in the same way as dialing a TCP connection,
+// but the WebSocket is established on top of the TCP connection before the
+// handle function is called. The address is either a host and port, in which
+// case the DefaultPath is used, or a URL with the "ws" scheme.
+func Dial(ctx context.Context, address string, handle func(net.Conn), handleErr func(error), timeout func(int) time.Duration) error {
+	return DialWithDialer(ctx, new(net.Dialer), address, handle, handleErr, timeout)
+}
+
+// DialWithDialer is the same as Dial but instead of using a default dialer, it
+// accepts an already configured dialer. This can be used to control the local
+// address from which connections originate.
+func DialWithDialer(ctx context.Context, dialer *net.Dialer, address string, handle func(net.Conn), handleErr func(error), timeout func(int) time.Duration) error {
+	if handle == nil {
+		return fmt.Errorf("nil handle function")
+	}
+
+	if handleErr == nil {
+		handleErr = func(error) {}
+	}
+
+	if timeout == nil {
+		timeout = func(int) time.Duration { return time.Second }
+	}
+
+	u, err := parseAddress(address)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("dialing %w", ctx.Err())
+		default:
+		}
+
+		dialCtx, dialCancel := context.WithTimeout(ctx, timeout(attempt))
+		conn, err := dialer.DialContext(dialCtx, "tcp", u.Host)
+		if err == nil {
+			var wsConn *Conn
+			if wsConn, err = upgrade(dialCtx, conn, u); err == nil {
+				dialCancel()
+
+				defer wsConn.Close()
+				handle(wsConn)
+				return nil
+			}
+			conn.Close()
+		}
+		handleErr(err)
+		<-dialCtx.Done()
+		dialCancel()
+	}
+}
+
+// upgrade a TCP connection to a WebSocket, by sending an upgrade request, and
+// checking the response of the server.
+func upgrade(ctx context.Context, conn net.Conn, u *url.URL) (*Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, fmt.Errorf("upgrade: %w", err)
+		}
+	}
+
+	var keyBytes [16]byte
+	if _, err := rand.Read(keyBytes[:]); err != nil {
+		return nil, fmt.Errorf("upgrade: generating key: %v", err)
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes[:])
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-Websocket-Key":     {key},
+			"Sec-Websocket-Version": {"13"},
+		},
+		Host: u.Host,
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("upgrade: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, fmt.Errorf("upgrade: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("upgrade: bad status: expected %v, got %v", http.StatusSwitchingProtocols, resp.Status)
+	}
+	if !hasToken(resp.Header, "Connection", "upgrade") || !hasToken(resp.Header, "Upgrade", "websocket") {
+		return nil, fmt.Errorf("upgrade: not a websocket upgrade")
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != acceptKey(key) {
+		return nil, fmt.Errorf("upgrade: bad accept %q", accept)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("upgrade: %w", err)
+	}
+	return newConn(conn, r, true), nil
+}
+
+// parseAddress returns the URL of an address, which is either a host and port,
+// or a URL with the "ws" scheme.
+func parseAddress(address string) (*url.URL, error) {
+	if !strings.Contains(address, "://") {
+		return &url.URL{Scheme: "ws", Host: address, Path: DefaultPath}, nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("bad address %v: %w", address, err)
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("bad address %v: unsupported scheme %v", address, u.Scheme)
+	}
+	if u.Path == "" {
+		u.Path = DefaultPath
+	}
+	return u, nil
+}
+
+// acceptKey returns the value that a server must return to prove that it
+// received the key of a client.
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// hasToken returns whether or not a header contains a token, ignoring case.
+// Headers can contain comma-separated lists of tokens.
+func hasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
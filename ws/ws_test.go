@@ -0,0 +1,213 @@
+package ws_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/renproject/aw/policy"
+	"github.com/renproject/aw/ws"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WebSockets", func() {
+	// echo is a handler that reads messages with a length prefix, and writes
+	// them back.
+	echo := func(conn net.Conn) {
+		defer GinkgoRecover()
+
+		r := bufio.NewReader(conn)
+		for {
+			var prefix [4]byte
+			if _, err := io.ReadFull(r, prefix[:]); err != nil {
+				return
+			}
+			data := make([]byte, binary.BigEndian.Uint32(prefix[:]))
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			_, err := conn.Write(append(prefix[:], data...))
+			Expect(err).ToNot(HaveOccurred())
+		}
+	}
+
+	Context("when dialing a websocket handler", func() {
+		It("should send and receive messages of any size", func() {
+			server := httptest.NewServer(ws.Handler(echo, nil, nil))
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := ws.Dial(ctx, server.Listener.Addr().String(), func(conn net.Conn) {
+				defer GinkgoRecover()
+
+				for _, size := range []int{0, 1, 125, 126, 1000, 65535, 65536, 1 << 20} {
+					data := make([]byte, size)
+					rand.Read(data)
+					var prefix [4]byte
+					binary.BigEndian.PutUint32(prefix[:], uint32(size))
+					_, err := conn.Write(append(prefix[:], data...))
+					Expect(err).ToNot(HaveOccurred())
+
+					echoed := make([]byte, 4+size)
+					_, err = io.ReadFull(conn, echoed)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(echoed[4:]).To(Equal(data), fmt.Sprintf("size %v", size))
+				}
+			}, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("when the handler is mounted on a path", func() {
+		It("should dial the path given in the url", func() {
+			mux := http.NewServeMux()
+			mux.Handle("/aw", ws.Handler(func(conn net.Conn) {
+				conn.Write([]byte("hello"))
+			}, nil, nil))
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var data []byte
+			err := ws.Dial(ctx, "ws://"+server.Listener.Addr().String()+"/aw", func(conn net.Conn) {
+				data, _ = io.ReadAll(conn)
+			}, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			// The handler closes the connection after writing, so reading
+			// ends with a clean EOF.
+			Expect(string(data)).To(Equal("hello"))
+		})
+	})
+
+	Context("when the request is not a websocket upgrade", func() {
+		It("should reject the request", func() {
+			handled := make(chan struct{}, 1)
+			server := httptest.NewServer(ws.Handler(func(net.Conn) { handled <- struct{}{} }, nil, nil))
+			defer server.Close()
+
+			resp, err := http.Get(server.URL)
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			Expect(err).ToNot(HaveOccurred())
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			req.Header.Set("Sec-WebSocket-Version", "8")
+			resp, err = http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusUpgradeRequired))
+			Expect(resp.Header.Get("Sec-WebSocket-Version")).To(Equal("13"))
+
+			Expect(handled).ToNot(Receive())
+		})
+	})
+
+	Context("when the allow function rejects the connection", func() {
+		It("should fail to dial until the context is done", func() {
+			handled := make(chan struct{}, 1)
+			server := httptest.NewServer(ws.Handler(func(net.Conn) { handled <- struct{}{} }, nil, policy.Max(0)))
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			errs := 0
+			err := ws.Dial(ctx, server.Listener.Addr().String(), func(net.Conn) {}, func(error) { errs++ }, func(int) time.Duration { return 100 * time.Millisecond })
+			Expect(err).To(HaveOccurred())
+			Expect(errs).To(BeNumerically(">", 0))
+			Expect(handled).ToNot(Receive())
+		})
+	})
+
+	Context("when the remote peer sends a ping", func() {
+		It("should reply with a pong, and keep reading", func() {
+			server := httptest.NewServer(ws.Handler(func(conn net.Conn) {
+				defer GinkgoRecover()
+
+				data, err := io.ReadAll(conn)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(data)).To(Equal("hello"))
+			}, nil, nil))
+			defer server.Close()
+
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %v\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", server.Listener.Addr())
+			Expect(err).ToNot(HaveOccurred())
+			r := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(r, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+			// This is the example from RFC 6455.
+			Expect(resp.Header.Get("Sec-WebSocket-Accept")).To(Equal("s3pPLMBiTxaQ9kYGzzhZRbK+xOo="))
+
+			// Frames from clients are masked. A zero mask is used, so that
+			// the payloads can be written as they are.
+			frame := func(opcode byte, payload string) []byte {
+				return append([]byte{0x80 | opcode, 0x80 | byte(len(payload)), 0, 0, 0, 0}, payload...)
+			}
+			_, err = conn.Write(frame(0x9, "ping"))
+			Expect(err).ToNot(HaveOccurred())
+			pong := make([]byte, 6)
+			_, err = io.ReadFull(r, pong)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pong).To(Equal([]byte{0x8a, 4, 'p', 'i', 'n', 'g'}))
+
+			// The payload is split across a binary frame, and a
+			// continuation frame, and the stream is ended with a close frame.
+			_, err = conn.Write(append(append(append([]byte{}, frame(0x2, "hel")...), frame(0x0, "lo")...), frame(0x8, "\x03\xe8")...))
+			Expect(err).ToNot(HaveOccurred())
+			closing := make([]byte, 4)
+			_, err = io.ReadFull(r, closing)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(closing).To(Equal([]byte{0x88, 2, 0x03, 0xe8}))
+		})
+	})
+
+	Context("when the remote peer sends a text frame", func() {
+		It("should return an error", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				// Complete the upgrade by hand, so that a text frame can be
+				// sent.
+				h := sha1.New()
+				h.Write([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+				fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %v\r\n\r\n", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+				conn.Write([]byte{0x81, 5, 'h', 'e', 'l', 'l', 'o'})
+				io.Copy(io.Discard, conn)
+			}))
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var readErr error
+			err := ws.Dial(ctx, server.Listener.Addr().String(), func(conn net.Conn) {
+				_, readErr = conn.Read(make([]byte, 16))
+			}, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(errors.Is(readErr, ws.ErrUnsupportedFrame)).To(BeTrue())
+		})
+	})
+})